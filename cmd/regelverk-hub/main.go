@@ -1,81 +1,30 @@
 package main
 
 import (
-	"time"
+	_ "embed"
+	"log/slog"
+	"os"
 
 	internal "github.com/claes/regelverk/internal"
 )
 
+//go:embed regelverk.yaml
+var defaultSetup []byte
+
 func main() {
 
 	config := internal.ParseConfig()
 
-	bridgeWrappers := &[]internal.BridgeWrapper{
-		&internal.CecBridgeWrapper{},
-		&internal.MpdBridgeWrapper{},
-		&internal.HidBridgeWrapper{},
-		&internal.PulseaudioBridgeWrapper{},
-		&internal.RotelBridgeWrapper{},
-		&internal.RouterOSBridgeWrapper{},
-		&internal.SamsungBridgeWrapper{},
-		&internal.SnapcastBridgeWrapper{},
-		&internal.TelegramBridgeWrapper{},
+	if config.Setup == nil {
+		setup, err := internal.ParseSetup(defaultSetup)
+		if err != nil {
+			slog.Error("Invalid default setup", "error", err)
+			os.Exit(1)
+		}
+		config.Setup = setup
 	}
 
-	controllers := &[]internal.Controller{
-		&internal.TVController{},
-		&internal.KitchenController{},
-		//&internal.KitchenFreezerDoorController{},
-		&internal.DoorReminderController{
-			BaseController:  internal.BaseController{Name: "kitchenfreezerdoor"},
-			SensorName:      "freezer-door",
-			StateOpenKey:    "freezerDoorOpen",
-			OpenLongLimit:   10 * time.Second,
-			ReminderPeriod:  10 * time.Second,
-			MaxReminders:    20,
-			ReminderTopic:   "kitchen/audio/play",
-			ReminderPayload: `embed://assets/ping.wav`,
-		},
-		&internal.DoorReminderController{
-			BaseController:  internal.BaseController{Name: "kitchenfridgedoor"},
-			SensorName:      "fridge-door",
-			StateOpenKey:    "fridgeDoorOpen",
-			OpenLongLimit:   10 * time.Second,
-			ReminderPeriod:  10 * time.Second,
-			MaxReminders:    20,
-			ReminderTopic:   "kitchen/audio/play",
-			ReminderPayload: `embed://assets/ping.wav`,
-		},
-		&internal.BatteryReminderController{
-			BaseController:      internal.BaseController{Name: "balconydoorbattery"},
-			StateBatteryPoorKey: "balconyDoorBatteryLow",
-			ReminderPeriod:      24 * time.Hour,
-			MaxReminders:        20,
-			ReminderTopic:       "telegram/regelverkgeneral/send",
-			ReminderPayload:     `Battery balcony door is low`,
-		},
-		&internal.BatteryReminderController{
-			BaseController:      internal.BaseController{Name: "kitchenfreezerdoorbattery"},
-			StateBatteryPoorKey: "freezerDoorBatteryLow",
-			ReminderPeriod:      24 * time.Hour,
-			MaxReminders:        20,
-			ReminderTopic:       "telegram/regelverkgeneral/send",
-			ReminderPayload:     `Battery freezer door is low`,
-		},
-		&internal.BatteryReminderController{
-			BaseController:      internal.BaseController{Name: "kitchenfridgedoorbattery"},
-			StateBatteryPoorKey: "fridgeDoorBatteryLow",
-			ReminderPeriod:      24 * time.Hour,
-			MaxReminders:        20,
-			ReminderTopic:       "telegram/regelverkgeneral/send",
-			ReminderPayload:     `Battery fridge door is low`,
-		},
-		&internal.LivingroomController{},
-		&internal.BedroomController{},
-		&internal.SnapcastController{},
-		&internal.WebController{},
-		&internal.DebugController{},
-	}
+	bridgeWrappers, controllers := config.Setup.Build()
 
 	internal.StartRegelverk(config, bridgeWrappers, controllers)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	internal "github.com/claes/regelverk/internal"
+)
+
+func main() {
+	configFile := flag.String("configFile", "", "YAML file declaring the controllers to replay against")
+	events := flag.Bool("events", false, "true/false whether to print the recorded events")
+	recorded := flag.Bool("recorded", false, "true/false whether to print what was originally published")
+	from := flag.String("from", "", "Only print from this time on, RFC 3339")
+	until := flag.String("until", "", "Stop replaying at this time, RFC 3339")
+	debug := flag.Bool("debug", false, "Debug logging")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: regelverk-replay -configFile regelverk.yaml [OPTIONS] RECORDING...")
+		fmt.Fprintln(os.Stderr, "Recordings are replayed in the order given, oldest first.")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	level := slog.LevelWarn
+	if *debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if *configFile == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	setup, err := internal.LoadSetupFile(*configFile)
+	if err != nil {
+		slog.Error("Invalid config file", "configFile", *configFile, "error", err)
+		os.Exit(1)
+	}
+
+	options := internal.ReplayOptions{ShowEvents: *events, ShowRecorded: *recorded}
+	if options.From, err = parseTime(*from); err != nil {
+		slog.Error("Invalid from time", "from", *from, "error", err)
+		os.Exit(2)
+	}
+	if options.Until, err = parseTime(*until); err != nil {
+		slog.Error("Invalid until time", "until", *until, "error", err)
+		os.Exit(2)
+	}
+
+	config := internal.Config{Setup: setup}
+	if err := internal.Replay(config, flag.Args(), options, os.Stdout); err != nil {
+		slog.Error("Replay failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
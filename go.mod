@@ -22,6 +22,7 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/qmuntal/stateless v1.7.2
 	github.com/sj14/astral v0.2.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,87 @@
+package regelverk
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Active source messages by simulated source, as the devices broadcast them
+var simulatedCecSources = map[string]string{
+	"tv":         "0F:82:00:00",
+	"mediaflix":  "1F:82:40:00",
+	"chromecast": "4F:82:30:00",
+	"bluray":     "4F:82:20:00",
+}
+
+// SimulatedCecBridgeWrapper answers the power status polls of the real CEC
+// bridge on behalf of a TV that is watched in the evening. Publishing on, off
+// or auto to simulator/cec/tv/power and a source name to
+// simulator/cec/tv/source operates the TV by hand.
+type SimulatedCecBridgeWrapper struct {
+	simulatedBridge
+	mu           sync.Mutex
+	powerControl string
+	powered      bool
+	initialized  bool
+}
+
+func (l *SimulatedCecBridgeWrapper) String() string {
+	return "SimulatedCecBridgeWrapper"
+}
+
+func (l *SimulatedCecBridgeWrapper) InitializeBridge(mqttClient mqtt.Client, config Config) error {
+	l.initialize(mqttClient, config)
+	l.powerControl = "auto"
+	return nil
+}
+
+func (l *SimulatedCecBridgeWrapper) Run(ctx context.Context) error {
+	slog.Debug("Starting simulated CEC bridge")
+	l.run(ctx, map[string]func(string, []byte){
+		l.controlTopic("cec/tv/power"): func(_ string, payload []byte) {
+			l.mu.Lock()
+			l.powerControl = string(payload)
+			l.mu.Unlock()
+			l.reportPower()
+		},
+		l.controlTopic("cec/tv/source"): func(_ string, payload []byte) {
+			if message, found := simulatedCecSources[string(payload)]; found {
+				l.publish(l.topic("cec/message/hex/rx"), false, message)
+			}
+		},
+	}, 10*time.Second, l.reportPower)
+	return nil
+}
+
+// reportPower publishes the power status and, when the TV has just been
+// turned on, that it is the active source
+func (l *SimulatedCecBridgeWrapper) reportPower() {
+	l.mu.Lock()
+	powered := simulatedTvPowered(time.Now())
+	switch l.powerControl {
+	case "on":
+		powered = true
+	case "off":
+		powered = false
+	}
+	turnedOn := powered && (!l.powered || !l.initialized)
+	l.powered, l.initialized = powered, true
+	l.mu.Unlock()
+
+	if powered {
+		l.publish(l.topic("cec/message/hex/rx"), false, "01:90:00")
+	} else {
+		l.publish(l.topic("cec/message/hex/rx"), false, "01:90:01")
+	}
+	if turnedOn {
+		l.publish(l.topic("cec/message/hex/rx"), false, simulatedCecSources["tv"])
+	}
+}
+
+func simulatedTvPowered(now time.Time) bool {
+	return now.Hour() >= 19 && now.Hour() < 23
+}
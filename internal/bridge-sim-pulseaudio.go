@@ -0,0 +1,176 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	pulsemqtt "github.com/claes/mqtt-bridges/pulseaudio-mqtt/lib"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Sink states as reported by PulseAudio
+const (
+	pulseaudioSinkRunning   = 0
+	pulseaudioSinkSuspended = 2
+)
+
+// SimulatedPulseaudioBridgeWrapper stands in for a PulseAudio server with an
+// HDMI and a Snapcast sink. Playback is started and stopped by publishing
+// kodi, bluetooth or stop to simulator/pulseaudio/playing.
+type SimulatedPulseaudioBridgeWrapper struct {
+	simulatedBridge
+	mu    sync.Mutex
+	state pulsemqtt.PulseAudioState
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) String() string {
+	return "SimulatedPulseaudioBridgeWrapper"
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) InitializeBridge(mqttClient mqtt.Client, config Config) error {
+	l.initialize(mqttClient, config)
+	l.state = pulsemqtt.PulseAudioState{
+		Sinks: []pulsemqtt.PulseAudioSink{
+			{Name: "alsa_output.pci-0000_00_0e.0.hdmi-stereo", Id: "HDMI", SinkIndex: 0, State: pulseaudioSinkSuspended},
+			{Name: "Snapcast", Id: "Snapcast", SinkIndex: 1, State: pulseaudioSinkSuspended},
+		},
+		Cards: []pulsemqtt.PulseAudioCard{{
+			Name: "alsa_card.pci-0000_00_0e.0",
+			Profiles: []pulsemqtt.PulseAudioProfile{
+				{Name: "output:hdmi-stereo", Description: "Digital Stereo (HDMI) Output"},
+				{Name: "output:iec958-stereo+input:analog-stereo", Description: "Digital Stereo (IEC958) Output + Analog Stereo Input"},
+			},
+		}},
+		ActiveProfilePerCard: map[uint32]string{0: "output:hdmi-stereo"},
+	}
+	l.state.DefaultSink = l.state.Sinks[0]
+	return nil
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) Run(ctx context.Context) error {
+	slog.Debug("Starting simulated pulseaudio bridge")
+	l.run(ctx, map[string]func(string, []byte){
+		l.topic("pulseaudio/initialize"):        func(string, []byte) { l.publishState() },
+		l.topic("pulseaudio/sinkinput/req"):     l.update(l.handleSinkInputRequest),
+		l.topic("pulseaudio/cardprofile/0/set"): l.update(l.handleCardProfile),
+		l.topic("pulseaudio/sink/default/set"):  l.update(l.handleDefaultSink),
+		l.controlTopic("pulseaudio/playing"):    l.update(l.handlePlaying),
+	}, time.Minute, l.publishState)
+	return nil
+}
+
+// update runs a handler under the lock and publishes the state if it changed
+func (l *SimulatedPulseaudioBridgeWrapper) update(handler func(payload []byte) bool) func(string, []byte) {
+	return func(_ string, payload []byte) {
+		l.mu.Lock()
+		changed := handler(payload)
+		l.mu.Unlock()
+		if changed {
+			l.publishState()
+		}
+	}
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) publishState() {
+	l.mu.Lock()
+	data, err := json.Marshal(l.state)
+	l.mu.Unlock()
+	if err != nil {
+		slog.Error("Could not marshal simulated pulseaudio state", "error", err)
+		return
+	}
+	l.publish(l.topic("pulseaudio/state"), false, data)
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) handleSinkInputRequest(payload []byte) bool {
+	var req struct {
+		Command        string
+		SinkInputIndex uint32
+		SinkName       string
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || req.Command != "movesink" {
+		slog.Debug("Unsupported simulated sink input request", "payload", string(payload), "error", err)
+		return false
+	}
+	sink, found := l.findSink(req.SinkName)
+	if !found {
+		slog.Debug("Unknown simulated sink", "sinkName", req.SinkName)
+		return false
+	}
+	for i := range l.state.SinkInputs {
+		if l.state.SinkInputs[i].SinkInputIndex == req.SinkInputIndex {
+			l.state.SinkInputs[i].SinkIndex = sink.SinkIndex
+			l.updateSinkStates()
+			return true
+		}
+	}
+	return false
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) handleCardProfile(payload []byte) bool {
+	for _, profile := range l.state.Cards[0].Profiles {
+		if profile.Name == string(payload) {
+			l.state.ActiveProfilePerCard[0] = profile.Name
+			return true
+		}
+	}
+	slog.Debug("Unknown simulated card profile", "profile", string(payload))
+	return false
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) handleDefaultSink(payload []byte) bool {
+	sink, found := l.findSink(string(payload))
+	if !found {
+		return false
+	}
+	l.state.DefaultSink = sink
+	return true
+}
+
+// handlePlaying starts a stream on the default sink as Kodi or a phone
+// connected over bluetooth would, or removes it
+func (l *SimulatedPulseaudioBridgeWrapper) handlePlaying(payload []byte) bool {
+	var properties map[string]string
+	switch string(payload) {
+	case "kodi", "true":
+		properties = map[string]string{"application.process.binary": "kodi.bin", "application.name": "Kodi"}
+	case "bluetooth":
+		properties = map[string]string{"media.icon_name": "audio-card-bluetooth", "device.api": "bluez"}
+	}
+	l.state.SinkInputs = nil
+	if properties != nil {
+		l.state.SinkInputs = []pulsemqtt.PulseAudioSinkInput{
+			{SinkInputIndex: 42, SinkIndex: l.state.DefaultSink.SinkIndex, Properties: properties},
+		}
+	}
+	l.updateSinkStates()
+	return true
+}
+
+func (l *SimulatedPulseaudioBridgeWrapper) findSink(name string) (pulsemqtt.PulseAudioSink, bool) {
+	for _, sink := range l.state.Sinks {
+		if sink.Name == name || sink.Id == name {
+			return sink, true
+		}
+	}
+	return pulsemqtt.PulseAudioSink{}, false
+}
+
+// updateSinkStates marks sinks with inputs as running and the others as
+// suspended
+func (l *SimulatedPulseaudioBridgeWrapper) updateSinkStates() {
+	for i := range l.state.Sinks {
+		l.state.Sinks[i].State = pulseaudioSinkSuspended
+		for _, sinkInput := range l.state.SinkInputs {
+			if sinkInput.SinkIndex == l.state.Sinks[i].SinkIndex {
+				l.state.Sinks[i].State = pulseaudioSinkRunning
+			}
+		}
+		if l.state.Sinks[i].SinkIndex == l.state.DefaultSink.SinkIndex {
+			l.state.DefaultSink = l.state.Sinks[i]
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package regelverk
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rotelmqtt "github.com/claes/mqtt-bridges/rotel-mqtt/lib"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SimulatedRotelBridgeWrapper stands in for the amplifier on the serial port.
+// It takes the same "!" separated commands and publishes the resulting state.
+type SimulatedRotelBridgeWrapper struct {
+	simulatedBridge
+	mu    sync.Mutex
+	state rotelmqtt.RotelState
+}
+
+func (l *SimulatedRotelBridgeWrapper) String() string {
+	return "SimulatedRotelBridgeWrapper"
+}
+
+func (l *SimulatedRotelBridgeWrapper) InitializeBridge(mqttClient mqtt.Client, config Config) error {
+	l.initialize(mqttClient, config)
+	l.state = rotelmqtt.RotelState{State: "standby", Volume: "30", Source: "opt1", Freq: "off",
+		Tone: "off", Balance: "000", Bass: "000", Treble: "000", Mute: "off"}
+	return nil
+}
+
+func (l *SimulatedRotelBridgeWrapper) Run(ctx context.Context) error {
+	slog.Debug("Starting simulated rotel bridge")
+	l.run(ctx, map[string]func(string, []byte){
+		l.topic("rotel/command/send"):       func(_ string, payload []byte) { l.handleCommands(string(payload)) },
+		l.topic("rotel/command/initialize"): func(string, []byte) { l.publishState() },
+	}, time.Minute, l.publishState)
+	return nil
+}
+
+func (l *SimulatedRotelBridgeWrapper) handleCommands(commands string) {
+	l.mu.Lock()
+	changed := false
+	for _, command := range strings.Split(commands, "!") {
+		if command != "" && applyRotelCommand(&l.state, command) {
+			changed = true
+		}
+	}
+	l.mu.Unlock()
+	if changed {
+		l.publishState()
+	}
+}
+
+func (l *SimulatedRotelBridgeWrapper) publishState() {
+	l.mu.Lock()
+	state := l.state
+	l.mu.Unlock()
+	l.publish(l.topic("rotel/state"), false, state)
+}
+
+// applyRotelCommand changes state as the amplifier would and reports whether
+// the state should be published. In standby only power commands are obeyed.
+func applyRotelCommand(state *rotelmqtt.RotelState, command string) bool {
+	switch command {
+	case "power_on":
+		state.State = "on"
+	case "power_off":
+		state.State = "standby"
+	case "power_toggle":
+		if state.State == "on" {
+			state.State = "standby"
+		} else {
+			state.State = "on"
+		}
+	default:
+		if state.State != "on" {
+			slog.Debug("Simulated rotel in standby, ignoring command", "command", command)
+			return false
+		}
+		if !applyRotelSetting(state, command) {
+			return false
+		}
+	}
+	state.Display = rotelDisplay(*state)
+	return true
+}
+
+func applyRotelSetting(state *rotelmqtt.RotelState, command string) bool {
+	name, value, _ := strings.Cut(command, "_")
+	switch {
+	case slices.Contains(rotelSources, command):
+		state.Source = command
+	case command == "volume_up" || command == "volume_down":
+		volume, _ := strconv.Atoi(state.Volume)
+		if command == "volume_up" {
+			volume = min(volume+1, 96)
+		} else {
+			volume = max(volume-1, 0)
+		}
+		state.Volume = strconv.Itoa(volume)
+	case name == "volume":
+		volume, err := strconv.Atoi(value)
+		if err != nil || volume < 0 || volume > 96 {
+			slog.Debug("Invalid simulated rotel volume", "command", command)
+			return false
+		}
+		state.Volume = strconv.Itoa(volume)
+	case command == "mute":
+		state.Mute = map[string]string{"on": "off", "off": "on"}[state.Mute]
+	case name == "mute" && (value == "on" || value == "off"):
+		state.Mute = value
+	case name == "tone" && (value == "on" || value == "off"):
+		state.Tone = value
+	case name == "balance":
+		if _, err := balanceToInt(value); err != nil {
+			return false
+		}
+		state.Balance = value
+	case name == "bass" || name == "treble":
+		if _, err := bassOrTrebleToInt(value); err != nil {
+			return false
+		}
+		if name == "bass" {
+			state.Bass = value
+		} else {
+			state.Treble = value
+		}
+	case strings.HasPrefix(command, "get_"):
+		// Queries only republish the state
+	default:
+		slog.Debug("Unknown simulated rotel command", "command", command)
+		return false
+	}
+	return true
+}
+
+func rotelDisplay(state rotelmqtt.RotelState) string {
+	if state.State != "on" {
+		return ""
+	}
+	return fmt.Sprintf("%-6s VOL %s", strings.ToUpper(state.Source), state.Volume)
+}
@@ -0,0 +1,77 @@
+package regelverk
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	routerosmqtt "github.com/claes/mqtt-bridges/routeros-mqtt/lib"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SimulatedRouterOSBridgeWrapper reports wifi clients like the router does.
+// The phone leaves during office hours on weekdays. Publishing true, false or
+// auto to simulator/routeros/phone overrides that.
+type SimulatedRouterOSBridgeWrapper struct {
+	simulatedBridge
+	mu           sync.Mutex
+	phoneControl string
+	started      time.Time
+}
+
+func (l *SimulatedRouterOSBridgeWrapper) String() string {
+	return "SimulatedRouterOSBridgeWrapper"
+}
+
+func (l *SimulatedRouterOSBridgeWrapper) InitializeBridge(mqttClient mqtt.Client, config Config) error {
+	l.initialize(mqttClient, config)
+	l.phoneControl = "auto"
+	l.started = time.Now()
+	return nil
+}
+
+func (l *SimulatedRouterOSBridgeWrapper) Run(ctx context.Context) error {
+	slog.Debug("Starting simulated RouterOS bridge")
+	l.run(ctx, map[string]func(string, []byte){
+		l.controlTopic("routeros/phone"): func(_ string, payload []byte) {
+			l.mu.Lock()
+			l.phoneControl = string(payload)
+			l.mu.Unlock()
+			l.publishClients()
+		},
+	}, 30*time.Second, l.publishClients)
+	return nil
+}
+
+func (l *SimulatedRouterOSBridgeWrapper) publishClients() {
+	now := time.Now()
+	l.mu.Lock()
+	phonePresent := simulatedPhonePresent(now)
+	switch l.phoneControl {
+	case "true":
+		phonePresent = true
+	case "false":
+		phonePresent = false
+	}
+	l.mu.Unlock()
+	l.publish(l.topic("routeros/wificlients"), false, simulatedWifiClients(now.Sub(l.started), phonePresent))
+}
+
+func simulatedPhonePresent(now time.Time) bool {
+	weekday := now.Weekday() != time.Saturday && now.Weekday() != time.Sunday
+	return !weekday || now.Hour() < 9 || now.Hour() >= 17
+}
+
+func simulatedWifiClients(uptime time.Duration, phonePresent bool) []routerosmqtt.WifiClient {
+	uptimeText := uptime.Truncate(time.Second).String()
+	clients := []routerosmqtt.WifiClient{
+		{MacAddress: "3C:22:FB:10:4E:A1", Interface: "wifi1", Uptime: uptimeText, LastActivity: "1s", SignalStrength: "-61"},
+		{MacAddress: "B8:27:EB:5D:02:7C", Interface: "wifi2", Uptime: uptimeText, LastActivity: "4s", SignalStrength: "-48"},
+	}
+	if phonePresent {
+		clients = append(clients, routerosmqtt.WifiClient{MacAddress: phoneMacAddress, Interface: "wifi1",
+			Uptime: uptimeText, LastActivity: "2s", SignalStrength: "-55"})
+	}
+	return clients
+}
@@ -0,0 +1,234 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// simulatedZigbeeDevice is a device on the simulated Zigbee network, with its
+// state as zigbee2mqtt reports it
+type simulatedZigbeeDevice struct {
+	model       string
+	description string
+	endDevice   bool
+	// travel is how long a cover takes to reach a requested state
+	travel time.Duration
+	// drift changes the readings of sensors between reports
+	drift func(state map[string]any)
+	state map[string]any
+}
+
+func simulatedZigbeeDevices() map[string]*simulatedZigbeeDevice {
+	plug := func() *simulatedZigbeeDevice {
+		return &simulatedZigbeeDevice{model: "E2204", description: "TRETAKT smart plug",
+			state: map[string]any{"state": "OFF", "power_on_behavior": "OFF", "linkquality": 120.0, "update_available": false}}
+	}
+	door := func() *simulatedZigbeeDevice {
+		return &simulatedZigbeeDevice{model: "E2013", description: "PARASOLL door/window sensor", endDevice: true,
+			state: map[string]any{"contact": true, "battery": 87.0, "voltage": 2900.0, "linkquality": 90.0}}
+	}
+	return map[string]*simulatedZigbeeDevice{
+		"ikea_uttag":           plug(),
+		"livingroom-floorlamp": plug(),
+		"kitchen-amp":          plug(),
+		"kitchen-computer":     plug(),
+		"fridge-door":          door(),
+		"freezer-door":         door(),
+		"balcony-door":         door(),
+		"blinds-bedroom": {model: "E1757", description: "FYRTUR roller blind", endDevice: true, travel: 20 * time.Second,
+			state: map[string]any{"state": "OPEN", "position": 100.0, "battery": 74.0, "linkquality": 80.0}},
+		"livingroom-presence": {model: "E2134", description: "VALLHORN wireless motion sensor", endDevice: true,
+			drift: func(state map[string]any) {
+				lux := float64(rand.IntN(200))
+				state["illuminance"], state["illuminance_lux"] = lux, lux
+			},
+			state: map[string]any{"occupancy": false, "battery": 90.0, "illuminance": 30.0, "illuminance_lux": 30.0,
+				"linkquality": 100.0, "update_available": false}},
+		"vindstyrka": {model: "E2112", description: "VINDSTYRKA air quality and humidity sensor",
+			drift: func(state map[string]any) {
+				state["temperature"] = 20 + float64(rand.IntN(30))/10
+				state["humidity"] = float64(38 + rand.IntN(8))
+				state["pm25"] = float64(2 + rand.IntN(6))
+				state["voc_index"] = float64(90 + rand.IntN(30))
+			},
+			state: map[string]any{"temperature": 21.5, "humidity": 42.0, "pm25": 3.0, "voc_index": 100.0, "linkquality": 110.0}},
+	}
+}
+
+// SimulatedZigbeeBridgeWrapper stands in for zigbee2mqtt and the plugs,
+// blinds and sensors the controllers use. Devices obey <device>/set, answer
+// <device>/get and report periodically. A sensor reading is simulated by
+// publishing the changed properties as JSON to
+// simulator/zigbee2mqtt/<device>.
+type SimulatedZigbeeBridgeWrapper struct {
+	simulatedBridge
+	ctx     context.Context
+	mu      sync.Mutex
+	devices map[string]*simulatedZigbeeDevice
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) String() string {
+	return "SimulatedZigbeeBridgeWrapper"
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) InitializeBridge(mqttClient mqtt.Client, config Config) error {
+	l.initialize(mqttClient, config)
+	l.devices = simulatedZigbeeDevices()
+	return nil
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) Run(ctx context.Context) error {
+	slog.Debug("Starting simulated zigbee2mqtt bridge")
+	l.ctx = ctx
+	l.publishDevices()
+	l.run(ctx, map[string]func(string, []byte){
+		l.topic("zigbee2mqtt/+/set"):                  l.handleSet,
+		l.topic("zigbee2mqtt/+/get"):                  l.handleGet,
+		l.controlTopic("zigbee2mqtt/+"):               l.handleReading,
+		l.topic("zigbee2mqtt/bridge/request/devices"): func(string, []byte) { l.publishDevices() },
+	}, 5*time.Minute, l.report)
+	return nil
+}
+
+// deviceName extracts the device from zigbee2mqtt/<device>[/set|/get],
+// whatever prefix precedes it
+func deviceName(topic string) string {
+	_, rest, _ := strings.Cut(topic, "zigbee2mqtt/")
+	name, _, _ := strings.Cut(rest, "/")
+	return name
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) handleSet(topic string, payload []byte) {
+	var request map[string]any
+	if err := json.Unmarshal(payload, &request); err != nil {
+		slog.Debug("Invalid simulated zigbee set request", "topic", topic, "error", err)
+		return
+	}
+	name := deviceName(topic)
+	l.mu.Lock()
+	device, found := l.devices[name]
+	if !found {
+		l.mu.Unlock()
+		slog.Debug("Unknown simulated zigbee device", "device", name)
+		return
+	}
+	if request["state"] == "TOGGLE" {
+		request["state"] = map[any]string{"ON": "OFF", "OFF": "ON"}[device.state["state"]]
+	}
+	travel := device.travel
+	l.mu.Unlock()
+
+	if travel == 0 {
+		l.apply(name, request)
+		return
+	}
+	// Covers report when they have reached the new position
+	if state, ok := request["state"].(string); ok {
+		switch state {
+		case "OPEN":
+			request["position"] = 100.0
+		case "CLOSE":
+			request["position"] = 0.0
+		}
+	}
+	time.AfterFunc(travel, func() {
+		if l.ctx.Err() == nil {
+			l.apply(name, request)
+		}
+	})
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) handleGet(topic string, _ []byte) {
+	l.publishDevice(deviceName(topic))
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) handleReading(topic string, payload []byte) {
+	var reading map[string]any
+	if err := json.Unmarshal(payload, &reading); err != nil {
+		slog.Debug("Invalid simulated zigbee reading", "topic", topic, "error", err)
+		return
+	}
+	l.apply(deviceName(topic), reading)
+}
+
+// apply merges changes into the state of a device and publishes it
+func (l *SimulatedZigbeeBridgeWrapper) apply(name string, changes map[string]any) {
+	l.mu.Lock()
+	device, found := l.devices[name]
+	if found {
+		maps.Copy(device.state, changes)
+	}
+	l.mu.Unlock()
+	if found {
+		l.publishDevice(name)
+	}
+}
+
+func (l *SimulatedZigbeeBridgeWrapper) publishDevice(name string) {
+	l.mu.Lock()
+	device, found := l.devices[name]
+	if !found {
+		l.mu.Unlock()
+		return
+	}
+	state := maps.Clone(device.state)
+	l.mu.Unlock()
+	state["last_seen"] = time.Now().Format(time.RFC3339)
+	l.publish(l.topic("zigbee2mqtt/"+name), false, state)
+}
+
+// report is the periodic check-in of all devices, sensors with new readings
+func (l *SimulatedZigbeeBridgeWrapper) report() {
+	l.mu.Lock()
+	names := slices.Sorted(maps.Keys(l.devices))
+	for _, device := range l.devices {
+		if device.drift != nil {
+			device.drift(device.state)
+		}
+	}
+	l.mu.Unlock()
+	for _, name := range names {
+		l.publishDevice(name)
+	}
+}
+
+// publishDevices announces the devices on zigbee2mqtt/bridge/devices, retained
+// as zigbee2mqtt does
+func (l *SimulatedZigbeeBridgeWrapper) publishDevices() {
+	l.mu.Lock()
+	names := slices.Sorted(maps.Keys(l.devices))
+	var devices []map[string]any
+	for i, name := range names {
+		device := l.devices[name]
+		deviceType := "Router"
+		if device.endDevice {
+			deviceType = "EndDevice"
+		}
+		devices = append(devices, map[string]any{
+			"friendly_name":       name,
+			"ieee_address":        fmt.Sprintf("0x%016x", 0xd44867fffe000000+uint64(i)),
+			"network_address":     1000 + i,
+			"type":                deviceType,
+			"supported":           true,
+			"disabled":            false,
+			"interviewing":        false,
+			"interview_completed": true,
+			"interview_state":     "SUCCESSFUL",
+			"manufacturer":        "IKEA of Sweden",
+			"model_id":            device.model,
+			"definition":          map[string]any{"model": device.model, "description": device.description, "vendor": "IKEA"},
+		})
+	}
+	l.mu.Unlock()
+	l.publish(l.topic("zigbee2mqtt/bridge/devices"), true, devices)
+}
@@ -0,0 +1,91 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Simulated devices can be operated by hand by publishing to
+// simulator/<device topic>, e.g. simulator/zigbee2mqtt/fridge-door
+// {"contact": false} opens the simulated fridge door
+const simulatorControlPrefix = "simulator/"
+
+// simulatedBridge is what the simulated bridges share. They publish and
+// subscribe on the same topics as the real bridges, including the topic
+// prefix, so that the hub can run without any hardware.
+type simulatedBridge struct {
+	mqttClient  mqtt.Client
+	topicPrefix string
+}
+
+func (b *simulatedBridge) initialize(mqttClient mqtt.Client, config Config) {
+	b.mqttClient = mqttClient
+	b.topicPrefix = config.MQTTTopicPrefix
+}
+
+func (b *simulatedBridge) topic(topic string) string {
+	if b.topicPrefix == "" {
+		return topic
+	}
+	return strings.TrimSuffix(b.topicPrefix, "/") + "/" + topic
+}
+
+func (b *simulatedBridge) controlTopic(topic string) string {
+	return simulatorControlPrefix + b.topic(topic)
+}
+
+// publish sends strings and byte slices as they are and anything else as
+// JSON
+func (b *simulatedBridge) publish(topic string, retained bool, payload any) {
+	switch payload.(type) {
+	case string, []byte:
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			slog.Error("Could not marshal simulated payload", "topic", topic, "error", err)
+			return
+		}
+		payload = data
+	}
+	b.mqttClient.Publish(topic, 0, retained, payload)
+}
+
+// run subscribes the handlers by topic, calls tick every interval until ctx
+// is cancelled and unsubscribes again. Handlers run on the MQTT client's
+// goroutines.
+func (b *simulatedBridge) run(ctx context.Context, handlers map[string]func(topic string, payload []byte),
+	interval time.Duration, tick func()) {
+	topics := make([]string, 0, len(handlers))
+	for topic, handler := range handlers {
+		token := b.mqttClient.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+			handler(m.Topic(), m.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Error subscribing to MQTT topic", "error", token.Error(), "topic", topic)
+			continue
+		}
+		topics = append(topics, topic)
+	}
+	defer func() {
+		if len(topics) > 0 && b.mqttClient.IsConnected() {
+			b.mqttClient.Unsubscribe(topics...).WaitTimeout(time.Second)
+		}
+	}()
+
+	tick()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	pulsemqtt "github.com/claes/mqtt-bridges/pulseaudio-mqtt/lib"
+	rotelmqtt "github.com/claes/mqtt-bridges/rotel-mqtt/lib"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestApplyRotelCommand(t *testing.T) {
+	state := rotelmqtt.RotelState{State: "standby", Volume: "30", Source: "opt1", Mute: "off"}
+	if applyRotelCommand(&state, "volume_40") || state.Volume != "30" {
+		t.Fatalf("expected volume to be ignored in standby, got %+v", state)
+	}
+	for _, command := range []string{"power_on", "volume_38", "opt2", "mute", "balance_L05", "bass_+03", "volume_up"} {
+		if !applyRotelCommand(&state, command) {
+			t.Errorf("expected %s to be applied", command)
+		}
+	}
+	want := rotelmqtt.RotelState{State: "on", Volume: "39", Source: "opt2", Mute: "on", Balance: "L05", Bass: "+03",
+		Display: "OPT2   VOL 39"}
+	if state != want {
+		t.Errorf("got %+v, want %+v", state, want)
+	}
+	for _, command := range []string{"volume_97", "balance_X01", "optical9"} {
+		if applyRotelCommand(&state, command) {
+			t.Errorf("expected %s to be rejected", command)
+		}
+	}
+}
+
+// TestSimulatedBridges runs the simulated bridges against the embedded
+// broker and commands them as the controllers do
+func TestSimulatedBridges(t *testing.T) {
+	broker := startTestBroker(t, BrokerConfig{})
+	defer broker.Close()
+	bridgeClient, err := connectTestClient(t, broker, "bridges", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer bridgeClient.Disconnect(0)
+	client, err := connectTestClient(t, broker, "hub", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer client.Disconnect(0)
+
+	var mu sync.Mutex
+	latest := make(map[string][]byte)
+	subscribe := func(topic string) {
+		client.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			latest[m.Topic()] = m.Payload()
+		}).Wait()
+	}
+	payloadMatches := func(topic string, match func([]byte) bool) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			payload, found := latest[topic]
+			return found && match(payload)
+		}
+	}
+	subscribe("zigbee2mqtt/#")
+	subscribe("pulseaudio/state")
+	subscribe("rotel/state")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	for _, name := range []string{"sim-zigbee", "sim-pulseaudio", "sim-rotel"} {
+		startBridge(ctx, bridgeClient, Config{}, bridgeFactories[name](), &wg)
+	}
+
+	waitFor(t, payloadMatches("zigbee2mqtt/bridge/devices", func(payload []byte) bool {
+		return strings.Contains(string(payload), `"friendly_name":"blinds-bedroom"`)
+	}))
+	waitFor(t, payloadMatches("zigbee2mqtt/kitchen-amp", func(payload []byte) bool {
+		return strings.Contains(string(payload), `"state":"OFF"`)
+	}))
+	client.Publish("zigbee2mqtt/kitchen-amp/set", 1, false, `{"state": "ON"}`).Wait()
+	waitFor(t, payloadMatches("zigbee2mqtt/kitchen-amp", func(payload []byte) bool {
+		return strings.Contains(string(payload), `"state":"ON"`)
+	}))
+
+	client.Publish("simulator/pulseaudio/playing", 1, false, "kodi").Wait()
+	client.Publish("pulseaudio/sinkinput/req", 1, false,
+		`{ "Command": "movesink", "SinkInputIndex": 42, "SinkName": "Snapcast" }`).Wait()
+	waitFor(t, payloadMatches("pulseaudio/state", func(payload []byte) bool {
+		var state pulsemqtt.PulseAudioState
+		json.Unmarshal(payload, &state)
+		return slices.ContainsFunc(state.SinkInputs, func(sinkInput pulsemqtt.PulseAudioSinkInput) bool {
+			return sinkInput.SinkIndex == 1
+		})
+	}))
+
+	client.Publish("rotel/command/send", 1, false, "power_on!volume_38!opt1!").Wait()
+	waitFor(t, payloadMatches("rotel/state", func(payload []byte) bool {
+		var state rotelmqtt.RotelState
+		json.Unmarshal(payload, &state)
+		return state.State == "on" && state.Volume == "38"
+	}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -14,33 +15,47 @@ type BridgeWrapper interface {
 	Run(context context.Context) error
 }
 
-func initBridges(ctx context.Context, mqttClient mqtt.Client, config Config, bridgeWrappers *[]BridgeWrapper) {
-
+// initBridges starts all bridges and returns their cancel functions by name,
+// so that individual bridges can be stopped on reload. Running bridges are
+// tracked in wg.
+func initBridges(ctx context.Context, mqttClient mqtt.Client, config Config, bridgeWrappers *[]BridgeWrapper,
+	wg *sync.WaitGroup) map[string]context.CancelFunc {
+	running := make(map[string]context.CancelFunc)
 	for _, bridgeWrapper := range *bridgeWrappers {
-		go func(ctx context.Context, bridgeWrapper BridgeWrapper) {
-			defer func() {
-				if r := recover(); r != nil {
-					slog.Error("Recovered from panic", "recover", r, "bridgeWrapper", bridgeWrapper)
-				}
-			}()
-
-			bridgeCtx, cancel := context.WithCancel(ctx)
-			defer cancel()
-
-			slog.Info("Initializing bridge", "bridgeWrapper", bridgeWrapper)
-			err := bridgeWrapper.InitializeBridge(mqttClient, config)
-			if err != nil {
-				slog.Error("Could not initialize bridge", "error", err, "bridgeWrapper", bridgeWrapper)
-				return
-			}
+		running[bridgeWrapper.String()] = startBridge(ctx, mqttClient, config, bridgeWrapper, wg)
+	}
+	return running
+}
+
+func startBridge(ctx context.Context, mqttClient mqtt.Client, config Config, bridgeWrapper BridgeWrapper,
+	wg *sync.WaitGroup) context.CancelFunc {
+	bridgeCtx, cancel := context.WithCancel(ctx)
 
-			slog.Info("Starting bridge", "bridgeWrapper", bridgeWrapper)
-			err = bridgeWrapper.Run(bridgeCtx)
-			if err != nil {
-				slog.Error("Error when running bridge", "error", err, "bridgeWrapper", bridgeWrapper)
-			} else {
-				slog.Info("Bridge exited gracefully", "bridgeWrapper", bridgeWrapper)
+	wg.Add(1)
+	go func(ctx context.Context, bridgeWrapper BridgeWrapper) {
+		defer wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Recovered from panic", "recover", r, "bridgeWrapper", bridgeWrapper)
 			}
-		}(ctx, bridgeWrapper)
-	}
+		}()
+		defer cancel()
+
+		slog.Info("Initializing bridge", "bridgeWrapper", bridgeWrapper)
+		err := bridgeWrapper.InitializeBridge(mqttClient, config)
+		if err != nil {
+			slog.Error("Could not initialize bridge", "error", err, "bridgeWrapper", bridgeWrapper)
+			return
+		}
+
+		slog.Info("Starting bridge", "bridgeWrapper", bridgeWrapper)
+		err = bridgeWrapper.Run(ctx)
+		if err != nil {
+			slog.Error("Error when running bridge", "error", err, "bridgeWrapper", bridgeWrapper)
+		} else {
+			slog.Info("Bridge exited gracefully", "bridgeWrapper", bridgeWrapper)
+		}
+	}(bridgeCtx, bridgeWrapper)
+
+	return cancel
 }
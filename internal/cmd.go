@@ -9,17 +9,26 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
 func ParseConfig() Config {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	bluetoothAddress := flag.String("bluetoothAddress", "", "Bluetooth MAC address")
+	brokerListenAddress := flag.String("brokerListenAddress", "", "Address to run an embedded MQTT broker on, e.g. :1883, which the hub then uses instead of mqttBroker. If mqttUserName is set, clients must log in with it and the password in mqttPasswordFile. Empty to disable")
+	brokerRetainedFile := flag.String("brokerRetainedFile", "", "File to persist retained messages of the embedded MQTT broker to, empty to keep them in memory only")
 	hidProductID := flag.String("hidProductId", "", "HID product id")
 	hidVendorID := flag.String("hidVendorId", "", "HID vendor id")
 	httpListenAddress := flag.String("httpListenAddress", ":8080", "HTTP listen address")
 	collectMetrics := flag.Bool("collectMetrics", false, "true/false whether to collect metrics")
 	collectDebugMetrics := flag.Bool("collectDebugMetrics", false, "true/false whether to collect debug metrics")
+	commandFailureTopic := flag.String("commandFailureTopic", "", "Topic to send a notification to when a device never reaches the state a command expects, e.g. telegram/regelverkgeneral/send")
+	configFile := flag.String("configFile", "", "YAML file declaring bridges and controllers, reloaded on SIGHUP or POST /admin/reload")
+	controllerQueueSize := flag.Int("controllerQueueSize", defaultControllerQueueSize, "Max number of queued events per controller")
+	dryRun := flag.Bool("dryRun", false, "true/false whether to record publishes on regelverk/dryrun/<controller> instead of sending them, to run in shadow of another instance")
+	flushOnShutdown := flag.Bool("flushOnShutdown", false, "true/false whether to send delayed publishes on shutdown instead of dropping them")
 	metricsAddress := flag.String("metricsAddress", "", "Metrics address")
 	metricsRealm := flag.String("metricsRealm", "", "Metrics realm")
 	mpdPasswordFile := flag.String("mpdPasswordFile", "", "MPD password file")
@@ -29,13 +38,23 @@ func ParseConfig() Config {
 	mqttTopicPrefix := flag.String("mqttTopicPrefix", "", "MQTT topic prefix")
 	mqttUserName := flag.String("mqttUserName", "", "MQTT username")
 	pulseServer := flag.String("pulseServer", "", "Pulse server")
+	recordFile := flag.String("recordFile", "", "File to record incoming and outgoing MQTT messages to for regelverk-replay, empty to disable")
+	recordKeep := flag.Int("recordKeep", 5, "Number of rotated recordings to keep")
+	recordMaxSize := flag.Int64("recordMaxSize", 64<<20, "Size in bytes at which the recording is rotated")
+	reinitializeOnPanic := flag.Bool("reinitializeOnPanic", false, "true/false whether to re-initialize a controller after it panics")
 	rotelSerialPort := flag.String("rotelSerialPort", "", "Rotel serial port")
 	routerAddress := flag.String("routerAddress", "", "Mikrotik router address:port")
 	routerPasswordFile := flag.String("routerPasswordFile", "", "Mikrotik router password file")
 	routerUsername := flag.String("routerUsername", "", "Mikrotik router username")
 	samsungTVAddress := flag.String("samsungTVAddress", "", "Samsung TV address")
+	shutdownTimeout := flag.Duration("shutdownTimeout", defaultShutdownTimeout, "Max time for an orderly shutdown")
 	snapcastServer := flag.String("snapcastServer", "", "Snapcast server address")
+	stateFile := flag.String("stateFile", "", "File to persist state values and controller states to, empty to disable")
+	stateMaxAge := flag.Duration("stateMaxAge", 1*time.Hour, "Max age of persisted state values to restore on startup")
+	stateSaveInterval := flag.Duration("stateSaveInterval", 5*time.Minute, "Interval between persisted state snapshots")
 	telegramTokenFile := flag.String("telegramTokenFile", "", "Telegram bot token file")
+	watchdogThreshold := flag.Duration("watchdogThreshold", defaultWatchdogThreshold, "Time a controller may spend on one event before it is reported as stuck")
+	watchdogTopic := flag.String("watchdogTopic", "", "Topic to send an alert to when a controller is stuck, empty to only log")
 
 	help := flag.Bool("help", false, "Print help")
 	debug := flag.Bool("debug", false, "Debug logging")
@@ -56,10 +75,17 @@ func ParseConfig() Config {
 
 	config := Config{
 		BluetoothAddress:    *bluetoothAddress,
+		BrokerListenAddress: *brokerListenAddress,
+		BrokerRetainedFile:  *brokerRetainedFile,
 		HIDProductID:        *hidProductID,
 		HIDVendorID:         *hidVendorID,
 		CollectMetrics:      *collectMetrics,
 		CollectDebugMetrics: *collectDebugMetrics,
+		CommandFailureTopic: *commandFailureTopic,
+		ConfigFile:          *configFile,
+		ControllerQueueSize: *controllerQueueSize,
+		DryRun:              *dryRun,
+		FlushOnShutdown:     *flushOnShutdown,
 		MetricsAddress:      *metricsAddress,
 		MetricsRealm:        *metricsRealm,
 		MpdPasswordFile:     *mpdPasswordFile,
@@ -69,15 +95,34 @@ func ParseConfig() Config {
 		MQTTTopicPrefix:     *mqttTopicPrefix,
 		MQTTUserName:        *mqttUserName,
 		Pulseserver:         *pulseServer,
+		RecordFile:          *recordFile,
+		RecordKeep:          *recordKeep,
+		RecordMaxSize:       *recordMaxSize,
+		ReinitializeOnPanic: *reinitializeOnPanic,
 		RotelSerialPort:     *rotelSerialPort,
 		RouterAddress:       *routerAddress,
 		RouterPasswordFile:  *routerPasswordFile,
 		RouterUsername:      *routerUsername,
 		SamsungTvAddress:    *samsungTVAddress,
+		ShutdownTimeout:     *shutdownTimeout,
 		SnapcastServer:      *snapcastServer,
+		StateFile:           *stateFile,
+		StateMaxAge:         *stateMaxAge,
+		StateSaveInterval:   *stateSaveInterval,
 		TelegramTokenFile:   *telegramTokenFile,
+		WatchdogThreshold:   *watchdogThreshold,
+		WatchdogTopic:       *watchdogTopic,
 		WebAddress:          *httpListenAddress,
 	}
+
+	if config.ConfigFile != "" {
+		setup, err := LoadSetupFile(config.ConfigFile)
+		if err != nil {
+			slog.Error("Invalid config file", "configFile", config.ConfigFile, "error", err)
+			os.Exit(1)
+		}
+		config.Setup = setup
+	}
 	return config
 }
 
@@ -92,6 +137,10 @@ func StartRegelverk(config Config, bridgeWrappers *[]BridgeWrapper, controllers
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
+	// SIGHUP reloads the config file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -100,7 +149,7 @@ func StartRegelverk(config Config, bridgeWrappers *[]BridgeWrapper, controllers
 	go func() {
 		defer wg.Done()
 		slog.Info("Initializing Regelverk", "config", config)
-		err := runRegelverk(ctx, config, bridgeWrappers, controllers)
+		err := runRegelverk(ctx, config, bridgeWrappers, controllers, hup)
 		if err != nil {
 			slog.Error("Error initializing regelverk", "error", err)
 		}
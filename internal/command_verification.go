@@ -0,0 +1,250 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Topic a failure event is published to when a device never reaches the
+// expected state
+const commandFailedTopic = "regelverk/command/failed"
+
+// ExpectedState is a state a device is expected to report after a publish.
+// If it is not reported within Timeout the publish is repeated, up to Retries
+// times with the timeout doubled each time.
+type ExpectedState struct {
+	Topic   string
+	Field   string
+	Value   any
+	Timeout time.Duration
+	Retries int
+}
+
+type commandVerifier struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[expectationKey]*pendingVerification
+}
+
+// A newer command for the same device state replaces a pending one
+type expectationKey struct {
+	topic string
+	field string
+}
+
+type pendingVerification struct {
+	id        uint64
+	client    mqtt.Client
+	publish   MQTTPublish
+	attempt   int
+	sentAt    time.Time
+	lastValue any
+	timer     afterTimer
+}
+
+// PendingVerificationDebug is a JSON-friendly view of a publish waiting for
+// its expected state.
+type PendingVerificationDebug struct {
+	Topic         string    `json:"topic"`
+	ExpectedTopic string    `json:"expectedTopic"`
+	Field         string    `json:"field"`
+	Expected      any       `json:"expected"`
+	LastValue     any       `json:"lastValue,omitempty"`
+	Attempt       int       `json:"attempt"`
+	SentAt        time.Time `json:"sentAt"`
+}
+
+// commandFailure is the payload of commandFailedTopic.
+type commandFailure struct {
+	Topic     string `json:"topic"`
+	Field     string `json:"field"`
+	Expected  any    `json:"expected"`
+	LastValue any    `json:"lastValue,omitempty"`
+	Attempts  int    `json:"attempts"`
+}
+
+func verificationTimeout(expect *ExpectedState, attempt int) time.Duration {
+	return expect.Timeout << attempt
+}
+
+// trackVerification starts waiting for the expected state of a publish that
+// has just been sent.
+func (masterController *MasterController) trackVerification(client mqtt.Client, p MQTTPublish) {
+	if p.Expect.Timeout <= 0 {
+		slog.Error("Expected state without timeout, not verifying", "topic", p.Topic)
+		return
+	}
+	verifier := &masterController.verifier
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	if verifier.pending == nil {
+		verifier.pending = make(map[expectationKey]*pendingVerification)
+	}
+	key := expectationKey{topic: p.Expect.Topic, field: p.Expect.Field}
+	if previous, exists := verifier.pending[key]; exists {
+		previous.timer.Stop()
+	}
+	verifier.nextID++
+	pending := &pendingVerification{
+		id:      verifier.nextID,
+		client:  client,
+		publish: p,
+		sentAt:  nowFunc(),
+	}
+	pending.timer = afterFunc(verificationTimeout(p.Expect, 0), func() {
+		masterController.verificationTimedOut(key, pending.id)
+	})
+	verifier.pending[key] = pending
+}
+
+// verifyExpectedStates runs as an event callback and resolves pending
+// verifications when the device reports the expected state.
+func (masterController *MasterController) verifyExpectedStates(ev MQTTEvent) {
+	verifier := &masterController.verifier
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	var state map[string]any
+	parsed := false
+	for key, pending := range verifier.pending {
+		if key.topic != ev.Topic {
+			continue
+		}
+		if !parsed {
+			payload, ok := ev.Payload.([]byte)
+			if !ok || json.Unmarshal(payload, &state) != nil {
+				return
+			}
+			parsed = true
+		}
+		value, found := state[key.field]
+		if !found {
+			continue
+		}
+		pending.lastValue = value
+		if fmt.Sprint(value) != fmt.Sprint(pending.publish.Expect.Value) {
+			continue
+		}
+		pending.timer.Stop()
+		delete(verifier.pending, key)
+		slog.Debug("Command verified", "topic", pending.publish.Topic, "stateTopic", key.topic,
+			"field", key.field, "value", value, "attempt", pending.attempt)
+		if masterController.metricsConfig.CollectDebugMetrics {
+			counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_command_verified{topic="%s",realm="%s"}`,
+				pending.publish.Topic, masterController.metricsConfig.MetricsRealm))
+			counter.Inc()
+		}
+	}
+}
+
+func (masterController *MasterController) verificationTimedOut(key expectationKey, id uint64) {
+	verifier := &masterController.verifier
+	verifier.mu.Lock()
+	pending, exists := verifier.pending[key]
+	if !exists || pending.id != id {
+		verifier.mu.Unlock()
+		return
+	}
+	p := pending.publish
+
+	// Someone took over the device, stop insisting
+	if masterController.isHeld(p.Topic) {
+		delete(verifier.pending, key)
+		verifier.mu.Unlock()
+		slog.Info("Abandoning command verification of manually held device", "topic", p.Topic)
+		return
+	}
+
+	if pending.attempt < p.Expect.Retries {
+		pending.attempt++
+		pending.sentAt = nowFunc()
+		timeout := verificationTimeout(p.Expect, pending.attempt)
+		pending.timer = afterFunc(timeout, func() {
+			masterController.verificationTimedOut(key, id)
+		})
+		attempt := pending.attempt
+		verifier.mu.Unlock()
+
+		slog.Warn("Device did not reach expected state, retrying", "topic", p.Topic, "stateTopic", key.topic,
+			"field", key.field, "expected", p.Expect.Value, "lastValue", pending.lastValue,
+			"attempt", attempt, "timeout", timeout)
+		masterController.sendPublish(pending.client, p)
+		return
+	}
+
+	delete(verifier.pending, key)
+	verifier.mu.Unlock()
+
+	failure := commandFailure{
+		Topic:     p.Topic,
+		Field:     key.field,
+		Expected:  p.Expect.Value,
+		LastValue: pending.lastValue,
+		Attempts:  pending.attempt + 1,
+	}
+	slog.Error("Device never reached expected state", "topic", p.Topic, "stateTopic", key.topic,
+		"field", key.field, "expected", p.Expect.Value, "lastValue", pending.lastValue, "attempts", failure.Attempts)
+	if masterController.metricsConfig.CollectMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_command_failed{topic="%s",realm="%s"}`,
+			p.Topic, masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+
+	payload, err := json.Marshal(failure)
+	if err != nil {
+		slog.Error("Could not marshal command failure", "error", err)
+		return
+	}
+	masterController.sendPublish(pending.client, MQTTPublish{Topic: commandFailedTopic, Payload: payload, Qos: 1})
+	if notifyTopic := masterController.config.CommandFailureTopic; notifyTopic != "" {
+		masterController.sendPublish(pending.client, MQTTPublish{
+			Topic: notifyTopic,
+			Payload: fmt.Sprintf("%s did not reach %s %v after %d attempts",
+				key.topic, key.field, p.Expect.Value, failure.Attempts),
+			Qos: 1,
+		})
+	}
+}
+
+func (masterController *MasterController) pendingVerificationsDebug() []PendingVerificationDebug {
+	verifier := &masterController.verifier
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	result := make([]PendingVerificationDebug, 0, len(verifier.pending))
+	for key, pending := range verifier.pending {
+		result = append(result, PendingVerificationDebug{
+			Topic:         pending.publish.Topic,
+			ExpectedTopic: key.topic,
+			Field:         key.field,
+			Expected:      pending.publish.Expect.Value,
+			LastValue:     pending.lastValue,
+			Attempt:       pending.attempt,
+			SentAt:        pending.sentAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SentAt.Before(result[j].SentAt) })
+	return result
+}
+
+// stopVerifications gives up on all pending verifications without retrying.
+func (masterController *MasterController) stopVerifications() int {
+	verifier := &masterController.verifier
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+
+	stopped := len(verifier.pending)
+	for key, pending := range verifier.pending {
+		pending.timer.Stop()
+		delete(verifier.pending, key)
+	}
+	return stopped
+}
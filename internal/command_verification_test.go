@@ -0,0 +1,117 @@
+package regelverk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// recordingClient records publishes and disconnects, other client methods are
+// not used
+type recordingClient struct {
+	mqtt.Client
+	mu           sync.Mutex
+	published    []MQTTPublish
+	connected    bool
+	disconnected bool
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, MQTTPublish{Topic: topic, Qos: qos, Retained: retained, Payload: payload})
+	return &mqtt.DummyToken{}
+}
+
+func (c *recordingClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *recordingClient) Disconnect(_ uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	c.disconnected = true
+}
+
+func (c *recordingClient) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var topics []string
+	for _, p := range c.published {
+		topics = append(topics, p.Topic)
+	}
+	return topics
+}
+
+func expectingPublish(timeout time.Duration, retries int) MQTTPublish {
+	p := setIkeaTretaktPower("zigbee2mqtt/lamp/set", true)
+	p.Expect.Timeout = timeout
+	p.Expect.Retries = retries
+	return p
+}
+
+func TestCommandVerified(t *testing.T) {
+	masterController := CreateMasterController()
+	client := &recordingClient{}
+
+	masterController.publish(client, expectingPublish(time.Hour, 2))
+	if pending := masterController.pendingVerificationsDebug(); len(pending) != 1 || pending[0].ExpectedTopic != "zigbee2mqtt/lamp" {
+		t.Fatalf("expected one pending verification, got %+v", pending)
+	}
+
+	// Other fields or values do not resolve the verification
+	masterController.verifyExpectedStates(MQTTEvent{Topic: "zigbee2mqtt/lamp", Payload: []byte(`{"state": "OFF"}`)})
+	masterController.verifyExpectedStates(MQTTEvent{Topic: "zigbee2mqtt/lamp", Payload: []byte(`{"linkquality": 80}`)})
+	pending := masterController.pendingVerificationsDebug()
+	if len(pending) != 1 || pending[0].LastValue != "OFF" {
+		t.Fatalf("expected verification to remain pending with last value OFF, got %+v", pending)
+	}
+
+	masterController.verifyExpectedStates(MQTTEvent{Topic: "zigbee2mqtt/lamp", Payload: []byte(`{"state": "ON"}`)})
+	if pending := masterController.pendingVerificationsDebug(); len(pending) != 0 {
+		t.Fatalf("expected verification to be resolved, got %+v", pending)
+	}
+}
+
+func TestCommandRetriedAndFailed(t *testing.T) {
+	masterController := CreateMasterController()
+	masterController.config.CommandFailureTopic = "telegram/regelverkgeneral/send"
+	client := &recordingClient{}
+
+	masterController.publish(client, expectingPublish(5*time.Millisecond, 2))
+	waitFor(t, func() bool { return len(masterController.pendingVerificationsDebug()) == 0 })
+
+	want := []string{
+		"zigbee2mqtt/lamp/set",
+		"zigbee2mqtt/lamp/set",
+		"zigbee2mqtt/lamp/set",
+		commandFailedTopic,
+		"telegram/regelverkgeneral/send",
+	}
+	waitFor(t, func() bool { return len(client.topics()) == len(want) })
+	for i, topic := range client.topics() {
+		if topic != want[i] {
+			t.Errorf("publish %d: expected %s, got %s", i, want[i], topic)
+		}
+	}
+}
+
+func TestCommandReplacedByNewer(t *testing.T) {
+	masterController := CreateMasterController()
+	client := &recordingClient{}
+
+	masterController.publish(client, expectingPublish(time.Hour, 0))
+	off := setIkeaTretaktPower("zigbee2mqtt/lamp/set", false)
+	off.Expect.Timeout = time.Hour
+	masterController.publish(client, off)
+
+	pending := masterController.pendingVerificationsDebug()
+	if len(pending) != 1 || pending[0].Expected != "OFF" {
+		t.Fatalf("expected only the newer command to be pending, got %+v", pending)
+	}
+}
@@ -0,0 +1,594 @@
+package regelverk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SetupConfig declares which bridges run and which controllers are
+// instantiated, as read from the YAML config file.
+//
+//	bridges: [cec, mpd, telegram]
+//	controllers:
+//	  - type: tv
+//	  - type: doorreminder
+//	    name: kitchenfridgedoor
+//	    sensorName: fridge-door
+//	    stateOpenKey: fridgeDoorOpen
+//	    openLongLimit: 10s
+//	    ...
+type SetupConfig struct {
+	Bridges     []string
+	Controllers []ControllerSetup
+	StateRules  []StateRule
+
+	ManualOverrides []ManualOverrideConfig
+	StateHistory    []StateHistoryConfig
+	DerivedStates   []DerivedStateConfig
+}
+
+// ControllerSetup is a single controller declaration. Params holds the
+// type-specific parameters, nil for controllers without parameters.
+type ControllerSetup struct {
+	Type   string
+	Name   string
+	Params any
+	// Publishes of the controller are recorded instead of sent
+	DryRun bool
+	Line   int
+}
+
+// key identifies a declared controller by its name, or by its type if it has
+// none. Also used as the name of controllers without a name parameter.
+func (controllerSetup ControllerSetup) key() string {
+	if controllerSetup.Name != "" {
+		return controllerSetup.Name
+	}
+	return controllerSetup.Type
+}
+
+type DoorReminderConfig struct {
+	Type            string        `yaml:"type"`
+	Name            string        `yaml:"name"`
+	SensorName      string        `yaml:"sensorName"`
+	StateOpenKey    StateKey      `yaml:"stateOpenKey"`
+	OpenLongLimit   time.Duration `yaml:"openLongLimit"`
+	ReminderPeriod  time.Duration `yaml:"reminderPeriod"`
+	MaxReminders    int           `yaml:"maxReminders"`
+	ReminderTopic   string        `yaml:"reminderTopic"`
+	ReminderPayload string        `yaml:"reminderPayload"`
+}
+
+type BatteryReminderConfig struct {
+	Type                string        `yaml:"type"`
+	Name                string        `yaml:"name"`
+	StateBatteryPoorKey StateKey      `yaml:"stateBatteryPoorKey"`
+	ReminderPeriod      time.Duration `yaml:"reminderPeriod"`
+	MaxReminders        int           `yaml:"maxReminders"`
+	ReminderTopic       string        `yaml:"reminderTopic"`
+	ReminderPayload     string        `yaml:"reminderPayload"`
+}
+
+// Declarations of controllers without parameters may only contain the type
+// and the common keys
+type plainControllerConfig struct {
+	Type string `yaml:"type"`
+}
+
+var bridgeFactories = map[string]func() BridgeWrapper{
+	"audio":      func() BridgeWrapper { return &AudioBridgeWrapper{} },
+	"bluez":      func() BridgeWrapper { return &BluezBridgeWrapper{} },
+	"cec":        func() BridgeWrapper { return &CecBridgeWrapper{} },
+	"hid":        func() BridgeWrapper { return &HidBridgeWrapper{} },
+	"mpd":        func() BridgeWrapper { return &MpdBridgeWrapper{} },
+	"pulseaudio": func() BridgeWrapper { return &PulseaudioBridgeWrapper{} },
+	"rotel":      func() BridgeWrapper { return &RotelBridgeWrapper{} },
+	"routeros":   func() BridgeWrapper { return &RouterOSBridgeWrapper{} },
+	"samsung":    func() BridgeWrapper { return &SamsungBridgeWrapper{} },
+	"snapcast":   func() BridgeWrapper { return &SnapcastBridgeWrapper{} },
+	"telegram":   func() BridgeWrapper { return &TelegramBridgeWrapper{} },
+
+	// Simulated hardware, for running the hub without devices
+	"sim-cec":        func() BridgeWrapper { return &SimulatedCecBridgeWrapper{} },
+	"sim-pulseaudio": func() BridgeWrapper { return &SimulatedPulseaudioBridgeWrapper{} },
+	"sim-rotel":      func() BridgeWrapper { return &SimulatedRotelBridgeWrapper{} },
+	"sim-routeros":   func() BridgeWrapper { return &SimulatedRouterOSBridgeWrapper{} },
+	"sim-zigbee":     func() BridgeWrapper { return &SimulatedZigbeeBridgeWrapper{} },
+}
+
+type controllerFactory struct {
+	// params returns a pointer to the struct the declaration is decoded
+	// into, nil if the controller takes no parameters
+	params func() any
+	// validate checks the decoded parameters
+	validate func(params any) error
+	build    func(name string, params any) Controller
+	// static controllers register HTTP handlers and cannot be added or
+	// removed by a reload
+	static bool
+	// derivations returns the derived states the controller registers when
+	// initialized, nil if none
+	derivations func() []*derivedState
+}
+
+var controllerFactories = map[string]controllerFactory{
+	"tv":           plainController(func() Controller { return &TVController{} }),
+	"kitchen":      plainController(func() Controller { return &KitchenController{} }),
+	"kitchenaudio": plainController(func() Controller { return &KitchenAudioController{} }),
+	"livingroom":   plainController(func() Controller { return &LivingroomController{} }),
+	"bedroom":      plainController(func() Controller { return &BedroomController{} }),
+	"snapcast":     plainController(func() Controller { return &SnapcastController{} }),
+	"mpd":          plainController(func() Controller { return &MPDController{} }),
+	"web":          staticController(func() Controller { return &WebController{} }),
+	"debug":        staticController(func() Controller { return &DebugController{} }),
+	"doorreminder": {
+		params:   func() any { return &DoorReminderConfig{} },
+		validate: validateDoorReminder,
+		build: func(name string, params any) Controller {
+			p := params.(*DoorReminderConfig)
+			return &DoorReminderController{
+				BaseController:  BaseController{Name: name},
+				SensorName:      p.SensorName,
+				StateOpenKey:    p.StateOpenKey,
+				OpenLongLimit:   p.OpenLongLimit,
+				ReminderPeriod:  p.ReminderPeriod,
+				MaxReminders:    p.MaxReminders,
+				ReminderTopic:   p.ReminderTopic,
+				ReminderPayload: p.ReminderPayload,
+			}
+		},
+	},
+	"batteryreminder": {
+		params:   func() any { return &BatteryReminderConfig{} },
+		validate: validateBatteryReminder,
+		build: func(name string, params any) Controller {
+			p := params.(*BatteryReminderConfig)
+			return &BatteryReminderController{
+				BaseController:      BaseController{Name: name},
+				StateBatteryPoorKey: p.StateBatteryPoorKey,
+				ReminderPeriod:      p.ReminderPeriod,
+				MaxReminders:        p.MaxReminders,
+				ReminderTopic:       p.ReminderTopic,
+				ReminderPayload:     p.ReminderPayload,
+			}
+		},
+	},
+	"statemachine": {
+		params:   func() any { return &StateMachineConfig{} },
+		validate: validateStateMachine,
+		build: func(name string, params any) Controller {
+			p := params.(*StateMachineConfig)
+			return &StateMachineController{
+				BaseController: BaseController{Name: name},
+				States:         p.States,
+			}
+		},
+	},
+	"homepresence": {
+		build: plainController(func() Controller { return &PresenceController{} }).build,
+		derivations: func() []*derivedState {
+			return []*derivedState{bayesianDerivation(HomePresenceStateKey, homePresenceModel)}
+		},
+	},
+}
+
+// plainController names the controller after its type already when built,
+// so that it can be addressed before it is initialized.
+func plainController(create func() Controller) controllerFactory {
+	return controllerFactory{
+		build: func(name string, _ any) Controller {
+			controller := create()
+			if named, ok := controller.(interface{ setName(string) }); ok {
+				named.setName(name)
+			}
+			return controller
+		},
+	}
+}
+
+func staticController(create func() Controller) controllerFactory {
+	factory := plainController(create)
+	factory.static = true
+	return factory
+}
+
+func validateDoorReminder(params any) error {
+	p := params.(*DoorReminderConfig)
+	var errs []error
+	errs = append(errs, requireNonEmpty("name", p.Name), requireNonEmpty("stateOpenKey", string(p.StateOpenKey)),
+		requireNonEmpty("reminderTopic", p.ReminderTopic))
+	errs = append(errs, requirePositive("openLongLimit", p.OpenLongLimit), requirePositive("reminderPeriod", p.ReminderPeriod))
+	if p.MaxReminders < 0 {
+		errs = append(errs, fmt.Errorf("maxReminders must not be negative, got %d", p.MaxReminders))
+	}
+	return errors.Join(errs...)
+}
+
+func validateBatteryReminder(params any) error {
+	p := params.(*BatteryReminderConfig)
+	var errs []error
+	errs = append(errs, requireNonEmpty("name", p.Name), requireNonEmpty("stateBatteryPoorKey", string(p.StateBatteryPoorKey)),
+		requireNonEmpty("reminderTopic", p.ReminderTopic))
+	errs = append(errs, requirePositive("reminderPeriod", p.ReminderPeriod))
+	if p.MaxReminders < 0 {
+		errs = append(errs, fmt.Errorf("maxReminders must not be negative, got %d", p.MaxReminders))
+	}
+	return errors.Join(errs...)
+}
+
+func requireNonEmpty(key, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", key)
+	}
+	return nil
+}
+
+func requirePositive(key string, value time.Duration) error {
+	if value <= 0 {
+		return fmt.Errorf("%s must be a positive duration, got %v", key, value)
+	}
+	return nil
+}
+
+// LoadSetupFile reads and validates the YAML config file at path. A file
+// with a base key is layered on top of the setup file it names, relative to
+// path, see layerSetup.
+func LoadSetupFile(path string) (*SetupConfig, error) {
+	raw, err := loadRawSetup(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setup, err := parseRawSetup(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return setup, nil
+}
+
+// rawSetup is a setup declaration before validation. The nodes keep their
+// line numbers for error messages.
+type rawSetup struct {
+	Base        string      `yaml:"base"`
+	Bridges     []string    `yaml:"bridges"`
+	Controllers []yaml.Node `yaml:"controllers"`
+	StateRules  []yaml.Node `yaml:"stateRules"`
+
+	ManualOverrides []yaml.Node `yaml:"manualOverrides"`
+	StateHistory    []yaml.Node `yaml:"stateHistory"`
+	DerivedStates   []yaml.Node `yaml:"derivedStates"`
+}
+
+func decodeRawSetup(data []byte) (*rawSetup, error) {
+	var raw rawSetup
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&raw); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &raw, nil
+}
+
+// loadRawSetup reads the file at path and layers it on its base, if any.
+// A base must be a valid setup by itself. seen holds the files layered on
+// path, to detect cycles.
+func loadRawSetup(path string, seen []string) (*rawSetup, error) {
+	if slices.Contains(seen, path) {
+		return nil, fmt.Errorf("%s: base files form a cycle: %s", path, strings.Join(append(seen, path), " -> "))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeRawSetup(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if raw.Base == "" {
+		return raw, nil
+	}
+
+	basePath := raw.Base
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(path), basePath)
+	}
+	base, err := loadRawSetup(basePath, append(seen, path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseRawSetup(base); err != nil {
+		return nil, fmt.Errorf("%s: %w", basePath, err)
+	}
+	layered, err := layerSetup(base, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return layered, nil
+}
+
+// layerSetup applies overlay on top of base. Bridges, if given, replace those
+// of base. A controller replaces the one of base with the same key, i.e.
+// name or type, other controllers are added. State rules, manual overrides,
+// state history and derived states are added to those of base.
+func layerSetup(base, overlay *rawSetup) (*rawSetup, error) {
+	layered := &rawSetup{
+		Bridges:         base.Bridges,
+		Controllers:     slices.Clone(base.Controllers),
+		StateRules:      slices.Concat(base.StateRules, overlay.StateRules),
+		ManualOverrides: slices.Concat(base.ManualOverrides, overlay.ManualOverrides),
+		StateHistory:    slices.Concat(base.StateHistory, overlay.StateHistory),
+		DerivedStates:   slices.Concat(base.DerivedStates, overlay.DerivedStates),
+	}
+	if overlay.Bridges != nil {
+		layered.Bridges = overlay.Bridges
+	}
+
+	controllerKey := func(node *yaml.Node) (string, error) {
+		var header struct {
+			Type string `yaml:"type"`
+			Name string `yaml:"name"`
+		}
+		if err := node.Decode(&header); err != nil {
+			return "", fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		return ControllerSetup{Type: header.Type, Name: header.Name}.key(), nil
+	}
+	index := make(map[string]int)
+	for i := range layered.Controllers {
+		key, err := controllerKey(&layered.Controllers[i])
+		if err != nil {
+			return nil, err
+		}
+		index[key] = i
+	}
+	for _, node := range overlay.Controllers {
+		key, err := controllerKey(&node)
+		if err != nil {
+			return nil, err
+		}
+		if i, found := index[key]; found {
+			layered.Controllers[i] = node
+		} else {
+			layered.Controllers = append(layered.Controllers, node)
+		}
+	}
+	return layered, nil
+}
+
+// ParseSetup parses and validates a YAML setup declaration. Unknown keys,
+// unknown bridge or controller types and invalid durations are errors.
+func ParseSetup(data []byte) (*SetupConfig, error) {
+	raw, err := decodeRawSetup(data)
+	if err != nil {
+		return nil, err
+	}
+	if raw.Base != "" {
+		return nil, fmt.Errorf("base is only supported in config files")
+	}
+	return parseRawSetup(raw)
+}
+
+func parseRawSetup(raw *rawSetup) (*SetupConfig, error) {
+	setup := &SetupConfig{}
+	for _, bridge := range raw.Bridges {
+		if _, found := bridgeFactories[bridge]; !found {
+			return nil, fmt.Errorf("unknown bridge %q, known bridges are %s", bridge, knownKeys(bridgeFactories))
+		}
+		setup.Bridges = append(setup.Bridges, bridge)
+	}
+
+	names := make(map[string]int)
+	for i := range raw.Controllers {
+		controllerSetup, err := parseControllerSetup(&raw.Controllers[i])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: controller %d: %w", raw.Controllers[i].Line, i, err)
+		}
+		// Unnamed controllers are keyed by their type, so a type can only be
+		// declared once without a name
+		key := controllerSetup.key()
+		if line, exists := names[key]; exists {
+			return nil, fmt.Errorf("line %d: controller name %q already declared on line %d",
+				controllerSetup.Line, key, line)
+		}
+		names[key] = controllerSetup.Line
+		setup.Controllers = append(setup.Controllers, controllerSetup)
+	}
+
+	for i := range raw.StateRules {
+		node := &raw.StateRules[i]
+		var rule StateRule
+		if err := checkKnownKeys(node, &rule); err != nil {
+			return nil, fmt.Errorf("state rule %d: %w", i, err)
+		}
+		if err := node.Decode(&rule); err != nil {
+			return nil, fmt.Errorf("state rule %d: %w", i, err)
+		}
+		if _, err := compileStateRule(rule); err != nil {
+			return nil, fmt.Errorf("line %d: state rule %d: %w", node.Line, i, err)
+		}
+		setup.StateRules = append(setup.StateRules, rule)
+	}
+
+	devices := make(map[string]bool)
+	for i := range raw.ManualOverrides {
+		node := &raw.ManualOverrides[i]
+		var override ManualOverrideConfig
+		if err := checkKnownKeys(node, &override); err != nil {
+			return nil, fmt.Errorf("manual override %d: %w", i, err)
+		}
+		if err := node.Decode(&override); err != nil {
+			return nil, fmt.Errorf("manual override %d: %w", i, err)
+		}
+		if err := validateManualOverride(override); err != nil {
+			return nil, fmt.Errorf("line %d: manual override %d: %w", node.Line, i, err)
+		}
+		if devices[override.Device] {
+			return nil, fmt.Errorf("line %d: manual override for %s already declared", node.Line, override.Device)
+		}
+		devices[override.Device] = true
+		setup.ManualOverrides = append(setup.ManualOverrides, override)
+	}
+
+	historyKeys := make(map[StateKey]bool)
+	for i := range raw.StateHistory {
+		node := &raw.StateHistory[i]
+		var history StateHistoryConfig
+		if err := checkKnownKeys(node, &history); err != nil {
+			return nil, fmt.Errorf("state history %d: %w", i, err)
+		}
+		if err := node.Decode(&history); err != nil {
+			return nil, fmt.Errorf("state history %d: %w", i, err)
+		}
+		if err := validateStateHistory(history); err != nil {
+			return nil, fmt.Errorf("line %d: state history %d: %w", node.Line, i, err)
+		}
+		if historyKeys[history.Key] {
+			return nil, fmt.Errorf("line %d: state history for %s already declared", node.Line, history.Key)
+		}
+		historyKeys[history.Key] = true
+		setup.StateHistory = append(setup.StateHistory, history)
+	}
+
+	var derivations []*derivedState
+	for i := range raw.DerivedStates {
+		node := &raw.DerivedStates[i]
+		var derived DerivedStateConfig
+		if err := checkKnownKeys(node, &derived); err != nil {
+			return nil, fmt.Errorf("derived state %d: %w", i, err)
+		}
+		if err := node.Decode(&derived); err != nil {
+			return nil, fmt.Errorf("derived state %d: %w", i, err)
+		}
+		compiled, err := compileDerivedState(derived)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: derived state %d: %w", node.Line, i, err)
+		}
+		derivations = append(derivations, compiled)
+		setup.DerivedStates = append(setup.DerivedStates, derived)
+	}
+	// Controllers of the same type register the same derivations
+	var controllerDerivations []*derivedState
+	derivingTypes := make(map[string]bool)
+	for _, controllerSetup := range setup.Controllers {
+		factory := controllerFactories[controllerSetup.Type]
+		if factory.derivations != nil && !derivingTypes[controllerSetup.Type] {
+			derivingTypes[controllerSetup.Type] = true
+			controllerDerivations = append(controllerDerivations, factory.derivations()...)
+		}
+	}
+	stateKeys := knownStateKeys(setup)
+	if err := validateDerivedStates(derivations, controllerDerivations, stateKeys); err != nil {
+		return nil, fmt.Errorf("derived states: %w", err)
+	}
+
+	// Guards may read any key, including derived ones
+	for _, controllerSetup := range setup.Controllers {
+		if stateMachine, ok := controllerSetup.Params.(*StateMachineConfig); ok {
+			if err := stateMachine.validateGuardKeys(stateKeys); err != nil {
+				return nil, fmt.Errorf("line %d: controller %s: %w", controllerSetup.Line, controllerSetup.key(), err)
+			}
+		}
+	}
+	return setup, nil
+}
+
+func parseControllerSetup(node *yaml.Node) (ControllerSetup, error) {
+	var header struct {
+		Type   string `yaml:"type"`
+		Name   string `yaml:"name"`
+		DryRun bool   `yaml:"dryRun"`
+	}
+	if node.Kind != yaml.MappingNode {
+		return ControllerSetup{}, fmt.Errorf("expected a mapping")
+	}
+	if err := node.Decode(&header); err != nil {
+		return ControllerSetup{}, err
+	}
+	factory, found := controllerFactories[header.Type]
+	if !found {
+		return ControllerSetup{}, fmt.Errorf("unknown controller type %q, known types are %s",
+			header.Type, knownKeys(controllerFactories))
+	}
+
+	controllerSetup := ControllerSetup{Type: header.Type, Name: header.Name, DryRun: header.DryRun, Line: node.Line}
+	if factory.params == nil {
+		if err := checkKnownKeys(node, &plainControllerConfig{}, commonControllerKeys...); err != nil {
+			return ControllerSetup{}, fmt.Errorf("%s: %w", header.Type, err)
+		}
+		return controllerSetup, nil
+	}
+
+	params := factory.params()
+	if err := checkKnownKeys(node, params, commonControllerKeys...); err != nil {
+		return ControllerSetup{}, fmt.Errorf("%s: %w", header.Type, err)
+	}
+	if err := node.Decode(params); err != nil {
+		return ControllerSetup{}, fmt.Errorf("%s: %w", header.Type, err)
+	}
+	if err := factory.validate(params); err != nil {
+		return ControllerSetup{}, fmt.Errorf("%s: %w", header.Type, err)
+	}
+	controllerSetup.Params = params
+	return controllerSetup, nil
+}
+
+// Keys accepted in every controller declaration, in addition to the
+// parameters of the type
+var commonControllerKeys = []string{"dryRun"}
+
+// checkKnownKeys fails on mapping keys that do not correspond to a yaml tag
+// of target or to one of extra. yaml.Node.Decode has no strict mode of its
+// own.
+func checkKnownKeys(node *yaml.Node, target any, extra ...string) error {
+	known := make(map[string]bool)
+	for _, key := range extra {
+		known[key] = true
+	}
+	t := reflect.TypeOf(target).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" {
+			known[tag] = true
+		}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !known[key.Value] {
+			return fmt.Errorf("line %d: unknown key %q, known keys are %s", key.Line, key.Value, knownKeys(known))
+		}
+	}
+	return nil
+}
+
+func knownKeys[V any](m map[string]V) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// Build creates fresh bridge and controller instances from the declaration.
+func (setup *SetupConfig) Build() (*[]BridgeWrapper, *[]Controller) {
+	bridgeWrappers := make([]BridgeWrapper, 0, len(setup.Bridges))
+	for _, bridge := range setup.Bridges {
+		bridgeWrappers = append(bridgeWrappers, bridgeFactories[bridge]())
+	}
+	controllers := make([]Controller, 0, len(setup.Controllers))
+	for _, controllerSetup := range setup.Controllers {
+		factory := controllerFactories[controllerSetup.Type]
+		controllers = append(controllers, factory.build(controllerSetup.key(), controllerSetup.Params))
+	}
+	return &bridgeWrappers, &controllers
+}
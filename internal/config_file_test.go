@@ -0,0 +1,181 @@
+package regelverk
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSetup(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+bridges: [mpd, telegram]
+controllers:
+  - type: tv
+  - type: doorreminder
+    name: fridgedoor
+    sensorName: fridge-door
+    stateOpenKey: fridgeDoorOpen
+    openLongLimit: 10s
+    reminderPeriod: 1m
+    maxReminders: 3
+    reminderTopic: kitchen/audio/play
+    reminderPayload: ping
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bridgeWrappers, controllers := setup.Build()
+	if len(*bridgeWrappers) != 2 || (*bridgeWrappers)[0].String() != "MpdBridgeWrapper" {
+		t.Fatalf("unexpected bridges %v", *bridgeWrappers)
+	}
+	if len(*controllers) != 2 {
+		t.Fatalf("expected 2 controllers, got %d", len(*controllers))
+	}
+	door, ok := (*controllers)[1].(*DoorReminderController)
+	if !ok {
+		t.Fatalf("expected DoorReminderController, got %T", (*controllers)[1])
+	}
+	if door.Name != "fridgedoor" || door.OpenLongLimit != 10*time.Second || door.ReminderPeriod != time.Minute ||
+		door.StateOpenKey != "fridgeDoorOpen" || door.MaxReminders != 3 {
+		t.Fatalf("unexpected door controller %+v", door)
+	}
+}
+
+func TestParseSetupErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"unknown top-level key", "bridge: [mpd]", "field bridge not found"},
+		{"unknown bridge", "bridges: [mqtt]", `unknown bridge "mqtt"`},
+		{"unknown controller type", "controllers:\n  - type: garage", `unknown controller type "garage"`},
+		{"unknown controller key", "controllers:\n  - type: batteryreminder\n    name: b\n    stateBatteryPoorKey: k\n    reminderPeriod: 1h\n    reminderTopic: t\n    reminderPeriode: 2h",
+			`line 7: unknown key "reminderPeriode"`},
+		{"parameters on plain controller", "controllers:\n  - type: tv\n    name: tv2", `unknown key "name"`},
+		{"invalid duration", "controllers:\n  - type: batteryreminder\n    name: b\n    stateBatteryPoorKey: k\n    reminderPeriod: 1 day\n    reminderTopic: t",
+			"into time.Duration"},
+		{"missing duration", "controllers:\n  - type: batteryreminder\n    name: b\n    stateBatteryPoorKey: k\n    reminderTopic: t",
+			"reminderPeriod must be a positive duration"},
+		{"duplicate name", "controllers:\n  - type: batteryreminder\n    name: b\n    stateBatteryPoorKey: k\n    reminderPeriod: 1h\n    reminderTopic: t\n  - type: batteryreminder\n    name: b\n    stateBatteryPoorKey: k\n    reminderPeriod: 1h\n    reminderTopic: t",
+			`controller name "b" already declared on line 2`},
+		{"duplicate type", "controllers:\n  - type: tv\n  - type: tv", `line 3: controller name "tv" already declared on line 2`},
+		{"unknown state rule key", "stateRules:\n  - topic: t\n    path: battery\n    threshold: 30\n    key: k",
+			`line 4: unknown key "threshold"`},
+		{"invalid state rule", "stateRules:\n  - topic: t\n    path: battery\n    compare: lt\n    value: low\n    key: k",
+			"line 2: state rule 0: compare lt requires a numeric value"},
+		{"duplicate state history", "stateHistory:\n  - key: k\n  - key: k\n    retention: 1h",
+			"line 3: state history for k already declared"},
+		{"negative state history retention", "stateHistory:\n  - key: k\n    retention: -1h",
+			"retention must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSetup([]byte(tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHubDefaultSetup(t *testing.T) {
+	setup, err := LoadSetupFile("../cmd/regelverk-hub/regelverk.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(setup.Controllers) != 12 {
+		t.Fatalf("expected 12 controllers, got %d", len(setup.Controllers))
+	}
+}
+
+func TestHubSimulatorSetup(t *testing.T) {
+	setup, err := LoadSetupFile("../cmd/regelverk-hub/simulator.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, bridge := range setup.Bridges {
+		if !strings.HasPrefix(bridge, "sim-") {
+			t.Errorf("expected only simulated bridges, got %s", bridge)
+		}
+	}
+	// The controllers of the default setup and the state machine
+	if len(setup.Controllers) != 13 || setup.Controllers[12].key() != "balconydoorcold" {
+		t.Fatalf("expected the default controllers and balconydoorcold, got %d", len(setup.Controllers))
+	}
+}
+
+func TestLoadLayeredSetupFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("base.yaml", `
+bridges: [cec, mpd]
+controllers:
+  - type: tv
+  - type: batteryreminder
+    name: b
+    stateBatteryPoorKey: k
+    reminderPeriod: 24h
+    reminderTopic: t
+stateRules:
+  - topic: zigbee2mqtt/door
+    path: contact
+    key: doorClosed
+`)
+	overlay := write("overlay.yaml", `
+base: base.yaml
+controllers:
+  - type: batteryreminder
+    name: b
+    stateBatteryPoorKey: k
+    reminderPeriod: 1h
+    reminderTopic: t
+  - type: kitchen
+derivedStates:
+  - key: doorOpen
+    expression: "!doorClosed"
+`)
+	setup, err := LoadSetupFile(overlay)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(setup.Bridges, []string{"cec", "mpd"}) {
+		t.Errorf("expected the bridges of the base, got %v", setup.Bridges)
+	}
+	var keys []string
+	for _, controllerSetup := range setup.Controllers {
+		keys = append(keys, controllerSetup.key())
+	}
+	if !slices.Equal(keys, []string{"tv", "b", "kitchen"}) {
+		t.Errorf("expected b to be replaced in place and kitchen added, got %v", keys)
+	}
+	if period := setup.Controllers[1].Params.(*BatteryReminderConfig).ReminderPeriod; period != time.Hour {
+		t.Errorf("expected the reminder period of the overlay, got %v", period)
+	}
+	if len(setup.StateRules) != 1 || len(setup.DerivedStates) != 1 {
+		t.Errorf("expected state rules and derived states to be added, got %+v", setup)
+	}
+
+	invalidBase := write("invalid.yaml", "base: base.yaml\ncontrollers:\n  - type: garage\n")
+	if _, err := LoadSetupFile(write("on-invalid.yaml", "base: invalid.yaml\n")); err == nil ||
+		!strings.Contains(err.Error(), invalidBase+`: line 3: controller 2: unknown controller type "garage"`) {
+		t.Errorf("expected an error in the base file, got %v", err)
+	}
+	write("a.yaml", "base: b.yaml\n")
+	if _, err := LoadSetupFile(write("b.yaml", "base: a.yaml\n")); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	if _, err := ParseSetup([]byte("base: base.yaml\n")); err == nil {
+		t.Errorf("expected base to be rejected outside config files")
+	}
+}
@@ -0,0 +1,390 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// How long a replaced controller's worker may take to finish the event it is
+// processing
+const controllerStopTimeout = 5 * time.Second
+
+func sameControllerSetup(a, b ControllerSetup) bool {
+	return a.Type == b.Type && reflect.DeepEqual(a.Params, b.Params)
+}
+
+// ReloadConfig re-reads the config file and applies the difference to the
+// running hub. On error the running configuration is kept.
+func (masterController *MasterController) ReloadConfig() ([]string, error) {
+	if masterController.config.ConfigFile == "" {
+		return nil, fmt.Errorf("no config file given, nothing to reload")
+	}
+	setup, err := LoadSetupFile(masterController.config.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return masterController.applySetup(setup)
+}
+
+// applySetup rebuilds added and changed controllers, stops removed ones,
+// starts and stops bridges and re-registers state rules. Unchanged
+// controllers keep running and the StateValueMap is left as is. Returns the
+// list of changes.
+func (masterController *MasterController) applySetup(setup *SetupConfig) ([]string, error) {
+	masterController.reloadMu.Lock()
+	defer masterController.reloadMu.Unlock()
+
+	masterController.mu.Lock()
+	oldSetup := masterController.config.Setup
+	var oldControllers []Controller
+	if masterController.controllers != nil {
+		oldControllers = *masterController.controllers
+	}
+	oldQueues := masterController.controllerQueues
+	masterController.mu.Unlock()
+
+	if oldSetup == nil || len(oldSetup.Controllers) != len(oldControllers) {
+		return nil, fmt.Errorf("running controllers were not created from a config file, cannot reload")
+	}
+	changes, err := diffSetup(oldSetup, setup)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		slog.Info("Config reloaded, no changes", "configFile", masterController.config.ConfigFile)
+		return nil, nil
+	}
+	for _, change := range changes {
+		slog.Info("Config change", "change", change)
+	}
+
+	oldIndex := make(map[string]int)
+	for i, controllerSetup := range oldSetup.Controllers {
+		oldIndex[controllerSetup.key()] = i
+	}
+
+	controllers := make([]Controller, len(setup.Controllers))
+	kept := make(map[int]int)
+	for i, controllerSetup := range setup.Controllers {
+		if j, found := oldIndex[controllerSetup.key()]; found && sameControllerSetup(oldSetup.Controllers[j], controllerSetup) {
+			controllers[i] = oldControllers[j]
+			kept[i] = j
+			continue
+		}
+		controllers[i] = controllerFactories[controllerSetup.Type].build(controllerSetup.key(), controllerSetup.Params)
+	}
+
+	// Retire replaced and removed controllers before their successors start,
+	// so that cancelling by name does not hit the new instance
+	keptOld := make(map[int]bool)
+	for _, j := range kept {
+		keptOld[j] = true
+	}
+	for j, controller := range oldControllers {
+		if keptOld[j] {
+			continue
+		}
+		if queue, found := oldQueues[controller]; found {
+			queue.stop(controllerStopTimeout)
+		}
+		masterController.retireController(controller)
+		masterController.restoredControllerStates.drop(oldSetup.Controllers[j].key())
+	}
+
+	var queues map[Controller]*controllerQueue
+	if masterController.queueCtx != nil {
+		queues = make(map[Controller]*controllerQueue, len(controllers))
+		for _, controller := range controllers {
+			if queue, found := oldQueues[controller]; found {
+				queues[controller] = queue
+			} else {
+				queues[controller] = masterController.startControllerQueue(controller)
+			}
+		}
+	}
+
+	masterController.mu.Lock()
+	masterController.config.Setup = setup
+	masterController.controllers = &controllers
+	masterController.controllerQueues = queues
+	masterController.eventCallbacks = nil
+	masterController.stateRules = nil
+	masterController.registerEventCallbacks()
+	masterController.mu.Unlock()
+	masterController.updateDryRunControllers()
+
+	masterController.reloadBridges(oldSetup.Bridges, setup.Bridges)
+
+	slog.Info("Config reloaded", "configFile", masterController.config.ConfigFile, "changes", len(changes))
+	return changes, nil
+}
+
+// retireController cancels timers and delayed publishes of a controller that
+// is removed or replaced, and forgets its panics.
+func (masterController *MasterController) retireController(controller Controller) {
+	if timerAware, ok := controller.(interface{ stopStateTimers() int }); ok {
+		timerAware.stopStateTimers()
+	}
+	if masterController.publishScheduler != nil {
+		masterController.publishScheduler.CancelController(controllerName(controller))
+	}
+	masterController.forgetControllerHealth(controllerName(controller))
+}
+
+func (masterController *MasterController) reloadBridges(oldBridges, newBridges []string) {
+	masterController.mu.Lock()
+	defer masterController.mu.Unlock()
+
+	removed, added := diffNames(oldBridges, newBridges)
+	for _, bridge := range removed {
+		name := bridgeFactories[bridge]().String()
+		if cancel, running := masterController.runningBridges[name]; running {
+			slog.Info("Stopping bridge", "bridgeWrapper", name)
+			cancel()
+			delete(masterController.runningBridges, name)
+		}
+	}
+	if masterController.bridgeCtx == nil || masterController.shuttingDown {
+		return
+	}
+	for _, bridge := range added {
+		bridgeWrapper := bridgeFactories[bridge]()
+		masterController.runningBridges[bridgeWrapper.String()] = startBridge(masterController.bridgeCtx,
+			masterController.mqttClient, masterController.config, bridgeWrapper, &masterController.bridgeWorkers)
+	}
+}
+
+// diffSetup lists the differences between two setups, one line per change.
+// Fails if a static controller would be added or removed.
+func diffSetup(oldSetup, newSetup *SetupConfig) ([]string, error) {
+	var changes []string
+
+	removed, added := diffNames(oldSetup.Bridges, newSetup.Bridges)
+	for _, bridge := range removed {
+		changes = append(changes, "bridge removed: "+bridge)
+	}
+	for _, bridge := range added {
+		changes = append(changes, "bridge added: "+bridge)
+	}
+
+	oldControllers := make(map[string]ControllerSetup)
+	for _, controllerSetup := range oldSetup.Controllers {
+		oldControllers[controllerSetup.key()] = controllerSetup
+	}
+	newControllers := make(map[string]bool)
+	for _, controllerSetup := range newSetup.Controllers {
+		key := controllerSetup.key()
+		newControllers[key] = true
+		oldControllerSetup, found := oldControllers[key]
+		switch {
+		case !found:
+			if controllerFactories[controllerSetup.Type].static {
+				return nil, fmt.Errorf("controller %s cannot be added without a restart", key)
+			}
+			changes = append(changes, "controller added: "+key)
+		case oldControllerSetup.Type != controllerSetup.Type:
+			if controllerFactories[controllerSetup.Type].static || controllerFactories[oldControllerSetup.Type].static {
+				return nil, fmt.Errorf("controller %s cannot change type without a restart", key)
+			}
+			changes = append(changes, fmt.Sprintf("controller changed: %s: type %s -> %s", key,
+				oldControllerSetup.Type, controllerSetup.Type))
+		default:
+			for _, param := range diffParams(oldControllerSetup.Params, controllerSetup.Params) {
+				changes = append(changes, fmt.Sprintf("controller changed: %s: %s", key, param))
+			}
+			if oldControllerSetup.DryRun != controllerSetup.DryRun {
+				changes = append(changes, fmt.Sprintf("controller changed: %s: dryRun %v -> %v", key,
+					oldControllerSetup.DryRun, controllerSetup.DryRun))
+			}
+		}
+	}
+	for _, controllerSetup := range oldSetup.Controllers {
+		key := controllerSetup.key()
+		if newControllers[key] {
+			continue
+		}
+		if controllerFactories[controllerSetup.Type].static {
+			return nil, fmt.Errorf("controller %s cannot be removed without a restart", key)
+		}
+		changes = append(changes, "controller removed: "+key)
+	}
+
+	removed, added = diffNames(describeStateRules(oldSetup.StateRules), describeStateRules(newSetup.StateRules))
+	for _, rule := range removed {
+		changes = append(changes, "state rule removed: "+rule)
+	}
+	for _, rule := range added {
+		changes = append(changes, "state rule added: "+rule)
+	}
+
+	removed, added = diffNames(describeManualOverrides(oldSetup.ManualOverrides), describeManualOverrides(newSetup.ManualOverrides))
+	for _, override := range removed {
+		changes = append(changes, "manual override removed: "+override)
+	}
+	for _, override := range added {
+		changes = append(changes, "manual override added: "+override)
+	}
+
+	removed, added = diffNames(describeStateHistory(oldSetup.StateHistory), describeStateHistory(newSetup.StateHistory))
+	for _, history := range removed {
+		changes = append(changes, "state history removed: "+history)
+	}
+	for _, history := range added {
+		changes = append(changes, "state history added: "+history)
+	}
+
+	removed, added = diffNames(describeDerivedStates(oldSetup.DerivedStates), describeDerivedStates(newSetup.DerivedStates))
+	for _, derived := range removed {
+		changes = append(changes, "derived state removed: "+derived)
+	}
+	for _, derived := range added {
+		changes = append(changes, "derived state added: "+derived)
+	}
+	return changes, nil
+}
+
+// diffParams compares two parameter structs field by field, by yaml name.
+func diffParams(oldParams, newParams any) []string {
+	if oldParams == nil || newParams == nil {
+		if oldParams != newParams {
+			return []string{"parameters changed"}
+		}
+		return nil
+	}
+	oldValue := reflect.ValueOf(oldParams).Elem()
+	newValue := reflect.ValueOf(newParams).Elem()
+	var diff []string
+	for i := 0; i < oldValue.NumField(); i++ {
+		oldField, newField := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(oldField, newField) {
+			continue
+		}
+		name := strings.Split(oldValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		diff = append(diff, fmt.Sprintf("%s %v -> %v", name, oldField, newField))
+	}
+	return diff
+}
+
+func describeStateRules(rules []StateRule) []string {
+	descriptions := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		description := rule.Topic
+		if rule.Path != "" {
+			description += " " + rule.Path
+		}
+		if rule.Compare != "" {
+			description += fmt.Sprintf(" %s %v", rule.Compare, rule.Value)
+		}
+		if rule.Invert {
+			description += " inverted"
+		}
+		if rule.Type != "" {
+			description += " " + rule.Type
+		}
+		if len(rule.Values) > 0 {
+			description += fmt.Sprintf(" %v", rule.Values)
+		}
+		if rule.Key != "" {
+			description += " -> " + string(rule.Key)
+		}
+		if rule.Metric != "" {
+			description += " metric " + rule.Metric
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
+
+func describeManualOverrides(overrides []ManualOverrideConfig) []string {
+	descriptions := make([]string, 0, len(overrides))
+	for _, override := range overrides {
+		description := fmt.Sprintf("%s hold %v", override.Device, override.Hold)
+		if override.Property != "" {
+			description += " property " + override.Property
+		}
+		if override.CommandWindow != 0 {
+			description += fmt.Sprintf(" commandWindow %v", override.CommandWindow)
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
+
+func describeStateHistory(configs []StateHistoryConfig) []string {
+	descriptions := make([]string, 0, len(configs))
+	for _, config := range configs {
+		description := string(config.Key)
+		if config.Retention != 0 {
+			description += fmt.Sprintf(" retention %v", config.Retention)
+		}
+		if config.MaxEntries != 0 {
+			description += fmt.Sprintf(" maxEntries %d", config.MaxEntries)
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
+
+func describeDerivedStates(configs []DerivedStateConfig) []string {
+	descriptions := make([]string, 0, len(configs))
+	for _, config := range configs {
+		definition := config.Expression
+		if config.Aggregate != "" {
+			definition = fmt.Sprintf("%s(%s)", config.Aggregate, joinKeys(config.Keys, ", "))
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s = %s", config.Key, definition))
+	}
+	return descriptions
+}
+
+// diffNames returns the entries only in a and only in b, respecting
+// duplicates.
+func diffNames(a, b []string) (onlyA, onlyB []string) {
+	counts := make(map[string]int)
+	for _, name := range a {
+		counts[name]++
+	}
+	for _, name := range b {
+		if counts[name] > 0 {
+			counts[name]--
+		} else {
+			onlyB = append(onlyB, name)
+		}
+	}
+	for _, name := range a {
+		if counts[name] > 0 {
+			counts[name]--
+			onlyA = append(onlyA, name)
+		}
+	}
+	return onlyA, onlyB
+}
+
+func (masterController *MasterController) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes, err := masterController.ReloadConfig()
+	if err != nil {
+		slog.Error("Config reload failed, keeping running configuration", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Changes []string `json:"changes"`
+	}{Changes: changes}); err != nil {
+		http.Error(w, "failed to encode reload result", http.StatusInternalServerError)
+		return
+	}
+}
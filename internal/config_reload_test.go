@@ -0,0 +1,131 @@
+package regelverk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const reloadTestSetup = `
+controllers:
+  - type: batteryreminder
+    name: b1
+    stateBatteryPoorKey: b1Low
+    reminderPeriod: 1h
+    reminderTopic: t
+  - type: batteryreminder
+    name: b2
+    stateBatteryPoorKey: b2Low
+    reminderPeriod: 1h
+    reminderTopic: t
+stateRules:
+  - topic: zigbee2mqtt/b1
+    path: battery
+    compare: lt
+    value: 30
+    key: b1Low
+`
+
+func TestReloadConfig(t *testing.T) {
+	setup, err := ParseSetup([]byte(reloadTestSetup))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.config.Setup = setup
+	masterController.config.ConfigFile = filepath.Join(t.TempDir(), "regelverk.yaml")
+	_, masterController.controllers = setup.Build()
+	masterController.Init()
+	masterController.startControllerQueues(ctx)
+	masterController.stateValueMap.setState("b1Low", true)
+
+	before := *masterController.controllers
+
+	// A broken config file keeps the running configuration
+	if err := os.WriteFile(masterController.config.ConfigFile, []byte("controllers:\n  - type: garage\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := masterController.ReloadConfig(); err == nil {
+		t.Fatalf("expected reload error")
+	}
+	if masterController.config.Setup != setup || len(masterController.controllerQueues) != 2 {
+		t.Fatalf("running configuration changed on failed reload")
+	}
+
+	// Static controllers cannot be added at runtime
+	withDebug := strings.Replace(reloadTestSetup, "stateRules:", "  - type: debug\nstateRules:", 1)
+	if err := os.WriteFile(masterController.config.ConfigFile, []byte(withDebug), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := masterController.ReloadConfig(); err == nil || !strings.Contains(err.Error(), "cannot be added") {
+		t.Fatalf("expected error when adding a static controller, got %v", err)
+	}
+
+	changed := `
+controllers:
+  - type: batteryreminder
+    name: b1
+    stateBatteryPoorKey: b1Low
+    reminderPeriod: 1h
+    reminderTopic: t
+  - type: batteryreminder
+    name: b2
+    stateBatteryPoorKey: b2Low
+    reminderPeriod: 2h
+    reminderTopic: t
+  - type: tv
+stateRules:
+  - topic: zigbee2mqtt/b1
+    path: battery
+    compare: lt
+    value: 20
+    key: b1Low
+`
+	if err := os.WriteFile(masterController.config.ConfigFile, []byte(changed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := masterController.ReloadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"controller changed: b2: reminderPeriod 1h0m0s -> 2h0m0s",
+		"controller added: tv",
+		"state rule removed: zigbee2mqtt/b1 battery lt 30 -> b1Low",
+		"state rule added: zigbee2mqtt/b1 battery lt 20 -> b1Low",
+	} {
+		if !slices.Contains(changes, want) {
+			t.Errorf("missing change %q in %q", want, changes)
+		}
+	}
+
+	after := *masterController.controllers
+	if len(after) != 3 || len(masterController.controllerQueues) != 3 {
+		t.Fatalf("expected 3 controllers and queues, got %d and %d", len(after), len(masterController.controllerQueues))
+	}
+	if after[0] != before[0] {
+		t.Errorf("unchanged controller b1 was rebuilt")
+	}
+	if after[1] == before[1] {
+		t.Errorf("changed controller b2 was not rebuilt")
+	}
+	if !masterController.stateValueMap.currentlyTrue("b1Low") {
+		t.Errorf("state values not preserved across reload")
+	}
+	if rules := masterController.stateRulesDebug(); len(rules) != 1 || rules[0].Value != float64(20) {
+		t.Errorf("state rules not reloaded: %+v", rules)
+	}
+
+	// Reloading the same file is a no-op
+	changes, err = masterController.ReloadConfig()
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %q, %v", changes, err)
+	}
+}
@@ -1,6 +1,7 @@
 package regelverk
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -18,6 +19,8 @@ type BaseController struct {
 	isInitialized    bool
 	eventHandlers    []func(ev MQTTEvent) []MQTTPublish
 	triggerFactory   func(ev MQTTEvent) []string // For override of default event -> trigger mapping
+	queue            *controllerQueue
+	timers           stateTimers
 	mu               sync.Mutex
 
 	backoffUntil        time.Time
@@ -28,6 +31,10 @@ func (c *BaseController) String() string {
 	return c.Name
 }
 
+func (c *BaseController) setName(name string) {
+	c.Name = name
+}
+
 func (c *BaseController) Lock() {
 	c.mu.Lock()
 }
@@ -36,6 +43,10 @@ func (c *BaseController) Unlock() {
 	c.mu.Unlock()
 }
 
+func (c *BaseController) TryLock() bool {
+	return c.mu.TryLock()
+}
+
 func (c *BaseController) SetInitialized() {
 	c.isInitialized = true
 
@@ -54,6 +65,14 @@ func (c *BaseController) IsInitialized() bool {
 	return c.isInitialized
 }
 
+// resetInitialized makes the next event initialize the controller again.
+// Requires the controller lock to be held.
+func (c *BaseController) resetInitialized() {
+	c.isInitialized = false
+	c.eventsToPublish = nil
+	c.stopStateTimers()
+}
+
 func (c *BaseController) DebugState() ControllerDebugState {
 	var state any
 	var stateText string
@@ -70,11 +89,12 @@ func (c *BaseController) DebugState() ControllerDebugState {
 		StateMachine:          c.stateMachine.String(),
 		BackoffUntil:          c.backoffUntil,
 		LastBackoffDuration:   c.lastBackoffDuration,
+		Timers:                c.stateTimersDebug(),
 	}
 }
 
 func (c *BaseController) checkBackoff() bool {
-	return time.Now().After(c.backoffUntil)
+	return nowFunc().After(c.backoffUntil)
 }
 
 func (c *BaseController) extendBackoff(maxBackoff time.Duration) {
@@ -86,7 +106,7 @@ func (c *BaseController) extendBackoff(maxBackoff time.Duration) {
 			c.lastBackoffDuration = maxBackoff
 		}
 	}
-	c.backoffUntil = time.Now().Add(c.lastBackoffDuration)
+	c.backoffUntil = nowFunc().Add(c.lastBackoffDuration)
 }
 
 func (c *BaseController) ProcessEvent(ev MQTTEvent) []MQTTPublish {
@@ -175,10 +195,73 @@ func (c *BaseController) StateMachineFire(trigger stateless.Trigger, args ...any
 			c.Name, c.masterController.metricsConfig.MetricsRealm))
 		counter.Inc()
 	}
-	return c.stateMachine.Fire(trigger, args...)
+	err := c.stateMachine.Fire(trigger, args...)
+	c.pruneStateTimers()
+	return err
+}
+
+// cancelScheduledPublishes drops delayed publishes requested by this
+// controller that have not been sent yet. Intended to be used as an OnExit
+// action, so that e.g. a power on sequence stops when the state is left.
+func (c *BaseController) cancelScheduledPublishes(_ context.Context, _ ...any) error {
+	var remaining []MQTTPublish
+	for _, event := range c.eventsToPublish {
+		if event.Wait == 0 {
+			remaining = append(remaining, event)
+		}
+	}
+	c.eventsToPublish = remaining
+
+	if c.masterController.publishScheduler != nil {
+		cancelled := c.masterController.publishScheduler.CancelController(c.Name)
+		if c.masterController.metricsConfig.CollectDebugMetrics && cancelled > 0 {
+			counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_mqtt_publish_cancelled{controller="%s",realm="%s"}`,
+				c.Name, c.masterController.metricsConfig.MetricsRealm))
+			counter.Add(cancelled)
+		}
+	}
+	return nil
+}
+
+func (c *BaseController) setControllerQueue(queue *controllerQueue) {
+	c.queue = queue
+}
+
+// publishAsync emits events outside of ProcessEvent, e.g. from timers,
+// goroutines or HTTP handlers. The events are queued in order with the
+// controller's MQTT events and published through the same path.
+func (c *BaseController) publishAsync(events []MQTTPublish) {
+	if len(events) == 0 {
+		return
+	}
+	c.runAsync("publish "+events[0].Topic, func() []MQTTPublish { return events })
+}
+
+// runAsync queues action to be run while holding the controller lock, in
+// order with the controller's MQTT events. Returned events are published.
+// name identifies the action in logs.
+func (c *BaseController) runAsync(name string, action func() []MQTTPublish) {
+	c.enqueueAsync(queuedEvent{actionName: name, action: action})
+}
+
+// enqueueAsync queues an action item, or runs it right away if the
+// controller has no queue, e.g. before the queues are started
+func (c *BaseController) enqueueAsync(item queuedEvent) {
+	if c.queue != nil {
+		item.client = c.masterController.mqttClient
+		c.queue.enqueueItem(item)
+		return
+	}
+	c.Lock()
+	events := item.action()
+	c.Unlock()
+	c.masterController.dispatchPublishes(c.masterController.mqttClient, c.Name, events)
 }
 
+// addEventsToPublish queues the outputs of a transition. Commands to devices
+// that are manually held are skipped.
 func (c *BaseController) addEventsToPublish(events []MQTTPublish) {
+	events = c.masterController.filterHeldOutputs(c.Name, events)
 	c.eventsToPublish = append(c.eventsToPublish, events...)
 }
 
@@ -22,12 +22,12 @@ func (t batteryState) ToInt() int {
 
 type BatteryReminderController struct {
 	BaseController
-	cancelFunc          context.CancelFunc
 	StateBatteryPoorKey StateKey
 	ReminderPeriod      time.Duration
 	MaxReminders        int
 	ReminderTopic       string
 	ReminderPayload     string
+	remindersSent       int
 }
 
 func (c *BatteryReminderController) Initialize(masterController *MasterController) []MQTTPublish {
@@ -35,7 +35,7 @@ func (c *BatteryReminderController) Initialize(masterController *MasterControlle
 
 	var initialState batteryState = batteryGood
 
-	c.stateMachine = stateless.NewStateMachine(initialState)
+	c.stateMachine = stateless.NewStateMachine(c.restoredInitialState(initialState, batteryGood, batteryPoor))
 	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 
 	c.stateMachine.Configure(batteryGood).
@@ -43,52 +43,41 @@ func (c *BatteryReminderController) Initialize(masterController *MasterControlle
 
 	c.stateMachine.Configure(batteryPoor).
 		OnEntry(c.startNotifyBatteryPoor).
-		OnExit(c.stopNotifyBatteryPoor).
+		InternalTransition("remind", c.remind).
 		Permit("mqttEvent", batteryGood, c.masterController.requireFalseByKey(c.StateBatteryPoorKey))
 
+	// Reminders continue after a restart in batteryPoor
+	if c.stateMachine.MustState() == batteryPoor {
+		c.startNotifyBatteryPoor(context.Background())
+	}
+
 	c.SetInitialized()
 	return nil
 }
 
-func (c *BatteryReminderController) startNotifyBatteryPoor(parentContext context.Context, _ ...any) error {
-	if c.cancelFunc != nil {
-		c.cancelFunc()
+// Reminders are state timers, so they stop when the state is left and run
+// in virtual time in replays and scenario tests
+func (c *BatteryReminderController) startNotifyBatteryPoor(_ context.Context, _ ...any) error {
+	c.remindersSent = 0
+	if c.MaxReminders > 0 {
+		c.scheduleTrigger("remind", c.ReminderPeriod)
 	}
-
-	var ctx context.Context
-	ctx, c.cancelFunc = context.WithCancel(parentContext)
-
-	go func() {
-		ticker := time.NewTicker(c.ReminderPeriod)
-		defer ticker.Stop()
-		for i := 0; i < c.MaxReminders; i++ {
-			select {
-			case <-ticker.C:
-
-				events := []MQTTPublish{
-					{
-						Topic:    c.ReminderTopic,
-						Payload:  c.ReminderPayload,
-						Qos:      2,
-						Retained: false,
-						Wait:     0 * time.Second,
-					},
-				}
-				c.addEventsToPublish(events)
-				i = i + 1
-			case <-ctx.Done():
-				return
-			}
-		}
-		c.cancelFunc()
-	}()
 	return nil
 }
 
-func (c *BatteryReminderController) stopNotifyBatteryPoor(_ context.Context, _ ...any) error {
-	if c.cancelFunc != nil {
-		c.cancelFunc()
-		c.cancelFunc = nil
+func (c *BatteryReminderController) remind(_ context.Context, _ ...any) error {
+	c.addEventsToPublish([]MQTTPublish{
+		{
+			Topic:    c.ReminderTopic,
+			Payload:  c.ReminderPayload,
+			Qos:      2,
+			Retained: false,
+			Wait:     0 * time.Second,
+		},
+	})
+	c.remindersSent++
+	if c.remindersSent < c.MaxReminders {
+		c.scheduleTrigger("remind", c.ReminderPeriod)
 	}
 	return nil
 }
@@ -21,10 +21,12 @@ func (t blindsState) ToInt() int {
 	return int(t)
 }
 
+// How long the blinds stay in the manually selected position before
+// returning to the scheduled one
+const bedroomBlindsTemporaryDuration = 30 * time.Minute
+
 type BedroomController struct {
 	BaseController
-	scheduleUp   time.Time
-	scheduleDown time.Time
 }
 
 func (c *BedroomController) Initialize(masterController *MasterController) []MQTTPublish {
@@ -42,7 +44,7 @@ func (c *BedroomController) Initialize(masterController *MasterController) []MQT
 	// 	return nil
 	// }
 
-	c.stateMachine = stateless.NewStateMachine(bedroomBlindsStateOpen)
+	c.stateMachine = stateless.NewStateMachine(c.restoredInitialState(bedroomBlindsStateOpen, bedroomBlindsStateClosed, bedroomBlindsStateOpen))
 	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 
 	c.stateMachine.Configure(bedroomBlindsStateOpen).
@@ -65,37 +67,14 @@ func (c *BedroomController) Initialize(masterController *MasterController) []MQT
 		OnEntryFrom("timer", c.refreshBedroomBlinds).
 		OnEntryFrom("blindsdowntemporarily", c.scheduleBlindsUp)
 
-	go func() {
-		for {
-			now := time.Now()
-			if now.Hour() == 9 && now.Minute() == 0 {
-				c.StateMachineFire("blindsup")
-			} else if now.Hour() == 21 && now.Minute() == 0 {
-				c.StateMachineFire("blindsdown")
-			}
-
-			if now.Hour() == 8 && now.Minute() == 0 {
-				c.StateMachineFire("timer")
-			} else if now.Hour() == 20 && now.Minute() == 0 {
-				c.StateMachineFire("timer")
-			}
-
-			if !c.scheduleDown.IsZero() && now.After(c.scheduleDown) {
-				c.StateMachineFire("blindsdown")
-				c.scheduleDown = time.Time{} // unset
-			} else if !c.scheduleUp.IsZero() && now.After(c.scheduleUp) {
-				c.StateMachineFire("blindsup")
-				c.scheduleUp = time.Time{} // unset
-			}
-			time.Sleep(1 * time.Minute)
-		}
-	}()
-
 	c.SetInitialized()
 	return nil
 }
 
 func (c *BedroomController) createTriggers(ev MQTTEvent) []string {
+	if ev.Topic == "regelverk/ticker/timeofday" {
+		return bedroomScheduleTriggers(ev.Timestamp)
+	}
 	val, _ := processJSON(ev, "zigbee2mqtt/blinds-bedroom-remote", "action")
 	if val != nil {
 		if val.(string) == "on" {
@@ -107,15 +86,32 @@ func (c *BedroomController) createTriggers(ev MQTTEvent) []string {
 	return []string{"mqttEvent"}
 }
 
+// The blinds follow the minute ticker rather than the wall clock, so that the
+// schedule also runs in virtual time
+func bedroomScheduleTriggers(now time.Time) []string {
+	if now.Minute() != 0 {
+		return nil
+	}
+	switch now.Hour() {
+	case 9:
+		return []string{"blindsup"}
+	case 21:
+		return []string{"blindsdown"}
+	case 8, 20:
+		return []string{"timer"}
+	}
+	return nil
+}
+
+// The scheduled trigger is cancelled automatically if the state is left
+// before it fires, e.g. when the remote is pressed again
 func (c *BedroomController) scheduleBlindsDown(_ context.Context, _ ...any) error {
-	c.scheduleDown = time.Now().Add(30 * time.Minute)
-	c.scheduleUp = time.Time{}
+	c.scheduleTrigger("blindsdown", bedroomBlindsTemporaryDuration)
 	return nil
 }
 
 func (c *BedroomController) scheduleBlindsUp(_ context.Context, _ ...any) error {
-	c.scheduleUp = time.Now().Add(30 * time.Minute)
-	c.scheduleDown = time.Time{}
+	c.scheduleTrigger("blindsup", bedroomBlindsTemporaryDuration)
 	return nil
 }
 
@@ -156,13 +152,14 @@ func bedroomBlindsOutput(open bool) []MQTTPublish {
 			Payload:  fmt.Sprintf(`{"state": "%s"}`, state),
 			Qos:      2,
 			Retained: true,
-		},
-		{
-			Topic:    "zigbee2mqtt/blinds-bedroom/get",
-			Payload:  fmt.Sprintf(`{"state": "%s"}`, state),
-			Qos:      2,
-			Wait:     60 * time.Second,
-			Retained: true,
+			// The blinds take a while to move and report the state when done
+			Expect: &ExpectedState{
+				Topic:   "zigbee2mqtt/blinds-bedroom",
+				Field:   "state",
+				Value:   state,
+				Timeout: 90 * time.Second,
+				Retries: 1,
+			},
 		},
 	}
 }
@@ -2,15 +2,25 @@ package regelverk
 
 import (
 	"encoding/json"
-	"fmt"
 	"log/slog"
 	"strings"
 
-	"github.com/VictoriaMetrics/metrics"
 	pulseaudiomqtt "github.com/claes/mqtt-bridges/pulseaudio-mqtt/lib"
 	routerosmqtt "github.com/claes/mqtt-bridges/routeros-mqtt/lib"
 )
 
+// The phone whose presence on the wifi sets phonePresent
+const phoneMacAddress = "AA:73:49:2B:D8:45"
+
+// State keys set by the event callbacks
+var (
+	phonePresentStateKey        = builtinStateKey("phonePresent")
+	nighttimeStateKey           = builtinStateKey("nighttime")
+	kitchenAudioPlayingStateKey = builtinStateKey("kitchenAudioPlaying")
+	tvPowerStateKey             = builtinStateKey("tvPower")
+	tvSourceStateKey            = builtinStateKey("tvSource")
+)
+
 func processJSON(ev MQTTEvent, topic, eventProperty string) (any, bool) {
 	if ev.Topic == topic {
 		m := parseJSONPayload(ev)
@@ -36,34 +46,6 @@ func processString(ev MQTTEvent, topic string) (string, bool) {
 	}
 }
 
-// First argument, a function that extracts relevant value from a MQTT event
-// Second argument, a function that maps the extracted value to a state key and value, and updates the state value map
-// Third argument, a function that maps the extracted value to a metrics key and value, and updates the metrics
-func (l *MasterController) createProcessEventFunc(extractValueFunc func(MQTTEvent) (any, bool),
-	stateValueFunc func(any) (StateKey, bool),
-	metricsGaugeFunc func(any) (string, float64)) func(MQTTEvent) {
-
-	return func(ev MQTTEvent) {
-		val, _ := extractValueFunc(ev)
-		if val != nil {
-
-			if stateValueFunc != nil {
-				key, b := stateValueFunc(val)
-				l.stateValueMap.setState(key, b)
-			}
-
-			if metricsGaugeFunc != nil {
-				key, v := metricsGaugeFunc(val)
-				// Log to VictoriaMetrics
-				if l.metricsConfig.CollectMetrics {
-					gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`eventvalue{name="%s",realm="%s"}`, key, l.metricsConfig.MetricsRealm), nil)
-					gauge.Set(v)
-				}
-			}
-		}
-	}
-}
-
 func (masterController *MasterController) registerEventCallback(callback func(MQTTEvent)) {
 	masterController.eventCallbacks = append(masterController.eventCallbacks, callback)
 }
@@ -75,8 +57,12 @@ func (masterController *MasterController) executeEventCallbacks(ev MQTTEvent) {
 }
 
 func (masterController *MasterController) registerEventCallbacks() {
+	masterController.stateValueMap.defineEnum(tvSourceStateKey, "tv", "mediaflix", "chromecast", "bluray")
 
 	masterController.registerEventCallback(masterController.detectCECState)
+	masterController.registerEventCallback(masterController.detectControllerEnable)
+	masterController.registerEventCallback(masterController.detectManualOverrides)
+	masterController.registerEventCallback(masterController.verifyExpectedStates)
 
 	//masterController.registerCallback(masterController.detectPhonePresent)
 	masterController.registerEventCallback(func(ev MQTTEvent) {
@@ -90,87 +76,22 @@ func (masterController *MasterController) registerEventCallbacks() {
 			}
 			found := false
 			for _, wifiClient := range wifiClients {
-				if wifiClient.MacAddress == "AA:73:49:2B:D8:45" {
+				if wifiClient.MacAddress == phoneMacAddress {
 					found = true
 					break
 				}
 			}
-			masterController.stateValueMap.setState("phonePresent", found)
+			masterController.stateValueMap.setState(phonePresentStateKey, found)
 		}
 	})
 	// masterController.registerCallback(masterController.detectNighttime)
 	masterController.registerEventCallback(func(ev MQTTEvent) {
 		if ev.Topic == "regelverk/ticker/timeofday" {
-			masterController.stateValueMap.setState("nighttime", ev.Payload.(TimeOfDay) == Nighttime)
+			masterController.stateValueMap.setState(nighttimeStateKey, ev.Payload.(TimeOfDay) == Nighttime)
 		}
 	})
 
-	// Livingroom
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/livingroom-presence", "occupancy")
-		},
-		func(val any) (StateKey, bool) { return "livingroomPresence", val.(bool) },
-		nil,
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/livingroom-presence", "battery")
-		},
-		func(val any) (StateKey, bool) { return "livingroomPresenceBatteryLow", val.(float64) < 20 },
-		func(val any) (string, float64) { return "livingroomPresenceBattery", val.(float64) },
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/livingroom-presence", "illuminance_lux")
-		},
-		nil,
-		func(val any) (string, float64) { return "livingroomPresenceIlluminanceLux", val.(float64) },
-	))
-
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/livingroom-floorlamp", "state")
-		},
-		func(val any) (StateKey, bool) { return "livingroomFloorlamp", val.(string) == "ON" },
-		nil,
-	))
-	//masterController.registerEventCallback(masterController.detectTVPower)
-	// masterController.registerEventCallback(func(ev MQTTEvent) {
-	// 	if ev.Topic == "regelverk/state/tvpower" {
-	// 		tvPower, err := strconv.ParseBool(string(ev.Payload.([]byte)))
-	// 		if err != nil {
-	// 			slog.Error("Could not parse payload", "topic", "regelverk/state/tvpower", "error", err)
-	// 		}
-	// 		masterController.stateValueMap.setState("tvPower", tvPower)
-	// 	}
-	// })
-
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "rotel/state", "state")
-		},
-		func(val any) (StateKey, bool) { return "rotelActive", val.(string) == "on" },
-		nil,
-	))
-
 	// Kitchen
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/kitchen-amp", "state")
-		},
-		func(val any) (StateKey, bool) { return "kitchenAmpPower", val.(string) == "ON" },
-		nil,
-	))
-
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/kitchen-computer", "state")
-		},
-		func(val any) (StateKey, bool) { return "kitchenComputerPower", val.(string) == "ON" },
-		nil,
-	))
-
 	masterController.registerEventCallback(func(ev MQTTEvent) {
 		if ev.Topic == "kitchen/pulseaudio/state" {
 			var pulseaudioState pulseaudiomqtt.PulseAudioState
@@ -179,140 +100,18 @@ func (masterController *MasterController) registerEventCallbacks() {
 				slog.Error("Could not parse payload", "topic", "kitchen/pulseaudio/state", "error", err)
 				return
 			}
-			masterController.stateValueMap.setState("kitchenAudioPlaying", pulseaudioState.DefaultSink.State == 0)
+			masterController.stateValueMap.setState(kitchenAudioPlayingStateKey, pulseaudioState.DefaultSink.State == 0)
 		}
 	})
 
-	// Bedroom
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/blinds-bedroom", "position")
-		},
-		func(val any) (StateKey, bool) { return "bedroomBlindsOpen", val.(float64) > 50 },
-		func(val any) (string, float64) { return "bedroomBlindsPosition", val.(float64) },
-	))
-
-	// Balcony door
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/balcony-door", "contact")
-		},
-		func(val any) (StateKey, bool) { return "balconyDoorOpen", !val.(bool) },
-		nil,
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/balcony-door", "battery")
-		},
-		func(val any) (StateKey, bool) { return "balconyDoorBatteryLow", val.(float64) < 30 },
-		func(val any) (string, float64) { return "balconyDoorBattery", val.(float64) },
-	))
-
-	// Freezer door
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/freezer-door", "contact")
-		},
-		func(val any) (StateKey, bool) { return "freezerDoorOpen", !val.(bool) },
-		nil,
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/freezer-door", "battery")
-		},
-		func(val any) (StateKey, bool) { return "freezerDoorBatteryLow", val.(float64) < 30 },
-		func(val any) (string, float64) { return "freezerDoorBattery", val.(float64) },
-	))
-
-	// Fridge door
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/fridge-door", "contact")
-		},
-		func(val any) (StateKey, bool) { return "fridgeDoorOpen", !val.(bool) },
-		nil,
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/fridge-door", "battery")
-		},
-		func(val any) (StateKey, bool) { return "fridgeDoorBatteryLow", val.(float64) < 30 },
-		func(val any) (string, float64) { return "fridgeDoorBattery", val.(float64) },
-	))
-
-	// MPD
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "mpd/status", "state")
-		},
-		func(val any) (StateKey, bool) { return "mpdPlay", val.(string) == "play" },
-		nil,
-	))
-
-	// Vindstyrka
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/vindstyrka", "humidity")
-		},
-		nil,
-		func(val any) (string, float64) { return "indoorHumidity", val.(float64) },
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/vindstyrka", "temperature")
-		},
-		nil,
-		func(val any) (string, float64) { return "indoorTemperature", val.(float64) },
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/vindstyrka", "pm25")
-		},
-		nil,
-		func(val any) (string, float64) { return "indoorPm25", val.(float64) },
-	))
-	masterController.registerEventCallback(masterController.createProcessEventFunc(
-		func(ev MQTTEvent) (any, bool) {
-			return processJSON(ev, "zigbee2mqtt/vindstyrka", "voc_index")
-		},
-		nil,
-		func(val any) (string, float64) { return "indoorVocIndex", val.(float64) },
-	))
-}
-
-// func (masterController *MasterController) createBayesianCallback(bayesianStateKey StateKey, bayesianModel BayesianModel) func(key StateKey) (StateKey, bool) {
-// 	return func(key StateKey) (StateKey, bool) {
-// 		// If the updated state value is a likelihood dependency,
-// 		// it is valid to re-infer the bayesian model's state
-// 		_, found := bayesianModel.Likelihoods[key]
-// 		if found {
-// 			posterior, decision := inferPosterior(bayesianModel, &masterController.stateValueMap)
-// 			slog.Debug("Bayesian inference", "bayesianStateKey", bayesianStateKey, "updatedKey", key, "posterior", posterior, "decision", decision)
-// 			return bayesianStateKey, decision
-// 		} else {
-// 			return NoKey, false
-// 		}
-// 	}
-// }
-
-// func (masterController *MasterController) registerBayesianModel(bayesianStateKey StateKey, bayesianModel BayesianModel) {
-// 	masterController.stateValueMap.registerMutatorCallback(masterController.createBayesianCallback(bayesianStateKey, bayesianModel))
-// }
-
-func (masterController *MasterController) registerBayesianModel(bayesianStateKey StateKey, bayesianModel BayesianModel) {
-
-	masterController.stateValueMap.registerMutatorCallback(func(key StateKey) (StateKey, bool) {
-		// If the updated state value is a likelihood dependency,
-		// it is valid to re-infer the bayesian model's state
-		_, found := bayesianModel.Likelihoods[key]
-		if found {
-			posterior, decision := inferPosterior(bayesianModel, &masterController.stateValueMap)
-			slog.Debug("Bayesian inference", "bayesianStateKey", bayesianStateKey, "updatedKey", key, "posterior", posterior, "decision", decision)
-			return bayesianStateKey, decision
-		} else {
-			return NoKey, false
-		}
-	})
+	// Topic and JSON property mappings from the stateRules section of the
+	// config file
+	if masterController.config.Setup != nil {
+		masterController.registerStateRules(masterController.config.Setup.StateRules)
+		masterController.registerManualOverrides(masterController.config.Setup.ManualOverrides)
+		masterController.stateValueMap.configureHistory(masterController.config.Setup.StateHistory)
+		masterController.registerDerivedStates(masterController.config.Setup.DerivedStates)
+	}
 }
 
 // func (l *MasterController) detectTVPower(ev MQTTEvent) {
@@ -321,7 +120,7 @@ func (masterController *MasterController) registerBayesianModel(bayesianStateKey
 // 		if err != nil {
 // 			slog.Error("Could not parse payload", "topic", "regelverk/state/tvpower", "error", err)
 // 		}
-// 		l.stateValueMap.setState("tvPower", tvPower)
+// 		l.stateValueMap.setState(tvPowerStateKey, tvPower)
 // 	}
 // }
 
@@ -339,44 +138,32 @@ func (l *MasterController) detectCECState(ev MQTTEvent) {
 			fallthrough
 		case "01:90:00:00:00":
 			slog.Debug("TV power")
-			l.stateValueMap.setState("tvPower", true)
+			l.stateValueMap.setState(tvPowerStateKey, true)
 		case "01:90:01":
 			fallthrough
 		case "01:90:01:00:00":
 			slog.Debug("TV standby")
-			l.stateValueMap.setState("tvPower", false)
+			l.stateValueMap.setState(tvPowerStateKey, false)
 		case "0F:82:00:00:00:00":
 			fallthrough
 		case "0F:82:00:00":
 			slog.Debug("TV active source")
-			l.stateValueMap.setState("tvSourceTvActive", true)
-			l.stateValueMap.setState("tvSourceMediaflixActive", false)
-			l.stateValueMap.setState("tvSourceChromecastActive", false)
-			l.stateValueMap.setState("tvSourceBlurayActive", false)
+			l.stateValueMap.setEnum(tvSourceStateKey, "tv")
 		case "1F:82:40:00:00:00":
 			fallthrough
 		case "1F:82:40:00":
 			slog.Info("Mediaflix active source")
-			l.stateValueMap.setState("tvSourceTvActive", false)
-			l.stateValueMap.setState("tvSourceMediaflixActive", true)
-			l.stateValueMap.setState("tvSourceChromecastActive", false)
-			l.stateValueMap.setState("tvSourceBlurayActive", false)
+			l.stateValueMap.setEnum(tvSourceStateKey, "mediaflix")
 		case "4F:82:30:00:00:00": // 4F:82:30:00
 			fallthrough
 		case "4F:82:30:00":
 			slog.Info("Chromecast active source")
-			l.stateValueMap.setState("tvSourceTvActive", false)
-			l.stateValueMap.setState("tvSourceMediaflixActive", false)
-			l.stateValueMap.setState("tvSourceChromecastActive", true)
-			l.stateValueMap.setState("tvSourceBlurayActive", false)
+			l.stateValueMap.setEnum(tvSourceStateKey, "chromecast")
 		case "4F:82:20:00:00:00":
 			fallthrough
 		case "4F:82:20:00":
 			slog.Info("Bluray active source")
-			l.stateValueMap.setState("tvSourceTvActive", false)
-			l.stateValueMap.setState("tvSourceMediaflixActive", false)
-			l.stateValueMap.setState("tvSourceChromecastActive", false)
-			l.stateValueMap.setState("tvSourceBlurayActive", true)
+			l.stateValueMap.setEnum(tvSourceStateKey, "bluray")
 		case "0F:36":
 			slog.Debug("TV requests standby")
 		default:
@@ -2,16 +2,29 @@ package regelverk
 
 import (
 	"encoding/json"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 type DebugController struct {
 	masterController *MasterController
 	mu               sync.Mutex
 	initialized      bool
-	Name             string
+	// Handlers can only be registered once on the mux
+	handlersRegistered bool
+	Name               string
+}
+
+func (c *DebugController) String() string {
+	return c.Name
+}
+
+func (c *DebugController) setName(name string) {
+	c.Name = name
 }
 
 func (c *DebugController) Lock() {
@@ -22,6 +35,10 @@ func (c *DebugController) Unlock() {
 	c.mu.Unlock()
 }
 
+func (c *DebugController) TryLock() bool {
+	return c.mu.TryLock()
+}
+
 func (c *DebugController) IsInitialized() bool {
 	return c.initialized
 }
@@ -30,9 +47,23 @@ func (c *DebugController) Initialize(masterController *MasterController) []MQTTP
 	slog.Info("Setting up debug HTTP handlers")
 
 	c.masterController = masterController
-	c.Name = "debug"
-	http.HandleFunc("/debug/statevalues", c.stateValueMapHandler)
-	http.HandleFunc("/debug/devicestate", c.deviceStateHandler)
+	if c.Name == "" {
+		c.Name = "debug"
+	}
+	if c.handlersRegistered {
+		c.initialized = true
+		return nil
+	}
+	masterController.httpMux.HandleFunc("/debug/statevalues", c.stateValueMapHandler)
+	masterController.httpMux.HandleFunc("/debug/devicestate", c.deviceStateHandler)
+	masterController.httpMux.HandleFunc("/debug/staterules", c.stateRulesHandler)
+	masterController.httpMux.HandleFunc("/debug/overrides", c.manualOverridesHandler)
+	masterController.httpMux.HandleFunc("/debug/verifications", c.pendingVerificationsHandler)
+	masterController.httpMux.HandleFunc("/debug/dryrun", c.dryRunHandler)
+	masterController.httpMux.HandleFunc("/debug/broker", c.brokerHandler)
+	masterController.httpMux.HandleFunc("/debug/history/", c.historyHandler)
+	masterController.httpMux.HandleFunc("/debug/derived", c.derivedStatesHandler)
+	c.handlersRegistered = true
 	c.initialized = true
 	return nil
 }
@@ -55,19 +86,21 @@ func (c *DebugController) stateValueMapHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	snapshot := c.masterController.stateValueMap.Snapshot()
-	controllerStates := []ControllerDebugState{}
-	if c.masterController.controllers != nil {
-		for _, controller := range *c.masterController.controllers {
-			controllerStates = append(controllerStates, controller.DebugState())
-		}
+	controllerStates := c.masterController.controllerDebugStates()
+
+	scheduledPublishes := []ScheduledPublishDebug{}
+	if c.masterController.publishScheduler != nil {
+		scheduledPublishes = c.masterController.publishScheduler.Pending()
 	}
 
 	payload := struct {
-		StateValueMap map[string]StateValueDebug `json:"stateValueMap"`
-		Controllers   []ControllerDebugState     `json:"controllers"`
+		StateValueMap      map[string]StateValueDebug `json:"stateValueMap"`
+		Controllers        []ControllerDebugState     `json:"controllers"`
+		ScheduledPublishes []ScheduledPublishDebug    `json:"scheduledPublishes"`
 	}{
-		StateValueMap: snapshot,
-		Controllers:   controllerStates,
+		StateValueMap:      snapshot,
+		Controllers:        controllerStates,
+		ScheduledPublishes: scheduledPublishes,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -95,3 +128,147 @@ func (c *DebugController) deviceStateHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 }
+
+func (c *DebugController) stateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := c.masterController.stateRulesDebug()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(rules); err != nil {
+		http.Error(w, "failed to encode state rules", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *DebugController) manualOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	overrides := c.masterController.manualOverridesDebug()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(overrides); err != nil {
+		http.Error(w, "failed to encode manual overrides", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *DebugController) pendingVerificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	verifications := c.masterController.pendingVerificationsDebug()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(verifications); err != nil {
+		http.Error(w, "failed to encode pending verifications", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *DebugController) dryRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	publishes := c.masterController.dryRunDebug()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(publishes); err != nil {
+		http.Error(w, "failed to encode dry run publishes", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *DebugController) brokerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if c.masterController.broker == nil {
+		http.Error(w, "embedded broker not enabled", http.StatusNotFound)
+		return
+	}
+
+	broker := c.masterController.broker.debug()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(broker); err != nil {
+		http.Error(w, "failed to encode broker", http.StatusInternalServerError)
+		return
+	}
+}
+
+// historyHandler serves /debug/history/<key>, summarized over the window
+// query parameter, by default an hour
+func (c *DebugController) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	key := StateKey(strings.TrimPrefix(r.URL.Path, "/debug/history/"))
+	window := time.Hour
+	if value := r.URL.Query().Get("window"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, found := c.masterController.stateValueMap.historyDebug(key, window)
+	if !found {
+		http.Error(w, "no history for "+string(key), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(history); err != nil {
+		http.Error(w, "failed to encode history", http.StatusInternalServerError)
+		return
+	}
+}
+
+// derivedStatesHandler serves the derived states in evaluation order, or
+// with format=dot the dependency graph for Graphviz
+func (c *DebugController) derivedStatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	stateValueMap := &c.masterController.stateValueMap
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		io.WriteString(w, stateValueMap.derivationsDot())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(stateValueMap.derivationsDebug()); err != nil {
+		http.Error(w, "failed to encode derived states", http.StatusInternalServerError)
+		return
+	}
+}
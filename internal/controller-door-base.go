@@ -23,7 +23,6 @@ func (t doorState) ToInt() int {
 
 type DoorReminderController struct {
 	BaseController
-	cancelFunc      context.CancelFunc
 	SensorName      string
 	StateOpenKey    StateKey // "freezerDoorOpen"
 	OpenLongLimit   time.Duration
@@ -31,6 +30,7 @@ type DoorReminderController struct {
 	MaxReminders    int
 	ReminderTopic   string
 	ReminderPayload string
+	remindersSent   int
 }
 
 func (c *DoorReminderController) Initialize(masterController *MasterController) []MQTTPublish {
@@ -53,7 +53,7 @@ func (c *DoorReminderController) Initialize(masterController *MasterController)
 
 	var initialState doorState = doorClosed
 
-	c.stateMachine = stateless.NewStateMachine(initialState)
+	c.stateMachine = stateless.NewStateMachine(c.restoredInitialState(initialState, doorClosed, doorOpen, doorOpenLong))
 	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 
 	c.stateMachine.Configure(doorClosed).
@@ -61,57 +61,57 @@ func (c *DoorReminderController) Initialize(masterController *MasterController)
 
 	c.stateMachine.Configure(doorOpen).
 		OnEntry(c.requestBatteryStatus).
+		OnEntry(c.scheduleDoorOpenLong).
 		Permit("mqttEvent", doorClosed, c.masterController.requireFalseByKey(c.StateOpenKey)).
-		Permit("mqttEvent", doorOpenLong, c.masterController.requireTrueSinceByKey(c.StateOpenKey, c.OpenLongLimit))
+		Permit("mqttEvent", doorOpenLong, c.masterController.requireTrueSinceByKey(c.StateOpenKey, c.OpenLongLimit)).
+		Permit("openLongTimer", doorOpenLong, c.masterController.requireTrueSinceByKey(c.StateOpenKey, c.OpenLongLimit))
 
 	c.stateMachine.Configure(doorOpenLong).
 		OnEntry(c.startNotifyDoorOpen).
-		OnExit(c.stopNotifyDoorOpen).
+		InternalTransition("remind", c.remind).
 		Permit("mqttEvent", doorClosed, c.masterController.requireFalseByKey(c.StateOpenKey))
 
+	// A restored state is not entered, so arm the timers its entry would have
+	switch c.stateMachine.MustState() {
+	case doorOpen:
+		c.scheduleDoorOpenLong(context.Background())
+	case doorOpenLong:
+		c.startNotifyDoorOpen(context.Background())
+	}
+
 	c.SetInitialized()
 	return nil
 }
 
-func (c *DoorReminderController) startNotifyDoorOpen(parentContext context.Context, _ ...any) error {
-	if c.cancelFunc != nil {
-		c.cancelFunc()
-	}
+// Fire when the door has been open long enough, instead of waiting for the
+// next MQTT event. Cancelled if the door is closed before.
+func (c *DoorReminderController) scheduleDoorOpenLong(_ context.Context, _ ...any) error {
+	c.scheduleTrigger("openLongTimer", c.OpenLongLimit)
+	return nil
+}
 
-	var ctx context.Context
-	ctx, c.cancelFunc = context.WithCancel(parentContext)
-
-	go func() {
-		ticker := time.NewTicker(c.ReminderPeriod)
-		defer ticker.Stop()
-		for i := 0; i < c.MaxReminders; i++ {
-			select {
-			case <-ticker.C:
-
-				events := []MQTTPublish{
-					{
-						Topic:    c.ReminderTopic,
-						Payload:  c.ReminderPayload,
-						Qos:      2,
-						Retained: false,
-						Wait:     0 * time.Second,
-					},
-				}
-				c.addEventsToPublish(events)
-				i = i + 1
-			case <-ctx.Done():
-				return
-			}
-		}
-		c.cancelFunc()
-	}()
+// Cancelled along with the state timers when the door is closed
+func (c *DoorReminderController) startNotifyDoorOpen(_ context.Context, _ ...any) error {
+	c.remindersSent = 0
+	if c.MaxReminders > 0 {
+		c.scheduleTrigger("remind", c.ReminderPeriod)
+	}
 	return nil
 }
 
-func (c *DoorReminderController) stopNotifyDoorOpen(_ context.Context, _ ...any) error {
-	if c.cancelFunc != nil {
-		c.cancelFunc()
-		c.cancelFunc = nil
+func (c *DoorReminderController) remind(_ context.Context, _ ...any) error {
+	c.addEventsToPublish([]MQTTPublish{
+		{
+			Topic:    c.ReminderTopic,
+			Payload:  c.ReminderPayload,
+			Qos:      2,
+			Retained: false,
+			Wait:     0 * time.Second,
+		},
+	})
+	c.remindersSent++
+	if c.remindersSent < c.MaxReminders {
+		c.scheduleTrigger("remind", c.ReminderPeriod)
 	}
 	return nil
 }
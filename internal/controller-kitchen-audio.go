@@ -12,6 +12,9 @@ import (
 	"github.com/qmuntal/stateless"
 )
 
+// Set by the kitchen remote, true to play local music
+var kitchenAudioLocalStateKey = builtinStateKey("kitchenaudiolocal")
+
 //go:generate stringer -type=kitchenAudioState
 type kitchenAudioState int
 
@@ -72,7 +75,7 @@ func (c *KitchenAudioController) Initialize(masterController *MasterController)
 		OnEntry(c.turnOnRemote).
 		Permit("mqttEvent", stateKitchenAudioLocal, masterController.guardKitchenAudioLocal)
 
-	c.eventHandlers = append(c.eventHandlers, c.customProcessEvent)
+	c.eventHandlers = []func(ev MQTTEvent) []MQTTPublish{c.customProcessEvent}
 
 	c.SetInitialized()
 	return nil
@@ -106,12 +109,12 @@ func (c *KitchenAudioController) customProcessEvent(ev MQTTEvent) []MQTTPublish
 }
 
 func (l *MasterController) guardKitchenAudioLocal(_ context.Context, _ ...any) bool {
-	check := l.stateValueMap.currentlyTrue("kitchenaudiolocal")
+	check := l.stateValueMap.currentlyTrue(kitchenAudioLocalStateKey)
 	return check
 }
 
 func (l *MasterController) guardKitchenAudioRemote(_ context.Context, _ ...any) bool {
-	check := l.stateValueMap.currentlyFalse("kitchenaudiolocal")
+	check := l.stateValueMap.currentlyFalse(kitchenAudioLocalStateKey)
 	return check
 }
 
@@ -147,9 +150,9 @@ func (c *KitchenAudioController) handleMediaRemoteEvents(ev MQTTEvent) []MQTTPub
 		}
 		switch val {
 		case "dots_2_double_press":
-			c.masterController.stateValueMap.setState("kitchenaudiolocal", false)
+			c.masterController.stateValueMap.setState(kitchenAudioLocalStateKey, false)
 		case "dots_2_long_press":
-			c.masterController.stateValueMap.setState("kitchenaudiolocal", true)
+			c.masterController.stateValueMap.setState(kitchenAudioLocalStateKey, true)
 		}
 	}
 	return nil
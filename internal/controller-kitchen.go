@@ -55,7 +55,7 @@ func (c *KitchenController) Initialize(masterController *MasterController) []MQT
 		OnEntry(c.turnOffKitchenAmp).
 		Permit("mqttEvent", kitchenAmpStateOn, c.masterController.guardStateKitchenAmpOn)
 
-	c.eventHandlers = append(c.eventHandlers, c.handleMediaRemoteEvents)
+	c.eventHandlers = []func(ev MQTTEvent) []MQTTPublish{c.handleMediaRemoteEvents}
 
 	c.SetInitialized()
 	return nil
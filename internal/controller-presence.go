@@ -22,6 +22,39 @@ func (t homePresenceState) ToInt() int {
 	return int(t)
 }
 
+// homePresenceModel infers atHome from the door sensors
+var homePresenceModel = BayesianModel{
+	Prior:     0.6,
+	Threshold: 0.9,
+	Likelihoods: map[StateKey][]LikelihoodModel{
+		"freezerDoorOpen": {
+			{
+				ProbGivenTrue:  0.9,              // If home, phone detected 90% of the time
+				ProbGivenFalse: 0.01,             // If not home, phone still shows up 20% of the time
+				HalfLife:       60 * time.Minute, // Evidence fades slowly
+				Weight:         1.0,              // Highly trusted
+			},
+		},
+		"fridgeDoorOpen": {
+			{
+				ProbGivenTrue:  0.8,  // If home, motion detected 80% of the time
+				ProbGivenFalse: 0.01, // If not home, motion falsely triggered 30% of the time
+				HalfLife:       15 * time.Minute,
+				Weight:         1.0, // Less trusted
+			},
+			{
+				ProbGivenTrue:  0.8,
+				ProbGivenFalse: 0.01,
+				HalfLife:       0,
+				Weight:         1.0,
+				StateValueEvaluator: func(value StateValue) (bool, time.Duration) {
+					return value.recentlyTrue(10 * time.Minute), 10 * time.Minute
+				},
+			},
+		},
+	},
+}
+
 type PresenceController struct {
 	BaseController
 }
@@ -29,41 +62,10 @@ type PresenceController struct {
 func (c *PresenceController) Initialize(masterController *MasterController) []MQTTPublish {
 	c.Name = "homepresence"
 	c.masterController = masterController
-	atHomeModel := BayesianModel{
-		Prior:     0.6,
-		Threshold: 0.9,
-		Likelihoods: map[StateKey][]LikelihoodModel{
-			"freezerDoorOpen": {
-				{
-					ProbGivenTrue:  0.9,              // If home, phone detected 90% of the time
-					ProbGivenFalse: 0.01,             // If not home, phone still shows up 20% of the time
-					HalfLife:       60 * time.Minute, // Evidence fades slowly
-					Weight:         1.0,              // Highly trusted
-				},
-			},
-			"fridgeDoorOpen": {
-				{
-					ProbGivenTrue:  0.8,  // If home, motion detected 80% of the time
-					ProbGivenFalse: 0.01, // If not home, motion falsely triggered 30% of the time
-					HalfLife:       15 * time.Minute,
-					Weight:         1.0, // Less trusted
-				},
-				{
-					ProbGivenTrue:  0.8,
-					ProbGivenFalse: 0.01,
-					HalfLife:       0,
-					Weight:         1.0,
-					StateValueEvaluator: func(value StateValue) (bool, time.Duration) {
-						return value.recentlyTrue(10 * time.Minute), 10 * time.Minute
-					},
-				},
-			},
-		},
-	}
 
-	masterController.registerBayesianModel(HomePresenceStateKey, atHomeModel)
+	masterController.registerBayesianModel(HomePresenceStateKey, homePresenceModel)
 
-	c.stateMachine = stateless.NewStateMachine(presenceInitial)
+	c.stateMachine = stateless.NewStateMachine(c.restoredInitialState(presenceInitial, presenceInitial, presenceHome, presenceAway))
 	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 
 	c.stateMachine.Configure(presenceInitial).
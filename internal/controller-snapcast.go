@@ -26,6 +26,9 @@ func (t snapcastState) ToInt() int {
 	return int(t)
 }
 
+// Set while a snapcast stream is playing
+var snapcastStateKey = builtinStateKey("snapcast")
+
 var topicStreamRe = regexp.MustCompile(`snapcast/stream/([^/]+)$`)
 var topicClientRe = regexp.MustCompile(`snapcast/client/([^/]+)$`)
 var topicGroupRe = regexp.MustCompile(`snapcast/group/([^/]+)$`)
@@ -50,7 +53,7 @@ func (c *SnapcastController) Initialize(masterController *MasterController) []MQ
 	// }
 
 	var initialState snapcastState = stateSnapcastOff
-	c.stateMachine = stateless.NewStateMachine(initialState) // can this be reliable determined early on?
+	c.stateMachine = stateless.NewStateMachine(c.restoredInitialState(initialState, stateSnapcastOff, stateSnapcastOn)) // can this be reliable determined early on?
 	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 
 	c.stateMachine.Configure(stateSnapcastOn).
@@ -61,7 +64,7 @@ func (c *SnapcastController) Initialize(masterController *MasterController) []MQ
 		OnEntry(c.turnOffSnapcast).
 		Permit("mqttEvent", stateSnapcastOn, masterController.guardStateSnapcastOn)
 
-	c.eventHandlers = append(c.eventHandlers, c.customProcessEvent)
+	c.eventHandlers = []func(ev MQTTEvent) []MQTTPublish{c.customProcessEvent}
 
 	c.SetInitialized()
 	return nil
@@ -110,9 +113,9 @@ func (c *SnapcastController) detectRemoteToggle(ev MQTTEvent) {
 		}
 		action := val.(string)
 		if action == "arrow_right_click" {
-			c.masterController.stateValueMap.setState("snapcast", true)
+			c.masterController.stateValueMap.setState(snapcastStateKey, true)
 		} else if action == "arrow_left_click" {
-			c.masterController.stateValueMap.setState("snapcast", false)
+			c.masterController.stateValueMap.setState(snapcastStateKey, false)
 		}
 	}
 }
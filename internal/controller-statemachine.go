@@ -0,0 +1,255 @@
+package regelverk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/qmuntal/stateless"
+)
+
+// StateMachineConfig declares a controller entirely in the config file. The
+// first state is the initial one. On every event the transitions of the
+// current state are tried in order and the first whose guard expression is
+// true is taken. See Expression for the guard syntax.
+//
+//	controllers:
+//	  - type: statemachine
+//	    name: hallwaylamp
+//	    states:
+//	      - name: off
+//	        onEntry:
+//	          - topic: zigbee2mqtt/hallway-lamp/set
+//	            payload: '{"state": "OFF"}'
+//	        transitions:
+//	          - to: on
+//	            guard: nighttime && recently(hallwayPresence, 5m)
+//	      - name: on
+//	        ...
+type StateMachineConfig struct {
+	Type   string                    `yaml:"type"`
+	Name   string                    `yaml:"name"`
+	States []StateMachineStateConfig `yaml:"states"`
+}
+
+type StateMachineStateConfig struct {
+	Name string `yaml:"name"`
+	// Published when the state is entered
+	OnEntry     []PublishConfig    `yaml:"onEntry"`
+	Transitions []TransitionConfig `yaml:"transitions"`
+}
+
+type TransitionConfig struct {
+	To    string `yaml:"to"`
+	Guard string `yaml:"guard"`
+}
+
+type PublishConfig struct {
+	Topic    string `yaml:"topic"`
+	Payload  string `yaml:"payload"`
+	Qos      byte   `yaml:"qos"`
+	Retained bool   `yaml:"retained"`
+}
+
+func validateStateMachine(params any) error {
+	p := params.(*StateMachineConfig)
+	var errs []error
+	errs = append(errs, requireNonEmpty("name", p.Name))
+	if len(p.States) == 0 {
+		errs = append(errs, fmt.Errorf("at least one state is required"))
+	}
+	states := make(map[string]bool)
+	for _, state := range p.States {
+		if state.Name == "" {
+			errs = append(errs, fmt.Errorf("state name is required"))
+		} else if states[state.Name] {
+			errs = append(errs, fmt.Errorf("state %s already declared", state.Name))
+		}
+		states[state.Name] = true
+	}
+	for _, state := range p.States {
+		for i, transition := range state.Transitions {
+			if !states[transition.To] {
+				errs = append(errs, fmt.Errorf("state %s: transition %d: unknown state %q", state.Name, i, transition.To))
+			} else if transition.To == state.Name {
+				errs = append(errs, fmt.Errorf("state %s: transition %d: cannot transition to itself", state.Name, i))
+			}
+			if _, err := ParseExpression(transition.Guard); err != nil {
+				errs = append(errs, fmt.Errorf("state %s: transition %d: guard: %w", state.Name, i, err))
+			}
+		}
+		for i, publish := range state.OnEntry {
+			if publish.Topic == "" {
+				errs = append(errs, fmt.Errorf("state %s: onEntry %d: topic is required", state.Name, i))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateGuardKeys checks that the guards only read known keys
+func (p *StateMachineConfig) validateGuardKeys(known map[StateKey]bool) error {
+	var errs []error
+	for _, state := range p.States {
+		for i, transition := range state.Transitions {
+			expression, err := ParseExpression(transition.Guard)
+			if err != nil {
+				continue
+			}
+			for _, key := range expression.Keys() {
+				if !known[key] {
+					errs = append(errs, fmt.Errorf("state %s: transition %d: guard reads unknown state key %s",
+						state.Name, i, key))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configuredState is the index of a state in StateMachineConfig.States
+type configuredState int
+
+func (s configuredState) ToInt() int {
+	return int(s)
+}
+
+// GuardDebug tells why a guard last evaluated as it did.
+type GuardDebug struct {
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Guard       string    `json:"guard"`
+	Result      bool      `json:"result"`
+	Explanation string    `json:"explanation,omitempty"`
+	EvaluatedAt time.Time `json:"evaluatedAt,omitzero"`
+}
+
+type configuredGuard struct {
+	from, to   string
+	expression *Expression
+	// Earlier transitions of the same state, which take precedence
+	preceding []*configuredGuard
+	last      atomic.Pointer[GuardDebug]
+}
+
+type StateMachineController struct {
+	BaseController
+	States []StateMachineStateConfig
+	guards []*configuredGuard
+}
+
+func (c *StateMachineController) Initialize(masterController *MasterController) []MQTTPublish {
+	c.masterController = masterController
+
+	c.stateMachine = stateless.NewStateMachine(c.restoredConfiguredState())
+	c.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
+
+	index := make(map[string]configuredState)
+	for i, state := range c.States {
+		index[state.Name] = configuredState(i)
+	}
+	c.guards = nil
+	for i, state := range c.States {
+		stateConfig := c.stateMachine.Configure(configuredState(i))
+		if len(state.OnEntry) > 0 {
+			stateConfig.OnEntry(c.publishOnEntry(state.OnEntry))
+		}
+		var preceding []*configuredGuard
+		for _, transition := range state.Transitions {
+			expression, err := ParseExpression(transition.Guard)
+			if err != nil {
+				slog.Error("Skipping invalid transition", "fsm", c.Name, "from", state.Name, "to", transition.To, "error", err)
+				continue
+			}
+			guard := &configuredGuard{from: state.Name, to: transition.To, expression: expression, preceding: preceding}
+			stateConfig.Permit("mqttEvent", index[transition.To], c.evaluateGuard(guard))
+			c.guards = append(c.guards, guard)
+			preceding = append(preceding, guard)
+		}
+	}
+
+	c.SetInitialized()
+	return nil
+}
+
+// restoredConfiguredState looks up the persisted state by name, as states
+// may have been added, removed or reordered in the config file since it was
+// saved. A state no longer in the config is dropped.
+func (c *StateMachineController) restoredConfiguredState() configuredState {
+	restored, found := c.masterController.restoredControllerStates.take(c.Name)
+	if !found {
+		return configuredState(0)
+	}
+	i := slices.IndexFunc(c.States, func(state StateMachineStateConfig) bool { return state.Name == restored })
+	if i < 0 {
+		slog.Info("Dropping restored state not in the state machine", "fsm", c.Name, "state", restored)
+		return configuredState(0)
+	}
+	slog.Info("Restored state machine state", "fsm", c.Name, "state", restored)
+	return configuredState(i)
+}
+
+// evaluateGuard returns a stateless guard that is true if guard is and none
+// of the preceding guards are
+func (c *StateMachineController) evaluateGuard(guard *configuredGuard) func(context.Context, ...any) bool {
+	return func(_ context.Context, _ ...any) bool {
+		for _, preceding := range guard.preceding {
+			if c.explainGuard(preceding) {
+				return false
+			}
+		}
+		return c.explainGuard(guard)
+	}
+}
+
+func (c *StateMachineController) explainGuard(guard *configuredGuard) bool {
+	result, explanation := guard.expression.Explain(&c.masterController.stateValueMap)
+	guard.last.Store(&GuardDebug{
+		From:        guard.from,
+		To:          guard.to,
+		Guard:       guard.expression.String(),
+		Result:      result,
+		Explanation: explanation,
+		EvaluatedAt: nowFunc(),
+	})
+	return result
+}
+
+func (c *StateMachineController) publishOnEntry(publishes []PublishConfig) func(context.Context, ...any) error {
+	return func(_ context.Context, _ ...any) error {
+		events := make([]MQTTPublish, 0, len(publishes))
+		for _, publish := range publishes {
+			events = append(events, MQTTPublish{
+				Topic:    publish.Topic,
+				Payload:  publish.Payload,
+				Qos:      publish.Qos,
+				Retained: publish.Retained,
+			})
+		}
+		c.addEventsToPublish(events)
+		return nil
+	}
+}
+
+// DebugState names the current state and explains the last evaluation of
+// each guard
+func (c *StateMachineController) DebugState() ControllerDebugState {
+	debugState := c.BaseController.DebugState()
+	if state, ok := debugState.StateMachineState.(configuredState); ok && int(state) < len(c.States) {
+		debugState.StateMachineStateText = c.States[state].Name
+	}
+	for _, guard := range c.guards {
+		if last := guard.last.Load(); last != nil {
+			debugState.Guards = append(debugState.Guards, *last)
+		} else {
+			debugState.Guards = append(debugState.Guards, GuardDebug{From: guard.from, To: guard.to,
+				Guard: guard.expression.String()})
+		}
+	}
+	return debugState
+}
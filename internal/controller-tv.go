@@ -43,6 +43,7 @@ func (c *TVController) Initialize(masterController *MasterController) []MQTTPubl
 
 	stateMachine.Configure(stateTvOn).
 		OnEntry(c.turnOnTvAppliances).
+		OnExit(c.cancelScheduledPublishes).
 		Permit("mqttEvent", stateTvOff, masterController.guardStateTvOff)
 
 	stateMachine.Configure(stateTvOff).
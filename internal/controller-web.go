@@ -1,7 +1,9 @@
 package regelverk
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -30,6 +32,17 @@ type WebController struct {
 	BaseController
 	upgrader         websocket.Upgrader
 	deviceStateStore *DeviceStateStore
+	server           *http.Server
+}
+
+// Shutdown stops the HTTP server, letting active requests finish until ctx is
+// done
+func (l *WebController) Shutdown(ctx context.Context) error {
+	if l.server == nil {
+		return nil
+	}
+	slog.Info("Shutting down HTTP server", "address", l.server.Addr)
+	return l.server.Shutdown(ctx)
 }
 
 func IsInitialized() bool {
@@ -46,41 +59,11 @@ func (l *WebController) Initialize(masterController *MasterController) []MQTTPub
 	l.stateMachine.SetTriggerParameters("mqttEvent", reflect.TypeOf(MQTTEvent{}))
 	l.stateMachine.Configure(initialWebState)
 
-	slog.Info("Setting up HTTP handlers")
-	http.HandleFunc("/", l.mainHandler)
-	http.HandleFunc("/web/state/init", l.rotelStateInitWs)
-	http.HandleFunc("/web/state/ws", l.rotelStateWs)
-
-	http.HandleFunc("/rotel/source", l.rotelSourceHandler)
-	http.HandleFunc("/rotel/tone", l.rotelToneHandler)
-	http.HandleFunc("/rotel/mute", l.rotelMuteHandler)
-	http.HandleFunc("/rotel/volume", l.rotelVolumeHandler)
-	http.HandleFunc("/rotel/balance", l.rotelBalanceHandler)
-	http.HandleFunc("/rotel/bass", l.rotelBassHandler)
-	http.HandleFunc("/rotel/treble", l.rotelTrebleHandler)
-	http.HandleFunc("/rotel/power", l.rotelPowerHandler)
-
-	http.HandleFunc("/pulseaudio/sink", l.pulseaudioSinkHandler)
-	http.HandleFunc("/pulseaudio/profile", l.pulseaudioProfileHandler)
-
-	http.HandleFunc("/styles.css", func(w http.ResponseWriter, r *http.Request) {
-		data, _ := webContent.ReadFile("templates/styles.css")
-		w.Header().Add("Content-Type", "text/css")
-		w.Write(data)
-	})
-	slog.Info("Finished setting up HTTP handlers")
-
-	go func() {
-		slog.Info("Initializing HTTP server", "address", masterController.config.WebAddress)
-
-		err := http.ListenAndServe(masterController.config.WebAddress, nil)
-
-		if err != nil {
-			slog.Error("Error initializing HTTP server",
-				"listenAddr", masterController.config.WebAddress, "error", err)
-			os.Exit(1)
-		}
-	}()
+	// Handlers can only be registered once and the server keeps running when
+	// the controller is initialized again after a panic
+	if l.server == nil {
+		l.startServer(masterController.config.WebAddress)
+	}
 
 	l.SetInitialized()
 
@@ -100,10 +83,68 @@ func (l *WebController) Initialize(masterController *MasterController) []MQTTPub
 	}
 }
 
+func (l *WebController) startServer(address string) {
+	slog.Info("Setting up HTTP handlers")
+	l.masterController.httpMux.HandleFunc("/", l.mainHandler)
+	l.masterController.httpMux.HandleFunc("/web/state/init", l.rotelStateInitWs)
+	l.masterController.httpMux.HandleFunc("/web/state/ws", l.rotelStateWs)
+
+	l.masterController.httpMux.HandleFunc("/rotel/source", l.rotelSourceHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/tone", l.rotelToneHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/mute", l.rotelMuteHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/volume", l.rotelVolumeHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/balance", l.rotelBalanceHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/bass", l.rotelBassHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/treble", l.rotelTrebleHandler)
+	l.masterController.httpMux.HandleFunc("/rotel/power", l.rotelPowerHandler)
+
+	l.masterController.httpMux.HandleFunc("/pulseaudio/sink", l.pulseaudioSinkHandler)
+	l.masterController.httpMux.HandleFunc("/pulseaudio/profile", l.pulseaudioProfileHandler)
+
+	l.masterController.httpMux.HandleFunc("/styles.css", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := webContent.ReadFile("templates/styles.css")
+		w.Header().Add("Content-Type", "text/css")
+		w.Write(data)
+	})
+	slog.Info("Finished setting up HTTP handlers")
+
+	server := &http.Server{Addr: address, Handler: l.masterController.httpMux}
+	l.server = server
+	go func() {
+		slog.Info("Initializing HTTP server", "address", address)
+
+		err := server.ListenAndServe()
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error initializing HTTP server",
+				"listenAddr", address, "error", err)
+			os.Exit(1)
+		}
+	}()
+}
+
 func (l *WebController) ProcessEvent(ev MQTTEvent) []MQTTPublish {
 	return nil
 }
 
+// publishCommand sends a command triggered from the web UI through the
+// regular controller publish path. It fails if the web controller is paused,
+// as the command would be dropped.
+func (l *WebController) publishCommand(topic string, payload string) error {
+	if l.masterController.isPaused(l.Name) {
+		return fmt.Errorf("controller %s is paused, %s not sent", l.Name, topic)
+	}
+	l.publishAsync([]MQTTPublish{
+		{
+			Topic:    topic,
+			Payload:  payload,
+			Qos:      2,
+			Retained: false,
+		},
+	})
+	return nil
+}
+
 func (l *WebController) mainHandler(w http.ResponseWriter, r *http.Request) {
 
 	data, readErr := webContent.ReadFile("templates/rotel.html") //TODO rename
@@ -127,14 +168,18 @@ func (l *WebController) mainHandler(w http.ResponseWriter, r *http.Request) {
 
 func (l *WebController) rotelSourceHandler(w http.ResponseWriter, r *http.Request) {
 	selectedSource := r.FormValue("rotel-source")
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, selectedSource+"!")
+	if err := l.publishCommand("rotel/command/send", selectedSource+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelSourceRenderer(w, selectedSource)
 }
 
+var rotelSources = []string{"opt1", "opt2", "coax1", "coax2"}
+
 func (l *WebController) rotelSourceRenderer(w io.Writer, currentSource string) {
-	var sources = []string{"opt1", "opt2", "coax1", "coax2"}
 	fmt.Fprintf(w, "<select id='rotel-source' name='rotel-source' hx-post='/rotel/source' hx-trigger='change' hx-swap-oob='true'>")
-	for _, source := range sources {
+	for _, source := range rotelSources {
 		selected := ""
 		if source == currentSource {
 			selected = "selected"
@@ -146,7 +191,10 @@ func (l *WebController) rotelSourceRenderer(w io.Writer, currentSource string) {
 
 func (l *WebController) pulseaudioSinkHandler(w http.ResponseWriter, r *http.Request) {
 	selectedSink := r.FormValue("pulseaudio-sink")
-	l.masterController.mqttClient.Publish("pulseaudio/sink/default/set", 2, false, selectedSink)
+	if err := l.publishCommand("pulseaudio/sink/default/set", selectedSink); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.pulseaudioSinkRenderer(w, l.deviceStateStore.GetPulse(), selectedSink)
 }
 
@@ -164,7 +212,10 @@ func (l *WebController) pulseaudioSinkRenderer(w io.Writer, state pulsemqtt.Puls
 
 func (l *WebController) pulseaudioProfileHandler(w http.ResponseWriter, r *http.Request) {
 	selectedProfile := r.FormValue("pulseaudio-profile")
-	l.masterController.mqttClient.Publish("pulseaudio/cardprofile/0/set", 2, false, selectedProfile)
+	if err := l.publishCommand("pulseaudio/cardprofile/0/set", selectedProfile); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.pulseaudioProfileRenderer(w, l.deviceStateStore.GetPulse(), selectedProfile)
 }
 
@@ -188,7 +239,10 @@ func (l *WebController) rotelToneHandler(w http.ResponseWriter, r *http.Request)
 	if tone != "on" {
 		tone = "off"
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "tone_"+tone+"!")
+	if err := l.publishCommand("rotel/command/send", "tone_"+tone+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelToneRenderer(w, tone)
 }
 
@@ -205,7 +259,10 @@ func (l *WebController) rotelMuteHandler(w http.ResponseWriter, r *http.Request)
 	if mute != "on" {
 		mute = "off"
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "mute_"+mute+"!")
+	if err := l.publishCommand("rotel/command/send", "mute_"+mute+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelMuteRenderer(w, mute)
 }
 
@@ -222,8 +279,14 @@ func (l *WebController) rotelPowerHandler(w http.ResponseWriter, r *http.Request
 	if power != "on" {
 		power = "off"
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "power_"+power+"!")
-	l.masterController.mqttClient.Publish("rotel/command/initialize", 2, false, "true")
+	if err := l.publishCommand("rotel/command/send", "power_"+power+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := l.publishCommand("rotel/command/initialize", "true"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelPowerRenderer(w, power)
 }
 
@@ -237,7 +300,10 @@ func (l *WebController) rotelPowerRenderer(w io.Writer, currentPower string) {
 
 func (l *WebController) rotelVolumeHandler(w http.ResponseWriter, r *http.Request) {
 	volume := r.FormValue("rotel-volume")
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "volume_"+volume+"!")
+	if err := l.publishCommand("rotel/command/send", "volume_"+volume+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	//	l.mqttMessageHandler.client.Publish("rotel/command/send", 2, false, "get_display!")
 	l.rotelVolumeRenderer(w, volume)
 }
@@ -257,7 +323,10 @@ func (l *WebController) rotelBalanceHandler(w http.ResponseWriter, r *http.Reque
 		slog.Error("Could not parse balance", "error", err)
 		return
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "balance_"+balance+"!")
+	if err := l.publishCommand("rotel/command/send", "balance_"+balance+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelBalanceRenderer(w, balance)
 }
 
@@ -320,7 +389,10 @@ func (l *WebController) rotelTrebleHandler(w http.ResponseWriter, r *http.Reques
 		slog.Error("Could not parse treble", "error", err)
 		return
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "treble_"+treble+"!")
+	if err := l.publishCommand("rotel/command/send", "treble_"+treble+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelTrebleRenderer(w, treble)
 }
 
@@ -383,7 +455,10 @@ func (l *WebController) rotelBassHandler(w http.ResponseWriter, r *http.Request)
 		slog.Error("Could not parse bass", "error", err)
 		return
 	}
-	l.masterController.mqttClient.Publish("rotel/command/send", 2, false, "bass_"+bass+"!")
+	if err := l.publishCommand("rotel/command/send", "bass_"+bass+"!"); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	l.rotelBassRenderer(w, bass)
 }
 
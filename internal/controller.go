@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,25 +27,61 @@ type Controller interface {
 
 // ControllerDebugState provides a JSON-friendly snapshot of a controller.
 type ControllerDebugState struct {
-	Name                  string        `json:"name"`
-	Initialized           bool          `json:"initialized"`
-	StateMachineState     any           `json:"stateMachineState,omitempty"`
-	StateMachineStateText string        `json:"stateMachineStateText,omitempty"`
-	StateMachine          string        `json:"stateMachine,omitempty"`
-	BackoffUntil          time.Time     `json:"backoffUntil,omitempty"`
-	LastBackoffDuration   time.Duration `json:"lastBackoffDuration,omitempty"`
+	Name                  string                   `json:"name"`
+	Initialized           bool                     `json:"initialized"`
+	StateMachineState     any                      `json:"stateMachineState,omitempty"`
+	StateMachineStateText string                   `json:"stateMachineStateText,omitempty"`
+	StateMachine          string                   `json:"stateMachine,omitempty"`
+	BackoffUntil          time.Time                `json:"backoffUntil,omitempty"`
+	LastBackoffDuration   time.Duration            `json:"lastBackoffDuration,omitempty"`
+	Timers                []StateTimerDebug        `json:"timers,omitempty"`
+	Paused                bool                     `json:"paused"`
+	PausedUntil           time.Time                `json:"pausedUntil,omitzero"`
+	Healthy               bool                     `json:"healthy"`
+	Panics                int                      `json:"panics,omitempty"`
+	LastPanic             time.Time                `json:"lastPanic,omitzero"`
+	LastPanicError        string                   `json:"lastPanicError,omitempty"`
+	LastPanicTopic        string                   `json:"lastPanicTopic,omitempty"`
+	Worker                *ControllerWatchdogDebug `json:"worker,omitempty"`
+	Guards                []GuardDebug             `json:"guards,omitempty"`
 }
 
 type MasterController struct {
-	mqttClient       mqtt.Client
-	stateValueMap    StateValueMap
-	controllers      *[]Controller
+	mqttClient    mqtt.Client
+	stateValueMap StateValueMap
+	controllers   *[]Controller
+	// Inbox of each controller, replaced as a whole when controllers change
+	controllerQueues map[Controller]*controllerQueue
+	queueCtx         context.Context
+	queueWorkers     sync.WaitGroup
 	mu               sync.Mutex
 	pushMetrics      bool
 	metricsConfig    MetricsConfig
 	config           Config
 	eventCallbacks   []func(MQTTEvent)
+	stateRules       []*compiledStateRule
 	deviceStateStore *DeviceStateStore
+	publishScheduler *PublishScheduler
+	reevaluation     temporalReevaluation
+	reloadMu         sync.Mutex
+	pauses           controllerPauses
+	overrides        manualOverrides
+	verifier         commandVerifier
+	health           controllerHealth
+	dryRun           dryRunRecorder
+	recorder         *Recorder
+	broker           *Broker
+	bridgeCtx        context.Context
+	runningBridges   map[string]context.CancelFunc
+	bridgeWorkers    sync.WaitGroup
+	// Web, debug and admin handlers, served by the web controller
+	httpMux      *http.ServeMux
+	shuttingDown bool
+
+	restoredControllerStates restoredStates
+	persistenceWorker        sync.WaitGroup
+
+	controllerQueueSize int
 }
 
 type MetricsConfig struct {
@@ -57,24 +95,46 @@ func CreateMasterController() MasterController {
 	return MasterController{
 		stateValueMap:    NewStateValueMap(),
 		deviceStateStore: NewDeviceStateStore(),
+		httpMux:          http.NewServeMux(),
 	}
 }
 
 func (l *MasterController) Init() {
+	l.publishScheduler = NewPublishScheduler(l.publishScheduled)
 	l.registerEventCallbacks()
+	l.updateDryRunControllers()
 	if l.metricsConfig.CollectMetrics {
 		slog.Info("Registering state value callback in master controller")
-		l.stateValueMap.registerObserverCallback(l.StateValueCallback)
+		l.stateValueMap.registerValueObserverCallback(l.StateValueCallback)
 	}
 }
 
-func (l *MasterController) StateValueCallback(key StateKey, value, new, updated bool) {
+// StateValueCallback exports state values as gauges. Booleans are 0 or 1,
+// enums get a gauge per allowed value that is 1 for the current one and
+// strings are not exported.
+func (l *MasterController) StateValueCallback(key StateKey, value StateValue, new, updated bool) {
 	if l.metricsConfig.CollectMetrics {
-		gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`statevalue{name="%s",realm="%s"}`, key, l.metricsConfig.MetricsRealm), nil)
-		if value {
-			gauge.Set(1)
-		} else {
-			gauge.Set(0)
+		switch value.kind {
+		case BoolValue, NumberValue:
+			gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`statevalue{name="%s",realm="%s"}`, key, l.metricsConfig.MetricsRealm), nil)
+			switch {
+			case value.kind == NumberValue:
+				gauge.Set(value.number)
+			case value.value:
+				gauge.Set(1)
+			default:
+				gauge.Set(0)
+			}
+		case EnumValue:
+			for _, enumValue := range l.stateValueMap.enums[key] {
+				gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`statevalue{name="%s",value="%s",realm="%s"}`,
+					key, enumValue, l.metricsConfig.MetricsRealm), nil)
+				if enumValue == value.text {
+					gauge.Set(1)
+				} else {
+					gauge.Set(0)
+				}
+			}
 		}
 		if new || updated {
 			l.pushMetrics = true
@@ -89,49 +149,174 @@ func (masterController *MasterController) ProcessEvent(client mqtt.Client, ev MQ
 	masterController.mu.Lock()
 	defer masterController.mu.Unlock()
 
+	if masterController.shuttingDown {
+		return
+	}
+
 	masterController.deviceStateStore.UpdateFromEvent(ev)
 
 	masterController.pushMetrics = false // Reset
 	masterController.executeEventCallbacks(ev)
+	masterController.stateValueMap.evaluateDerivations()
+
+	// Each controller has its own ordered inbox and worker, so that one
+	// controller can be stuck while others still make progress.
+	for _, queue := range masterController.controllerQueues {
+		// Events arriving while a controller is paused are not processed
+		// even if it has been resumed when they reach the head of the queue
+		if masterController.isPaused(queue.name) {
+			continue
+		}
+		queue.enqueue(client, ev)
+	}
+	masterController.scheduleReevaluation()
+	masterController.checkPushMetrics()
+}
 
-	for _, c := range *masterController.controllers {
-		controller := c
-		go func() {
-			// For reliability, we call each loop in its own goroutine (yes, one
-			// per message), so that one loop can be stuck while others still
-			// make progress.
-
-			controller.Lock()
-			defer controller.Unlock()
-
-			var toPublish []MQTTPublish
-			if !controller.IsInitialized() {
-				// If initialize requires other processes to update some state to determine
-				// correct init state it can be requested  by events returned here
-				// But the Initialize method must make sure to not request unneccessarily often
-				toPublish = append(toPublish, controller.Initialize(masterController)...)
-			}
-			if controller.IsInitialized() {
-				toPublish = append(toPublish, controller.ProcessEvent(ev)...)
-			}
+// startControllerQueues creates one inbox and worker per controller. Workers
+// stop when ctx is cancelled.
+func (masterController *MasterController) startControllerQueues(ctx context.Context) {
+	masterController.mu.Lock()
+	defer masterController.mu.Unlock()
 
-			for _, result := range toPublish {
-				go func(toPublish MQTTPublish) {
-					if toPublish.Wait != 0 {
-						time.Sleep(toPublish.Wait)
-					}
-					client.Publish(toPublish.Topic, toPublish.Qos, toPublish.Retained, toPublish.Payload)
+	masterController.queueCtx = ctx
+	queues := make(map[Controller]*controllerQueue, len(*masterController.controllers))
+	for _, controller := range *masterController.controllers {
+		queues[controller] = masterController.startControllerQueue(controller)
+	}
+	masterController.controllerQueues = queues
+}
 
-					if masterController.metricsConfig.CollectDebugMetrics {
-						counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_mqtt_published{topic="%s",realm="%s"}`,
-							toPublish.Topic, masterController.metricsConfig.MetricsRealm))
-						counter.Inc()
-					}
-				}(result)
-			}
-		}()
+func (masterController *MasterController) startControllerQueue(controller Controller) *controllerQueue {
+	queue := newControllerQueue(masterController, controller, masterController.controllerQueueSize)
+	if queueAware, ok := controller.(interface{ setControllerQueue(*controllerQueue) }); ok {
+		queueAware.setControllerQueue(queue)
+	}
+	ctx, cancel := context.WithCancel(masterController.queueCtx)
+	queue.cancel = cancel
+	masterController.queueWorkers.Add(1)
+	go func() {
+		defer masterController.queueWorkers.Done()
+		queue.run(ctx)
+	}()
+	return queue
+}
+
+// controllerDebugStates returns the debug state of all controllers, including
+// whether they are paused and healthy, and what their worker is doing.
+func (masterController *MasterController) controllerDebugStates() []ControllerDebugState {
+	states := []ControllerDebugState{}
+	masterController.mu.Lock()
+	if masterController.controllers == nil {
+		masterController.mu.Unlock()
+		return states
+	}
+	controllers := *masterController.controllers
+	queues := masterController.controllerQueues
+	masterController.mu.Unlock()
+
+	now := time.Now()
+	for _, controller := range controllers {
+		state := controller.DebugState()
+		state.Paused, state.PausedUntil = masterController.pausedUntil(controllerName(controller))
+		masterController.applyControllerHealth(controllerName(controller), &state)
+		if queue, found := queues[controller]; found {
+			worker := queue.watchdogDebug(now)
+			state.Worker = &worker
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func (masterController *MasterController) processControllerEvent(client mqtt.Client, controller Controller, ev MQTTEvent) {
+	controller.Lock()
+	defer controller.Unlock()
+	defer masterController.recoverControllerPanic(controller, &ev)
+
+	if masterController.isPaused(controllerName(controller)) {
+		return
+	}
+
+	var toPublish []MQTTPublish
+	if !controller.IsInitialized() {
+		// If initialize requires other processes to update some state to determine
+		// correct init state it can be requested  by events returned here
+		// But the Initialize method must make sure to not request unneccessarily often
+		toPublish = append(toPublish, controller.Initialize(masterController)...)
+		if controller.IsInitialized() {
+			masterController.markReinitialized(controllerName(controller))
+		}
+	}
+	if controller.IsInitialized() {
+		toPublish = append(toPublish, controller.ProcessEvent(ev)...)
+	}
+
+	masterController.dispatchPublishes(client, controllerName(controller), toPublish)
+}
+
+// processControllerAction runs an action requested asynchronously by a
+// controller and publishes its result, with the same locking as ProcessEvent.
+func (masterController *MasterController) processControllerAction(client mqtt.Client, controller Controller, action func() []MQTTPublish) {
+	controller.Lock()
+	defer controller.Unlock()
+	defer masterController.recoverControllerPanic(controller, nil)
+
+	name := controllerName(controller)
+	if masterController.isPaused(name) {
+		slog.Debug("Dropping action of paused controller", "controller", name)
+		return
+	}
+	masterController.dispatchPublishes(client, name, action())
+}
+
+func (masterController *MasterController) dispatchPublishes(client mqtt.Client, controllerName string, toPublish []MQTTPublish) {
+	for _, result := range toPublish {
+		if result.Wait > 0 {
+			// Delayed publishes of dry-run controllers are scheduled too, so
+			// that they are recorded when due and can still be cancelled
+			masterController.publishScheduler.Schedule(controllerName, client, result)
+		} else {
+			masterController.publishScheduled(controllerName, client, result)
+		}
+	}
+}
+
+// publishScheduled sends a publish of the named controller, or records it if
+// the controller is in dry-run mode.
+func (masterController *MasterController) publishScheduled(controllerName string, client mqtt.Client, toPublish MQTTPublish) {
+	if masterController.isDryRun(controllerName) {
+		masterController.recordDryRun(client, controllerName, toPublish)
+		return
+	}
+	masterController.publish(client, toPublish)
+}
+
+func (masterController *MasterController) publish(client mqtt.Client, toPublish MQTTPublish) {
+	// Track first so that a fast state report cannot be missed
+	if toPublish.Expect != nil {
+		masterController.trackVerification(client, toPublish)
+	}
+	masterController.sendPublish(client, toPublish)
+}
+
+// sendPublish publishes without tracking the expected state, used for retries.
+func (masterController *MasterController) sendPublish(client mqtt.Client, toPublish MQTTPublish) {
+	if masterController.config.DryRun {
+		masterController.recordDryRun(client, engineControllerName, toPublish)
+		return
+	}
+	masterController.recordCommand(toPublish.Topic, nowFunc())
+	if masterController.recorder != nil {
+		masterController.recorder.recordPublish(toPublish, nowFunc())
+	}
+	client.Publish(toPublish.Topic, toPublish.Qos, toPublish.Retained, toPublish.Payload)
+
+	if masterController.metricsConfig.CollectDebugMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_mqtt_published{topic="%s",realm="%s"}`,
+			toPublish.Topic, masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
 	}
-	masterController.checkPushMetrics()
 }
 
 func (masterController *MasterController) checkPushMetrics() {
@@ -161,12 +346,12 @@ func (l *MasterController) guardStateMPDOff(_ context.Context, _ ...any) bool {
 }
 
 func (l *MasterController) guardStateSnapcastOn(_ context.Context, _ ...any) bool {
-	check := l.stateValueMap.currentlyTrue("snapcast")
+	check := l.stateValueMap.currentlyTrue(snapcastStateKey)
 	return check
 }
 
 func (l *MasterController) guardStateSnapcastOff(_ context.Context, _ ...any) bool {
-	check := l.stateValueMap.currentlyFalse("snapcast")
+	check := l.stateValueMap.currentlyFalse(snapcastStateKey)
 	return check
 }
 
@@ -252,6 +437,13 @@ func setIkeaTretaktPower(topic string, on bool) MQTTPublish {
 		Payload:  fmt.Sprintf(`{"state": "%s"}`, state),
 		Qos:      2,
 		Retained: true,
+		Expect: &ExpectedState{
+			Topic:   strings.TrimSuffix(topic, "/set"),
+			Field:   "state",
+			Value:   state,
+			Timeout: 10 * time.Second,
+			Retries: 2,
+		},
 	}
 }
 
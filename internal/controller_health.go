@@ -0,0 +1,139 @@
+package regelverk
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// controllerHealth keeps track of panics per controller name. A controller is
+// unhealthy from a panic until it has been re-initialized successfully.
+type controllerHealth struct {
+	mu          sync.Mutex
+	controllers map[string]*controllerHealthState
+}
+
+type controllerHealthState struct {
+	unhealthy      bool
+	panics         int
+	lastPanic      time.Time
+	lastPanicError string
+	lastPanicTopic string
+	reinitialize   bool
+}
+
+// recoverControllerPanic is deferred around controller execution. ev is nil
+// for asynchronous actions.
+func (masterController *MasterController) recoverControllerPanic(controller Controller, ev *MQTTEvent) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	name := controllerName(controller)
+	var topic string
+	var payload any
+	if ev != nil {
+		topic = ev.Topic
+		payload = ev.Payload
+		if bytes, ok := payload.([]byte); ok {
+			payload = string(bytes)
+		}
+	}
+	slog.Error("Recovered from panic in controller", "controller", name, "recover", r,
+		"topic", topic, "payload", payload, "stack", string(debug.Stack()))
+
+	health := &masterController.health
+	health.mu.Lock()
+	if health.controllers == nil {
+		health.controllers = make(map[string]*controllerHealthState)
+	}
+	state, exists := health.controllers[name]
+	if !exists {
+		state = &controllerHealthState{}
+		health.controllers[name] = state
+	}
+	state.unhealthy = true
+	state.panics++
+	state.lastPanic = nowFunc()
+	state.lastPanicError = fmt.Sprint(r)
+	state.lastPanicTopic = topic
+	state.reinitialize = masterController.config.ReinitializeOnPanic
+	health.mu.Unlock()
+
+	if masterController.metricsConfig.CollectMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_controller_panics{controller="%s",realm="%s"}`,
+			name, masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+	masterController.updateHealthyMetric(name, false)
+
+	// The state machine may be left half-way through a transition, let the
+	// next event initialize the controller from scratch
+	if masterController.config.ReinitializeOnPanic {
+		if resettable, ok := controller.(interface{ resetInitialized() }); ok {
+			resettable.resetInitialized()
+			slog.Info("Controller will be re-initialized on next event", "controller", name)
+		}
+	}
+}
+
+// markReinitialized clears the unhealthy mark of a controller that was reset
+// after a panic and has now initialized again.
+func (masterController *MasterController) markReinitialized(name string) {
+	health := &masterController.health
+	health.mu.Lock()
+	state, exists := health.controllers[name]
+	recovered := exists && state.unhealthy && state.reinitialize
+	if recovered {
+		state.unhealthy = false
+		state.reinitialize = false
+	}
+	health.mu.Unlock()
+
+	if recovered {
+		slog.Info("Controller re-initialized after panic", "controller", name)
+		masterController.updateHealthyMetric(name, true)
+	}
+}
+
+// forgetControllerHealth drops the panic history of a controller that is
+// replaced or removed on reload.
+func (masterController *MasterController) forgetControllerHealth(name string) {
+	health := &masterController.health
+	health.mu.Lock()
+	delete(health.controllers, name)
+	health.mu.Unlock()
+	masterController.updateHealthyMetric(name, true)
+}
+
+// applyControllerHealth fills in the health fields of a debug state.
+func (masterController *MasterController) applyControllerHealth(name string, debugState *ControllerDebugState) {
+	health := &masterController.health
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	debugState.Healthy = true
+	if state, exists := health.controllers[name]; exists {
+		debugState.Healthy = !state.unhealthy
+		debugState.Panics = state.panics
+		debugState.LastPanic = state.lastPanic
+		debugState.LastPanicError = state.lastPanicError
+		debugState.LastPanicTopic = state.lastPanicTopic
+	}
+}
+
+func (masterController *MasterController) updateHealthyMetric(name string, healthy bool) {
+	if masterController.metricsConfig.CollectMetrics {
+		gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`regelverk_controller_healthy{controller="%s",realm="%s"}`,
+			name, masterController.metricsConfig.MetricsRealm), nil)
+		if healthy {
+			gauge.Set(1)
+		} else {
+			gauge.Set(0)
+		}
+	}
+}
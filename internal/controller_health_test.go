@@ -0,0 +1,117 @@
+package regelverk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type panickingController struct {
+	BaseController
+	initializations int
+	processed       []string
+}
+
+func (c *panickingController) Initialize(masterController *MasterController) []MQTTPublish {
+	c.Name = "panicking"
+	c.masterController = masterController
+	c.initializations++
+	c.isInitialized = true
+	return nil
+}
+
+func (c *panickingController) ProcessEvent(ev MQTTEvent) []MQTTPublish {
+	if ev.Topic == "boom" {
+		var m map[string]string
+		m[ev.Topic] = "nil map"
+	}
+	c.processed = append(c.processed, ev.Topic)
+	return nil
+}
+
+func (c *panickingController) DebugState() ControllerDebugState {
+	return ControllerDebugState{Name: c.Name, Initialized: c.isInitialized}
+}
+
+func TestControllerPanicRecovered(t *testing.T) {
+	for _, reinitialize := range []bool{false, true} {
+		masterController := CreateMasterController()
+		masterController.config.ReinitializeOnPanic = reinitialize
+		controller := &panickingController{}
+		masterController.controllers = &[]Controller{controller}
+
+		masterController.processControllerEvent(nil, controller, MQTTEvent{Topic: "first"})
+		masterController.processControllerEvent(nil, controller, MQTTEvent{Topic: "boom"})
+
+		state := masterController.controllerDebugStates()[0]
+		if state.Healthy || state.Panics != 1 || state.LastPanicTopic != "boom" || state.LastPanicError == "" {
+			t.Fatalf("reinitialize=%v: expected controller marked unhealthy after panic, got %+v", reinitialize, state)
+		}
+		if state.Initialized == reinitialize {
+			t.Errorf("reinitialize=%v: unexpected initialized %v after panic", reinitialize, state.Initialized)
+		}
+
+		masterController.processControllerEvent(nil, controller, MQTTEvent{Topic: "second"})
+		state = masterController.controllerDebugStates()[0]
+		if state.Healthy != reinitialize {
+			t.Errorf("reinitialize=%v: expected healthy %v after next event, got %+v", reinitialize, reinitialize, state)
+		}
+		wantInitializations := 1
+		if reinitialize {
+			wantInitializations = 2
+		}
+		if controller.initializations != wantInitializations {
+			t.Errorf("reinitialize=%v: expected %d initializations, got %d", reinitialize, wantInitializations, controller.initializations)
+		}
+		if len(controller.processed) != 2 || controller.processed[1] != "second" {
+			t.Errorf("reinitialize=%v: expected events to be processed after panic, got %v", reinitialize, controller.processed)
+		}
+	}
+}
+
+func TestControllerActionPanicRecovered(t *testing.T) {
+	masterController := CreateMasterController()
+	controller := &panickingController{}
+	masterController.controllers = &[]Controller{controller}
+	controller.Initialize(&masterController)
+
+	masterController.processControllerAction(nil, controller, func() []MQTTPublish {
+		panic("action failed")
+	})
+	if state := masterController.controllerDebugStates()[0]; state.Healthy || state.LastPanicError != "action failed" {
+		t.Fatalf("expected controller marked unhealthy after panicking action, got %+v", state)
+	}
+
+	masterController.retireController(controller)
+	if state := masterController.controllerDebugStates()[0]; !state.Healthy || state.Panics != 0 {
+		t.Errorf("expected panics to be forgotten when controller is retired, got %+v", state)
+	}
+}
+
+func TestControllersInitializedTwice(t *testing.T) {
+	masterController := CreateMasterController()
+
+	snapcast := &SnapcastController{}
+	snapcast.Initialize(&masterController)
+	snapcast.resetInitialized()
+	snapcast.Initialize(&masterController)
+	if len(snapcast.eventHandlers) != 1 {
+		t.Errorf("expected one event handler after re-initialization, got %d", len(snapcast.eventHandlers))
+	}
+
+	// Registering the handlers again would panic
+	debug := &DebugController{}
+	debug.Initialize(&masterController)
+	debug.Initialize(&masterController)
+	if !debug.IsInitialized() {
+		t.Errorf("expected the debug controller to be initialized")
+	}
+
+	// Handlers are served by the mux of the master controller, not the
+	// process-wide default one
+	recorder := httptest.NewRecorder()
+	masterController.httpMux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/statevalues", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the debug handler to be registered, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Topics regelverk/controller/<name>/enable pause and resume a controller
+const (
+	controllerEnableTopicPrefix = "regelverk/controller/"
+	controllerEnableTopicSuffix = "/enable"
+)
+
+// controllerPauses keeps track of paused controllers by name, so that a pause
+// survives the controller being rebuilt on reload.
+type controllerPauses struct {
+	mu     sync.Mutex
+	paused map[string]*controllerPause
+}
+
+type controllerPause struct {
+	since time.Time
+	until time.Time // Zero if paused until resumed
+	timer afterTimer
+}
+
+// controllerEnableRequest is the payload of the enable topic and HTTP
+// endpoint. A plain true/false payload is also accepted.
+type controllerEnableRequest struct {
+	Enabled  bool   `json:"enabled"`
+	Duration string `json:"duration,omitempty"`
+}
+
+func parseControllerEnableRequest(payload []byte) (bool, time.Duration, error) {
+	trimmed := strings.TrimSpace(string(payload))
+	if enabled, err := strconv.ParseBool(trimmed); err == nil {
+		return enabled, 0, nil
+	}
+	var request controllerEnableRequest
+	if err := json.Unmarshal([]byte(trimmed), &request); err != nil {
+		return false, 0, fmt.Errorf("expected true, false or {\"enabled\": false, \"duration\": \"1h\"}, got %q", trimmed)
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(request.Duration)
+		if err != nil {
+			return false, 0, fmt.Errorf("invalid duration %q: %w", request.Duration, err)
+		}
+		if duration <= 0 {
+			return false, 0, fmt.Errorf("duration must be positive, got %v", duration)
+		}
+	}
+	return request.Enabled, duration, nil
+}
+
+// PauseController stops a controller from processing events and from
+// publishing. Pending delayed publishes are cancelled. If duration is
+// positive the controller is resumed automatically.
+func (masterController *MasterController) PauseController(name string, duration time.Duration) error {
+	if !masterController.hasController(name) {
+		return fmt.Errorf("unknown controller %q", name)
+	}
+	masterController.pauseController(name, duration)
+	return nil
+}
+
+func (masterController *MasterController) pauseController(name string, duration time.Duration) {
+	pauses := &masterController.pauses
+	pauses.mu.Lock()
+	if pauses.paused == nil {
+		pauses.paused = make(map[string]*controllerPause)
+	}
+	pause, exists := pauses.paused[name]
+	if !exists {
+		pause = &controllerPause{since: nowFunc()}
+		pauses.paused[name] = pause
+	}
+	if pause.timer != nil {
+		pause.timer.Stop()
+		pause.timer = nil
+	}
+	pause.until = time.Time{}
+	if duration > 0 {
+		pause.until = nowFunc().Add(duration)
+		pause.timer = afterFunc(duration, func() {
+			masterController.resumeExpired(name, pause)
+		})
+	}
+	pauses.mu.Unlock()
+
+	cancelled := 0
+	if masterController.publishScheduler != nil {
+		cancelled = masterController.publishScheduler.CancelController(name)
+	}
+	slog.Info("Paused controller", "controller", name, "duration", duration, "cancelledPublishes", cancelled)
+	masterController.updatePausedMetric(name, true)
+}
+
+// ResumeController lets a paused controller process events again. It catches
+// up with the current state on the next event.
+func (masterController *MasterController) ResumeController(name string) error {
+	if !masterController.hasController(name) {
+		return fmt.Errorf("unknown controller %q", name)
+	}
+	masterController.resumeController(name)
+	return nil
+}
+
+func (masterController *MasterController) resumeController(name string) {
+	pauses := &masterController.pauses
+	pauses.mu.Lock()
+	pause, exists := pauses.paused[name]
+	if exists {
+		if pause.timer != nil {
+			pause.timer.Stop()
+		}
+		delete(pauses.paused, name)
+	}
+	pauses.mu.Unlock()
+
+	if exists {
+		slog.Info("Resumed controller", "controller", name, "pausedSince", pause.since)
+		masterController.updatePausedMetric(name, false)
+	}
+}
+
+// resumeExpired resumes the controller unless the pause was replaced since
+// the timer was started.
+func (masterController *MasterController) resumeExpired(name string, expired *controllerPause) {
+	pauses := &masterController.pauses
+	pauses.mu.Lock()
+	if pauses.paused[name] != expired {
+		pauses.mu.Unlock()
+		return
+	}
+	delete(pauses.paused, name)
+	pauses.mu.Unlock()
+
+	slog.Info("Auto-resumed controller", "controller", name, "pausedSince", expired.since)
+	masterController.updatePausedMetric(name, false)
+}
+
+func (masterController *MasterController) isPaused(name string) bool {
+	pauses := &masterController.pauses
+	pauses.mu.Lock()
+	defer pauses.mu.Unlock()
+	_, paused := pauses.paused[name]
+	return paused
+}
+
+// pausedUntil returns whether the controller is paused and, if it resumes
+// automatically, when.
+func (masterController *MasterController) pausedUntil(name string) (bool, time.Time) {
+	pauses := &masterController.pauses
+	pauses.mu.Lock()
+	defer pauses.mu.Unlock()
+	pause, paused := pauses.paused[name]
+	if !paused {
+		return false, time.Time{}
+	}
+	return true, pause.until
+}
+
+func (masterController *MasterController) hasController(name string) bool {
+	masterController.mu.Lock()
+	defer masterController.mu.Unlock()
+	return masterController.hasControllerUnsafe(name)
+}
+
+// hasControllerUnsafe requires the master controller lock to be held.
+func (masterController *MasterController) hasControllerUnsafe(name string) bool {
+	if masterController.controllers == nil {
+		return false
+	}
+	for _, controller := range *masterController.controllers {
+		if controllerName(controller) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (masterController *MasterController) updatePausedMetric(name string, paused bool) {
+	if masterController.metricsConfig.CollectMetrics {
+		gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`regelverk_controller_paused{controller="%s",realm="%s"}`,
+			name, masterController.metricsConfig.MetricsRealm), nil)
+		if paused {
+			gauge.Set(1)
+		} else {
+			gauge.Set(0)
+		}
+	}
+}
+
+func (masterController *MasterController) setControllerEnabled(name string, enabled bool, duration time.Duration) error {
+	if enabled {
+		return masterController.ResumeController(name)
+	}
+	return masterController.PauseController(name, duration)
+}
+
+// detectControllerEnable handles regelverk/controller/<name>/enable events.
+// Runs as an event callback, with the master controller lock held.
+func (masterController *MasterController) detectControllerEnable(ev MQTTEvent) {
+	if !strings.HasPrefix(ev.Topic, controllerEnableTopicPrefix) || !strings.HasSuffix(ev.Topic, controllerEnableTopicSuffix) {
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(ev.Topic, controllerEnableTopicPrefix), controllerEnableTopicSuffix)
+	payload, ok := ev.Payload.([]byte)
+	if !ok || name == "" {
+		return
+	}
+	enabled, duration, err := parseControllerEnableRequest(payload)
+	if err != nil {
+		slog.Error("Could not parse payload", "topic", ev.Topic, "error", err)
+		return
+	}
+	if !masterController.hasControllerUnsafe(name) {
+		slog.Warn("Unknown controller in enable topic", "topic", ev.Topic, "controller", name)
+		return
+	}
+	if enabled {
+		masterController.resumeController(name)
+	} else {
+		masterController.pauseController(name, duration)
+	}
+}
+
+// controllerEnableHandler serves POST /admin/controller/{name}/enable with the
+// same payload as the MQTT topic.
+func (masterController *MasterController) controllerEnableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	enabled, duration, err := parseControllerEnableRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := masterController.setControllerEnabled(name, enabled, duration); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	paused, until := masterController.pausedUntil(name)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Name        string    `json:"name"`
+		Paused      bool      `json:"paused"`
+		PausedUntil time.Time `json:"pausedUntil,omitzero"`
+	}{Name: name, Paused: paused, PausedUntil: until}); err != nil {
+		http.Error(w, "failed to encode controller state", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,84 @@
+package regelverk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauseController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	controller := &recordingController{}
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.controllers = &[]Controller{controller}
+	masterController.Init()
+	masterController.startControllerQueues(ctx)
+
+	event := func(topic, payload string) {
+		masterController.ProcessEvent(nil, MQTTEvent{Timestamp: time.Now(), Topic: topic, Payload: []byte(payload)})
+	}
+
+	event("a", "")
+	waitFor(t, func() bool { return len(controller.processed()) == 1 })
+
+	event("regelverk/controller/recordingController/enable", "false")
+	if !masterController.isPaused("recordingController") {
+		t.Fatalf("expected controller to be paused")
+	}
+	event("b", "")
+
+	states := masterController.controllerDebugStates()
+	if len(states) != 1 || !states[0].Paused || !states[0].PausedUntil.IsZero() {
+		t.Fatalf("unexpected debug state %+v", states)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/controller/{name}/enable", masterController.controllerEnableHandler)
+	post := func(name, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/controller/"+name+"/enable", strings.NewReader(body)))
+		return recorder
+	}
+	if code := post("garage", "true").Code; code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown controller, got %d", code)
+	}
+	if code := post("recordingController", `{"enabled": false, "duration": "soon"}`).Code; code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid duration, got %d", code)
+	}
+	if code := post("recordingController", "true").Code; code != http.StatusOK {
+		t.Fatalf("expected 200 when resuming, got %d", code)
+	}
+
+	event("c", "")
+	waitFor(t, func() bool { return slices.Contains(controller.processed(), "c") })
+	if processed := controller.processed(); slices.Contains(processed, "b") {
+		t.Fatalf("paused controller processed events: %v", processed)
+	}
+
+	// Auto-resume
+	recorder := post("recordingController", `{"enabled": false, "duration": "20ms"}`)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "pausedUntil") {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	waitFor(t, func() bool { return !masterController.isPaused("recordingController") })
+}
+
+func TestPausedWebControllerRejectsCommands(t *testing.T) {
+	masterController := CreateMasterController()
+	controller := &WebController{BaseController: BaseController{Name: "web", masterController: &masterController}}
+	masterController.pauseController("web", 0)
+
+	recorder := httptest.NewRecorder()
+	controller.rotelMuteHandler(recorder, httptest.NewRequest(http.MethodPost, "/rotel/mute",
+		strings.NewReader("rotel-mute=on")))
+	if recorder.Code != http.StatusServiceUnavailable || strings.Contains(recorder.Body.String(), "rotel-mute") {
+		t.Fatalf("expected the command to be rejected, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
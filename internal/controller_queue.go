@@ -0,0 +1,212 @@
+package regelverk
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Default capacity of each controller inbox. When full, the oldest queued
+// item is dropped so that a stuck controller never blocks the others. Timer
+// actions are only dropped if the inbox holds nothing else.
+const defaultControllerQueueSize = 256
+
+// queuedEvent is either an MQTT event to process, or an action requested
+// asynchronously by the controller (timers, goroutines, HTTP handlers).
+type queuedEvent struct {
+	client mqtt.Client
+	ev     MQTTEvent
+	action func() []MQTTPublish
+	// Identifies the action in logs, e.g. the trigger of a timer
+	actionName string
+	// Timer actions fire reminders, which would be lost if dropped
+	timer bool
+}
+
+func (item queuedEvent) kind() string {
+	switch {
+	case item.timer:
+		return "timer"
+	case item.action != nil:
+		return "action"
+	default:
+		return "event"
+	}
+}
+
+// describe returns the topic of an event or the name of an action
+func (item queuedEvent) describe() string {
+	if item.action != nil {
+		return item.actionName
+	}
+	return item.ev.Topic
+}
+
+// controllerQueue is a bounded, ordered inbox for a single controller. Events
+// are processed one at a time, in arrival order, by a dedicated worker.
+type controllerQueue struct {
+	name             string
+	controller       Controller
+	masterController *MasterController
+	events           chan queuedEvent
+	mu               sync.Mutex
+	dropped          uint64
+	cancel           context.CancelFunc
+	done             chan struct{}
+
+	// Watched by the watchdog, guarded by mu
+	goroutineID int64
+	busySince   time.Time
+	busyTopic   string
+	stuck       bool
+	stuckStack  string
+}
+
+func newControllerQueue(masterController *MasterController, controller Controller, size int) *controllerQueue {
+	if size <= 0 {
+		size = defaultControllerQueueSize
+	}
+	return &controllerQueue{
+		name:             controllerName(controller),
+		controller:       controller,
+		masterController: masterController,
+		events:           make(chan queuedEvent, size),
+		done:             make(chan struct{}),
+	}
+}
+
+// controllerName returns a name usable as metrics label before the controller
+// has been initialized, falling back to the type name.
+func controllerName(controller Controller) string {
+	if stringer, ok := controller.(fmt.Stringer); ok && stringer.String() != "" {
+		return stringer.String()
+	}
+	t := reflect.TypeOf(controller)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+func (q *controllerQueue) enqueue(client mqtt.Client, ev MQTTEvent) {
+	q.enqueueItem(queuedEvent{client: client, ev: ev})
+}
+
+// enqueueItem never blocks. If the inbox is full the oldest item is discarded,
+// see dropOldest.
+func (q *controllerQueue) enqueueItem(item queuedEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		select {
+		case q.events <- item:
+			q.updateDepthMetric()
+			return
+		default:
+		}
+		q.dropOldest()
+	}
+}
+
+// dropOldest discards the oldest queued item that is not a timer action, or
+// the oldest timer action if there is nothing else. The remaining items keep
+// their order. Requires mu, so that nothing is enqueued meanwhile.
+func (q *controllerQueue) dropOldest() {
+	var items []queuedEvent
+drain:
+	for {
+		select {
+		case item := <-q.events:
+			items = append(items, item)
+		default:
+			break drain
+		}
+	}
+	if len(items) == 0 {
+		// Worker drained the queue concurrently, retry the send
+		return
+	}
+	i := slices.IndexFunc(items, func(item queuedEvent) bool { return !item.timer })
+	if i < 0 {
+		i = 0
+	}
+	dropped := items[i]
+	for _, item := range slices.Delete(items, i, i+1) {
+		q.events <- item
+	}
+
+	q.dropped++
+	slog.Warn("Controller queue full, dropping oldest item", "controller", q.name,
+		"droppedKind", dropped.kind(), "dropped", dropped.describe(), "droppedCount", q.dropped)
+	if q.masterController.metricsConfig.CollectMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_controller_queue_dropped{controller="%s",kind="%s",realm="%s"}`,
+			q.name, dropped.kind(), q.masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+}
+
+func (q *controllerQueue) depth() int {
+	return len(q.events)
+}
+
+func (q *controllerQueue) droppedCount() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *controllerQueue) updateDepthMetric() {
+	if q.masterController.metricsConfig.CollectMetrics {
+		gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`regelverk_controller_queue_depth{controller="%s",realm="%s"}`,
+			q.name, q.masterController.metricsConfig.MetricsRealm), nil)
+		gauge.Set(float64(len(q.events)))
+	}
+}
+
+func (q *controllerQueue) run(ctx context.Context) {
+	defer close(q.done)
+	q.mu.Lock()
+	q.goroutineID = currentGoroutineID()
+	q.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-q.events:
+			q.updateDepthMetric()
+			q.markBusy(item.describe())
+			if item.action != nil {
+				q.masterController.processControllerAction(item.client, q.controller, item.action)
+			} else {
+				q.masterController.processControllerEvent(item.client, q.controller, item.ev)
+			}
+			q.markIdle()
+			// Guards evaluated by the controller may have registered new
+			// time windows, or the controller may have updated state
+			q.masterController.scheduleReevaluation()
+		}
+	}
+}
+
+// stop cancels the worker and waits, at most timeout, for the event being
+// processed to finish. Returns false if the worker did not stop in time.
+func (q *controllerQueue) stop(timeout time.Duration) bool {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	select {
+	case <-q.done:
+		return true
+	case <-time.After(timeout):
+		slog.Warn("Controller worker did not stop in time", "controller", q.name, "timeout", timeout)
+		return false
+	}
+}
@@ -0,0 +1,245 @@
+package regelverk
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingController struct {
+	mu     sync.Mutex
+	topics []string
+	block  chan struct{}
+}
+
+func (c *recordingController) Lock()   { c.mu.Lock() }
+func (c *recordingController) Unlock() { c.mu.Unlock() }
+
+func (c *recordingController) IsInitialized() bool { return true }
+
+func (c *recordingController) Initialize(_ *MasterController) []MQTTPublish { return nil }
+
+func (c *recordingController) ProcessEvent(ev MQTTEvent) []MQTTPublish {
+	if c.block != nil {
+		<-c.block
+	}
+	c.topics = append(c.topics, ev.Topic)
+	return nil
+}
+
+func (c *recordingController) DebugState() ControllerDebugState {
+	return ControllerDebugState{Name: "recording"}
+}
+
+func (c *recordingController) processed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.topics...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestControllerQueueOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	controller := &recordingController{}
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.controllers = &[]Controller{controller}
+	masterController.startControllerQueues(ctx)
+
+	topics := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, topic := range topics {
+		masterController.ProcessEvent(nil, MQTTEvent{Topic: topic, Payload: []byte{}})
+	}
+
+	waitFor(t, func() bool { return len(controller.processed()) == len(topics) })
+	for i, topic := range controller.processed() {
+		if topic != topics[i] {
+			t.Fatalf("event %d processed out of order: got %s, want %s", i, topic, topics[i])
+		}
+	}
+}
+
+func TestControllerQueueDropsOldest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stuck := &recordingController{block: make(chan struct{})}
+	other := &recordingController{}
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.controllerQueueSize = 2
+	masterController.controllers = &[]Controller{stuck, other}
+	masterController.startControllerQueues(ctx)
+
+	// First event is picked up by the worker and blocks, next two fill the
+	// inbox and the remaining ones push out the oldest queued events
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "first"})
+	waitFor(t, func() bool { return masterController.controllerQueues[stuck].depth() == 0 })
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		masterController.ProcessEvent(nil, MQTTEvent{Topic: topic})
+	}
+
+	// The stuck controller must not block the other one
+	waitFor(t, func() bool {
+		processed := other.processed()
+		return len(processed) > 0 && processed[len(processed)-1] == "d"
+	})
+
+	if dropped := masterController.controllerQueues[stuck].droppedCount(); dropped != 2 {
+		t.Errorf("expected 2 dropped events, got %d", dropped)
+	}
+
+	close(stuck.block)
+	waitFor(t, func() bool { return len(stuck.processed()) == 3 })
+	expected := []string{"first", "c", "d"}
+	for i, topic := range stuck.processed() {
+		if topic != expected[i] {
+			t.Errorf("event %d: got %s, want %s", i, topic, expected[i])
+		}
+	}
+}
+
+func TestControllerQueueKeepsTimerActions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stuck := &recordingController{block: make(chan struct{})}
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.controllerQueueSize = 2
+	masterController.controllers = &[]Controller{stuck}
+	masterController.startControllerQueues(ctx)
+	queue := masterController.controllerQueues[stuck]
+
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "first"})
+	waitFor(t, func() bool { return queue.depth() == 0 })
+	// Runs under the controller lock
+	queue.enqueueItem(queuedEvent{actionName: "timer reminder", timer: true, action: func() []MQTTPublish {
+		stuck.topics = append(stuck.topics, "reminder")
+		return nil
+	}})
+	for _, topic := range []string{"a", "b", "c"} {
+		masterController.ProcessEvent(nil, MQTTEvent{Topic: topic})
+	}
+	if dropped := queue.droppedCount(); dropped != 2 {
+		t.Errorf("expected 2 dropped events, got %d", dropped)
+	}
+
+	close(stuck.block)
+	waitFor(t, func() bool { return len(stuck.processed()) == 3 })
+	expected := []string{"first", "reminder", "c"}
+	for i, topic := range stuck.processed() {
+		if topic != expected[i] {
+			t.Errorf("item %d: got %s, want %s", i, topic, expected[i])
+		}
+	}
+}
+
+func TestControllerNameOfDebugController(t *testing.T) {
+	controller := controllerFactories["debug"].build("debug", nil)
+	if name := controllerName(controller); name != "debug" {
+		t.Fatalf("expected the debug controller to be named by its config key, got %s", name)
+	}
+}
+
+// asyncController is a BaseController that publishes one event per processed
+// event, so that the dry-run records show the order of events and actions
+type asyncController struct {
+	BaseController
+	block chan struct{}
+}
+
+func (c *asyncController) Initialize(_ *MasterController) []MQTTPublish { return nil }
+
+func (c *asyncController) ProcessEvent(ev MQTTEvent) []MQTTPublish {
+	if c.block != nil {
+		<-c.block
+	}
+	return []MQTTPublish{{Topic: "processed/" + ev.Topic}}
+}
+
+func newAsyncController(masterController *MasterController) *asyncController {
+	masterController.config.DryRun = true
+	return &asyncController{BaseController: BaseController{Name: "async", masterController: masterController, isInitialized: true}}
+}
+
+func publishedTopics(masterController *MasterController, controller string) []string {
+	var topics []string
+	for _, record := range masterController.dryRunDebug() {
+		if record.Controller == controller {
+			topics = append(topics, record.Topic)
+		}
+	}
+	return topics
+}
+
+func TestControllerQueueAsyncInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	controller := newAsyncController(&masterController)
+	controller.block = make(chan struct{})
+	masterController.controllers = &[]Controller{controller}
+	masterController.startControllerQueues(ctx)
+
+	// Hold the worker so that everything below is queued behind each other
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "first"})
+	waitFor(t, func() bool { return masterController.controllerQueues[controller].depth() == 0 })
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "a"})
+	controller.publishAsync([]MQTTPublish{{Topic: "published"}})
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "b"})
+	controller.runAsync("test action", func() []MQTTPublish {
+		if controller.mu.TryLock() {
+			controller.mu.Unlock()
+			t.Error("expected action to run under the controller lock")
+		}
+		return []MQTTPublish{{Topic: "action"}}
+	})
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "c"})
+	if published := publishedTopics(&masterController, "async"); len(published) != 0 {
+		t.Fatalf("expected async items to wait in the queue, got %v", published)
+	}
+
+	close(controller.block)
+	expected := []string{"processed/first", "processed/a", "published", "processed/b", "action", "processed/c"}
+	waitFor(t, func() bool { return len(publishedTopics(&masterController, "async")) == len(expected) })
+	if published := publishedTopics(&masterController, "async"); !slices.Equal(published, expected) {
+		t.Errorf("expected %v, got %v", expected, published)
+	}
+}
+
+func TestControllerAsyncWithoutQueue(t *testing.T) {
+	masterController := CreateMasterController()
+	controller := newAsyncController(&masterController)
+
+	controller.publishAsync([]MQTTPublish{{Topic: "published"}})
+	controller.runAsync("test action", func() []MQTTPublish {
+		if controller.mu.TryLock() {
+			controller.mu.Unlock()
+			t.Error("expected action to run under the controller lock")
+		}
+		return []MQTTPublish{{Topic: "action"}}
+	})
+
+	// Without a queue both run before returning
+	expected := []string{"published", "action"}
+	if published := publishedTopics(&masterController, "async"); !slices.Equal(published, expected) {
+		t.Errorf("expected %v, got %v", expected, published)
+	}
+}
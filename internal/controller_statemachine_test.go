@@ -0,0 +1,148 @@
+package regelverk
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const balconyDoorSetup = `
+stateRules:
+  - topic: zigbee2mqtt/balcony-door
+    path: contact
+    invert: true
+    key: balconyDoorOpen
+  - topic: zigbee2mqtt/vindstyrka
+    path: temperature
+    type: number
+    key: indoorTemperature
+controllers:
+  - type: statemachine
+    name: balconydoorcold
+    states:
+      - name: ok
+        transitions:
+          - to: cold
+            guard: continuouslyTrue(balconyDoorOpen, 15m) && indoorTemperature < 19
+          - to: closed
+            guard: currentlyFalse(balconyDoorOpen)
+      - name: cold
+        onEntry:
+          - topic: telegram/regelverkgeneral/send
+            payload: Balcony door is open and it is getting cold
+        transitions:
+          - to: ok
+            guard: currentlyFalse(balconyDoorOpen)
+      - name: closed
+`
+
+func TestStateMachineController(t *testing.T) {
+	setup, err := ParseSetup([]byte(balconyDoorSetup))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	controllerSetup := setup.Controllers[0]
+	controller := controllerFactories[controllerSetup.Type].build(controllerSetup.key(), controllerSetup.Params).(*StateMachineController)
+
+	masterController := CreateMasterController()
+	controller.Initialize(&masterController)
+	sv := &masterController.stateValueMap
+
+	seedAt(20*time.Minute, func() { sv.setState("balconyDoorOpen", true) })
+	sv.setNumber("indoorTemperature", 20)
+	if events := controller.ProcessEvent(MQTTEvent{}); len(events) != 0 {
+		t.Fatalf("expected no transition while warm, got %v", events)
+	}
+	debugState := controller.DebugState()
+	if debugState.StateMachineStateText != "ok" || len(debugState.Guards) != 3 {
+		t.Fatalf("unexpected debug state %+v", debugState)
+	}
+	if guard := debugState.Guards[0]; guard.Result ||
+		guard.Explanation != "indoorTemperature < 19 is false (indoorTemperature is 20, changed 0s ago)" {
+		t.Errorf("unexpected guard explanation %+v", guard)
+	}
+
+	sv.setNumber("indoorTemperature", 18.5)
+	events := controller.ProcessEvent(MQTTEvent{})
+	if len(events) != 1 || events[0].Topic != "telegram/regelverkgeneral/send" {
+		t.Fatalf("expected a notification, got %v", events)
+	}
+	if state := controller.DebugState().StateMachineStateText; state != "cold" {
+		t.Fatalf("expected cold, got %s", state)
+	}
+	if guard := controller.DebugState().Guards[0]; !guard.Result || !strings.Contains(guard.Explanation,
+		"continuouslyTrue(balconyDoorOpen, 15m0s) is true (balconyDoorOpen is true, changed 20m0s ago)") {
+		t.Errorf("unexpected guard explanation %+v", guard)
+	}
+
+	sv.setState("balconyDoorOpen", false)
+	controller.ProcessEvent(MQTTEvent{})
+	if state := controller.DebugState().StateMachineStateText; state != "ok" {
+		t.Fatalf("expected ok, got %s", state)
+	}
+
+	// The first transition with a true guard is taken
+	controller.ProcessEvent(MQTTEvent{})
+	if state := controller.DebugState().StateMachineStateText; state != "closed" {
+		t.Fatalf("expected closed, got %s", state)
+	}
+}
+
+func TestStateMachineErrors(t *testing.T) {
+	controller := func(states string) string {
+		return "controllers:\n  - type: statemachine\n    name: m\n    states:\n" + states
+	}
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"no states", "controllers:\n  - type: statemachine\n    name: m", "at least one state is required"},
+		{"duplicate state", controller("      - name: a\n      - name: a"), "state a already declared"},
+		{"unknown state", controller("      - name: a\n        transitions:\n          - to: b\n            guard: nighttime"),
+			`state a: transition 0: unknown state "b"`},
+		{"self transition", controller("      - name: a\n        transitions:\n          - to: a\n            guard: nighttime"),
+			"cannot transition to itself"},
+		{"invalid guard", controller("      - name: a\n        transitions:\n          - to: b\n            guard: recently(nighttime)\n      - name: b"),
+			"state a: transition 0: guard: position 19: expected \",\""},
+		{"unknown key", controller("      - name: a\n        transitions:\n          - to: b\n            guard: nighttime && garageDoorOpen\n      - name: b"),
+			"line 2: controller m: state a: transition 0: guard reads unknown state key garageDoorOpen"},
+		{"missing topic", controller("      - name: a\n        onEntry:\n          - payload: x"), "state a: onEntry 0: topic is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSetup([]byte(tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStateMachineControllerRestoresStateByName(t *testing.T) {
+	setup, err := ParseSetup([]byte(balconyDoorSetup))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	controllerSetup := setup.Controllers[0]
+
+	tests := []struct {
+		name      string
+		stateName string
+		want      string
+	}{
+		{"by name", "cold", "cold"},
+		{"removed state", "freezing", "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := controllerFactories[controllerSetup.Type].build(controllerSetup.key(), controllerSetup.Params).(*StateMachineController)
+			masterController := CreateMasterController()
+			masterController.restoredControllerStates.set(map[string]string{"balconydoorcold": tt.stateName})
+			controller.Initialize(&masterController)
+			if state := controller.DebugState().StateMachineStateText; state != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, state)
+			}
+		})
+	}
+}
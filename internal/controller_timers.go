@@ -0,0 +1,184 @@
+package regelverk
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/qmuntal/stateless"
+)
+
+// stateTimer fires a trigger on the controller's state machine at a later
+// point in time, unless the state machine has left the state it was scheduled
+// in.
+type stateTimer struct {
+	id      uint64
+	trigger string
+	state   stateless.State
+	dueAt   time.Time
+	timer   afterTimer
+}
+
+type stateTimers struct {
+	mu     sync.Mutex
+	nextID uint64
+	timers map[uint64]*stateTimer
+}
+
+// StateTimerDebug is a JSON-friendly view of a pending state machine timer.
+type StateTimerDebug struct {
+	ID      uint64    `json:"id"`
+	Trigger string    `json:"trigger"`
+	State   string    `json:"state"`
+	DueAt   time.Time `json:"dueAt"`
+}
+
+// scheduleTrigger fires trigger after the given duration. The timer is
+// cancelled if the state machine leaves its current state before then.
+func (c *BaseController) scheduleTrigger(trigger string, after time.Duration) uint64 {
+	return c.scheduleTriggerAt(trigger, nowFunc().Add(after))
+}
+
+// scheduleTriggerAt fires trigger at the given wall-clock time. The timer is
+// cancelled if the state machine leaves its current state before then.
+func (c *BaseController) scheduleTriggerAt(trigger string, at time.Time) uint64 {
+	c.timers.mu.Lock()
+	defer c.timers.mu.Unlock()
+
+	if c.timers.timers == nil {
+		c.timers.timers = make(map[uint64]*stateTimer)
+	}
+	c.timers.nextID++
+	id := c.timers.nextID
+	state := c.stateMachine.MustState()
+	entry := &stateTimer{
+		id:      id,
+		trigger: trigger,
+		state:   state,
+		dueAt:   at,
+	}
+	entry.timer = afterFunc(at.Sub(nowFunc()), func() {
+		c.enqueueAsync(queuedEvent{actionName: "timer " + trigger, timer: true,
+			action: func() []MQTTPublish { return c.fireStateTimer(id) }})
+	})
+	c.timers.timers[id] = entry
+
+	slog.Debug("Scheduled trigger", "fsm", c.Name, "trigger", trigger, "state", state, "dueAt", at)
+	return id
+}
+
+// cancelTrigger cancels a pending timer. Returns false if it already fired or
+// was cancelled.
+func (c *BaseController) cancelTrigger(id uint64) bool {
+	c.timers.mu.Lock()
+	defer c.timers.mu.Unlock()
+
+	entry, exists := c.timers.timers[id]
+	if !exists {
+		return false
+	}
+	entry.timer.Stop()
+	delete(c.timers.timers, id)
+	return true
+}
+
+// pruneStateTimers cancels timers scheduled in a state the state machine is
+// no longer in. Called after every fire.
+func (c *BaseController) pruneStateTimers() {
+	c.timers.mu.Lock()
+	defer c.timers.mu.Unlock()
+
+	if len(c.timers.timers) == 0 {
+		return
+	}
+	current := c.stateMachine.MustState()
+	for id, entry := range c.timers.timers {
+		if entry.state != current {
+			entry.timer.Stop()
+			delete(c.timers.timers, id)
+			slog.Debug("Cancelled trigger since state was left", "fsm", c.Name, "trigger", entry.trigger,
+				"scheduledState", entry.state, "currentState", current)
+		}
+	}
+}
+
+// fireStateTimer runs under the controller lock, via the controller queue.
+func (c *BaseController) fireStateTimer(id uint64) []MQTTPublish {
+	c.timers.mu.Lock()
+	entry, exists := c.timers.timers[id]
+	if exists {
+		delete(c.timers.timers, id)
+	}
+	c.timers.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	if current := c.stateMachine.MustState(); current != entry.state {
+		return nil
+	}
+
+	beforeState := c.stateMachine.MustState()
+	err := c.StateMachineFire(entry.trigger)
+	if err != nil {
+		slog.Error("Could not fire scheduled trigger", "fsm", c.Name, "trigger", entry.trigger, "error", err)
+	}
+	eventsToPublish := c.getAndResetEventsToPublish()
+	slog.Debug("Scheduled trigger fired", "fsm", c.Name, "trigger", entry.trigger,
+		"beforeState", beforeState,
+		"afterState", c.stateMachine.MustState(),
+		"noOfEventsToPublish", len(eventsToPublish))
+
+	if c.masterController.metricsConfig.CollectDebugMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`fsm_timer_fired{controller="%s",trigger="%s",realm="%s"}`,
+			c.Name, entry.trigger, c.masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+	return eventsToPublish
+}
+
+// fireAsync fires trigger under the controller lock, in order with the
+// controller's MQTT events, and publishes the resulting events.
+func (c *BaseController) fireAsync(trigger string) {
+	c.runAsync("fire "+trigger, func() []MQTTPublish {
+		err := c.StateMachineFire(trigger)
+		if err != nil {
+			slog.Error("Could not fire trigger", "fsm", c.Name, "trigger", trigger, "error", err)
+		}
+		return c.getAndResetEventsToPublish()
+	})
+}
+
+func (c *BaseController) stateTimersDebug() []StateTimerDebug {
+	c.timers.mu.Lock()
+	defer c.timers.mu.Unlock()
+
+	result := make([]StateTimerDebug, 0, len(c.timers.timers))
+	for _, entry := range c.timers.timers {
+		result = append(result, StateTimerDebug{
+			ID:      entry.id,
+			Trigger: entry.trigger,
+			State:   fmt.Sprint(entry.state),
+			DueAt:   entry.dueAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DueAt.Before(result[j].DueAt) })
+	return result
+}
+
+// stopStateTimers cancels all pending timers, used when the controller is
+// removed, replaced or reset after a panic.
+func (c *BaseController) stopStateTimers() int {
+	c.timers.mu.Lock()
+	defer c.timers.mu.Unlock()
+
+	stopped := len(c.timers.timers)
+	for id, entry := range c.timers.timers {
+		entry.timer.Stop()
+		delete(c.timers.timers, id)
+	}
+	return stopped
+}
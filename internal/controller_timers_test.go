@@ -0,0 +1,62 @@
+package regelverk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qmuntal/stateless"
+)
+
+func newTimerTestController() *BaseController {
+	masterController := CreateMasterController()
+	c := &BaseController{Name: "timertest", masterController: &masterController}
+	c.stateMachine = stateless.NewStateMachine(bedroomBlindsStateOpen)
+	c.stateMachine.Configure(bedroomBlindsStateOpen).
+		Permit("down", bedroomBlindsStateClosed)
+	c.stateMachine.Configure(bedroomBlindsStateClosed).
+		Permit("up", bedroomBlindsStateOpen)
+	return c
+}
+
+// lockedState reads the state of c while holding its lock, as the timer
+// goroutines do
+func lockedState(c *BaseController) any {
+	c.Lock()
+	defer c.Unlock()
+	return c.stateMachine.MustState()
+}
+
+func TestScheduleTriggerFires(t *testing.T) {
+	c := newTimerTestController()
+
+	c.Lock()
+	c.scheduleTrigger("down", 10*time.Millisecond)
+	if len(c.stateTimersDebug()) != 1 {
+		t.Fatalf("expected one pending timer, got %v", c.stateTimersDebug())
+	}
+	c.Unlock()
+
+	waitFor(t, func() bool { return lockedState(c) == bedroomBlindsStateClosed })
+	if len(c.stateTimersDebug()) != 0 {
+		t.Errorf("expected no pending timers after firing, got %v", c.stateTimersDebug())
+	}
+}
+
+func TestScheduleTriggerCancelledOnStateExit(t *testing.T) {
+	c := newTimerTestController()
+
+	c.Lock()
+	c.scheduleTrigger("down", 20*time.Millisecond)
+	// Leave and return to the state, the timer must not survive this
+	c.StateMachineFire("down")
+	if len(c.stateTimersDebug()) != 0 {
+		t.Errorf("expected timer to be pruned, got %v", c.stateTimersDebug())
+	}
+	c.StateMachineFire("up")
+	c.Unlock()
+
+	time.Sleep(60 * time.Millisecond)
+	if state := lockedState(c); state != bedroomBlindsStateOpen {
+		t.Errorf("expected cancelled timer not to fire, state is %v", state)
+	}
+}
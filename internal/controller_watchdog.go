@@ -0,0 +1,192 @@
+package regelverk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Default time a controller may spend on a single event before it is
+// considered stuck
+const defaultWatchdogThreshold = 30 * time.Second
+
+// watchdogAlert is the payload published to the watchdog topic.
+type watchdogAlert struct {
+	Controller string        `json:"controller"`
+	Topic      string        `json:"topic,omitempty"`
+	BusySince  time.Time     `json:"busySince"`
+	BusyFor    time.Duration `json:"busyFor"`
+	Queued     int           `json:"queued"`
+	Stuck      bool          `json:"stuck"`
+}
+
+// ControllerWatchdogDebug is a JSON-friendly view of what a controller worker
+// is doing.
+type ControllerWatchdogDebug struct {
+	BusySince  time.Time     `json:"busySince,omitzero"`
+	BusyFor    time.Duration `json:"busyFor,omitempty"`
+	BusyTopic  string        `json:"busyTopic,omitempty"`
+	Queued     int           `json:"queued"`
+	Dropped    uint64        `json:"dropped"`
+	Stuck      bool          `json:"stuck"`
+	StuckStack string        `json:"stuckStack,omitempty"`
+}
+
+// markBusy records that the worker started processing an item and now holds
+// the controller lock. An empty topic means an asynchronous action.
+func (q *controllerQueue) markBusy(topic string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.busySince = time.Now()
+	q.busyTopic = topic
+}
+
+func (q *controllerQueue) markIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.busySince = time.Time{}
+	q.busyTopic = ""
+}
+
+// currentGoroutineID parses the id from the header of the current goroutine's
+// stack, "goroutine 42 [running]:".
+func currentGoroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+	return id
+}
+
+// goroutineStack returns the stack of the goroutine with the given id, or an
+// empty string if it is not running.
+func goroutineStack(id int64) string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	header := []byte("goroutine " + strconv.FormatInt(id, 10) + " ")
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return string(stack)
+		}
+	}
+	return ""
+}
+
+// runWatchdog checks the controller workers until ctx is cancelled.
+func (masterController *MasterController) runWatchdog(ctx context.Context) {
+	threshold := masterController.watchdogThreshold()
+	ticker := time.NewTicker(threshold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			masterController.checkWatchdog(now)
+		}
+	}
+}
+
+func (masterController *MasterController) watchdogThreshold() time.Duration {
+	if masterController.config.WatchdogThreshold > 0 {
+		return masterController.config.WatchdogThreshold
+	}
+	return defaultWatchdogThreshold
+}
+
+// checkWatchdog marks workers that have been busy with one item for longer
+// than the threshold as stuck, records their stack and sends an alert. An
+// alert is also sent when a stuck worker gets going again.
+func (masterController *MasterController) checkWatchdog(now time.Time) {
+	masterController.mu.Lock()
+	queues := masterController.controllerQueues
+	masterController.mu.Unlock()
+
+	threshold := masterController.watchdogThreshold()
+	for _, q := range queues {
+		q.mu.Lock()
+		busySince, topic := q.busySince, q.busyTopic
+		var busyFor time.Duration
+		if !busySince.IsZero() {
+			busyFor = now.Sub(busySince)
+		}
+		becameStuck := busyFor > threshold && !q.stuck
+		recovered := busyFor <= threshold && q.stuck
+		if becameStuck {
+			q.stuck = true
+		}
+		if recovered {
+			q.stuck = false
+		}
+		goroutineID := q.goroutineID
+		q.mu.Unlock()
+
+		if masterController.metricsConfig.CollectMetrics {
+			gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`regelverk_controller_busy_seconds{controller="%s",realm="%s"}`,
+				q.name, masterController.metricsConfig.MetricsRealm), nil)
+			gauge.Set(busyFor.Seconds())
+		}
+		if !becameStuck && !recovered {
+			continue
+		}
+
+		alert := watchdogAlert{Controller: q.name, Topic: topic, BusySince: busySince, BusyFor: busyFor,
+			Queued: q.depth(), Stuck: becameStuck}
+		if becameStuck {
+			stack := goroutineStack(goroutineID)
+			q.mu.Lock()
+			q.stuckStack = stack
+			q.mu.Unlock()
+			slog.Error("Controller is stuck", "controller", q.name, "topic", topic, "busyFor", busyFor,
+				"queued", alert.Queued, "stack", stack)
+			if masterController.metricsConfig.CollectMetrics {
+				counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_controller_stuck{controller="%s",realm="%s"}`,
+					q.name, masterController.metricsConfig.MetricsRealm))
+				counter.Inc()
+			}
+		} else {
+			slog.Info("Controller is no longer stuck", "controller", q.name, "queued", alert.Queued)
+		}
+		masterController.sendWatchdogAlert(alert)
+	}
+}
+
+func (masterController *MasterController) sendWatchdogAlert(alert watchdogAlert) {
+	topic := masterController.config.WatchdogTopic
+	if topic == "" || masterController.mqttClient == nil {
+		return
+	}
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		slog.Error("Could not marshal watchdog alert", "error", err)
+		return
+	}
+	masterController.publish(masterController.mqttClient, MQTTPublish{Topic: topic, Payload: payload, Qos: 1})
+}
+
+func (q *controllerQueue) watchdogDebug(now time.Time) ControllerWatchdogDebug {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	debug := ControllerWatchdogDebug{
+		BusySince:  q.busySince,
+		BusyTopic:  q.busyTopic,
+		Queued:     len(q.events),
+		Dropped:    q.dropped,
+		Stuck:      q.stuck,
+		StuckStack: q.stuckStack,
+	}
+	if !q.busySince.IsZero() {
+		debug.BusyFor = now.Sub(q.busySince)
+	}
+	return debug
+}
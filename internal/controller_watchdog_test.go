@@ -0,0 +1,64 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogDetectsStuckController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	controller := &recordingController{block: make(chan struct{})}
+	client := &recordingClient{}
+
+	masterController := CreateMasterController()
+	defer masterController.queueWorkers.Wait()
+	defer cancel()
+	masterController.config.WatchdogThreshold = time.Minute
+	masterController.config.WatchdogTopic = "regelverk/watchdog"
+	masterController.mqttClient = client
+	masterController.controllers = &[]Controller{controller}
+	masterController.startControllerQueues(ctx)
+
+	queue := masterController.controllerQueues[controller]
+	queue.enqueue(nil, MQTTEvent{Topic: "slow"})
+	queue.enqueue(nil, MQTTEvent{Topic: "waiting"})
+	waitFor(t, func() bool { return !queue.watchdogDebug(time.Now()).BusySince.IsZero() })
+
+	masterController.checkWatchdog(time.Now())
+	if topics := client.topics(); len(topics) != 0 {
+		t.Fatalf("expected no alert below threshold, got %v", topics)
+	}
+
+	masterController.checkWatchdog(time.Now().Add(2 * time.Minute))
+	worker := masterController.controllerDebugStates()[0].Worker
+	if worker == nil || !worker.Stuck || worker.BusyTopic != "slow" || worker.Queued != 1 {
+		t.Fatalf("expected stuck worker busy with slow and one queued event, got %+v", worker)
+	}
+	if !strings.Contains(worker.StuckStack, "recordingController") {
+		t.Errorf("expected stack of the blocked controller, got %q", worker.StuckStack)
+	}
+
+	// Only one alert while stuck
+	masterController.checkWatchdog(time.Now().Add(3 * time.Minute))
+	if topics := client.topics(); len(topics) != 1 || topics[0] != "regelverk/watchdog" {
+		t.Fatalf("expected one watchdog alert, got %v", topics)
+	}
+	var alert watchdogAlert
+	if err := json.Unmarshal(client.published[0].Payload.([]byte), &alert); err != nil || !alert.Stuck || alert.Controller != queue.name {
+		t.Fatalf("unexpected alert %+v, %v", alert, err)
+	}
+
+	close(controller.block)
+	waitFor(t, func() bool { return len(controller.processed()) == 2 })
+	waitFor(t, func() bool { return queue.watchdogDebug(time.Now()).BusySince.IsZero() })
+	masterController.checkWatchdog(time.Now())
+	if topics := client.topics(); len(topics) != 2 {
+		t.Fatalf("expected recovery alert, got %v", topics)
+	}
+	if worker := masterController.controllerDebugStates()[0].Worker; worker.Stuck {
+		t.Errorf("expected worker no longer stuck, got %+v", worker)
+	}
+}
@@ -0,0 +1,227 @@
+package regelverk
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// derivationGraph orders the derived states so that each is evaluated after
+// the derived states it reads. It is rebuilt on every registration and not
+// modified after.
+type derivationGraph struct {
+	// Topological order, inputs first
+	order []*derivedState
+	// For every key read by a derived state, directly or through other
+	// derived states, the derived states to re-evaluate when it is updated,
+	// in topological order
+	downstream map[StateKey][]*derivedState
+}
+
+// newDerivationGraph fails if a key is derived twice or if derived states
+// depend on each other in a cycle
+func newDerivationGraph(derivations []*derivedState) (*derivationGraph, error) {
+	nodes := make(map[StateKey]*derivedState, len(derivations))
+	for _, derived := range derivations {
+		if existing, found := nodes[derived.key]; found {
+			return nil, fmt.Errorf("%s is derived both by %s and %s", derived.key, existing.kind, derived.kind)
+		}
+		nodes[derived.key] = derived
+	}
+	keys := make([]StateKey, 0, len(nodes))
+	for key := range nodes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[StateKey]int)
+	var path []StateKey
+	graph := &derivationGraph{downstream: make(map[StateKey][]*derivedState)}
+
+	var visit func(key StateKey) error
+	visit = func(key StateKey) error {
+		derived, isDerived := nodes[key]
+		switch {
+		case !isDerived || marks[key] == visited:
+			return nil
+		case marks[key] == visiting:
+			cycle := slices.Concat(path[slices.Index(path, key):], []StateKey{key})
+			return fmt.Errorf("cycle in derived states: %s", joinKeys(cycle, " -> "))
+		}
+		marks[key] = visiting
+		path = append(path, key)
+		for _, input := range derived.inputs {
+			if err := visit(input); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[key] = visited
+		graph.order = append(graph.order, derived)
+		return nil
+	}
+	for _, key := range keys {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Inputs come first in the order, so their transitive inputs are known
+	transitiveInputs := make(map[StateKey][]StateKey)
+	for _, derived := range graph.order {
+		var inputs []StateKey
+		for _, input := range derived.inputs {
+			inputs = append(inputs, input)
+			inputs = append(inputs, transitiveInputs[input]...)
+		}
+		slices.Sort(inputs)
+		inputs = slices.Compact(inputs)
+		transitiveInputs[derived.key] = inputs
+		for _, input := range inputs {
+			graph.downstream[input] = append(graph.downstream[input], derived)
+		}
+	}
+	return graph, nil
+}
+
+func joinKeys(keys []StateKey, separator string) string {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = string(key)
+	}
+	return strings.Join(names, separator)
+}
+
+// setDerivations replaces the derived states registered by owner. On error,
+// e.g. a cycle, the registered derived states are left as they were.
+func (s *StateValueMap) setDerivations(owner string, derivations []*derivedState) error {
+	s.derivationsMu.Lock()
+	defer s.derivationsMu.Unlock()
+
+	var all []*derivedState
+	for _, derived := range s.derivations {
+		if derived.owner != owner {
+			all = append(all, derived)
+		}
+	}
+	for _, derived := range derivations {
+		derived.owner = owner
+		all = append(all, derived)
+	}
+	graph, err := newDerivationGraph(all)
+	if err != nil {
+		return err
+	}
+	s.derivations = all
+	s.derivationGraph.Store(graph)
+	return nil
+}
+
+// propagate re-evaluates the derived states that depend on key
+func (s *StateValueMap) propagate(key StateKey) {
+	graph := s.derivationGraph.Load()
+	if graph == nil {
+		return
+	}
+	for _, derived := range graph.downstream[key] {
+		s.updateDerived(derived)
+	}
+}
+
+// evaluateDerivations re-evaluates all derived states. Called for every
+// event, so that derived states with time windows follow the reevaluation
+// events injected when a window may have passed.
+func (s *StateValueMap) evaluateDerivations() {
+	graph := s.derivationGraph.Load()
+	if graph == nil {
+		return
+	}
+	for _, derived := range graph.order {
+		s.updateDerived(derived)
+	}
+}
+
+func (s *StateValueMap) updateDerived(derived *derivedState) {
+	value, ok := derived.evaluate(s)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateUnsafe(derived.key, value)
+}
+
+// DerivedStateDebug is a node of the derivation graph.
+type DerivedStateDebug struct {
+	Key        StateKey   `json:"key"`
+	Kind       string     `json:"kind"`
+	Owner      string     `json:"owner"`
+	Definition string     `json:"definition"`
+	Inputs     []StateKey `json:"inputs"`
+	Value      any        `json:"value,omitempty"`
+}
+
+// derivationsDebug lists the derived states in evaluation order
+func (s *StateValueMap) derivationsDebug() []DerivedStateDebug {
+	result := []DerivedStateDebug{}
+	graph := s.derivationGraph.Load()
+	if graph == nil {
+		return result
+	}
+	for _, derived := range graph.order {
+		debug := DerivedStateDebug{
+			Key:        derived.key,
+			Kind:       derived.kind,
+			Owner:      derived.owner,
+			Definition: derived.definition,
+			Inputs:     derived.inputs,
+		}
+		if stateValue, found := s.getState(derived.key); found {
+			debug.Value = stateValue.Value()
+		}
+		result = append(result, debug)
+	}
+	return result
+}
+
+// derivationsDot renders the derivation graph in the Graphviz dot language.
+// Derived keys are boxes labelled with their definition, keys that are only
+// read are ellipses.
+func (s *StateValueMap) derivationsDot() string {
+	var b strings.Builder
+	b.WriteString("digraph derivedStates {\n\trankdir=LR;\n")
+	derivations := s.derivationsDebug()
+	derived := make(map[StateKey]bool)
+	for _, d := range derivations {
+		derived[d.Key] = true
+	}
+	var inputs []StateKey
+	for _, d := range derivations {
+		label := fmt.Sprintf("%s\n%s: %s", d.Key, d.Kind, d.Definition)
+		if d.Value != nil {
+			label += fmt.Sprintf("\n= %v", d.Value)
+		}
+		fmt.Fprintf(&b, "\t%q [shape=box, label=%q];\n", d.Key, label)
+		for _, input := range d.Inputs {
+			if !derived[input] && !slices.Contains(inputs, input) {
+				inputs = append(inputs, input)
+			}
+		}
+	}
+	slices.Sort(inputs)
+	for _, input := range inputs {
+		fmt.Fprintf(&b, "\t%q;\n", input)
+	}
+	for _, d := range derivations {
+		for _, input := range d.Inputs {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", input, d.Key)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDerivationGraphPropagation(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+stateRules:
+  - topic: zigbee2mqtt/balcony-door
+    path: contact
+    invert: true
+    key: balconyDoorOpen
+  - topic: zigbee2mqtt/fridge-door
+    path: contact
+    invert: true
+    key: fridgeDoorOpen
+  - topic: zigbee2mqtt/vindstyrka
+    path: temperature
+    type: number
+    key: indoorTemperature
+  - topic: zigbee2mqtt/balcony-sensor
+    path: temperature
+    type: number
+    key: balconyTemperature
+derivedStates:
+  - key: doorAlarm
+    expression: anyDoorOpen && !nighttime
+  - key: anyDoorOpen
+    aggregate: any
+    keys: [balconyDoorOpen, fridgeDoorOpen]
+  - key: openDoors
+    aggregate: count
+    keys: [balconyDoorOpen, fridgeDoorOpen]
+  - key: coldestTemperature
+    aggregate: min
+    keys: [indoorTemperature, balconyTemperature]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	masterController := CreateMasterController()
+	masterController.registerDerivedStates(setup.DerivedStates)
+	sv := &masterController.stateValueMap
+
+	// Updates cascade through the graph without waiting for the next event
+	sv.setState("nighttime", false)
+	sv.setState("balconyDoorOpen", false)
+	sv.setState("fridgeDoorOpen", true)
+	if !sv.currentlyTrue("anyDoorOpen") || !sv.currentlyTrue("doorAlarm") {
+		t.Fatalf("expected an open door to raise the alarm, got %v", sv.Snapshot())
+	}
+	if count, _ := sv.getNumber("openDoors"); count != 1 {
+		t.Errorf("expected 1 open door, got %v", count)
+	}
+	sv.setState("fridgeDoorOpen", false)
+	if sv.currentlyTrue("anyDoorOpen") || sv.currentlyTrue("doorAlarm") {
+		t.Fatalf("expected closed doors to clear the alarm, got %v", sv.Snapshot())
+	}
+
+	// Number aggregates are undefined until some input is
+	if _, found := sv.getState("coldestTemperature"); found {
+		t.Fatalf("expected no coldest temperature without temperatures")
+	}
+	sv.setNumber("indoorTemperature", 21)
+	sv.setNumber("balconyTemperature", 4.5)
+	if coldest, _ := sv.getNumber("coldestTemperature"); coldest != 4.5 {
+		t.Errorf("expected coldest temperature 4.5, got %v", coldest)
+	}
+
+	order := sv.derivationsDebug()
+	position := make(map[StateKey]int)
+	for i, derived := range order {
+		position[derived.Key] = i
+	}
+	if len(order) != 4 || position["anyDoorOpen"] > position["doorAlarm"] {
+		t.Errorf("expected anyDoorOpen to be evaluated before doorAlarm, got %+v", order)
+	}
+}
+
+func TestSetDerivations(t *testing.T) {
+	sv := NewStateValueMap()
+	derived := func(key StateKey, inputs ...StateKey) *derivedState {
+		return &derivedState{key: key, kind: "aggregate", inputs: inputs,
+			evaluate: func(s *StateValueMap) (StateValue, bool) {
+				return StateValue{kind: BoolValue, value: countTrue(s, inputs) > 0}, true
+			}}
+	}
+
+	if err := sv.setDerivations("a", []*derivedState{derived("x", "input")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := sv.setDerivations("b", []*derivedState{derived("y", "x")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := sv.setDerivations("c", []*derivedState{derived("input", "y")})
+	if err == nil || err.Error() != "cycle in derived states: input -> y -> x -> input" {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	err = sv.setDerivations("c", []*derivedState{derived("x", "input")})
+	if err == nil || !strings.Contains(err.Error(), "x is derived both by") {
+		t.Fatalf("expected a duplicate error, got %v", err)
+	}
+
+	// The rejected registrations are not kept
+	sv.setState("input", true)
+	if !sv.currentlyTrue("x") || !sv.currentlyTrue("y") {
+		t.Fatalf("expected x and y to follow input, got %v", sv.Snapshot())
+	}
+
+	// A new registration of an owner replaces the old one
+	if err := sv.setDerivations("a", []*derivedState{derived("x", "other")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sv.setState("input", false)
+	if !sv.currentlyTrue("x") {
+		t.Fatalf("expected x to no longer follow input")
+	}
+	sv.setState("other", false)
+	if sv.currentlyTrue("x") || sv.currentlyTrue("y") {
+		t.Fatalf("expected x and y to follow other, got %v", sv.Snapshot())
+	}
+}
+
+func TestDerivedStatesHandler(t *testing.T) {
+	masterController := CreateMasterController()
+	masterController.registerDerivedStates([]DerivedStateConfig{
+		{Key: "anyDoorOpen", Aggregate: "any", Keys: []StateKey{"fridgeDoorOpen", "balconyDoorOpen"}},
+	})
+	masterController.stateValueMap.setState("fridgeDoorOpen", true)
+	controller := &DebugController{masterController: &masterController}
+
+	recorder := httptest.NewRecorder()
+	controller.derivedStatesHandler(recorder, httptest.NewRequest("GET", "/debug/derived", nil))
+	var derived []DerivedStateDebug
+	if err := json.Unmarshal(recorder.Body.Bytes(), &derived); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(derived) != 1 || derived[0].Definition != "any(fridgeDoorOpen, balconyDoorOpen)" ||
+		derived[0].Owner != configDerivations || derived[0].Value != true {
+		t.Fatalf("unexpected derived states %+v", derived)
+	}
+
+	recorder = httptest.NewRecorder()
+	controller.derivedStatesHandler(recorder, httptest.NewRequest("GET", "/debug/derived?format=dot", nil))
+	dot := recorder.Body.String()
+	for _, want := range []string{"digraph derivedStates {", `"anyDoorOpen" [shape=box`,
+		`"balconyDoorOpen";`, `"fridgeDoorOpen" -> "anyDoorOpen";`} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("expected %q in %s", want, dot)
+		}
+	}
+}
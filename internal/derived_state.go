@@ -0,0 +1,266 @@
+package regelverk
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// DerivedStateConfig defines a state key computed from other keys, as
+// declared in the derivedStates section of the config file. Either an
+// expression (see Expression for the syntax) or an aggregate over keys.
+//
+//	derivedStates:
+//	  - key: livingroomLampWanted
+//	    expression: phonePresent && nighttime && recently(livingroomPresence, 10m)
+//	  - key: anyDoorOpen
+//	    aggregate: any
+//	    keys: [balconyDoorOpen, freezerDoorOpen, fridgeDoorOpen]
+type DerivedStateConfig struct {
+	Key        StateKey `yaml:"key" json:"key"`
+	Expression string   `yaml:"expression" json:"expression,omitempty"`
+	// One of any, all and count of true keys, or min, max and average of
+	// number keys
+	Aggregate string     `yaml:"aggregate" json:"aggregate,omitempty"`
+	Keys      []StateKey `yaml:"keys" json:"keys,omitempty"`
+}
+
+// builtinStateKeys are the keys set by Go code rather than by state rules,
+// see builtinStateKey
+var builtinStateKeys = make(map[StateKey]bool)
+
+// builtinStateKey registers a key that Go code sets, so that derived states
+// may read it. Code setting a key declares it with this, e.g.
+//
+//	var snapcastStateKey = builtinStateKey("snapcast")
+func builtinStateKey(key StateKey) StateKey {
+	builtinStateKeys[key] = true
+	return key
+}
+
+// derivedState computes a key from the keys it reads. It is a node in the
+// derivationGraph.
+type derivedState struct {
+	key StateKey
+	// expression, aggregate or bayesian
+	kind       string
+	definition string
+	inputs     []StateKey
+	// evaluate returns false if there is no value to set
+	evaluate func(s *StateValueMap) (StateValue, bool)
+	// Registrations of the same owner replace each other
+	owner string
+}
+
+// derivedAggregates compute a value from the current values of keys
+var derivedAggregates = map[string]func(s *StateValueMap, keys []StateKey) (StateValue, bool){
+	"all": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		return StateValue{kind: BoolValue, value: countTrue(s, keys) == len(keys)}, true
+	},
+	"any": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		return StateValue{kind: BoolValue, value: countTrue(s, keys) > 0}, true
+	},
+	"average": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		numbers := currentNumbers(s, keys)
+		if len(numbers) == 0 {
+			return StateValue{}, false
+		}
+		sum := 0.0
+		for _, number := range numbers {
+			sum += number
+		}
+		return StateValue{kind: NumberValue, number: sum / float64(len(numbers))}, true
+	},
+	"count": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		return StateValue{kind: NumberValue, number: float64(countTrue(s, keys))}, true
+	},
+	"max": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		numbers := currentNumbers(s, keys)
+		if len(numbers) == 0 {
+			return StateValue{}, false
+		}
+		return StateValue{kind: NumberValue, number: slices.Max(numbers)}, true
+	},
+	"min": func(s *StateValueMap, keys []StateKey) (StateValue, bool) {
+		numbers := currentNumbers(s, keys)
+		if len(numbers) == 0 {
+			return StateValue{}, false
+		}
+		return StateValue{kind: NumberValue, number: slices.Min(numbers)}, true
+	},
+}
+
+func countTrue(s *StateValueMap, keys []StateKey) int {
+	count := 0
+	for _, key := range keys {
+		if s.currentlyTrue(key) {
+			count++
+		}
+	}
+	return count
+}
+
+// currentNumbers returns the values of the keys that are numbers
+func currentNumbers(s *StateValueMap, keys []StateKey) []float64 {
+	var numbers []float64
+	for _, key := range keys {
+		if number, found := s.getNumber(key); found {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
+
+func compileDerivedState(config DerivedStateConfig) (*derivedState, error) {
+	var errs []error
+	errs = append(errs, requireNonEmpty("key", string(config.Key)))
+	if (config.Expression == "") == (config.Aggregate == "") {
+		errs = append(errs, fmt.Errorf("one of expression and aggregate is required"))
+	}
+	if config.Expression != "" && len(config.Keys) > 0 {
+		errs = append(errs, fmt.Errorf("keys are only used with aggregate"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if config.Expression != "" {
+		expression, err := ParseExpression(config.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("expression: %w", err)
+		}
+		return &derivedState{
+			key:        config.Key,
+			kind:       "expression",
+			definition: config.Expression,
+			inputs:     expression.Keys(),
+			evaluate: func(s *StateValueMap) (StateValue, bool) {
+				return StateValue{kind: BoolValue, value: expression.Evaluate(s)}, true
+			},
+		}, nil
+	}
+
+	aggregate, found := derivedAggregates[config.Aggregate]
+	if !found {
+		return nil, fmt.Errorf("unknown aggregate %q, known are %s", config.Aggregate, knownKeys(derivedAggregates))
+	}
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("aggregate %s requires keys", config.Aggregate)
+	}
+	keys := slices.Clone(config.Keys)
+	inputs := slices.Clone(keys)
+	slices.Sort(inputs)
+	return &derivedState{
+		key:        config.Key,
+		kind:       "aggregate",
+		definition: fmt.Sprintf("%s(%s)", config.Aggregate, joinKeys(keys, ", ")),
+		inputs:     slices.Compact(inputs),
+		evaluate: func(s *StateValueMap) (StateValue, bool) {
+			return aggregate(s, keys)
+		},
+	}, nil
+}
+
+// knownStateKeys returns the keys that are set by other means than derived
+// states
+func knownStateKeys(setup *SetupConfig) map[StateKey]bool {
+	known := make(map[StateKey]bool)
+	maps.Copy(known, builtinStateKeys)
+	for _, rule := range setup.StateRules {
+		if rule.Key != "" {
+			known[rule.Key] = true
+		}
+	}
+	return known
+}
+
+// validateDerivedStates checks that the derived states only read keys that
+// are known or derived, and that they can be ordered without a cycle, also
+// together with the derivations registered by controllers. known is updated
+// with the derived keys, those of the controllers included.
+func validateDerivedStates(derived, controllerDerived []*derivedState, known map[StateKey]bool) error {
+	for _, d := range controllerDerived {
+		known[d.key] = true
+	}
+	for _, d := range derived {
+		if known[d.key] {
+			return fmt.Errorf("%s is already set by a state rule, built-in or other derived state", d.key)
+		}
+		known[d.key] = true
+	}
+	var errs []error
+	for _, d := range derived {
+		for _, key := range d.inputs {
+			if !known[key] {
+				errs = append(errs, fmt.Errorf("%s reads unknown state key %s", d.key, key))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	_, err := newDerivationGraph(slices.Concat(derived, controllerDerived))
+	return err
+}
+
+// Owner of the derived states from the config file
+const configDerivations = "derivedStates"
+
+// registerDerivedStates replaces the derived states from the config file.
+// They are validated when the config file is parsed, invalid ones here are
+// skipped.
+func (masterController *MasterController) registerDerivedStates(configs []DerivedStateConfig) {
+	var derivations []*derivedState
+	for _, config := range configs {
+		compiled, err := compileDerivedState(config)
+		if err != nil {
+			slog.Error("Skipping invalid derived state", "key", config.Key, "expression", config.Expression,
+				"aggregate", config.Aggregate, "error", err)
+			continue
+		}
+		derivations = append(derivations, compiled)
+	}
+	if err := masterController.stateValueMap.setDerivations(configDerivations, derivations); err != nil {
+		slog.Error("Could not register derived states", "error", err)
+		return
+	}
+	slog.Info("Registered derived states", "count", len(derivations))
+}
+
+// bayesianDerivation derives key from the inference of bayesianModel. The
+// key is left undefined until one of the likelihood keys is.
+func bayesianDerivation(bayesianStateKey StateKey, bayesianModel BayesianModel) *derivedState {
+	return &derivedState{
+		key:        bayesianStateKey,
+		kind:       "bayesian",
+		definition: fmt.Sprintf("prior %v, threshold %v", bayesianModel.Prior, bayesianModel.Threshold),
+		inputs:     slices.Sorted(maps.Keys(bayesianModel.Likelihoods)),
+		evaluate: func(s *StateValueMap) (StateValue, bool) {
+			defined := false
+			for key := range bayesianModel.Likelihoods {
+				if _, found := s.getState(key); found {
+					defined = true
+					break
+				}
+			}
+			if !defined {
+				return StateValue{}, false
+			}
+			posterior, decision := inferPosterior(bayesianModel, s)
+			slog.Debug("Bayesian inference", "bayesianStateKey", bayesianStateKey, "posterior", posterior, "decision", decision)
+			return StateValue{kind: BoolValue, value: decision}, true
+		},
+	}
+}
+
+// registerBayesianModel adds the derivation of bayesianStateKey to the graph.
+// Cycles with the derived states of the config file are rejected when it is
+// parsed, see controllerFactory.derivations.
+func (masterController *MasterController) registerBayesianModel(bayesianStateKey StateKey, bayesianModel BayesianModel) {
+	derived := bayesianDerivation(bayesianStateKey, bayesianModel)
+	if err := masterController.stateValueMap.setDerivations("bayesian/"+string(bayesianStateKey), []*derivedState{derived}); err != nil {
+		slog.Error("Could not register bayesian model", "key", bayesianStateKey, "error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	routerosmqtt "github.com/claes/mqtt-bridges/routeros-mqtt/lib"
+)
+
+func TestDerivedStates(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+stateRules:
+  - topic: zigbee2mqtt/livingroom-presence
+    path: occupancy
+    key: livingroomPresence
+derivedStates:
+  - key: livingroomLampWanted
+    expression: phonePresent && nighttime && recently(livingroomPresence, 10m)
+  - key: livingroomLampNotWanted
+    expression: "!livingroomLampWanted"
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	masterController := CreateMasterController()
+	masterController.config.Setup = setup
+	masterController.registerEventCallbacks()
+	event := func(topic string, payload any) {
+		masterController.executeEventCallbacks(MQTTEvent{Timestamp: nowFunc(), Topic: topic, Payload: payload})
+		masterController.stateValueMap.evaluateDerivations()
+	}
+	sv := &masterController.stateValueMap
+
+	wifiClients, _ := json.Marshal([]routerosmqtt.WifiClient{{MacAddress: phoneMacAddress}})
+	event("routeros/wificlients", wifiClients)
+	event("regelverk/ticker/timeofday", Nighttime)
+	if sv.currentlyTrue("livingroomLampWanted") || !sv.currentlyTrue("livingroomLampNotWanted") {
+		t.Fatalf("expected the lamp not to be wanted without presence, got %v", sv.Snapshot())
+	}
+
+	event("zigbee2mqtt/livingroom-presence", []byte(`{"occupancy": true}`))
+	event("zigbee2mqtt/livingroom-presence", []byte(`{"occupancy": false}`))
+	if !sv.currentlyTrue("livingroomLampWanted") || sv.currentlyTrue("livingroomLampNotWanted") {
+		t.Fatalf("expected the lamp to be wanted after presence, got %v", sv.Snapshot())
+	}
+
+	// The window of recently is scheduled for reevaluation
+	now := nowFunc()
+	deadline, found := sv.nextTemporalDeadline(now)
+	if !found || !deadline.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("expected a reevaluation in 10 minutes, got %v", deadline)
+	}
+	defer func() { nowFunc = func() time.Time { return now } }()
+	nowFunc = func() time.Time { return deadline.Add(time.Second) }
+	event(reevaluateTopic, []byte{})
+	if sv.currentlyTrue("livingroomLampWanted") || !sv.currentlyTrue("livingroomLampNotWanted") {
+		t.Fatalf("expected the lamp not to be wanted 10 minutes after presence, got %v", sv.Snapshot())
+	}
+}
+
+func TestDerivedStateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"syntax", "derivedStates:\n  - key: k\n    expression: a &&",
+			"line 2: derived state 0: expression: position 5: expected a state key"},
+		{"unknown key", "derivedStates:\n  - key: k\n    expression: nighttime && garageDoorOpen",
+			"unknown state key garageDoorOpen"},
+		{"own key", "derivedStates:\n  - key: k\n    expression: nighttime && !k",
+			"cycle in derived states: k -> k"},
+		{"cycle", "derivedStates:\n  - key: a\n    expression: b\n  - key: b\n    aggregate: any\n    keys: [c, nighttime]\n  - key: c\n    expression: a",
+			"cycle in derived states: a -> b -> c -> a"},
+		{"cycle with controller", "controllers:\n  - type: homepresence\nderivedStates:\n  - key: fridgeDoorOpen\n    expression: atHome",
+			"cycle in derived states: atHome -> fridgeDoorOpen -> atHome"},
+		{"built-in key", "derivedStates:\n  - key: nighttime\n    expression: \"true\"",
+			"nighttime is already set"},
+		{"controller key", "controllers:\n  - type: homepresence\nderivedStates:\n  - key: atHome\n    expression: nighttime",
+			"atHome is already set"},
+		{"key of absent controller", "derivedStates:\n  - key: k\n    expression: atHome",
+			"unknown state key atHome"},
+		{"duplicate key", "derivedStates:\n  - key: k\n    expression: nighttime\n  - key: k\n    expression: phonePresent",
+			"k is already set"},
+		{"missing expression", "derivedStates:\n  - key: k", "one of expression and aggregate is required"},
+		{"unknown aggregate", "derivedStates:\n  - key: k\n    aggregate: sum\n    keys: [nighttime]",
+			`line 2: derived state 0: unknown aggregate "sum"`},
+		{"aggregate without keys", "derivedStates:\n  - key: k\n    aggregate: any", "aggregate any requires keys"},
+		{"unknown field", "derivedStates:\n  - key: k\n    expr: nighttime", `unknown key "expr"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSetup([]byte(tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDerivedStatesReadBuiltinKeys(t *testing.T) {
+	_, err := ParseSetup([]byte(`
+controllers:
+  - type: homepresence
+derivedStates:
+  - key: k
+    expression: atHome && kitchenaudiolocal && snapcast && tvSource == "tv"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
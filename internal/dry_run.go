@@ -0,0 +1,136 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Publishes of dry-run controllers are mirrored to
+// regelverk/dryrun/<controller> instead of being sent
+const dryRunTopicPrefix = "regelverk/dryrun/"
+
+// Name used for publishes made by the engine itself, such as alerts
+const engineControllerName = "regelverk"
+
+// Number of recorded publishes kept for /debug/dryrun
+const dryRunHistorySize = 500
+
+// dryRunRecorder keeps the publishes that dry-run controllers would have
+// sent, newest last.
+type dryRunRecorder struct {
+	mu          sync.Mutex
+	controllers map[string]bool
+	records     []DryRunPublish
+	total       uint64
+}
+
+// DryRunPublish is a publish that was recorded instead of sent.
+type DryRunPublish struct {
+	Controller string        `json:"controller"`
+	Topic      string        `json:"topic"`
+	Payload    any           `json:"payload"`
+	Qos        byte          `json:"qos"`
+	Retained   bool          `json:"retained"`
+	Wait       time.Duration `json:"wait,omitempty"`
+	At         time.Time     `json:"at"`
+}
+
+// updateDryRunControllers picks up the controllers declared with dryRun from
+// the setup.
+func (masterController *MasterController) updateDryRunControllers() {
+	controllers := make(map[string]bool)
+	masterController.mu.Lock()
+	if masterController.config.Setup != nil {
+		for _, controllerSetup := range masterController.config.Setup.Controllers {
+			if controllerSetup.DryRun {
+				controllers[controllerSetup.key()] = true
+			}
+		}
+	}
+	masterController.mu.Unlock()
+
+	dryRun := &masterController.dryRun
+	dryRun.mu.Lock()
+	dryRun.controllers = controllers
+	dryRun.mu.Unlock()
+}
+
+// isDryRun reports whether publishes of the named controller are recorded
+// instead of sent, either because the whole engine runs in dry-run mode or
+// because the controller is declared with dryRun.
+func (masterController *MasterController) isDryRun(controller string) bool {
+	if masterController.config.DryRun {
+		return true
+	}
+	dryRun := &masterController.dryRun
+	dryRun.mu.Lock()
+	defer dryRun.mu.Unlock()
+	return dryRun.controllers[controller]
+}
+
+// recordDryRun records a publish instead of sending it, counts it and mirrors
+// it to the dry-run topic of the controller.
+func (masterController *MasterController) recordDryRun(client mqtt.Client, controller string, p MQTTPublish) {
+	payload := p.Payload
+	if bytes, ok := payload.([]byte); ok {
+		payload = string(bytes)
+	}
+	record := DryRunPublish{
+		Controller: controller,
+		Topic:      p.Topic,
+		Payload:    payload,
+		Qos:        p.Qos,
+		Retained:   p.Retained,
+		Wait:       p.Wait,
+		At:         nowFunc(),
+	}
+
+	dryRun := &masterController.dryRun
+	dryRun.mu.Lock()
+	dryRun.records = append(dryRun.records, record)
+	dryRun.total++
+	if len(dryRun.records) > dryRunHistorySize {
+		dryRun.records = dryRun.records[len(dryRun.records)-dryRunHistorySize:]
+	}
+	dryRun.mu.Unlock()
+
+	slog.Info("Dry run, not publishing", "controller", controller, "topic", p.Topic, "payload", payload, "wait", p.Wait)
+	if masterController.metricsConfig.CollectMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_dryrun_published{controller="%s",topic="%s",realm="%s"}`,
+			controller, p.Topic, masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+
+	if client == nil {
+		return
+	}
+	mirrored, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Could not marshal dry run publish", "error", err)
+		return
+	}
+	client.Publish(dryRunTopicPrefix+controller, 0, false, mirrored)
+}
+
+func (masterController *MasterController) dryRunDebug() []DryRunPublish {
+	dryRun := &masterController.dryRun
+	dryRun.mu.Lock()
+	defer dryRun.mu.Unlock()
+	return append([]DryRunPublish{}, dryRun.records...)
+}
+
+// dryRunSince returns the publishes recorded after the first seen ones, as
+// far as they are still kept, and the new total.
+func (masterController *MasterController) dryRunSince(seen uint64) ([]DryRunPublish, uint64) {
+	dryRun := &masterController.dryRun
+	dryRun.mu.Lock()
+	defer dryRun.mu.Unlock()
+	unseen := int(min(dryRun.total-seen, uint64(len(dryRun.records))))
+	return append([]DryRunPublish{}, dryRun.records[len(dryRun.records)-unseen:]...), dryRun.total
+}
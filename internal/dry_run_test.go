@@ -0,0 +1,88 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDryRunController(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+controllers:
+  - type: tv
+    dryRun: true
+  - type: kitchen
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !setup.Controllers[0].DryRun || setup.Controllers[1].DryRun {
+		t.Fatalf("unexpected dryRun flags: %+v", setup.Controllers)
+	}
+
+	masterController := CreateMasterController()
+	masterController.config.Setup = setup
+	masterController.Init()
+	client := &recordingClient{}
+
+	masterController.dispatchPublishes(client, "tv", []MQTTPublish{
+		{Topic: "samsungtv/set", Payload: []byte("on")},
+		{Topic: "samsungtv/get", Payload: "", Wait: time.Minute},
+	})
+	masterController.dispatchPublishes(client, "kitchen", []MQTTPublish{{Topic: "zigbee2mqtt/kitchen-amp/set"}})
+
+	want := []string{dryRunTopicPrefix + "tv", "zigbee2mqtt/kitchen-amp/set"}
+	if topics := client.topics(); !slices.Equal(topics, want) {
+		t.Fatalf("expected publishes %v, got %v", want, topics)
+	}
+	pending := masterController.publishScheduler.Pending()
+	if len(pending) != 1 || pending[0].Controller != "tv" {
+		t.Fatalf("expected delayed dry run publish to be scheduled, got %v", pending)
+	}
+	masterController.publishScheduler.Cancel(pending[0].ID)
+	masterController.publishScheduler.fire(pending[0].ID)
+	if topics := client.topics(); !slices.Equal(topics, want) {
+		t.Fatalf("expected cancelled publish not to be recorded, got %v", topics)
+	}
+	masterController.dispatchPublishes(client, "tv", []MQTTPublish{{Topic: "samsungtv/get", Payload: "", Wait: time.Minute}})
+	masterController.publishScheduler.fire(masterController.publishScheduler.Pending()[0].ID)
+	want = append(want, dryRunTopicPrefix+"tv")
+	if topics := client.topics(); !slices.Equal(topics, want) {
+		t.Fatalf("expected publishes %v, got %v", want, topics)
+	}
+
+	var mirrored DryRunPublish
+	if err := json.Unmarshal(client.published[0].Payload.([]byte), &mirrored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mirrored.Controller != "tv" || mirrored.Topic != "samsungtv/set" || mirrored.Payload != "on" {
+		t.Errorf("unexpected mirrored publish %+v", mirrored)
+	}
+
+	records := masterController.dryRunDebug()
+	if len(records) != 2 || records[1].Topic != "samsungtv/get" || records[1].Wait != time.Minute {
+		t.Errorf("unexpected recorded publishes %+v", records)
+	}
+}
+
+func TestDryRunEngine(t *testing.T) {
+	masterController := CreateMasterController()
+	masterController.config.DryRun = true
+	masterController.Init()
+	client := &recordingClient{}
+
+	masterController.dispatchPublishes(client, "kitchen", []MQTTPublish{{Topic: "zigbee2mqtt/kitchen-amp/set"}})
+	masterController.sendPublish(client, MQTTPublish{Topic: "regelverk/watchdog"})
+
+	want := []string{dryRunTopicPrefix + "kitchen", dryRunTopicPrefix + engineControllerName}
+	if topics := client.topics(); !slices.Equal(topics, want) {
+		t.Fatalf("expected publishes %v, got %v", want, topics)
+	}
+}
+
+func TestParseSetupDryRunRejectsUnknownKeys(t *testing.T) {
+	if _, err := ParseSetup([]byte("controllers:\n  - type: tv\n    dryrun: true\n")); err == nil {
+		t.Fatal("expected error for misspelled dryRun key")
+	}
+}
@@ -0,0 +1,520 @@
+package regelverk
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expression is a boolean expression over state keys, parsed from text such
+// as
+//
+//	phonePresent && nighttime && recently(livingroomPresence, 10m)
+//
+// A key on its own, or currentlyTrue(key), is true when it is currently
+// true, and currentlyFalse(key) when it is currently false. Keys are
+// combined with !, && and || and grouped with parentheses. Number, string and
+// enum keys are compared to a literal with ==, !=, <, <=, > or >=, as in
+// indoorTemperature > 24 or tvSource == "chromecast". The time window
+// functions recently (or recentlyTrue), continuously (or continuouslyTrue),
+// recentlyFalse and continuouslyFalse take a key and a duration. Undefined
+// keys make every test on them false.
+type Expression struct {
+	source string
+	root   expressionNode
+}
+
+type expressionNode interface {
+	eval(s *StateValueMap) bool
+	// explain evaluates like eval and also says which values decided the
+	// outcome
+	explain(s *StateValueMap) (bool, string)
+	keys(add func(StateKey))
+}
+
+// ParseExpression parses and checks the syntax of an expression. Errors name
+// the position in source, counting from 1.
+func ParseExpression(source string) (*Expression, error) {
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &expressionParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEnd {
+		return nil, fmt.Errorf("position %d: unexpected %s", token.pos, token)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate returns the value of the expression given the current state
+func (e *Expression) Evaluate(s *StateValueMap) bool {
+	return e.root.eval(s)
+}
+
+// Explain evaluates the expression and describes the values that decided
+// the outcome, e.g. "nighttime is false"
+func (e *Expression) Explain(s *StateValueMap) (bool, string) {
+	return e.root.explain(s)
+}
+
+// Keys returns the state keys the expression reads, sorted
+func (e *Expression) Keys() []StateKey {
+	var keys []StateKey
+	e.root.keys(func(key StateKey) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	})
+	slices.Sort(keys)
+	return keys
+}
+
+// Nodes
+
+type literalNode bool
+
+func (n literalNode) eval(_ *StateValueMap) bool { return bool(n) }
+func (n literalNode) keys(_ func(StateKey))      {}
+func (n literalNode) explain(_ *StateValueMap) (bool, string) {
+	return bool(n), strconv.FormatBool(bool(n))
+}
+
+type keyNode StateKey
+
+func (n keyNode) eval(s *StateValueMap) bool { return s.currentlyTrue(StateKey(n)) }
+func (n keyNode) keys(add func(StateKey))    { add(StateKey(n)) }
+func (n keyNode) explain(s *StateValueMap) (bool, string) {
+	return n.eval(s), describeStateKey(s, StateKey(n))
+}
+
+// keyFunctionNode is currentlyTrue(key) or currentlyFalse(key)
+type keyFunctionNode struct {
+	function string
+	key      StateKey
+}
+
+var keyFunctions = map[string]func(s *StateValueMap, key StateKey) bool{
+	"currentlyFalse": (*StateValueMap).currentlyFalse,
+	"currentlyTrue":  (*StateValueMap).currentlyTrue,
+}
+
+func (n keyFunctionNode) eval(s *StateValueMap) bool {
+	return keyFunctions[n.function](s, n.key)
+}
+
+func (n keyFunctionNode) explain(s *StateValueMap) (bool, string) {
+	return explainTest(s, fmt.Sprintf("%s(%s)", n.function, n.key), n.eval(s), n.key)
+}
+
+func (n keyFunctionNode) keys(add func(StateKey)) { add(n.key) }
+
+type notNode struct{ operand expressionNode }
+
+func (n notNode) eval(s *StateValueMap) bool { return !n.operand.eval(s) }
+func (n notNode) keys(add func(StateKey))    { n.operand.keys(add) }
+func (n notNode) explain(s *StateValueMap) (bool, string) {
+	value, explanation := n.operand.explain(s)
+	return !value, explanation
+}
+
+type andNode struct{ left, right expressionNode }
+
+func (n andNode) eval(s *StateValueMap) bool { return n.left.eval(s) && n.right.eval(s) }
+
+// A false conjunction is explained by its first false operand
+func (n andNode) explain(s *StateValueMap) (bool, string) {
+	left, leftExplanation := n.left.explain(s)
+	if !left {
+		return false, leftExplanation
+	}
+	right, rightExplanation := n.right.explain(s)
+	if !right {
+		return false, rightExplanation
+	}
+	return true, leftExplanation + ", " + rightExplanation
+}
+func (n andNode) keys(add func(StateKey)) {
+	n.left.keys(add)
+	n.right.keys(add)
+}
+
+type orNode struct{ left, right expressionNode }
+
+func (n orNode) eval(s *StateValueMap) bool { return n.left.eval(s) || n.right.eval(s) }
+
+// A true disjunction is explained by its first true operand
+func (n orNode) explain(s *StateValueMap) (bool, string) {
+	left, leftExplanation := n.left.explain(s)
+	if left {
+		return true, leftExplanation
+	}
+	right, rightExplanation := n.right.explain(s)
+	if right {
+		return true, rightExplanation
+	}
+	return false, leftExplanation + ", " + rightExplanation
+}
+func (n orNode) keys(add func(StateKey)) {
+	n.left.keys(add)
+	n.right.keys(add)
+}
+
+// compareNode compares a number key to a float64 or a string or enum key to
+// a string
+type compareNode struct {
+	key   StateKey
+	op    string
+	value any
+}
+
+func (n compareNode) eval(s *StateValueMap) bool {
+	switch value := n.value.(type) {
+	case float64:
+		number, found := s.getNumber(n.key)
+		if !found {
+			return false
+		}
+		switch n.op {
+		case "==":
+			return number == value
+		case "!=":
+			return number != value
+		case "<":
+			return number < value
+		case "<=":
+			return number <= value
+		case ">":
+			return number > value
+		case ">=":
+			return number >= value
+		}
+	case string:
+		text, found := s.getString(n.key)
+		if !found {
+			return false
+		}
+		return (text == value) == (n.op == "==")
+	}
+	return false
+}
+
+func (n compareNode) keys(add func(StateKey)) { add(n.key) }
+func (n compareNode) explain(s *StateValueMap) (bool, string) {
+	operand := fmt.Sprint(n.value)
+	if text, ok := n.value.(string); ok {
+		operand = strconv.Quote(text)
+	}
+	return explainTest(s, fmt.Sprintf("%s %s %s", n.key, n.op, operand), n.eval(s), n.key)
+}
+
+type windowNode struct {
+	function string
+	key      StateKey
+	duration time.Duration
+}
+
+// windowFunctions are the functions of a key and a duration
+var windowFunctions = map[string]func(s *StateValueMap, key StateKey, d time.Duration) bool{
+	"continuously":      (*StateValueMap).continuouslyTrue,
+	"continuouslyFalse": (*StateValueMap).continuouslyFalse,
+	"continuouslyTrue":  (*StateValueMap).continuouslyTrue,
+	"recently":          (*StateValueMap).recentlyTrue,
+	"recentlyFalse":     (*StateValueMap).recentlyFalse,
+	"recentlyTrue":      (*StateValueMap).recentlyTrue,
+}
+
+func (n windowNode) eval(s *StateValueMap) bool {
+	return windowFunctions[n.function](s, n.key, n.duration)
+}
+
+func (n windowNode) keys(add func(StateKey)) { add(n.key) }
+func (n windowNode) explain(s *StateValueMap) (bool, string) {
+	return explainTest(s, fmt.Sprintf("%s(%s, %v)", n.function, n.key, n.duration), n.eval(s), n.key)
+}
+
+// explainTest gives the outcome of a test on key along with its value
+func explainTest(s *StateValueMap, test string, value bool, key StateKey) (bool, string) {
+	return value, fmt.Sprintf("%s is %v (%s)", test, value, describeStateKey(s, key))
+}
+
+// describeStateKey describes the value of key and when it last changed
+func describeStateKey(s *StateValueMap, key StateKey) string {
+	stateValue, found := s.getState(key)
+	if !found {
+		return fmt.Sprintf("%s is undefined", key)
+	}
+	value := stateValue.Value()
+	if text, ok := value.(string); ok {
+		value = strconv.Quote(text)
+	}
+	return fmt.Sprintf("%s is %v, changed %v ago", key, value, nowFunc().Sub(stateValue.lastChange).Round(time.Second))
+}
+
+// Tokens
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenOperator
+)
+
+type expressionToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t expressionToken) String() string {
+	switch t.kind {
+	case tokenEnd:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var expressionOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ","}
+
+func tokenizeExpression(source string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: tokenIdent, text: string(runes[start:i]), pos: pos})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			// A number directly followed by letters is a duration, e.g. 1h30m
+			start := i
+			i++
+			kind := tokenNumber
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || unicode.IsLetter(runes[i])) {
+				if unicode.IsLetter(runes[i]) {
+					kind = tokenDuration
+				}
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: kind, text: string(runes[start:i]), pos: pos})
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("position %d: unterminated string", pos)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenString, text: string(runes[i+1 : end]), pos: pos})
+			i = end + 1
+		default:
+			rest := string(runes[i:])
+			operator := ""
+			for _, candidate := range expressionOperators {
+				if strings.HasPrefix(rest, candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("position %d: unexpected character %q", pos, r)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, pos: pos})
+			i += len([]rune(operator))
+		}
+	}
+	return append(tokens, expressionToken{kind: tokenEnd, pos: len(runes) + 1}), nil
+}
+
+// Parser, lowest precedence first:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | primary
+//	primary = "(" or ")" | "true" | "false" | function "(" key [ "," duration ] ")"
+//	        | key [ comparison ( number | string ) ]
+
+type expressionParser struct {
+	tokens []expressionToken
+	next   int
+}
+
+func (p *expressionParser) peek() expressionToken {
+	return p.tokens[p.next]
+}
+
+func (p *expressionParser) advance() expressionToken {
+	token := p.tokens[p.next]
+	if token.kind != tokenEnd {
+		p.next++
+	}
+	return token
+}
+
+func (p *expressionParser) acceptOperator(operators ...string) (string, bool) {
+	token := p.peek()
+	if token.kind == tokenOperator && slices.Contains(operators, token.text) {
+		p.advance()
+		return token.text, true
+	}
+	return "", false
+}
+
+func (p *expressionParser) expectOperator(operator string) error {
+	if _, ok := p.acceptOperator(operator); !ok {
+		token := p.peek()
+		return fmt.Errorf("position %d: expected %q, got %s", token.pos, operator, token)
+	}
+	return nil
+}
+
+func (p *expressionParser) parseOr() (expressionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+}
+
+func (p *expressionParser) parseAnd() (expressionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	if _, ok := p.acceptOperator("!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	if _, ok := p.acceptOperator("("); ok {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expectOperator(")")
+	}
+
+	token := p.advance()
+	if token.kind != tokenIdent {
+		return nil, fmt.Errorf("position %d: expected a state key, got %s", token.pos, token)
+	}
+	switch token.text {
+	case "true", "false":
+		return literalNode(token.text == "true"), nil
+	}
+	if _, isFunction := windowFunctions[token.text]; isFunction {
+		return p.parseWindow(token)
+	}
+	if _, isFunction := keyFunctions[token.text]; isFunction {
+		key, err := p.parseFunctionKey(token)
+		if err != nil {
+			return nil, err
+		}
+		return keyFunctionNode{function: token.text, key: key}, p.expectOperator(")")
+	}
+
+	key := StateKey(token.text)
+	operator, ok := p.acceptOperator("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return keyNode(key), nil
+	}
+	operand := p.advance()
+	switch operand.kind {
+	case tokenNumber:
+		number, err := strconv.ParseFloat(operand.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: invalid number %s", operand.pos, operand)
+		}
+		return compareNode{key: key, op: operator, value: number}, nil
+	case tokenString:
+		if operator != "==" && operator != "!=" {
+			return nil, fmt.Errorf("position %d: strings can only be compared with == or !=", operand.pos)
+		}
+		return compareNode{key: key, op: operator, value: operand.text}, nil
+	}
+	return nil, fmt.Errorf("position %d: expected a number or a string after %s, got %s", operand.pos, operator, operand)
+}
+
+// parseWindow parses the arguments of a time window function
+func (p *expressionParser) parseWindow(function expressionToken) (expressionNode, error) {
+	key, err := p.parseFunctionKey(function)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator(","); err != nil {
+		return nil, err
+	}
+	durationToken := p.advance()
+	duration, err := time.ParseDuration(durationToken.text)
+	if durationToken.kind != tokenDuration || err != nil || duration <= 0 {
+		return nil, fmt.Errorf("position %d: %s expects a positive duration such as 10m, got %s",
+			durationToken.pos, function.text, durationToken)
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return windowNode{function: function.text, key: key, duration: duration}, nil
+}
+
+// parseFunctionKey parses the opening parenthesis and first argument of a
+// function
+func (p *expressionParser) parseFunctionKey(function expressionToken) (StateKey, error) {
+	if err := p.expectOperator("("); err != nil {
+		return NoKey, err
+	}
+	key := p.advance()
+	if key.kind != tokenIdent {
+		return NoKey, fmt.Errorf("position %d: %s expects a state key, got %s", key.pos, function.text, key)
+	}
+	return StateKey(key.text), nil
+}
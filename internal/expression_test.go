@@ -0,0 +1,119 @@
+package regelverk
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	m := NewStateValueMap()
+	m.setState("phonePresent", true)
+	m.setState("nighttime", false)
+	seedAt(5*time.Minute, func() { m.setState("livingroomPresence", true) })
+	seedAt(3*time.Minute, func() { m.setState("livingroomPresence", false) })
+	m.setNumber("indoorTemperature", 23.5)
+	m.defineEnum("tvSource", "tv", "chromecast")
+	m.setEnum("tvSource", "chromecast")
+
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{"phonePresent", true},
+		{"!phonePresent", false},
+		{"phonePresent && nighttime", false},
+		{"phonePresent && !nighttime", true},
+		{"nighttime || phonePresent && livingroomPresence", false},
+		{"(nighttime || phonePresent) && recently(livingroomPresence, 10m)", true},
+		{"recently(livingroomPresence, 2m)", false},
+		{"continuouslyFalse(livingroomPresence, 4m)", false},
+		{"recentlyFalse(nighttime, 1h) && continuously(phonePresent, 0.5s)", false},
+		{"indoorTemperature > 23 && indoorTemperature <= 23.5 && indoorTemperature != 20", true},
+		{"indoorTemperature < -1", false},
+		{`tvSource == "chromecast" && tvSource != "tv"`, true},
+		// Undefined keys are false whatever the test
+		{`unknown == "x" || unknown != "x" || unknown >= 0 || recently(unknown, 1h)`, false},
+		{"!unknown", true},
+		// Booleans are not numbers or strings
+		{`phonePresent == 1 || phonePresent == "true"`, false},
+		{"true && !false", true},
+	}
+	for _, tt := range tests {
+		expression, err := ParseExpression(tt.expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expression, err)
+			continue
+		}
+		if got := expression.Evaluate(&m); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionKeys(t *testing.T) {
+	expression, err := ParseExpression(`nighttime && (recently(presence, 10m) || !nighttime) && tvSource == "tv"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := expression.Keys(); !slices.Equal(keys, []StateKey{"nighttime", "presence", "tvSource"}) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    string
+	}{
+		{"", `position 1: expected a state key, got end of expression`},
+		{"a &&", `position 5: expected a state key`},
+		{"a & b", `position 3: unexpected character '&'`},
+		{"a b", `position 3: unexpected "b"`},
+		{"(a || b", `position 8: expected ")", got end of expression`},
+		{"recently(a)", `position 11: expected ","`},
+		{"recently(a, 10)", `position 13: recently expects a positive duration such as 10m, got "10"`},
+		{"recently(a, 10 minutes)", `position 13: recently expects a positive duration`},
+		{`a < "x"`, "strings can only be compared with == or !="},
+		{"a == b", `position 6: expected a number or a string after ==, got "b"`},
+		{`a == "x`, "position 6: unterminated string"},
+	}
+	for _, tt := range tests {
+		_, err := ParseExpression(tt.expression)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.expression, tt.wantErr, err)
+		}
+	}
+}
+
+func TestExplainExpression(t *testing.T) {
+	m := NewStateValueMap()
+	seedAt(time.Hour, func() { m.setState("nighttime", false) })
+	m.setState("phonePresent", true)
+	m.defineEnum("tvSource", "tv", "chromecast")
+	seedAt(2*time.Minute, func() { m.setEnum("tvSource", "tv") })
+
+	tests := []struct {
+		expression string
+		want       bool
+		why        string
+	}{
+		{"phonePresent && nighttime", false, "nighttime is false, changed 1h0m0s ago"},
+		{"nighttime || !phonePresent", false, "nighttime is false, changed 1h0m0s ago, phonePresent is true, changed 0s ago"},
+		{`nighttime || currentlyTrue(phonePresent) || tvSource == "tv"`, true,
+			"currentlyTrue(phonePresent) is true (phonePresent is true, changed 0s ago)"},
+		{`recentlyTrue(tvSource, 5m) || tvSource != "tv"`, false,
+			`recentlyTrue(tvSource, 5m0s) is false (tvSource is "tv", changed 2m0s ago), tvSource != "tv" is false (tvSource is "tv", changed 2m0s ago)`},
+		{"garageDoorOpen", false, "garageDoorOpen is undefined"},
+	}
+	for _, tt := range tests {
+		expression, err := ParseExpression(tt.expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.expression, err)
+		}
+		if got, why := expression.Explain(&m); got != tt.want || why != tt.why {
+			t.Errorf("%s = %v, %q, want %v, %q", tt.expression, got, why, tt.want, tt.why)
+		}
+	}
+}
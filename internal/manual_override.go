@@ -0,0 +1,213 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Default time after a command during which a state change of the device is
+// attributed to regelverk
+const defaultOverrideCommandWindow = 10 * time.Second
+
+// ManualOverrideConfig declares a device whose manual state changes hold off
+// automation, as read from the manualOverrides section of the config file.
+//
+//	manualOverrides:
+//	  - device: zigbee2mqtt/livingroom-floorlamp
+//	    property: state
+//	    hold: 2h
+type ManualOverrideConfig struct {
+	// State topic of the device. Commands are published to <device>/set.
+	Device string `yaml:"device" json:"device"`
+	// JSON property of the state payload that is watched, defaults to state
+	Property string `yaml:"property" json:"property"`
+	// How long automation is held off after a manual change
+	Hold time.Duration `yaml:"hold" json:"hold"`
+	// State changes within this time after a command are caused by regelverk
+	CommandWindow time.Duration `yaml:"commandWindow" json:"commandWindow,omitempty"`
+}
+
+func validateManualOverride(override ManualOverrideConfig) error {
+	var errs []error
+	errs = append(errs, requireNonEmpty("device", override.Device), requirePositive("hold", override.Hold))
+	if override.CommandWindow < 0 {
+		errs = append(errs, fmt.Errorf("commandWindow must not be negative, got %v", override.CommandWindow))
+	}
+	return errors.Join(errs...)
+}
+
+type manualOverrides struct {
+	mu      sync.Mutex
+	devices map[string]*overrideDevice
+}
+
+type overrideDevice struct {
+	config      ManualOverrideConfig
+	lastValue   any
+	hasValue    bool
+	lastCommand time.Time
+	heldUntil   time.Time
+}
+
+// ManualOverrideDebug is a JSON-friendly view of a watched device.
+type ManualOverrideDebug struct {
+	ManualOverrideConfig
+	LastValue   any       `json:"lastValue,omitempty"`
+	LastCommand time.Time `json:"lastCommand,omitzero"`
+	HeldUntil   time.Time `json:"heldUntil,omitzero"`
+	Held        bool      `json:"held"`
+}
+
+// registerManualOverrides replaces the watched devices. Observed values and
+// holds of devices that are still declared are kept.
+func (masterController *MasterController) registerManualOverrides(configs []ManualOverrideConfig) {
+	overrides := &masterController.overrides
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+
+	devices := make(map[string]*overrideDevice)
+	for _, config := range configs {
+		if config.Property == "" {
+			config.Property = "state"
+		}
+		if config.CommandWindow == 0 {
+			config.CommandWindow = defaultOverrideCommandWindow
+		}
+		device, exists := overrides.devices[config.Device]
+		if !exists || device.config.Property != config.Property {
+			device = &overrideDevice{}
+		}
+		device.config = config
+		devices[config.Device] = device
+	}
+	overrides.devices = devices
+}
+
+// commandedDevice returns the device a publish to topic is a command for.
+func commandedDevice(topic string) (string, bool) {
+	index := strings.LastIndex(topic, "/set")
+	if index <= 0 || (index+len("/set") != len(topic) && topic[index+len("/set")] != '/') {
+		return "", false
+	}
+	return topic[:index], true
+}
+
+// recordCommand notes that regelverk sent a command to the device, so that
+// the resulting state change is not taken for a manual one.
+func (masterController *MasterController) recordCommand(topic string, at time.Time) {
+	deviceName, ok := commandedDevice(topic)
+	if !ok {
+		return
+	}
+	overrides := &masterController.overrides
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+	if device, watched := overrides.devices[deviceName]; watched {
+		device.lastCommand = at
+	}
+}
+
+// detectManualOverrides runs as an event callback. A change of the watched
+// property that cannot be attributed to a recent command holds the device.
+func (masterController *MasterController) detectManualOverrides(ev MQTTEvent) {
+	overrides := &masterController.overrides
+	overrides.mu.Lock()
+	device, watched := overrides.devices[ev.Topic]
+	var property string
+	if watched {
+		property = device.config.Property
+	}
+	overrides.mu.Unlock()
+	if !watched {
+		return
+	}
+	payload, ok := ev.Payload.([]byte)
+	if !ok {
+		return
+	}
+	var state map[string]any
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return
+	}
+	value, found := state[property]
+	if !found {
+		return
+	}
+
+	overrides.mu.Lock()
+	changed := device.hasValue && !reflect.DeepEqual(device.lastValue, value)
+	manual := changed && ev.Timestamp.Sub(device.lastCommand) > device.config.CommandWindow
+	device.lastValue = value
+	device.hasValue = true
+	if manual {
+		device.heldUntil = ev.Timestamp.Add(device.config.Hold)
+	}
+	heldUntil := device.heldUntil
+	overrides.mu.Unlock()
+
+	if manual {
+		slog.Info("Manual override detected", "device", ev.Topic, "property", property,
+			"value", value, "heldUntil", heldUntil)
+		if masterController.metricsConfig.CollectMetrics {
+			counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_manual_override{device="%s",realm="%s"}`,
+				ev.Topic, masterController.metricsConfig.MetricsRealm))
+			counter.Inc()
+		}
+	}
+}
+
+// isHeld reports whether a publish to topic is a command for a device that
+// is manually held.
+func (masterController *MasterController) isHeld(topic string) bool {
+	deviceName, ok := commandedDevice(topic)
+	if !ok {
+		return false
+	}
+	overrides := &masterController.overrides
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+	device, watched := overrides.devices[deviceName]
+	return watched && nowFunc().Before(device.heldUntil)
+}
+
+// filterHeldOutputs drops commands to manually held devices.
+func (masterController *MasterController) filterHeldOutputs(controller string, events []MQTTPublish) []MQTTPublish {
+	var filtered []MQTTPublish
+	for _, event := range events {
+		if masterController.isHeld(event.Topic) {
+			slog.Info("Skipping output to manually held device", "controller", controller, "topic", event.Topic)
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+func (masterController *MasterController) manualOverridesDebug() []ManualOverrideDebug {
+	overrides := &masterController.overrides
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+
+	now := nowFunc()
+	result := make([]ManualOverrideDebug, 0, len(overrides.devices))
+	for _, device := range overrides.devices {
+		result = append(result, ManualOverrideDebug{
+			ManualOverrideConfig: device.config,
+			LastValue:            device.lastValue,
+			LastCommand:          device.lastCommand,
+			HeldUntil:            device.heldUntil,
+			Held:                 now.Before(device.heldUntil),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
@@ -0,0 +1,81 @@
+package regelverk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualOverride(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+manualOverrides:
+  - device: zigbee2mqtt/lamp
+    hold: 1h
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	masterController := CreateMasterController()
+	masterController.config.Setup = setup
+	masterController.Init()
+
+	start := nowFunc()
+	report := func(at time.Time, state string) {
+		masterController.executeEventCallbacks(MQTTEvent{Timestamp: at, Topic: "zigbee2mqtt/lamp",
+			Payload: []byte(`{"state": "` + state + `", "linkquality": 80}`)})
+	}
+	lampOn := MQTTPublish{Topic: "zigbee2mqtt/lamp/set", Payload: `{"state": "ON"}`}
+	other := MQTTPublish{Topic: "zigbee2mqtt/other/set", Payload: `{"state": "ON"}`}
+
+	// A change following a command from regelverk is not manual
+	report(start.Add(-time.Hour), "OFF")
+	masterController.recordCommand(lampOn.Topic, start.Add(-time.Hour))
+	report(start.Add(-time.Hour+time.Second), "ON")
+	if masterController.isHeld(lampOn.Topic) {
+		t.Fatalf("change caused by a command was taken for a manual one")
+	}
+
+	// A change without a recent command holds the device
+	report(start.Add(-time.Minute), "OFF")
+	if !masterController.isHeld(lampOn.Topic) {
+		t.Fatalf("expected lamp to be held after manual change")
+	}
+	if masterController.isHeld(other.Topic) || masterController.isHeld("zigbee2mqtt/lamp/get") {
+		t.Fatalf("only commands to the held device should be held")
+	}
+
+	controller := &BaseController{Name: "livingroom", masterController: &masterController}
+	controller.addEventsToPublish([]MQTTPublish{lampOn, other})
+	if events := controller.getAndResetEventsToPublish(); len(events) != 1 || events[0].Topic != other.Topic {
+		t.Fatalf("expected only the command to the other device, got %v", events)
+	}
+
+	debug := masterController.manualOverridesDebug()
+	if len(debug) != 1 || !debug[0].Held || debug[0].Property != "state" || debug[0].LastValue != "OFF" {
+		t.Fatalf("unexpected debug state %+v", debug)
+	}
+
+	// The hold expires
+	masterController.overrides.devices["zigbee2mqtt/lamp"].heldUntil = start.Add(-time.Second)
+	if masterController.isHeld(lampOn.Topic) {
+		t.Fatalf("expected hold to have expired")
+	}
+}
+
+func TestCommandedDevice(t *testing.T) {
+	tests := []struct {
+		topic, device string
+		ok            bool
+	}{
+		{"zigbee2mqtt/lamp/set", "zigbee2mqtt/lamp", true},
+		{"zigbee2mqtt/lamp/set/state", "zigbee2mqtt/lamp", true},
+		{"zigbee2mqtt/lamp/get", "", false},
+		{"zigbee2mqtt/settings", "", false},
+		{"/set", "", false},
+	}
+	for _, tt := range tests {
+		device, ok := commandedDevice(tt.topic)
+		if device != tt.device || ok != tt.ok {
+			t.Errorf("commandedDevice(%q) = %q, %v, want %q, %v", tt.topic, device, ok, tt.device, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,833 @@
+package regelverk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetPubrec      byte = 5
+	packetPubrel      byte = 6
+	packetPubcomp     byte = 7
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// CONNACK return codes
+const (
+	connackAccepted            byte = 0
+	connackUnacceptableVersion byte = 1
+	connackBadCredentials      byte = 4
+)
+
+const (
+	// zigbee2mqtt/bridge/devices alone can be a few megabytes
+	maxBrokerPacketSize = 32 << 20
+	// Packets queued for a client before it is considered too slow and
+	// disconnected, so that it cannot hold up the other clients
+	brokerClientQueueSize = 4096
+	brokerConnectTimeout  = 10 * time.Second
+	// Retained messages are saved at most this often
+	brokerRetainedSaveDelay = time.Second
+)
+
+// BrokerConfig configures the embedded MQTT broker. If UserName is set,
+// clients must log in with it and Password.
+type BrokerConfig struct {
+	ListenAddress string
+	RetainedFile  string
+	UserName      string
+	Password      string
+}
+
+// Broker is a small MQTT 3.1.1 broker the hub can run in-process instead of
+// depending on an external one. It supports QoS 0, 1 and 2, retained
+// messages, wills and wildcard subscriptions. Sessions are always clean:
+// subscriptions and undelivered messages are dropped when a client
+// disconnects, and unacknowledged messages are not resent.
+type Broker struct {
+	config        BrokerConfig
+	metricsConfig MetricsConfig
+	listener      net.Listener
+	wg            sync.WaitGroup
+
+	mu        sync.Mutex
+	clients   map[string]*brokerClient
+	retained  map[string]brokerMessage
+	saveTimer *time.Timer
+	closed    bool
+}
+
+type brokerMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"-"`
+}
+
+type brokerClient struct {
+	id          string
+	conn        net.Conn
+	connectedAt time.Time
+	out         chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	// Guarded by the broker lock
+	subscriptions map[string]byte
+	nextPacketID  uint16
+}
+
+// BrokerDebug is a JSON-friendly view of the embedded broker.
+type BrokerDebug struct {
+	Address  string              `json:"address"`
+	Clients  []BrokerClientDebug `json:"clients"`
+	Retained int                 `json:"retained"`
+}
+
+type BrokerClientDebug struct {
+	ID            string          `json:"id"`
+	RemoteAddress string          `json:"remoteAddress"`
+	ConnectedAt   time.Time       `json:"connectedAt"`
+	Subscriptions map[string]byte `json:"subscriptions"`
+}
+
+func NewBroker(config BrokerConfig, metricsConfig MetricsConfig) *Broker {
+	return &Broker{
+		config:        config,
+		metricsConfig: metricsConfig,
+		clients:       make(map[string]*brokerClient),
+		retained:      make(map[string]brokerMessage),
+	}
+}
+
+// Start loads the persisted retained messages and starts accepting
+// connections.
+func (b *Broker) Start() error {
+	if err := b.loadRetained(); err != nil {
+		return fmt.Errorf("could not load retained messages from %s: %w", b.config.RetainedFile, err)
+	}
+	listener, err := net.Listen("tcp", b.config.ListenAddress)
+	if err != nil {
+		return err
+	}
+	b.listener = listener
+	slog.Info("Started embedded MQTT broker", "address", listener.Addr().String(),
+		"retained", len(b.retained), "retainedFile", b.config.RetainedFile)
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("Embedded MQTT broker stopped accepting connections", "error", err)
+				}
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// ClientURL is the broker URL local clients connect to. An unspecified
+// listen host is replaced by the loopback address.
+func (b *Broker) ClientURL() string {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "tcp://" + net.JoinHostPort(host, fmt.Sprint(addr.Port))
+}
+
+// Close disconnects all clients and saves the retained messages.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	clients := make([]*brokerClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		clients = append(clients, client)
+	}
+	if b.saveTimer != nil {
+		b.saveTimer.Stop()
+		b.saveTimer = nil
+	}
+	b.mu.Unlock()
+
+	var err error
+	if b.listener != nil {
+		err = b.listener.Close()
+	}
+	for _, client := range clients {
+		client.close()
+	}
+	b.wg.Wait()
+	if saveErr := b.saveRetained(); saveErr != nil {
+		slog.Error("Could not save retained messages", "retainedFile", b.config.RetainedFile, "error", saveErr)
+	}
+	slog.Info("Stopped embedded MQTT broker")
+	return err
+}
+
+// serve runs one client connection until it is closed.
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(brokerConnectTimeout))
+	packet, err := readBrokerPacket(reader)
+	if err != nil || packet.kind != packetConnect {
+		slog.Debug("Embedded MQTT broker dropped connection without CONNECT", "remoteAddress", conn.RemoteAddr(), "error", err)
+		return
+	}
+	connect, err := parseConnect(packet.body)
+	if err != nil {
+		slog.Warn("Invalid CONNECT", "remoteAddress", conn.RemoteAddr(), "error", err)
+		return
+	}
+	if connect.returnCode == connackAccepted && b.config.UserName != "" &&
+		(connect.userName != b.config.UserName || connect.password != b.config.Password) {
+		connect.returnCode = connackBadCredentials
+	}
+	if connect.returnCode != connackAccepted {
+		slog.Warn("Embedded MQTT broker refused connection", "remoteAddress", conn.RemoteAddr(),
+			"clientId", connect.clientID, "returnCode", connect.returnCode)
+		conn.Write(encodeBrokerPacket(packetConnack, 0, []byte{0, connect.returnCode}))
+		return
+	}
+
+	client := &brokerClient{
+		id:            connect.clientID,
+		conn:          conn,
+		connectedAt:   time.Now(),
+		out:           make(chan []byte, brokerClientQueueSize),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]byte),
+	}
+	if client.id == "" {
+		client.id = fmt.Sprintf("regelverk-anonymous-%s", conn.RemoteAddr())
+	}
+	if !b.register(client) {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		client.write()
+	}()
+	client.send(encodeBrokerPacket(packetConnack, 0, []byte{0, connackAccepted}))
+	slog.Info("MQTT client connected to embedded broker", "clientId", client.id, "remoteAddress", conn.RemoteAddr())
+
+	graceful := b.receive(client, reader, connect.keepAlive)
+
+	b.unregister(client)
+	client.close()
+	if !graceful && connect.will != nil {
+		slog.Info("Publishing will of disconnected MQTT client", "clientId", client.id, "topic", connect.will.Topic)
+		b.route(*connect.will)
+	}
+	slog.Info("MQTT client disconnected from embedded broker", "clientId", client.id, "graceful", graceful)
+}
+
+// receive handles packets from a connected client. Returns true if the
+// client disconnected with DISCONNECT.
+func (b *Broker) receive(client *brokerClient, reader *bufio.Reader, keepAlive time.Duration) bool {
+	// Packet ids of QoS 2 messages that were routed but not yet released
+	pendingQos2 := make(map[uint16]bool)
+	for {
+		if keepAlive > 0 {
+			client.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			client.conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := readBrokerPacket(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("MQTT client connection lost", "clientId", client.id, "error", err)
+			}
+			return false
+		}
+
+		switch packet.kind {
+		case packetPublish:
+			msg, packetID, err := parsePublish(packet)
+			if err != nil {
+				slog.Warn("Invalid PUBLISH", "clientId", client.id, "error", err)
+				return false
+			}
+			switch msg.Qos {
+			case 0:
+				b.route(msg)
+			case 1:
+				b.route(msg)
+				client.send(encodeBrokerPacket(packetPuback, 0, packetIDBytes(packetID)))
+			case 2:
+				// Routed on the first PUBLISH, a resend before PUBREL is a duplicate
+				if !pendingQos2[packetID] {
+					pendingQos2[packetID] = true
+					b.route(msg)
+				}
+				client.send(encodeBrokerPacket(packetPubrec, 0, packetIDBytes(packetID)))
+			}
+		case packetPubrel:
+			packetID, err := parsePacketID(packet.body)
+			if err != nil {
+				return false
+			}
+			delete(pendingQos2, packetID)
+			client.send(encodeBrokerPacket(packetPubcomp, 0, packetIDBytes(packetID)))
+		case packetPubrec:
+			packetID, err := parsePacketID(packet.body)
+			if err != nil {
+				return false
+			}
+			client.send(encodeBrokerPacket(packetPubrel, 0x02, packetIDBytes(packetID)))
+		case packetPuback, packetPubcomp:
+			// Nothing is resent, so there is nothing to clear
+		case packetSubscribe:
+			if err := b.subscribe(client, packet.body); err != nil {
+				slog.Warn("Invalid SUBSCRIBE", "clientId", client.id, "error", err)
+				return false
+			}
+		case packetUnsubscribe:
+			if err := b.unsubscribe(client, packet.body); err != nil {
+				slog.Warn("Invalid UNSUBSCRIBE", "clientId", client.id, "error", err)
+				return false
+			}
+		case packetPingreq:
+			client.send(encodeBrokerPacket(packetPingresp, 0, nil))
+		case packetDisconnect:
+			return true
+		default:
+			slog.Warn("Unexpected MQTT packet", "clientId", client.id, "type", packet.kind)
+			return false
+		}
+	}
+}
+
+// register adds the client, taking over from an existing connection with the
+// same client id.
+func (b *Broker) register(client *brokerClient) bool {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return false
+	}
+	previous := b.clients[client.id]
+	b.clients[client.id] = client
+	clients := len(b.clients)
+	b.mu.Unlock()
+
+	if previous != nil {
+		slog.Info("MQTT client id reconnected, closing previous connection", "clientId", client.id)
+		previous.close()
+	}
+	b.updateClientsGauge(clients)
+	return true
+}
+
+func (b *Broker) unregister(client *brokerClient) {
+	b.mu.Lock()
+	if b.clients[client.id] == client {
+		delete(b.clients, client.id)
+	}
+	clients := len(b.clients)
+	b.mu.Unlock()
+	b.updateClientsGauge(clients)
+}
+
+func (b *Broker) updateClientsGauge(clients int) {
+	if b.metricsConfig.CollectMetrics {
+		gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`regelverk_broker_clients{realm="%s"}`, b.metricsConfig.MetricsRealm), nil)
+		gauge.Set(float64(clients))
+	}
+}
+
+// route stores a retained message and forwards msg to every client with a
+// matching subscription, at the lower of the published and subscribed QoS.
+func (b *Broker) route(msg brokerMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+		b.scheduleRetainedSave()
+	}
+	for _, client := range b.clients {
+		if qos, ok := client.subscribedQos(msg.Topic); ok {
+			client.send(client.publishPacket(msg, min(qos, msg.Qos), false))
+		}
+	}
+
+	if b.metricsConfig.CollectMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_broker_messages{realm="%s"}`, b.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+}
+
+func (b *Broker) subscribe(client *brokerClient, body []byte) error {
+	r := packetReader{body: body}
+	packetID := r.uint16()
+	var filters []string
+	granted := []byte{}
+	for r.err == nil && r.remaining() > 0 {
+		filter := r.string()
+		qos := r.byte()
+		if r.err != nil {
+			break
+		}
+		if qos > 2 || !validTopicFilter(filter) {
+			granted = append(granted, 0x80)
+			continue
+		}
+		filters = append(filters, filter)
+		granted = append(granted, qos)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(granted) == 0 {
+		return errors.New("no topic filters")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := 0
+	for _, qos := range granted {
+		if qos == 0x80 {
+			continue
+		}
+		client.subscriptions[filters[i]] = qos
+		i++
+	}
+	client.send(encodeBrokerPacket(packetSuback, 0, append(packetIDBytes(packetID), granted...)))
+
+	// Retained messages matching the new subscriptions, in topic order
+	topics := make([]string, 0, len(b.retained))
+	for topic := range b.retained {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		for _, filter := range filters {
+			if matchSubscription(filter, topic) {
+				msg := b.retained[topic]
+				client.send(client.publishPacket(msg, min(client.subscriptions[filter], msg.Qos), true))
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) unsubscribe(client *brokerClient, body []byte) error {
+	r := packetReader{body: body}
+	packetID := r.uint16()
+	var filters []string
+	for r.err == nil && r.remaining() > 0 {
+		filters = append(filters, r.string())
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	b.mu.Lock()
+	for _, filter := range filters {
+		delete(client.subscriptions, filter)
+	}
+	b.mu.Unlock()
+	client.send(encodeBrokerPacket(packetUnsuback, 0, packetIDBytes(packetID)))
+	return nil
+}
+
+// subscribedQos returns the highest QoS of the client's subscriptions that
+// match topic. Requires the broker lock to be held.
+func (c *brokerClient) subscribedQos(topic string) (byte, bool) {
+	var qos byte
+	found := false
+	for filter, filterQos := range c.subscriptions {
+		if matchSubscription(filter, topic) {
+			qos = max(qos, filterQos)
+			found = true
+		}
+	}
+	return qos, found
+}
+
+// publishPacket requires the broker lock to be held, since it allocates a
+// packet id.
+func (c *brokerClient) publishPacket(msg brokerMessage, qos byte, retain bool) []byte {
+	body := encodeBrokerString(msg.Topic)
+	if qos > 0 {
+		c.nextPacketID++
+		if c.nextPacketID == 0 {
+			c.nextPacketID = 1
+		}
+		body = append(body, packetIDBytes(c.nextPacketID)...)
+	}
+	body = append(body, msg.Payload...)
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	return encodeBrokerPacket(packetPublish, flags, body)
+}
+
+// send queues a packet without blocking. A client that falls too far behind
+// is disconnected.
+func (c *brokerClient) send(packet []byte) {
+	select {
+	case <-c.done:
+	case c.out <- packet:
+	default:
+		slog.Warn("MQTT client too slow, disconnecting", "clientId", c.id)
+		c.close()
+	}
+}
+
+func (c *brokerClient) write() {
+	writer := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case <-c.done:
+			return
+		case packet := <-c.out:
+			writer.Write(packet)
+			// Batch whatever else is already queued into one write
+			for queued := len(c.out); queued > 0; queued-- {
+				writer.Write(<-c.out)
+			}
+			if err := writer.Flush(); err != nil {
+				slog.Debug("Could not write to MQTT client", "clientId", c.id, "error", err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *brokerClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// matchSubscription is matchTopic, except that wildcards at the first level
+// do not match topics starting with $, as the MQTT specification requires.
+func matchSubscription(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	return matchTopic(filter, topic)
+}
+
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if level != "#" && level != "+" && strings.ContainsAny(level, "#+") {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Broker) debug() BrokerDebug {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := BrokerDebug{Retained: len(b.retained), Clients: []BrokerClientDebug{}}
+	if b.listener != nil {
+		result.Address = b.listener.Addr().String()
+	}
+	for _, client := range b.clients {
+		subscriptions := make(map[string]byte, len(client.subscriptions))
+		for filter, qos := range client.subscriptions {
+			subscriptions[filter] = qos
+		}
+		result.Clients = append(result.Clients, BrokerClientDebug{
+			ID:            client.id,
+			RemoteAddress: client.conn.RemoteAddr().String(),
+			ConnectedAt:   client.connectedAt,
+			Subscriptions: subscriptions,
+		})
+	}
+	sort.Slice(result.Clients, func(i, j int) bool { return result.Clients[i].ID < result.Clients[j].ID })
+	return result
+}
+
+// scheduleRetainedSave requires the broker lock to be held.
+func (b *Broker) scheduleRetainedSave() {
+	if b.config.RetainedFile == "" || b.saveTimer != nil || b.closed {
+		return
+	}
+	b.saveTimer = time.AfterFunc(brokerRetainedSaveDelay, func() {
+		b.mu.Lock()
+		b.saveTimer = nil
+		b.mu.Unlock()
+		if err := b.saveRetained(); err != nil {
+			slog.Error("Could not save retained messages", "retainedFile", b.config.RetainedFile, "error", err)
+		}
+	})
+}
+
+func (b *Broker) saveRetained() error {
+	if b.config.RetainedFile == "" {
+		return nil
+	}
+	b.mu.Lock()
+	messages := make([]brokerMessage, 0, len(b.retained))
+	for _, msg := range b.retained {
+		messages = append(messages, msg)
+	}
+	b.mu.Unlock()
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Topic < messages[j].Topic })
+
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.config.RetainedFile, data)
+}
+
+func (b *Broker) loadRetained() error {
+	if b.config.RetainedFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.config.RetainedFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var messages []brokerMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		msg.Retain = true
+		b.retained[msg.Topic] = msg
+	}
+	return nil
+}
+
+// Packet encoding
+
+type brokerPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readBrokerPacket(reader *bufio.Reader) (brokerPacket, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return brokerPacket{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return brokerPacket{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return brokerPacket{}, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > maxBrokerPacketSize {
+		return brokerPacket{}, fmt.Errorf("packet of %d bytes exceeds max size", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return brokerPacket{}, err
+	}
+	return brokerPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func encodeBrokerPacket(kind, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func encodeBrokerString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func packetIDBytes(id uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, id)
+}
+
+// packetReader reads the fields of a packet body. The first error sticks and
+// later reads return zero values.
+type packetReader struct {
+	body []byte
+	err  error
+}
+
+func (r *packetReader) remaining() int { return len(r.body) }
+
+func (r *packetReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.body) < n {
+		r.err = errors.New("packet too short")
+		return nil
+	}
+	b := r.body[:n]
+	r.body = r.body[n:]
+	return b
+}
+
+func (r *packetReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *packetReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *packetReader) binary() []byte {
+	return r.bytes(int(r.uint16()))
+}
+
+func (r *packetReader) string() string {
+	return string(r.binary())
+}
+
+type connectPacket struct {
+	clientID   string
+	keepAlive  time.Duration
+	userName   string
+	password   string
+	will       *brokerMessage
+	returnCode byte
+}
+
+func parseConnect(body []byte) (connectPacket, error) {
+	r := packetReader{body: body}
+	protocol := r.string()
+	level := r.byte()
+	flags := r.byte()
+	keepAlive := r.uint16()
+	connect := connectPacket{keepAlive: time.Duration(keepAlive) * time.Second}
+	if r.err != nil {
+		return connect, r.err
+	}
+	if !(protocol == "MQTT" && level == 4) && !(protocol == "MQIsdp" && level == 3) {
+		connect.returnCode = connackUnacceptableVersion
+		return connect, nil
+	}
+
+	connect.clientID = r.string()
+	if flags&0x04 != 0 {
+		connect.will = &brokerMessage{
+			Topic:  r.string(),
+			Qos:    min((flags>>3)&0x03, 2),
+			Retain: flags&0x20 != 0,
+		}
+		connect.will.Payload = append([]byte{}, r.binary()...)
+	}
+	if flags&0x80 != 0 {
+		connect.userName = r.string()
+	}
+	if flags&0x40 != 0 {
+		connect.password = string(r.binary())
+	}
+	return connect, r.err
+}
+
+func parsePublish(packet brokerPacket) (brokerMessage, uint16, error) {
+	r := packetReader{body: packet.body}
+	msg := brokerMessage{
+		Topic:  r.string(),
+		Qos:    (packet.flags >> 1) & 0x03,
+		Retain: packet.flags&0x01 != 0,
+	}
+	var packetID uint16
+	if msg.Qos > 0 {
+		packetID = r.uint16()
+	}
+	if r.err != nil {
+		return msg, 0, r.err
+	}
+	if msg.Qos > 2 {
+		return msg, 0, errors.New("invalid QoS 3")
+	}
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "#+") {
+		return msg, 0, fmt.Errorf("invalid topic %q", msg.Topic)
+	}
+	msg.Payload = r.body
+	return msg, packetID, nil
+}
+
+func parsePacketID(body []byte) (uint16, error) {
+	r := packetReader{body: body}
+	id := r.uint16()
+	return id, r.err
+}
@@ -0,0 +1,202 @@
+package regelverk
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func startTestBroker(t *testing.T, config BrokerConfig) *Broker {
+	t.Helper()
+	config.ListenAddress = "127.0.0.1:0"
+	broker := NewBroker(config, MetricsConfig{})
+	if err := broker.Start(); err != nil {
+		t.Fatalf("could not start broker: %v", err)
+	}
+	return broker
+}
+
+func connectTestClient(t *testing.T, broker *Broker, id string, configure func(*mqtt.ClientOptions)) (mqtt.Client, error) {
+	t.Helper()
+	opts := mqtt.NewClientOptions().AddBroker(broker.ClientURL()).SetClientID(id).
+		SetAutoReconnect(false).SetConnectTimeout(5 * time.Second)
+	if configure != nil {
+		configure(opts)
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+type receivedMessages struct {
+	mu       sync.Mutex
+	messages []string
+	retained []bool
+}
+
+func (r *receivedMessages) handle(_ mqtt.Client, m mqtt.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m.Topic()+" "+string(m.Payload()))
+	r.retained = append(r.retained, m.Retained())
+}
+
+func (r *receivedMessages) get() ([]string, []bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.messages...), append([]bool{}, r.retained...)
+}
+
+func TestBrokerRoutesAndRetains(t *testing.T) {
+	retainedFile := filepath.Join(t.TempDir(), "retained.json")
+	broker := startTestBroker(t, BrokerConfig{RetainedFile: retainedFile})
+
+	subscriber, err := connectTestClient(t, broker, "subscriber", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer subscriber.Disconnect(0)
+	var received receivedMessages
+	if token := subscriber.Subscribe("zigbee2mqtt/+", 2, received.handle); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	publisher, err := connectTestClient(t, broker, "publisher", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		publisher.Publish("zigbee2mqtt/lamp", qos, false, []byte{'0' + qos}).Wait()
+	}
+	publisher.Publish("zigbee2mqtt/lamp/set", 1, false, "not matched").Wait()
+	publisher.Publish("zigbee2mqtt/blinds", 1, true, `{"state": "OPEN"}`).Wait()
+	publisher.Disconnect(100)
+
+	waitFor(t, func() bool {
+		messages, _ := received.get()
+		return len(messages) == 4
+	})
+	messages, _ := received.get()
+	want := []string{"zigbee2mqtt/lamp 0", "zigbee2mqtt/lamp 1", "zigbee2mqtt/lamp 2", `zigbee2mqtt/blinds {"state": "OPEN"}`}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Errorf("message %d: got %q, want %q", i, messages[i], want[i])
+		}
+	}
+
+	// Retained messages survive a restart and are delivered on subscribe
+	subscriber.Disconnect(100)
+	broker.Close()
+	broker = startTestBroker(t, BrokerConfig{RetainedFile: retainedFile})
+	defer broker.Close()
+
+	late, err := connectTestClient(t, broker, "late", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer late.Disconnect(0)
+	var lateReceived receivedMessages
+	late.Subscribe("#", 1, lateReceived.handle).Wait()
+	waitFor(t, func() bool {
+		messages, _ := lateReceived.get()
+		return len(messages) == 1
+	})
+	messages, retained := lateReceived.get()
+	if messages[0] != `zigbee2mqtt/blinds {"state": "OPEN"}` || !retained[0] {
+		t.Errorf("expected retained blinds state, got %q retained %v", messages, retained)
+	}
+}
+
+func TestBrokerRequiresLogin(t *testing.T) {
+	broker := startTestBroker(t, BrokerConfig{UserName: "regelverk", Password: "secret"})
+	defer broker.Close()
+
+	if _, err := connectTestClient(t, broker, "anonymous", nil); err == nil {
+		t.Errorf("expected connection without credentials to be refused")
+	}
+	client, err := connectTestClient(t, broker, "spoke", func(opts *mqtt.ClientOptions) {
+		opts.SetUsername("regelverk").SetPassword("secret")
+	})
+	if err != nil {
+		t.Fatalf("expected connection with credentials, got %v", err)
+	}
+	client.Disconnect(0)
+}
+
+func TestStartBrokerRequiresReadablePassword(t *testing.T) {
+	dir := t.TempDir()
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, passwordFile := range []string{filepath.Join(dir, "missing"), emptyFile} {
+		config := Config{BrokerListenAddress: "127.0.0.1:0", MQTTUserName: "regelverk", MQTTPasswordFile: passwordFile}
+		if broker, err := startBroker(&config, MetricsConfig{}); err == nil {
+			broker.Close()
+			t.Errorf("%s: expected the broker not to start", passwordFile)
+		}
+	}
+}
+
+func TestBrokerPublishesWillOnConnectionLoss(t *testing.T) {
+	broker := startTestBroker(t, BrokerConfig{})
+	defer broker.Close()
+
+	subscriber, err := connectTestClient(t, broker, "subscriber", nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer subscriber.Disconnect(0)
+	var received receivedMessages
+	subscriber.Subscribe("spoke/status", 1, received.handle).Wait()
+
+	// A raw connection that goes away without DISCONNECT
+	conn, err := net.Dial("tcp", broker.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := encodeBrokerString("MQTT")
+	body = append(body, 4, 0x04|0x02, 0, 0) // will flag, clean session, no keep alive
+	body = append(body, encodeBrokerString("spoke")...)
+	body = append(body, encodeBrokerString("spoke/status")...)
+	body = append(body, encodeBrokerString("offline")...)
+	conn.Write(encodeBrokerPacket(packetConnect, 0, body))
+	connack := make([]byte, 4)
+	if _, err := conn.Read(connack); err != nil || connack[3] != connackAccepted {
+		t.Fatalf("expected CONNACK, got %v %v", connack, err)
+	}
+	conn.Close()
+
+	waitFor(t, func() bool {
+		messages, _ := received.get()
+		return len(messages) == 1 && messages[0] == "spoke/status offline"
+	})
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	tests := map[string]bool{
+		"#":              true,
+		"zigbee2mqtt/+":  true,
+		"a/+/c/#":        true,
+		"":               false,
+		"a/#/c":          false,
+		"a/b#":           false,
+		"zigbee2mqtt/a+": false,
+	}
+	for filter, want := range tests {
+		if got := validTopicFilter(filter); got != want {
+			t.Errorf("validTopicFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+	if matchSubscription("#", "$SYS/uptime") {
+		t.Errorf("expected # not to match $ topics")
+	}
+}
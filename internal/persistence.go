@@ -0,0 +1,297 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/qmuntal/stateless"
+)
+
+// persistedState is the on-disk snapshot of the StateValueMap and the
+// controllers' state machine states.
+type persistedState struct {
+	SavedAt     time.Time                        `json:"savedAt"`
+	StateValues map[StateKey]persistedStateValue `json:"stateValues"`
+	History     map[StateKey][]StateTransition   `json:"history,omitempty"`
+	// State machine states by name, as the order of states may change
+	// between versions or, for config-defined state machines, config files
+	ControllerStates map[string]string `json:"controllerStates"`
+}
+
+type persistedStateValue struct {
+	// Empty for booleans
+	Kind         string    `json:"kind,omitempty"`
+	Value        bool      `json:"value"`
+	Number       float64   `json:"number,omitempty"`
+	Text         string    `json:"text,omitempty"`
+	LastUpdate   time.Time `json:"lastUpdate"`
+	LastChange   time.Time `json:"lastChange"`
+	LastSetTrue  time.Time `json:"lastSetTrue"`
+	LastSetFalse time.Time `json:"lastSetFalse"`
+}
+
+func (s *StateValueMap) persistedSnapshot() map[StateKey]persistedStateValue {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[StateKey]persistedStateValue, len(s.svMap))
+	for key, stateValue := range s.svMap {
+		persisted := persistedStateValue{
+			Value:        stateValue.value,
+			Number:       stateValue.number,
+			Text:         stateValue.text,
+			LastUpdate:   stateValue.lastUpdate,
+			LastChange:   stateValue.lastChange,
+			LastSetTrue:  stateValue.lastSetTrue,
+			LastSetFalse: stateValue.lastSetFalse,
+		}
+		if stateValue.kind != BoolValue {
+			persisted.Kind = stateValue.kind.String()
+		}
+		snapshot[key] = persisted
+	}
+	return snapshot
+}
+
+func (s *StateValueMap) persistedHistory() map[StateKey][]StateTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := make(map[StateKey][]StateTransition, len(s.history))
+	for key, keyHistory := range s.history {
+		history[key] = keyHistory.transitions()
+	}
+	return history
+}
+
+// restorePersisted adds persisted values that were updated within maxAge,
+// with their history. Older entries are left undefined. Values already
+// present are not overwritten. Returns the number of restored entries.
+func (s *StateValueMap) restorePersisted(values map[StateKey]persistedStateValue,
+	history map[StateKey][]StateTransition, maxAge time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := nowFunc()
+	restored := 0
+	for key, value := range values {
+		if maxAge > 0 && now.Sub(value.LastUpdate) > maxAge {
+			continue
+		}
+		if _, exists := s.svMap[key]; exists {
+			continue
+		}
+		kind := BoolValue
+		if value.Kind != "" {
+			var err error
+			if kind, err = parseStateValueKind(value.Kind); err != nil {
+				slog.Warn("Skipping persisted state value", "key", key, "error", err)
+				continue
+			}
+		}
+		stateValue := StateValue{
+			kind:         kind,
+			value:        value.Value,
+			number:       value.Number,
+			text:         value.Text,
+			isDefined:    true,
+			lastUpdate:   value.LastUpdate,
+			lastChange:   value.LastChange,
+			lastSetTrue:  value.LastSetTrue,
+			lastSetFalse: value.LastSetFalse,
+		}
+		s.svMap[key] = stateValue
+		if transitions, found := history[key]; found {
+			for _, transition := range transitions {
+				s.recordTransitionUnsafe(key, transition)
+			}
+		} else {
+			s.recordTransitionUnsafe(key, StateTransition{At: value.LastChange, Value: stateValue.Value()})
+		}
+		restored++
+	}
+	return restored
+}
+
+// restoredStates holds the persisted controller states until each
+// controller has taken its own when initialized.
+type restoredStates struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func (r *restoredStates) set(states map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = states
+}
+
+// take returns the name of the restored state of a controller and forgets
+// it, so that a controller initialized again starts from its default state
+func (r *restoredStates) take(controller string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, found := r.states[controller]
+	delete(r.states, controller)
+	return name, found
+}
+
+func (r *restoredStates) drop(controller string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.states, controller)
+}
+
+func (r *restoredStates) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.states)
+}
+
+// snapshotState reads the state of the engine. A controller whose lock is not
+// available before ctx is done, e.g. one stuck in an event, is left out.
+func (masterController *MasterController) snapshotState(ctx context.Context) persistedState {
+	masterController.mu.Lock()
+	var controllers []Controller
+	if masterController.controllers != nil {
+		controllers = *masterController.controllers
+	}
+	masterController.mu.Unlock()
+
+	controllerStates := make(map[string]string)
+	for _, controller := range controllers {
+		// The workers fire the state machines under the controller lock
+		if !lockWithin(ctx, controller) {
+			slog.Warn("Controller busy, not saving its state", "controller", controllerName(controller))
+			continue
+		}
+		debugState := controller.DebugState()
+		controller.Unlock()
+		if debugState.StateMachineStateText != "" && debugState.Name != "" {
+			controllerStates[debugState.Name] = debugState.StateMachineStateText
+		}
+	}
+	return persistedState{
+		SavedAt:          nowFunc(),
+		StateValues:      masterController.stateValueMap.persistedSnapshot(),
+		History:          masterController.stateValueMap.persistedHistory(),
+		ControllerStates: controllerStates,
+	}
+}
+
+func (masterController *MasterController) saveState(ctx context.Context) error {
+	stateFile := masterController.config.StateFile
+	if stateFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(masterController.snapshotState(ctx), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(stateFile, data)
+}
+
+// writeFileAtomic writes to a temporary file first so that a crash never
+// leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// restoreState loads a previously saved snapshot, if any. Must be called
+// before controllers are initialized.
+func (masterController *MasterController) restoreState() error {
+	stateFile := masterController.config.StateFile
+	if stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		slog.Info("No persisted state found", "stateFile", stateFile)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var persisted persistedState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return fmt.Errorf("could not parse state file %s: %w", stateFile, err)
+	}
+
+	maxAge := masterController.config.StateMaxAge
+	restored := masterController.stateValueMap.restorePersisted(persisted.StateValues, persisted.History, maxAge)
+
+	if maxAge <= 0 || nowFunc().Sub(persisted.SavedAt) <= maxAge {
+		masterController.restoredControllerStates.set(persisted.ControllerStates)
+	}
+	slog.Info("Restored persisted state", "stateFile", stateFile, "savedAt", persisted.SavedAt,
+		"stateValues", restored, "controllers", masterController.restoredControllerStates.len())
+	return nil
+}
+
+// runStatePersistence saves the state periodically until ctx is cancelled.
+// The last save is made by shutdown, once the controllers have stopped.
+func (masterController *MasterController) runStatePersistence(ctx context.Context) {
+	defer masterController.persistenceWorker.Done()
+	if masterController.config.StateFile == "" {
+		return
+	}
+	interval := masterController.config.StateSaveInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := masterController.saveState(ctx); err != nil {
+				slog.Error("Could not save state", "stateFile", masterController.config.StateFile, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restoredInitialState returns the persisted state machine state for this
+// controller if it is one of states, the states the machine is configured
+// with, otherwise defaultState. States are looked up by name and the
+// persisted state is only used by the first Initialize. The state is not
+// entered, so controllers with timers must arm them for a restored state
+// themselves.
+func (c *BaseController) restoredInitialState(defaultState stateless.State, states ...stateless.State) stateless.State {
+	name, found := c.masterController.restoredControllerStates.take(c.Name)
+	if !found {
+		return defaultState
+	}
+	i := slices.IndexFunc(states, func(state stateless.State) bool { return fmt.Sprint(state) == name })
+	if i < 0 {
+		slog.Info("Dropping restored state not in the state machine", "fsm", c.Name, "state", name)
+		return defaultState
+	}
+	slog.Info("Restored state machine state", "fsm", c.Name, "state", name)
+	return states[i]
+}
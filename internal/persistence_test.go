@@ -0,0 +1,88 @@
+package regelverk
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistStateRoundTrip(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	masterController := CreateMasterController()
+	masterController.config.StateFile = stateFile
+	seedTrue(&masterController.stateValueMap, "livingroomPresence", 5*time.Minute)
+	seedFalse(&masterController.stateValueMap, "livingroomPresence", 1*time.Minute)
+	seedTrue(&masterController.stateValueMap, "staleKey", 3*time.Hour)
+
+	masterController.stateValueMap.setState("fridgeDoorOpen", true)
+	door := &DoorReminderController{BaseController: BaseController{Name: "fridgedoor"},
+		StateOpenKey: "fridgeDoorOpen", OpenLongLimit: time.Hour, ReminderPeriod: time.Hour}
+	door.Initialize(&masterController)
+	door.StateMachineFire("mqttEvent", MQTTEvent{})
+	masterController.controllers = &[]Controller{door}
+
+	if err := masterController.saveState(context.Background()); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	restored := CreateMasterController()
+	restored.config.StateFile = stateFile
+	restored.config.StateMaxAge = 1 * time.Hour
+	if err := restored.restoreState(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	if !restored.stateValueMap.recentlyTrue("livingroomPresence", 10*time.Minute) {
+		t.Error(stateErrorString("restored key should keep its timestamps", &restored.stateValueMap, "livingroomPresence"))
+	}
+	if restored.stateValueMap.continuouslyFalse("livingroomPresence", 2*time.Minute) {
+		t.Error(stateErrorString("restored key should keep its timestamps", &restored.stateValueMap, "livingroomPresence"))
+	}
+	if _, exists := restored.stateValueMap.getState("staleKey"); exists {
+		t.Error("entries older than max age should be left undefined")
+	}
+	restoredDoor := &DoorReminderController{BaseController: BaseController{Name: "fridgedoor"},
+		StateOpenKey: "fridgeDoorOpen", OpenLongLimit: time.Hour, ReminderPeriod: time.Hour}
+	restoredDoor.Initialize(&restored)
+	if state := restoredDoor.stateMachine.MustState(); state != doorOpen {
+		t.Errorf("expected controller state %v to be restored, got %v", doorOpen, state)
+	}
+	if timers := restoredDoor.stateTimersDebug(); len(timers) != 1 || timers[0].Trigger != "openLongTimer" {
+		t.Errorf("expected the open long timer to be armed in the restored state, got %v", timers)
+	}
+
+	// The restored state is only used once, e.g. not when re-initialized after a panic
+	restoredDoor.resetInitialized()
+	restoredDoor.Initialize(&restored)
+	if state := restoredDoor.stateMachine.MustState(); state != doorClosed {
+		t.Errorf("expected a re-initialized controller to start in %v, got %v", doorClosed, state)
+	}
+	if timers := restoredDoor.stateTimersDebug(); len(timers) != 0 {
+		t.Errorf("expected no timers in the initial state, got %v", timers)
+	}
+}
+
+func TestRestoredStateMustBeConfigured(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		want  blindsState
+	}{
+		{"by name", "bedroomBlindsStateClosed", bedroomBlindsStateClosed},
+		{"unknown name", "bedroomBlindsStateHalfOpen", bedroomBlindsStateOpen},
+		{"out of range", "blindsState(7)", bedroomBlindsStateOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			masterController := CreateMasterController()
+			masterController.restoredControllerStates.set(map[string]string{"bedroom": tt.state})
+			controller := &BedroomController{}
+			controller.Initialize(&masterController)
+			if state := controller.stateMachine.MustState(); state != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package regelverk
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PublishScheduler keeps track of delayed publishes (MQTTPublish with Wait > 0)
+// so that they can be listed and cancelled before they are sent.
+type PublishScheduler struct {
+	mu          sync.Mutex
+	nextID      uint64
+	pending     map[uint64]*scheduledPublish
+	publishFunc func(controller string, client mqtt.Client, p MQTTPublish)
+}
+
+type scheduledPublish struct {
+	id          uint64
+	controller  string
+	client      mqtt.Client
+	publish     MQTTPublish
+	scheduledAt time.Time
+	dueAt       time.Time
+	timer       afterTimer
+}
+
+// ScheduledPublishDebug is a JSON-friendly view of a pending delayed publish.
+type ScheduledPublishDebug struct {
+	ID          uint64    `json:"id"`
+	Controller  string    `json:"controller"`
+	Topic       string    `json:"topic"`
+	Payload     any       `json:"payload"`
+	ScheduledAt time.Time `json:"scheduledAt"`
+	DueAt       time.Time `json:"dueAt"`
+}
+
+// NewPublishScheduler returns a scheduler that hands due publishes to
+// publishFunc along with the name of the controller that scheduled them.
+func NewPublishScheduler(publishFunc func(controller string, client mqtt.Client, p MQTTPublish)) *PublishScheduler {
+	return &PublishScheduler{
+		pending:     make(map[uint64]*scheduledPublish),
+		publishFunc: publishFunc,
+	}
+}
+
+// Schedule publishes p after p.Wait on behalf of the named controller and
+// returns an id that can be used to cancel it.
+func (s *PublishScheduler) Schedule(controller string, client mqtt.Client, p MQTTPublish) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := s.nextID
+	now := nowFunc()
+	entry := &scheduledPublish{
+		id:          id,
+		controller:  controller,
+		client:      client,
+		publish:     p,
+		scheduledAt: now,
+		dueAt:       now.Add(p.Wait),
+	}
+	entry.timer = afterFunc(p.Wait, func() { s.fire(id) })
+	s.pending[id] = entry
+	return id
+}
+
+func (s *PublishScheduler) fire(id uint64) {
+	s.mu.Lock()
+	entry, exists := s.pending[id]
+	if exists {
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+
+	if exists {
+		s.publishFunc(entry.controller, entry.client, entry.publish)
+	}
+}
+
+// next returns the pending publish that is due first
+func (s *PublishScheduler) next() (uint64, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first *scheduledPublish
+	for _, entry := range s.pending {
+		if first == nil || entry.dueAt.Before(first.dueAt) || (entry.dueAt.Equal(first.dueAt) && entry.id < first.id) {
+			first = entry
+		}
+	}
+	if first == nil {
+		return 0, time.Time{}, false
+	}
+	return first.id, first.dueAt, true
+}
+
+// Cancel removes a single pending publish. Returns false if it was already
+// sent or cancelled.
+func (s *PublishScheduler) Cancel(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.pending[id]
+	if !exists {
+		return false
+	}
+	entry.timer.Stop()
+	delete(s.pending, id)
+	return true
+}
+
+// CancelController removes all pending publishes scheduled by the named
+// controller and returns how many were cancelled.
+func (s *PublishScheduler) CancelController(controller string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cancelled := 0
+	for id, entry := range s.pending {
+		if entry.controller == controller {
+			entry.timer.Stop()
+			delete(s.pending, id)
+			cancelled++
+		}
+	}
+	if cancelled > 0 {
+		slog.Debug("Cancelled scheduled publishes", "controller", controller, "count", cancelled)
+	}
+	return cancelled
+}
+
+// Pending returns the pending publishes ordered by due time.
+func (s *PublishScheduler) Pending() []ScheduledPublishDebug {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]ScheduledPublishDebug, 0, len(s.pending))
+	for _, entry := range s.pending {
+		result = append(result, ScheduledPublishDebug{
+			ID:          entry.id,
+			Controller:  entry.controller,
+			Topic:       entry.publish.Topic,
+			Payload:     entry.publish.Payload,
+			ScheduledAt: entry.scheduledAt,
+			DueAt:       entry.dueAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DueAt.Equal(result[j].DueAt) {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].DueAt.Before(result[j].DueAt)
+	})
+	return result
+}
+
+// Drain removes all pending publishes and returns them ordered by due time.
+// If flush is true they are sent right away instead of being dropped.
+func (s *PublishScheduler) Drain(flush bool) []ScheduledPublishDebug {
+	s.mu.Lock()
+	var entries []*scheduledPublish
+	for id, entry := range s.pending {
+		entry.timer.Stop()
+		delete(s.pending, id)
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].dueAt.Equal(entries[j].dueAt) {
+			return entries[i].id < entries[j].id
+		}
+		return entries[i].dueAt.Before(entries[j].dueAt)
+	})
+	result := make([]ScheduledPublishDebug, 0, len(entries))
+	for _, entry := range entries {
+		if flush {
+			s.publishFunc(entry.controller, entry.client, entry.publish)
+		}
+		result = append(result, ScheduledPublishDebug{
+			ID:          entry.id,
+			Controller:  entry.controller,
+			Topic:       entry.publish.Topic,
+			Payload:     entry.publish.Payload,
+			ScheduledAt: entry.scheduledAt,
+			DueAt:       entry.dueAt,
+		})
+	}
+	return result
+}
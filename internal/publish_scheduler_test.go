@@ -0,0 +1,51 @@
+package regelverk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPublishSchedulerCancelController(t *testing.T) {
+	var mu sync.Mutex
+	var published []string
+	scheduler := NewPublishScheduler(func(_ string, _ mqtt.Client, p MQTTPublish) {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, p.Topic)
+	})
+
+	scheduler.Schedule("tv", nil, MQTTPublish{Topic: "tv/1", Wait: 20 * time.Millisecond})
+	scheduler.Schedule("tv", nil, MQTTPublish{Topic: "tv/2", Wait: 30 * time.Millisecond})
+	keep := scheduler.Schedule("kitchen", nil, MQTTPublish{Topic: "kitchen/1", Wait: 20 * time.Millisecond})
+
+	pending := scheduler.Pending()
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 pending publishes, got %d", len(pending))
+	}
+
+	if cancelled := scheduler.CancelController("tv"); cancelled != 2 {
+		t.Errorf("expected 2 cancelled publishes, got %d", cancelled)
+	}
+	if len(scheduler.Pending()) != 1 || scheduler.Pending()[0].ID != keep {
+		t.Errorf("expected only kitchen publish to remain pending, got %v", scheduler.Pending())
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(published) > 0
+	})
+	time.Sleep(30 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 1 || published[0] != "kitchen/1" {
+		t.Errorf("expected only kitchen/1 to be published, got %v", published)
+	}
+	if scheduler.Cancel(keep) {
+		t.Error("cancelling an already published entry should return false")
+	}
+}
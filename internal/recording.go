@@ -0,0 +1,216 @@
+package regelverk
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Directions of recorded messages
+const (
+	recordedIn  = "in"
+	recordedOut = "out"
+)
+
+// recordedMessage is one line of a recording. Keys are kept short since
+// every MQTT message ends up in the file.
+type recordedMessage struct {
+	Time      int64  `json:"t"` // Unix nanoseconds
+	Direction string `json:"d"`
+	Topic     string `json:"k"`
+	Payload   string `json:"p,omitempty"`
+	Base64    bool   `json:"b,omitempty"` // Payload is base64 encoded binary
+	Qos       byte   `json:"q,omitempty"`
+	Retained  bool   `json:"r,omitempty"`
+}
+
+func encodeRecordedPayload(payload any) (string, bool) {
+	switch p := payload.(type) {
+	case []byte:
+		if utf8.Valid(p) {
+			return string(p), false
+		}
+		return base64.StdEncoding.EncodeToString(p), true
+	case string:
+		return p, false
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(p), false
+	}
+}
+
+func (msg recordedMessage) payload() ([]byte, error) {
+	if msg.Base64 {
+		return base64.StdEncoding.DecodeString(msg.Payload)
+	}
+	return []byte(msg.Payload), nil
+}
+
+func (msg recordedMessage) time() time.Time {
+	return time.Unix(0, msg.Time)
+}
+
+// Recorder appends incoming events and outgoing publishes to a file, one JSON
+// object per line. When the file grows beyond maxSize it is rotated to
+// <path>.1, <path>.2 and so on, keeping at most keep old files.
+type Recorder struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+	closed  bool
+}
+
+func NewRecorder(path string, maxSize int64, keep int) (*Recorder, error) {
+	recorder := &Recorder{path: path, maxSize: maxSize, keep: keep}
+	if err := recorder.open(); err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *Recorder) recordEvent(ev MQTTEvent) {
+	payload, binary := encodeRecordedPayload(ev.Payload)
+	r.write(recordedMessage{
+		Time:      ev.Timestamp.UnixNano(),
+		Direction: recordedIn,
+		Topic:     ev.Topic,
+		Payload:   payload,
+		Base64:    binary,
+	})
+}
+
+func (r *Recorder) recordPublish(p MQTTPublish, at time.Time) {
+	payload, binary := encodeRecordedPayload(p.Payload)
+	r.write(recordedMessage{
+		Time:      at.UnixNano(),
+		Direction: recordedOut,
+		Topic:     p.Topic,
+		Payload:   payload,
+		Base64:    binary,
+		Qos:       p.Qos,
+		Retained:  p.Retained,
+	})
+}
+
+func (r *Recorder) write(msg recordedMessage) {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Could not marshal recorded message", "topic", msg.Topic, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.file == nil {
+		// Left without a file by a failed rotation
+		if err := r.open(); err != nil {
+			slog.Error("Could not reopen recording", "recordFile", r.path, "error", err)
+			return
+		}
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			slog.Error("Could not rotate recording", "recordFile", r.path, "error", err)
+		}
+		if r.file == nil {
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		slog.Error("Could not write recording", "recordFile", r.path, "error", err)
+	}
+}
+
+// rotate requires the recorder lock to be held. If the file cannot be
+// rotated, recording continues in the current file.
+func (r *Recorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		slog.Warn("Could not close recording before rotation", "recordFile", r.path, "error", err)
+	}
+	r.file = nil
+	if r.keep > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return errors.Join(err, r.open())
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return errors.Join(err, r.open())
+	}
+	slog.Info("Rotated recording", "recordFile", r.path)
+	return r.open()
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// readRecording calls fn for each message of the recording at path, in file
+// order.
+func readRecording(path string, fn func(recordedMessage) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
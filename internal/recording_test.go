@@ -0,0 +1,140 @@
+package regelverk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorderRoundTripAndRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path, 200, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	at := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	recorder.recordEvent(MQTTEvent{Timestamp: at, Topic: "zigbee2mqtt/b1", Payload: []byte(`{"battery": 20}`)})
+	recorder.recordEvent(MQTTEvent{Timestamp: at, Topic: "binary", Payload: []byte{0xff, 0x00}})
+	recorder.recordPublish(MQTTPublish{Topic: "zigbee2mqtt/lamp/set", Payload: `{"state": "ON"}`, Qos: 2, Retained: true}, at)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []recordedMessage
+	for _, file := range []string{path + ".1", path} {
+		if err := readRecording(file, func(msg recordedMessage) error {
+			messages = append(messages, msg)
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error reading %s: %v", file, err)
+		}
+	}
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages across rotated files, got %+v", messages)
+	}
+	if !messages[0].time().Equal(at) || messages[0].Direction != recordedIn || messages[0].Payload != `{"battery": 20}` {
+		t.Errorf("unexpected first message %+v", messages[0])
+	}
+	if payload, err := messages[1].payload(); err != nil || !bytes.Equal(payload, []byte{0xff, 0x00}) {
+		t.Errorf("binary payload not preserved: %v, %v", payload, err)
+	}
+	if out := messages[2]; out.Direction != recordedOut || out.Qos != 2 || !out.Retained {
+		t.Errorf("unexpected publish message %+v", out)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 rotated files")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+controllers:
+  - type: livingroom
+  - type: batteryreminder
+    name: b1
+    stateBatteryPoorKey: b1Low
+    reminderPeriod: 1h
+    reminderTopic: t
+stateRules:
+  - topic: zigbee2mqtt/b1
+    path: battery
+    compare: lt
+    value: 30
+    key: b1Low
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	recorder.recordEvent(MQTTEvent{Timestamp: at, Topic: "zigbee2mqtt/b1", Payload: []byte(`{"battery": 80}`)})
+	recorder.recordPublish(MQTTPublish{Topic: "original/publish"}, at)
+	recorder.recordEvent(MQTTEvent{Timestamp: at.Add(3 * time.Minute), Topic: "zigbee2mqtt/b1", Payload: []byte(`{"battery": 20}`)})
+	recorder.recordEvent(MQTTEvent{Timestamp: at.Add(time.Hour), Topic: "zigbee2mqtt/b1", Payload: []byte(`{"battery": 10}`)})
+	recorder.Close()
+
+	before := nowFunc()
+	var out bytes.Buffer
+	err = Replay(Config{Setup: setup}, []string{path},
+		ReplayOptions{ShowRecorded: true, Until: at.Add(30 * time.Minute)}, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nowFunc().Before(before) {
+		t.Errorf("nowFunc not restored after replay")
+	}
+
+	output := out.String()
+	for _, want := range []string{
+		"2026-10-17T03:00:00Z publish    livingroom zigbee2mqtt/livingroom-floorlamp/get",
+		"2026-10-17T03:00:00Z recorded   original/publish",
+		"2026-10-17T03:00:00Z transition b1 (uninitialized) -> batteryGood",
+		"2026-10-17T03:03:00Z transition b1 batteryGood -> batteryPoor",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("missing %q in replay output:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "04:00:00") {
+		t.Errorf("expected replay to stop at until, got:\n%s", output)
+	}
+}
+
+func TestRecorderContinuesAfterFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	// A non-empty directory in the way of the rotated file
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := NewRecorder(path, 100, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	at := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	for _, topic := range []string{"first", "second", "third"} {
+		recorder.recordEvent(MQTTEvent{Timestamp: at, Topic: topic, Payload: []byte(`{"state": "ON"}`)})
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var topics []string
+	if err := readRecording(path, func(msg recordedMessage) error {
+		topics = append(topics, msg.Topic)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(topics, ",") != "first,second,third" {
+		t.Fatalf("expected recording to continue in the current file, got %v", topics)
+	}
+}
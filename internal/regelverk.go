@@ -19,8 +19,15 @@ import (
 
 type Config struct {
 	BluetoothAddress    string
+	BrokerListenAddress string
+	BrokerRetainedFile  string
 	CollectMetrics      bool
 	CollectDebugMetrics bool
+	CommandFailureTopic string
+	ConfigFile          string
+	ControllerQueueSize int
+	DryRun              bool
+	FlushOnShutdown     bool
 	HIDVendorID         string
 	HIDProductID        string
 	MetricsAddress      string
@@ -32,13 +39,24 @@ type Config struct {
 	MQTTTopicPrefix     string
 	MQTTUserName        string
 	Pulseserver         string
+	RecordFile          string
+	RecordKeep          int
+	RecordMaxSize       int64
+	ReinitializeOnPanic bool
 	RotelSerialPort     string
 	RouterAddress       string
 	RouterPasswordFile  string
 	RouterUsername      string
 	SamsungTvAddress    string
+	Setup               *SetupConfig
+	ShutdownTimeout     time.Duration
 	SnapcastServer      string
+	StateFile           string
+	StateMaxAge         time.Duration
+	StateSaveInterval   time.Duration
 	TelegramTokenFile   string
+	WatchdogThreshold   time.Duration
+	WatchdogTopic       string
 	WebAddress          string
 }
 
@@ -54,6 +72,8 @@ type MQTTPublish struct {
 	Retained bool
 	Payload  interface{}
 	Wait     time.Duration
+	// Optional state the device is expected to report, verified and retried
+	Expect *ExpectedState
 }
 
 func (masterController *MasterController) handle(_ mqtt.Client, m mqtt.Message) {
@@ -64,6 +84,9 @@ func (masterController *MasterController) handle(_ mqtt.Client, m mqtt.Message)
 		Payload:   m.Payload(),
 	}
 
+	if masterController.recorder != nil {
+		masterController.recorder.recordEvent(ev)
+	}
 	masterController.ProcessEvent(masterController.mqttClient, ev)
 
 	if masterController.metricsConfig.CollectDebugMetrics {
@@ -79,14 +102,9 @@ func setupMQTTClient(config Config, masterController *MasterController) error {
 		return err
 	}
 
-	mqttPassword := ""
-	if len(config.MQTTPasswordFile) > 0 {
-		mqttPassword, err := fileToString(config.MQTTPasswordFile)
-		if err != nil {
-			slog.Error("Error reading MQTT password",
-				"mqttPasswordFile", config.MQTTPasswordFile, "error", err)
-		}
-		slog.Debug("MQTT password", "password", mqttPassword)
+	mqttPassword, err := readMQTTPassword(config)
+	if err != nil {
+		slog.Error("Error reading MQTT password", "mqttPasswordFile", config.MQTTPasswordFile, "error", err)
 	}
 
 	opts := mqtt.NewClientOptions().
@@ -129,7 +147,45 @@ func setupMQTTClient(config Config, masterController *MasterController) error {
 	return nil
 }
 
-func runRegelverk(ctx context.Context, config Config, bridgeWrappers *[]BridgeWrapper, controllers *[]Controller) error {
+// readMQTTPassword returns an empty password if no password file is
+// configured. A configured file must be readable and not empty.
+func readMQTTPassword(config Config) (string, error) {
+	if len(config.MQTTPasswordFile) == 0 {
+		return "", nil
+	}
+	mqttPassword, err := fileToString(config.MQTTPasswordFile)
+	if err != nil {
+		return "", err
+	}
+	if mqttPassword == "" {
+		return "", fmt.Errorf("%s is empty", config.MQTTPasswordFile)
+	}
+	return mqttPassword, nil
+}
+
+// startBroker starts the embedded broker and points the hub's own client at
+// it. Spokes connect to the listen address with their mqttBroker flag. Fails
+// rather than accepting any password if the password file cannot be read.
+func startBroker(config *Config, metricsConfig MetricsConfig) (*Broker, error) {
+	password, err := readMQTTPassword(*config)
+	if err != nil {
+		return nil, fmt.Errorf("could not read MQTT password: %w", err)
+	}
+	broker := NewBroker(BrokerConfig{
+		ListenAddress: config.BrokerListenAddress,
+		RetainedFile:  config.BrokerRetainedFile,
+		UserName:      config.MQTTUserName,
+		Password:      password,
+	}, metricsConfig)
+	if err := broker.Start(); err != nil {
+		return nil, err
+	}
+	config.MQTTBroker = broker.ClientURL()
+	return broker, nil
+}
+
+func runRegelverk(ctx context.Context, config Config, bridgeWrappers *[]BridgeWrapper, controllers *[]Controller,
+	reloadRequests <-chan os.Signal) error {
 
 	metricsConfig := MetricsConfig{CollectMetrics: config.CollectMetrics, CollectDebugMetrics: config.CollectDebugMetrics,
 		MetricsAddress: config.MetricsAddress, MetricsRealm: config.MetricsRealm}
@@ -140,35 +196,97 @@ func runRegelverk(ctx context.Context, config Config, bridgeWrappers *[]BridgeWr
 		slog.Info("Metrics collection not initialized")
 	}
 
+	var broker *Broker
+	if config.BrokerListenAddress != "" {
+		var err error
+		broker, err = startBroker(&config, metricsConfig)
+		if err != nil {
+			slog.Error("Could not start embedded MQTT broker", "address", config.BrokerListenAddress, "error", err)
+			return err
+		}
+		// Closed after shutdown has disconnected the hub's client
+		defer broker.Close()
+	}
+
 	masterController := CreateMasterController()
 	masterController.config = config
 	masterController.metricsConfig = metricsConfig
+	masterController.broker = broker
+	masterController.controllerQueueSize = config.ControllerQueueSize
 	masterController.Init()
 	masterController.controllers = controllers
 
-	err := setupMQTTClient(config, &masterController)
+	if config.RecordFile != "" {
+		recorder, err := NewRecorder(config.RecordFile, config.RecordMaxSize, config.RecordKeep)
+		if err != nil {
+			slog.Error("Could not open recording", "recordFile", config.RecordFile, "error", err)
+			return err
+		}
+		defer recorder.Close()
+		masterController.recorder = recorder
+	}
+
+	err := masterController.restoreState()
+	if err != nil {
+		slog.Error("Could not restore persisted state", "stateFile", config.StateFile, "error", err)
+	}
+	masterController.persistenceWorker.Add(1)
+	go masterController.runStatePersistence(ctx)
+
+	masterController.startControllerQueues(ctx)
+	go masterController.runWatchdog(ctx)
+
+	err = setupMQTTClient(config, &masterController)
 	if err != nil {
 		slog.Error("Error initializing MQTT Client", "error", err)
 		return err
 	}
 
 	slog.Info("Initializing bridges")
-	initBridges(ctx, masterController.mqttClient, config, bridgeWrappers)
+	masterController.mu.Lock()
+	masterController.bridgeCtx = ctx
+	masterController.runningBridges = initBridges(ctx, masterController.mqttClient, config, bridgeWrappers,
+		&masterController.bridgeWorkers)
+	masterController.mu.Unlock()
+
+	masterController.httpMux.HandleFunc("/admin/reload", masterController.reloadHandler)
+	masterController.httpMux.HandleFunc("/admin/controller/{name}/enable", masterController.controllerEnableHandler)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloadRequests:
+				slog.Info("Reloading config", "configFile", config.ConfigFile)
+				if _, err := masterController.ReloadConfig(); err != nil {
+					slog.Error("Config reload failed, keeping running configuration", "error", err)
+				}
+			}
+		}
+	}()
 
 	go func() {
-		for tick := range time.Tick(1 * time.Minute) {
-			timeOfDay := ComputeTimeOfDay(time.Now(), 59, 18)
-			ev := MQTTEvent{
-				Timestamp: tick,
-				Topic:     "regelverk/ticker/timeofday",
-				Payload:   timeOfDay,
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case tick := <-ticker.C:
+				timeOfDay := ComputeTimeOfDay(time.Now(), 59, 18)
+				ev := MQTTEvent{
+					Timestamp: tick,
+					Topic:     "regelverk/ticker/timeofday",
+					Payload:   timeOfDay,
+				}
+				masterController.ProcessEvent(masterController.mqttClient, ev)
 			}
-			masterController.ProcessEvent(masterController.mqttClient, ev)
 		}
 	}()
 
 	slog.Info("Started regelverk")
 	<-ctx.Done()
+	masterController.shutdown(config.ShutdownTimeout)
 	slog.Info("Finishing regelverk")
 	return nil
 }
@@ -0,0 +1,110 @@
+package regelverk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ReplayOptions selects what Replay prints. Events before From are processed
+// but not printed, processing stops at Until.
+type ReplayOptions struct {
+	ShowEvents   bool
+	ShowRecorded bool
+	From         time.Time
+	Until        time.Time
+}
+
+type replayer struct {
+	simulation *simulation
+	options    ReplayOptions
+	out        io.Writer
+}
+
+// Replay feeds recordings, oldest first, through the controllers of the setup
+// in config and prints the resulting state transitions and publishes to out.
+// Time is virtual: nowFunc follows the recorded timestamps and the minute
+// ticker, temporal guard deadlines and state machine timers fire when the
+// recording passes them. Nothing is published. Controllers that only serve
+// HTTP are skipped.
+func Replay(config Config, recordings []string, options ReplayOptions, out io.Writer) error {
+	if config.Setup == nil {
+		return fmt.Errorf("no setup to replay against")
+	}
+	var controllers []Controller
+	for _, controllerSetup := range config.Setup.Controllers {
+		factory := controllerFactories[controllerSetup.Type]
+		if factory.static {
+			continue
+		}
+		controllers = append(controllers, factory.build(controllerSetup.key(), controllerSetup.Params))
+	}
+
+	r := &replayer{
+		simulation: newSimulation(config, controllers),
+		options:    options,
+		out:        out,
+	}
+	defer r.simulation.close()
+	r.simulation.onTransition = func(at time.Time, controller, from, to string) {
+		r.print(at, "transition", controller, from+" -> "+to, "")
+	}
+	r.simulation.onPublish = func(at time.Time, p DryRunPublish) {
+		payload, _ := encodeRecordedPayload(p.Payload)
+		if p.Wait > 0 {
+			payload += fmt.Sprintf(" (after %v)", p.Wait)
+		}
+		r.print(at, "publish", p.Controller, p.Topic, payload)
+	}
+
+	for _, recording := range recordings {
+		err := readRecording(recording, func(msg recordedMessage) error {
+			at := msg.time()
+			if !options.Until.IsZero() && at.After(options.Until) {
+				return errReplayDone
+			}
+			r.simulation.advance(at)
+			switch msg.Direction {
+			case recordedIn:
+				payload, err := msg.payload()
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", recording, msg.Topic, err)
+				}
+				if options.ShowEvents {
+					r.print(at, "event", "", msg.Topic, msg.Payload)
+				}
+				r.simulation.process(MQTTEvent{Timestamp: at, Topic: msg.Topic, Payload: payload})
+			case recordedOut:
+				if options.ShowRecorded {
+					r.print(at, "recorded", "", msg.Topic, msg.Payload)
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errReplayDone) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errReplayDone = errors.New("replay done")
+
+func (r *replayer) print(at time.Time, kind, controller, subject, detail string) {
+	if !r.options.From.IsZero() && at.Before(r.options.From) {
+		return
+	}
+	line := at.Format(time.RFC3339Nano) + " " + fmt.Sprintf("%-10s", kind)
+	if controller != "" {
+		line += " " + controller
+	}
+	line += " " + subject
+	if detail != "" {
+		line += " " + detail
+	}
+	fmt.Fprintln(r.out, line)
+}
@@ -0,0 +1,335 @@
+package regelverk
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scenarioStep is an event at an offset from the start of the scenario. An
+// empty topic only advances the clock. The expectations cover everything the
+// controllers did since the previous step, ticks and timers included.
+type scenarioStep struct {
+	at          time.Duration
+	topic       string
+	payload     string
+	transitions []string // "controller: from -> to"
+	publishes   []string // "controller topic payload", see scenarioPublish
+}
+
+type scenario struct {
+	name  string
+	start time.Time
+	setup string // as in the config file
+	steps []scenarioStep
+}
+
+func scenarioPublish(controller string, p MQTTPublish) string {
+	line := fmt.Sprintf("%s %s %v", controller, p.Topic, p.Payload)
+	if p.Wait > 0 {
+		line += fmt.Sprintf(" (after %v)", p.Wait)
+	}
+	return line
+}
+
+func scenarioPublishes(controller string, publishes []MQTTPublish) []string {
+	var lines []string
+	for _, p := range publishes {
+		lines = append(lines, scenarioPublish(controller, p))
+	}
+	return lines
+}
+
+// immediatePublishes returns the publishes that are sent right away
+func immediatePublishes(publishes []MQTTPublish) []MQTTPublish {
+	var result []MQTTPublish
+	for _, p := range publishes {
+		if p.Wait == 0 {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// delayedPublishes returns the publishes that are sent after a wait of at
+// most upTo
+func delayedPublishes(publishes []MQTTPublish, upTo time.Duration) []MQTTPublish {
+	var result []MQTTPublish
+	for _, p := range publishes {
+		if p.Wait > 0 && p.Wait <= upTo {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func runScenario(t *testing.T, sc scenario) {
+	t.Helper()
+	setup, err := ParseSetup([]byte(sc.setup))
+	if err != nil {
+		t.Fatalf("invalid setup: %v", err)
+	}
+	var controllers []Controller
+	for _, controllerSetup := range setup.Controllers {
+		controllers = append(controllers, controllerFactories[controllerSetup.Type].build(controllerSetup.key(), controllerSetup.Params))
+	}
+
+	sim := newSimulation(Config{Setup: setup}, controllers)
+	defer sim.close()
+	var transitions, publishes []string
+	sim.onTransition = func(_ time.Time, controller, from, to string) {
+		transitions = append(transitions, controller+": "+from+" -> "+to)
+	}
+	sim.onPublish = func(_ time.Time, p DryRunPublish) {
+		publishes = append(publishes, scenarioPublish(p.Controller,
+			MQTTPublish{Topic: p.Topic, Payload: p.Payload, Wait: p.Wait}))
+	}
+
+	for i, step := range sc.steps {
+		at := sc.start.Add(step.at)
+		sim.advance(at)
+		if step.topic != "" {
+			sim.process(MQTTEvent{Timestamp: at, Topic: step.topic, Payload: []byte(step.payload)})
+		}
+		if !slices.Equal(transitions, step.transitions) {
+			t.Errorf("step %d at %v: transitions\n  %q\nwant\n  %q", i, step.at, transitions, step.transitions)
+		}
+		if !slices.Equal(publishes, step.publishes) {
+			t.Errorf("step %d at %v: publishes\n  %q\nwant\n  %q", i, step.at, publishes, step.publishes)
+		}
+		transitions, publishes = nil, nil
+	}
+
+	for _, p := range sim.client.publishes() {
+		if !strings.HasPrefix(p.Topic, dryRunTopicPrefix) {
+			t.Errorf("publish to %s bypassed dry run", p.Topic)
+		}
+	}
+}
+
+func TestControllerScenarios(t *testing.T) {
+	evening := time.Date(2026, 10, 17, 20, 58, 0, 0, time.UTC)
+	night := time.Date(2026, 10, 17, 22, 30, 0, 0, time.UTC)
+
+	scenarios := []scenario{
+		{
+			name:  "tv follows power over CEC",
+			start: night,
+			setup: `
+controllers:
+  - type: tv
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "cec/message/hex/rx", payload: "01:90:00",
+					transitions: []string{"tv: (uninitialized) -> stateTvOn"}},
+				{at: time.Minute, topic: "cec/message/hex/rx", payload: "01:90:01",
+					transitions: []string{"tv: stateTvOn -> stateTvOff"},
+					publishes:   scenarioPublishes("tv", tvPowerOffOutput())},
+				{at: 40 * time.Minute,
+					transitions: []string{"tv: stateTvOff -> stateTvOffLong"}},
+				{at: 41 * time.Minute, topic: "cec/message/hex/tx", payload: "01:90:00:00:00",
+					transitions: []string{"tv: stateTvOffLong -> stateTvOn"},
+					publishes:   scenarioPublishes("tv", immediatePublishes(tvPowerOnOutput()))},
+				{at: 42 * time.Minute,
+					publishes: scenarioPublishes("tv", delayedPublishes(tvPowerOnOutput(), time.Minute))},
+			},
+		},
+		{
+			name:  "tv switched off before the volume sequence finishes cancels the rest",
+			start: night,
+			setup: `
+controllers:
+  - type: tv
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "cec/message/hex/rx", payload: "01:90:01",
+					transitions: []string{"tv: (uninitialized) -> stateTvOffLong"}},
+				{at: 10 * time.Second, topic: "cec/message/hex/rx", payload: "01:90:00",
+					transitions: []string{"tv: stateTvOffLong -> stateTvOn"},
+					publishes:   scenarioPublishes("tv", immediatePublishes(tvPowerOnOutput()))},
+				{at: 20 * time.Second, topic: "cec/message/hex/rx", payload: "01:90:01",
+					transitions: []string{"tv: stateTvOn -> stateTvOff"},
+					publishes: append(scenarioPublishes("tv", delayedPublishes(tvPowerOnOutput(), 10*time.Second)),
+						scenarioPublishes("tv", tvPowerOffOutput())...)},
+				{at: 2 * time.Minute},
+			},
+		},
+		{
+			name:  "kitchen amp turns off without audio and remote controls playback",
+			start: night,
+			setup: `
+controllers:
+  - type: kitchen
+stateRules:
+  - topic: zigbee2mqtt/kitchen-amp
+    path: state
+    compare: eq
+    value: "ON"
+    key: kitchenAmpPower
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "zigbee2mqtt/media_remote_kitchen", payload: `{"action": "toggle"}`,
+					publishes: []string{`kitchen zigbee2mqtt/kitchen-amp/get {"state": ""}`}},
+				{at: 10 * time.Second, topic: "zigbee2mqtt/kitchen-amp", payload: `{"state": "ON"}`,
+					transitions: []string{"kitchen: (uninitialized) -> kitchenAmpStateOff"},
+					publishes:   []string{`kitchen zigbee2mqtt/kitchen-amp/set {"state": "OFF"}`}},
+				{at: 20 * time.Second, topic: "zigbee2mqtt/media_remote_kitchen", payload: `{"action": "toggle"}`,
+					publishes: []string{"kitchen kitchen/bluez/4C:66:A6:A1:39:58/mediaplayer/command/send Play"}},
+				{at: 30 * time.Second, topic: "zigbee2mqtt/media_remote_kitchen", payload: `{"action": "volume_up"}`,
+					publishes: []string{"kitchen kitchen/pulseaudio/volume/change 0.10"}},
+			},
+		},
+		{
+			name:  "livingroom lamp follows presence at night",
+			start: night,
+			setup: `
+controllers:
+  - type: livingroom
+stateRules:
+  - topic: zigbee2mqtt/livingroom-floorlamp
+    path: state
+    compare: eq
+    value: "ON"
+    key: livingroomFloorlamp
+  - topic: home/phone
+    path: present
+    key: phonePresent
+  - topic: zigbee2mqtt/livingroom-presence
+    path: occupancy
+    key: livingroomPresence
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "zigbee2mqtt/livingroom-floorlamp", payload: `{"state": "OFF"}`,
+					transitions: []string{"livingroom: (uninitialized) -> stateLivingroomFloorlampOff"}},
+				{at: time.Minute, topic: "home/phone", payload: `{"present": true}`},
+				{at: 2 * time.Minute, topic: "zigbee2mqtt/livingroom-presence", payload: `{"occupancy": true}`,
+					transitions: []string{"livingroom: stateLivingroomFloorlampOff -> stateLivingroomFloorlampOn"},
+					publishes:   []string{`livingroom zigbee2mqtt/livingroom-floorlamp/set {"state": "ON"}`}},
+				{at: 3 * time.Minute, topic: "zigbee2mqtt/livingroom-presence", payload: `{"occupancy": false}`},
+				{at: 12 * time.Minute},
+				{at: 14 * time.Minute,
+					transitions: []string{"livingroom: stateLivingroomFloorlampOn -> stateLivingroomFloorlampOff"},
+					publishes:   []string{`livingroom zigbee2mqtt/livingroom-floorlamp/set {"state": "OFF"}`}},
+			},
+		},
+		{
+			name:  "bedroom blinds follow the schedule and the remote temporarily",
+			start: evening,
+			setup: `
+controllers:
+  - type: bedroom
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "zigbee2mqtt/blinds-bedroom", payload: `{"state": "OPEN"}`,
+					transitions: []string{"bedroom: (uninitialized) -> bedroomBlindsStateOpen"}},
+				{at: 5 * time.Minute,
+					transitions: []string{"bedroom: bedroomBlindsStateOpen -> bedroomBlindsStateClosed"},
+					publishes:   []string{`bedroom zigbee2mqtt/blinds-bedroom/set {"state": "CLOSE"}`}},
+				{at: 10 * time.Minute, topic: "zigbee2mqtt/blinds-bedroom-remote", payload: `{"action": "on"}`,
+					transitions: []string{"bedroom: bedroomBlindsStateClosed -> bedroomBlindsStateOpen"},
+					publishes:   []string{`bedroom zigbee2mqtt/blinds-bedroom/set {"state": "OPEN"}`}},
+				{at: 45 * time.Minute,
+					transitions: []string{"bedroom: bedroomBlindsStateOpen -> bedroomBlindsStateClosed"},
+					publishes:   []string{`bedroom zigbee2mqtt/blinds-bedroom/set {"state": "CLOSE"}`}},
+			},
+		},
+		{
+			name:  "door left open is reminded of a limited number of times",
+			start: night,
+			setup: `
+controllers:
+  - type: doorreminder
+    name: fridgedoor
+    sensorName: fridge-door
+    stateOpenKey: fridgeDoorOpen
+    openLongLimit: 2m
+    reminderPeriod: 5m
+    maxReminders: 2
+    reminderTopic: notify
+    reminderPayload: Fridge door open
+stateRules:
+  - topic: zigbee2mqtt/fridge-door
+    path: contact
+    invert: true
+    key: fridgeDoorOpen
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "zigbee2mqtt/fridge-door", payload: `{"contact": true}`,
+					transitions: []string{"fridgedoor: (uninitialized) -> doorClosed"}},
+				{at: time.Minute, topic: "zigbee2mqtt/fridge-door", payload: `{"contact": false}`,
+					transitions: []string{"fridgedoor: doorClosed -> doorOpen"},
+					publishes:   []string{`fridgedoor zigbee2mqtt/fridge-door/get {"battery":""}`}},
+				{at: time.Hour,
+					transitions: []string{"fridgedoor: doorOpen -> doorOpenLong"},
+					publishes:   []string{"fridgedoor notify Fridge door open", "fridgedoor notify Fridge door open"}},
+				{at: time.Hour + time.Minute, topic: "zigbee2mqtt/fridge-door", payload: `{"contact": true}`,
+					transitions: []string{"fridgedoor: doorOpenLong -> doorClosed"}},
+			},
+		},
+		{
+			name:  "battery reminders stop when the battery is replaced",
+			start: night,
+			setup: `
+controllers:
+  - type: batteryreminder
+    name: b1
+    stateBatteryPoorKey: b1Low
+    reminderPeriod: 1h
+    maxReminders: 3
+    reminderTopic: notify
+    reminderPayload: Replace battery
+stateRules:
+  - topic: zigbee2mqtt/b1
+    path: battery
+    compare: lt
+    value: 30
+    key: b1Low
+`,
+			steps: []scenarioStep{
+				{at: 0, topic: "zigbee2mqtt/b1", payload: `{"battery": 80}`,
+					transitions: []string{"b1: (uninitialized) -> batteryGood"}},
+				{at: time.Minute, topic: "zigbee2mqtt/b1", payload: `{"battery": 20}`,
+					transitions: []string{"b1: batteryGood -> batteryPoor"}},
+				{at: 150 * time.Minute,
+					publishes: []string{"b1 notify Replace battery", "b1 notify Replace battery"}},
+				{at: 165 * time.Minute, topic: "zigbee2mqtt/b1", payload: `{"battery": 90}`,
+					transitions: []string{"b1: batteryPoor -> batteryGood"}},
+				{at: 5 * time.Hour},
+			},
+		},
+	}
+
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			runScenario(t, sc)
+		})
+	}
+}
+
+func TestSimulationStartsNoWallClockTimers(t *testing.T) {
+	door := &DoorReminderController{BaseController: BaseController{Name: "fridgedoor"},
+		StateOpenKey: "fridgeDoorOpen", OpenLongLimit: time.Millisecond, ReminderPeriod: time.Hour}
+	sim := newSimulation(Config{}, []Controller{door})
+	defer sim.close()
+	var transitions []string
+	sim.onTransition = func(_ time.Time, controller, from, to string) {
+		transitions = append(transitions, to)
+	}
+
+	start := time.Date(2026, 10, 17, 22, 30, 0, 0, time.UTC)
+	sim.advance(start)
+	sim.masterController.stateValueMap.setState("fridgeDoorOpen", true)
+	sim.process(MQTTEvent{Timestamp: start, Topic: "zigbee2mqtt/fridge-door", Payload: []byte(`{"contact": false}`)})
+
+	// The open long timer is due in virtual time only
+	time.Sleep(20 * time.Millisecond)
+	if state := lockedState(&door.BaseController); state != doorOpen {
+		t.Fatalf("expected the door to stay open until the clock advances, got %v", state)
+	}
+	sim.advance(start.Add(time.Second))
+	if !slices.Equal(transitions, []string{"doorOpen", "doorOpenLong"}) {
+		t.Fatalf("unexpected transitions %v", transitions)
+	}
+}
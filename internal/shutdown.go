@@ -0,0 +1,180 @@
+package regelverk
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Default time allowed for an orderly shutdown before giving up
+const defaultShutdownTimeout = 10 * time.Second
+
+// Shutdowner is implemented by controllers that hold resources beyond their
+// state machine, such as goroutines or servers. Shutdown is called with the
+// controller lock held, after the controller has stopped receiving events,
+// and should return before ctx is done.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown stops the hub in order: no more events are accepted, controller
+// workers are stopped, controllers release their resources, the state is
+// saved, delayed publishes are flushed or dropped, bridges are stopped and the
+// MQTT client is disconnected. Each step is bounded by what is left of
+// timeout.
+func (masterController *MasterController) shutdown(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	slog.Info("Shutting down", "timeout", timeout)
+
+	masterController.mu.Lock()
+	masterController.shuttingDown = true
+	var controllers []Controller
+	if masterController.controllers != nil {
+		controllers = *masterController.controllers
+	}
+	queues := masterController.controllerQueues
+	runningBridges := maps.Clone(masterController.runningBridges)
+	masterController.mu.Unlock()
+
+	// A periodic save must not overwrite the final one
+	if !waitGroupWithin(ctx, &masterController.persistenceWorker) {
+		slog.Warn("State persistence did not stop in time")
+	}
+
+	for _, queue := range queues {
+		if queue.cancel != nil {
+			queue.cancel()
+		}
+	}
+	if !waitGroupWithin(ctx, &masterController.queueWorkers) {
+		slog.Warn("Controller workers did not stop in time")
+	}
+
+	for _, controller := range controllers {
+		masterController.shutdownController(ctx, controller)
+	}
+
+	if stateFile := masterController.config.StateFile; stateFile != "" {
+		if err := masterController.saveState(ctx); err != nil {
+			slog.Error("Could not save state on shutdown", "stateFile", stateFile, "error", err)
+		} else {
+			slog.Info("Saved state on shutdown", "stateFile", stateFile)
+		}
+	}
+
+	if masterController.publishScheduler != nil {
+		flush := masterController.config.FlushOnShutdown
+		for _, p := range masterController.publishScheduler.Drain(flush) {
+			if flush {
+				slog.Info("Flushed scheduled publish on shutdown", "controller", p.Controller, "topic", p.Topic, "dueAt", p.DueAt)
+			} else {
+				slog.Info("Dropped scheduled publish on shutdown", "controller", p.Controller, "topic", p.Topic, "dueAt", p.DueAt)
+			}
+		}
+	}
+	if stopped := masterController.stopVerifications(); stopped > 0 {
+		slog.Info("Dropped pending command verifications on shutdown", "count", stopped)
+	}
+
+	for name, cancelBridge := range runningBridges {
+		slog.Info("Stopping bridge", "bridgeWrapper", name)
+		cancelBridge()
+	}
+	if !waitGroupWithin(ctx, &masterController.bridgeWorkers) {
+		slog.Warn("Bridges did not stop in time")
+	}
+
+	if masterController.mqttClient != nil && masterController.mqttClient.IsConnected() {
+		quiesce := uint(0)
+		if deadline, ok := ctx.Deadline(); ok {
+			quiesce = uint(max(time.Until(deadline), 0).Milliseconds())
+		}
+		slog.Info("Disconnecting MQTT client")
+		masterController.mqttClient.Disconnect(min(quiesce, 1000))
+	}
+	slog.Info("Shutdown complete")
+}
+
+// shutdownController stops the timers of a controller and calls its Shutdown
+// hook, if it has one.
+func (masterController *MasterController) shutdownController(ctx context.Context, controller Controller) {
+	name := controllerName(controller)
+	if timerAware, ok := controller.(interface{ stopStateTimers() int }); ok {
+		timerAware.stopStateTimers()
+	}
+	shutdowner, ok := controller.(Shutdowner)
+	if !ok {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		controller.Lock()
+		defer controller.Unlock()
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Recovered from panic in controller shutdown", "controller", name, "recover", r)
+				done <- nil
+			}
+		}()
+		done <- shutdowner.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Error("Error shutting down controller", "controller", name, "error", err)
+		} else {
+			slog.Info("Shut down controller", "controller", name)
+		}
+	case <-ctx.Done():
+		slog.Warn("Controller did not shut down in time", "controller", name)
+	}
+}
+
+// lockWithin locks l unless ctx is done first. Returns false on timeout, the
+// lock is then released as soon as it is acquired. Once ctx is done, l is
+// only locked if it is free and supports TryLock.
+func lockWithin(ctx context.Context, l sync.Locker) bool {
+	if tryLocker, ok := l.(interface{ TryLock() bool }); ok && tryLocker.TryLock() {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.Unlock()
+		}()
+		return false
+	}
+}
+
+// waitGroupWithin waits for wg until ctx is done. Returns false on timeout.
+func waitGroupWithin(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
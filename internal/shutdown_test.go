@@ -0,0 +1,102 @@
+package regelverk
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+type shutdownController struct {
+	recordingController
+	shutdownCalled bool
+}
+
+func (c *shutdownController) Shutdown(_ context.Context) error {
+	c.shutdownCalled = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		controller := &shutdownController{}
+		client := &recordingClient{connected: true}
+
+		masterController := CreateMasterController()
+		masterController.config.FlushOnShutdown = flush
+		masterController.mqttClient = client
+		masterController.Init()
+		masterController.controllers = &[]Controller{controller}
+		masterController.startControllerQueues(ctx)
+
+		masterController.publishScheduler.Schedule("recording", client, MQTTPublish{Topic: "delayed", Wait: time.Hour})
+
+		cancel()
+		masterController.shutdown(time.Second)
+
+		if !controller.shutdownCalled {
+			t.Errorf("flush=%v: expected Shutdown hook to be called", flush)
+		}
+		if pending := masterController.publishScheduler.Pending(); len(pending) != 0 {
+			t.Errorf("flush=%v: expected no pending publishes, got %v", flush, pending)
+		}
+		if slices.Contains(client.topics(), "delayed") != flush {
+			t.Errorf("flush=%v: unexpected publishes %v", flush, client.topics())
+		}
+		if !client.disconnected {
+			t.Errorf("flush=%v: expected MQTT client to be disconnected", flush)
+		}
+
+		// Events after shutdown are not accepted
+		masterController.ProcessEvent(client, MQTTEvent{Topic: "late"})
+		if depth := masterController.controllerQueues[controller].depth(); depth != 0 {
+			t.Errorf("flush=%v: expected no events queued after shutdown, got %d", flush, depth)
+		}
+	}
+}
+
+func TestShutdownSavesStateDespiteStuckController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	masterController := CreateMasterController()
+	masterController.config.StateFile = stateFile
+	masterController.stateValueMap.setState("fridgeDoorOpen", true)
+	door := &DoorReminderController{BaseController: BaseController{Name: "fridgedoor"},
+		StateOpenKey: "fridgeDoorOpen", OpenLongLimit: time.Hour, ReminderPeriod: time.Hour}
+	door.Initialize(&masterController)
+	stuck := &recordingController{block: make(chan struct{})}
+	defer masterController.queueWorkers.Wait()
+	defer close(stuck.block)
+	masterController.controllers = &[]Controller{door, stuck}
+	masterController.startControllerQueues(ctx)
+	masterController.persistenceWorker.Add(1)
+	go masterController.runStatePersistence(ctx)
+
+	masterController.ProcessEvent(nil, MQTTEvent{Topic: "first"})
+	waitFor(t, func() bool { return masterController.controllerQueues[stuck].depth() == 0 })
+	waitFor(t, func() bool { return lockedState(&door.BaseController) == doorOpen })
+
+	cancel()
+	started := time.Now()
+	masterController.shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("expected shutdown to give up on the stuck controller, took %v", elapsed)
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("expected state to be saved on shutdown: %v", err)
+	}
+	var persisted persistedState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state := persisted.ControllerStates["fridgedoor"]; state != "doorOpen" {
+		t.Errorf("expected the state of the other controller to be saved, got %v", persisted.ControllerStates)
+	}
+}
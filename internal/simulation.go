@@ -0,0 +1,230 @@
+package regelverk
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// virtualClock replaces nowFunc during a simulation.
+type virtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// idleTimer replaces the timers of afterFunc during a simulation. It never
+// fires, the simulation runs what is due itself.
+type idleTimer struct{}
+
+func (idleTimer) Stop() bool { return true }
+
+func idleAfterFunc(_ time.Duration, _ func()) afterTimer {
+	return idleTimer{}
+}
+
+// simulatedClient stands in for the MQTT client during a simulation. Nothing
+// is sent, what the engine publishes directly is kept for inspection.
+type simulatedClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published []MQTTPublish
+}
+
+func (c *simulatedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, MQTTPublish{Topic: topic, Payload: payload, Qos: qos, Retained: retained})
+	return &mqtt.DummyToken{}
+}
+
+func (c *simulatedClient) IsConnected() bool { return false }
+
+func (c *simulatedClient) publishes() []MQTTPublish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]MQTTPublish{}, c.published...)
+}
+
+// timerController is implemented by controllers with state machine timers,
+// which a simulation fires in virtual time.
+type timerController interface {
+	stateTimersDebug() []StateTimerDebug
+	fireStateTimer(id uint64) []MQTTPublish
+}
+
+// simulation runs controllers synchronously in virtual time. nowFunc follows
+// the simulated clock, and the minute ticker, temporal guard deadlines, state
+// machine timers and delayed publishes fire when the clock passes them.
+// afterFunc does not start wall-clock timers meanwhile. The engine runs in
+// dry-run mode, so what the controllers publish is reported through
+// onPublish instead of being sent. Used by Replay and the scenario tests.
+type simulation struct {
+	masterController *MasterController
+	controllers      []Controller
+	clock            *virtualClock
+	client           *simulatedClient
+	originalNowFunc  func() time.Time
+	originalAfter    func(time.Duration, func()) afterTimer
+	states           map[string]string
+	seenPublishes    uint64
+	nextTick         time.Time
+
+	onTransition func(at time.Time, controller, from, to string)
+	onPublish    func(at time.Time, p DryRunPublish)
+}
+
+// newSimulation sets up a master controller for the given controllers and
+// swaps nowFunc and afterFunc for the virtual clock until close is called. The clock starts
+// at the time of the first advance.
+func newSimulation(config Config, controllers []Controller) *simulation {
+	config.DryRun = true
+	config.StateFile = ""
+	config.RecordFile = ""
+
+	s := &simulation{
+		controllers:     controllers,
+		clock:           &virtualClock{},
+		client:          &simulatedClient{},
+		originalNowFunc: nowFunc,
+		originalAfter:   afterFunc,
+		states:          make(map[string]string),
+	}
+	nowFunc = s.clock.Now
+	afterFunc = idleAfterFunc
+
+	masterController := CreateMasterController()
+	masterController.config = config
+	masterController.Init()
+	masterController.controllers = &s.controllers
+	s.masterController = &masterController
+	return s
+}
+
+// advance moves the virtual clock to at, processing minute ticks, temporal
+// reevaluations, state machine timers and delayed publishes that fall due on
+// the way, in order.
+func (s *simulation) advance(at time.Time) {
+	if s.nextTick.IsZero() {
+		s.clock.set(at)
+		s.nextTick = at.Truncate(time.Minute).Add(time.Minute)
+		return
+	}
+	for {
+		next := s.nextTick
+		kind := "tick"
+		if deadline, found := s.masterController.stateValueMap.nextTemporalDeadline(s.clock.Now()); found && deadline.Before(next) {
+			next, kind = deadline, "reevaluate"
+		}
+		var timerOwner timerController
+		var timerID uint64
+		for _, controller := range s.controllers {
+			timerAware, ok := controller.(timerController)
+			if !ok {
+				continue
+			}
+			for _, timer := range timerAware.stateTimersDebug() {
+				if timer.DueAt.Before(next) {
+					next, kind, timerOwner, timerID = timer.DueAt, "timer", timerAware, timer.ID
+				}
+			}
+		}
+		var publishID uint64
+		if id, dueAt, found := s.masterController.publishScheduler.next(); found && dueAt.Before(next) {
+			next, kind, publishID = dueAt, "publish", id
+		}
+		if next.After(at) {
+			break
+		}
+		s.clock.set(next)
+
+		switch kind {
+		case "tick":
+			s.nextTick = s.nextTick.Add(time.Minute)
+			s.process(MQTTEvent{Timestamp: next, Topic: "regelverk/ticker/timeofday",
+				Payload: ComputeTimeOfDay(next, 59, 18)})
+		case "reevaluate":
+			s.process(MQTTEvent{Timestamp: next, Topic: reevaluateTopic, Payload: []byte{}})
+		case "timer":
+			controller := timerOwner.(Controller)
+			s.masterController.processControllerAction(s.client, controller, func() []MQTTPublish {
+				return timerOwner.fireStateTimer(timerID)
+			})
+			s.report(next)
+		case "publish":
+			s.masterController.publishScheduler.fire(publishID)
+			s.report(next)
+		}
+	}
+	s.clock.set(at)
+}
+
+// process runs an event through the event callbacks and every controller,
+// synchronously.
+func (s *simulation) process(ev MQTTEvent) {
+	s.masterController.ProcessEvent(s.client, ev)
+	for _, controller := range s.controllers {
+		s.masterController.processControllerEvent(s.client, controller, ev)
+	}
+	s.report(ev.Timestamp)
+}
+
+// report passes on state transitions and publishes since the last report.
+func (s *simulation) report(at time.Time) {
+	for _, controller := range s.controllers {
+		controller.Lock()
+		var state ControllerDebugState
+		if controller.IsInitialized() {
+			state = controller.DebugState()
+		}
+		controller.Unlock()
+		name := controllerName(controller)
+		previous, known := s.states[name]
+		if state.StateMachineStateText == previous {
+			continue
+		}
+		s.states[name] = state.StateMachineStateText
+		if known || state.StateMachineStateText != "" {
+			if !known {
+				previous = "(uninitialized)"
+			}
+			if s.onTransition != nil {
+				s.onTransition(at, name, previous, state.StateMachineStateText)
+			}
+		}
+	}
+
+	var publishes []DryRunPublish
+	publishes, s.seenPublishes = s.masterController.dryRunSince(s.seenPublishes)
+	if s.onPublish != nil {
+		for _, p := range publishes {
+			s.onPublish(at, p)
+		}
+	}
+}
+
+// close shuts the controllers down and restores nowFunc and afterFunc.
+func (s *simulation) close() {
+	for _, controller := range s.controllers {
+		if shutdowner, ok := controller.(Shutdowner); ok {
+			controller.Lock()
+			shutdowner.Shutdown(context.Background())
+			controller.Unlock()
+		}
+	}
+	nowFunc = s.originalNowFunc
+	afterFunc = s.originalAfter
+}
@@ -0,0 +1,294 @@
+package regelverk
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Keys without a stateHistory declaration keep this much history
+const (
+	defaultHistoryRetention  = 24 * time.Hour
+	defaultHistoryMaxEntries = 256
+)
+
+// StateHistoryConfig sets how much history of a state key is kept, as read
+// from the stateHistory section of the config file.
+//
+//	stateHistory:
+//	  - key: fridgeDoorOpen
+//	    retention: 168h
+//	    maxEntries: 2000
+type StateHistoryConfig struct {
+	Key StateKey `yaml:"key" json:"key"`
+	// Transitions older than this are dropped as new ones are recorded,
+	// defaults to 24h
+	Retention time.Duration `yaml:"retention" json:"retention,omitempty"`
+	// Size of the ring buffer, defaults to 256
+	MaxEntries int `yaml:"maxEntries" json:"maxEntries,omitempty"`
+}
+
+func validateStateHistory(config StateHistoryConfig) error {
+	var errs []error
+	errs = append(errs, requireNonEmpty("key", string(config.Key)))
+	if config.Retention < 0 {
+		errs = append(errs, fmt.Errorf("retention must not be negative, got %v", config.Retention))
+	}
+	if config.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("maxEntries must not be negative, got %d", config.MaxEntries))
+	}
+	return errors.Join(errs...)
+}
+
+func (config StateHistoryConfig) withDefaults() StateHistoryConfig {
+	if config.Retention == 0 {
+		config.Retention = defaultHistoryRetention
+	}
+	if config.MaxEntries == 0 {
+		config.MaxEntries = defaultHistoryMaxEntries
+	}
+	return config
+}
+
+// StateTransition is a change of a state value, to a bool, float64 or string
+type StateTransition struct {
+	At    time.Time `json:"at"`
+	Value any       `json:"value"`
+}
+
+// stateHistory is a ring buffer of the transitions of a key, oldest first.
+type stateHistory struct {
+	retention time.Duration
+	entries   []StateTransition
+	start     int
+	size      int
+}
+
+func newStateHistory(config StateHistoryConfig) *stateHistory {
+	config = config.withDefaults()
+	return &stateHistory{retention: config.Retention, entries: make([]StateTransition, config.MaxEntries)}
+}
+
+// at returns the i:th oldest transition
+func (h *stateHistory) at(i int) StateTransition {
+	return h.entries[(h.start+i)%len(h.entries)]
+}
+
+func (h *stateHistory) add(transition StateTransition) {
+	if h.size == len(h.entries) {
+		h.entries[h.start] = transition
+		h.start = (h.start + 1) % len(h.entries)
+	} else {
+		h.entries[(h.start+h.size)%len(h.entries)] = transition
+		h.size++
+	}
+	h.prune(transition.At)
+}
+
+// prune drops transitions older than the retention, except the one in effect
+// at its start
+func (h *stateHistory) prune(now time.Time) {
+	cut := now.Add(-h.retention)
+	for h.size > 1 && !h.at(1).At.After(cut) {
+		h.start = (h.start + 1) % len(h.entries)
+		h.size--
+	}
+}
+
+func (h *stateHistory) transitions() []StateTransition {
+	result := make([]StateTransition, h.size)
+	for i := range h.size {
+		result[i] = h.at(i)
+	}
+	return result
+}
+
+// resized returns a history with the new limits and the latest transitions
+func (h *stateHistory) resized(config StateHistoryConfig) *stateHistory {
+	resized := newStateHistory(config)
+	transitions := h.transitions()
+	for _, transition := range transitions[max(0, len(transitions)-len(resized.entries)):] {
+		resized.add(transition)
+	}
+	return resized
+}
+
+// configureHistory sets the limits of the declared keys. History already
+// recorded is kept within the new limits.
+func (s *StateValueMap) configureHistory(configs []StateHistoryConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.historyConfigs = make(map[StateKey]StateHistoryConfig, len(configs))
+	for _, config := range configs {
+		s.historyConfigs[config.Key] = config.withDefaults()
+	}
+	for key, history := range s.history {
+		s.history[key] = history.resized(s.historyConfigs[key])
+	}
+}
+
+// recordTransitionUnsafe adds a transition to the history of key. The caller
+// holds the write lock.
+func (s *StateValueMap) recordTransitionUnsafe(key StateKey, transition StateTransition) {
+	if s.history == nil {
+		s.history = make(map[StateKey]*stateHistory)
+	}
+	history, exists := s.history[key]
+	if !exists {
+		history = newStateHistory(s.historyConfigs[key])
+		s.history[key] = history
+	}
+	history.add(transition)
+}
+
+// historySince returns the transitions of key after since, preceded by the
+// one in effect at since if it is known
+func (s *StateValueMap) historySince(key StateKey, since time.Time) []StateTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, exists := s.history[key]
+	if !exists {
+		return nil
+	}
+	transitions := history.transitions()
+	first := 0
+	for first < len(transitions)-1 && !transitions[first+1].At.After(since) {
+		first++
+	}
+	return transitions[first:]
+}
+
+// History returns the recorded transitions of key, oldest first.
+func (s *StateValueMap) History(key StateKey) []StateTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, exists := s.history[key]
+	if !exists {
+		return nil
+	}
+	return history.transitions()
+}
+
+// countTransitionsSince counts how many times key changed to value after
+// since. Numbers are compared as float64.
+func (s *StateValueMap) countTransitionsSince(key StateKey, value any, since time.Time) int {
+	count := 0
+	for _, transition := range s.historySince(key, since) {
+		if transition.At.After(since) && transition.Value == value {
+			count++
+		}
+	}
+	return count
+}
+
+// countTransitions counts how many times key changed to value within
+// duration, e.g. how often a door was opened in the last hour
+func (s *StateValueMap) countTransitions(key StateKey, value any, duration time.Duration) int {
+	s.watchWindow(key, duration)
+	return s.countTransitionsSince(key, value, nowFunc().Add(-duration))
+}
+
+// durationTrueSince sums the time key has been true after since. Time before
+// the oldest recorded transition is not counted.
+func (s *StateValueMap) durationTrueSince(key StateKey, since time.Time) time.Duration {
+	now := nowFunc()
+	var total time.Duration
+	transitions := s.historySince(key, since)
+	for i, transition := range transitions {
+		if transition.Value != true {
+			continue
+		}
+		from := transition.At
+		if from.Before(since) {
+			from = since
+		}
+		to := now
+		if i+1 < len(transitions) {
+			to = transitions[i+1].At
+		}
+		if to.After(from) {
+			total += to.Sub(from)
+		}
+	}
+	return total
+}
+
+// durationTrue sums the time key has been true within duration. While key is
+// true, or while the window slides over a time it was true, the sum changes
+// continuously rather than at a transition, so nextTemporalDeadline does not
+// know when a comparison against it flips. Guards using it are re-evaluated
+// on the minute ticker and may react up to a minute late.
+func (s *StateValueMap) durationTrue(key StateKey, duration time.Duration) time.Duration {
+	s.watchWindow(key, duration)
+	return s.durationTrueSince(key, nowFunc().Add(-duration))
+}
+
+// dutyCycle is the share of duration, between 0 and 1, that key has been
+// true. It changes continuously like durationTrue.
+func (s *StateValueMap) dutyCycle(key StateKey, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(s.durationTrue(key, duration)) / float64(duration)
+}
+
+// holdsSince returns since when the value of key has satisfied predicate
+// without interruption, as far as the history tells
+func (s *StateValueMap) holdsSince(key StateKey, predicate func(value any) bool) (time.Time, bool) {
+	transitions := s.History(key)
+	var since time.Time
+	for _, transition := range slices.Backward(transitions) {
+		if !predicate(transition.Value) {
+			break
+		}
+		since = transition.At
+	}
+	return since, !since.IsZero()
+}
+
+// heldFor reports whether the value of key has satisfied predicate for at
+// least duration
+func (s *StateValueMap) heldFor(key StateKey, predicate func(value any) bool, duration time.Duration) bool {
+	s.watchWindow(key, duration)
+	since, holds := s.holdsSince(key, predicate)
+	return holds && !since.After(nowFunc().Add(-duration))
+}
+
+// StateHistoryDebug is a JSON-friendly view of the history of a key, with a
+// summary over Window.
+type StateHistoryDebug struct {
+	Key          StateKey          `json:"key"`
+	Retention    time.Duration     `json:"retention"`
+	MaxEntries   int               `json:"maxEntries"`
+	Transitions  []StateTransition `json:"transitions"`
+	Window       time.Duration     `json:"window"`
+	CountTrue    int               `json:"countTrue"`
+	DurationTrue time.Duration     `json:"durationTrue"`
+	DutyCycle    float64           `json:"dutyCycle"`
+}
+
+func (s *StateValueMap) historyDebug(key StateKey, window time.Duration) (StateHistoryDebug, bool) {
+	s.mu.RLock()
+	_, exists := s.history[key]
+	config := s.historyConfigs[key].withDefaults()
+	s.mu.RUnlock()
+	if !exists {
+		return StateHistoryDebug{}, false
+	}
+	since := nowFunc().Add(-window)
+	debug := StateHistoryDebug{
+		Key:          key,
+		Retention:    config.Retention,
+		MaxEntries:   config.MaxEntries,
+		Transitions:  s.History(key),
+		Window:       window,
+		CountTrue:    s.countTransitionsSince(key, true, since),
+		DurationTrue: s.durationTrueSince(key, since),
+	}
+	if window > 0 {
+		debug.DutyCycle = float64(debug.DurationTrue) / float64(window)
+	}
+	return debug, true
+}
@@ -0,0 +1,136 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStateHistoryRingBuffer(t *testing.T) {
+	start := nowFunc()
+	history := newStateHistory(StateHistoryConfig{Retention: time.Hour, MaxEntries: 3})
+	for i := range 5 {
+		history.add(StateTransition{At: start.Add(time.Duration(i) * time.Minute), Value: float64(i)})
+	}
+	transitions := history.transitions()
+	if len(transitions) != 3 || transitions[0].Value != 2.0 || transitions[2].Value != 4.0 {
+		t.Fatalf("expected the three latest transitions, got %v", transitions)
+	}
+
+	// The transition in effect at the start of the retention is kept
+	history.add(StateTransition{At: start.Add(2 * time.Hour), Value: 5.0})
+	transitions = history.transitions()
+	if len(transitions) != 2 || transitions[0].Value != 4.0 {
+		t.Fatalf("expected pruning to keep 4 and 5, got %v", transitions)
+	}
+
+	resized := history.resized(StateHistoryConfig{MaxEntries: 1})
+	if transitions := resized.transitions(); len(transitions) != 1 || transitions[0].Value != 5.0 {
+		t.Fatalf("expected only the latest transition after resize, got %v", transitions)
+	}
+}
+
+func TestStateHistoryQueries(t *testing.T) {
+	m := NewStateValueMap()
+	seedAt(90*time.Minute, func() { m.setState("fridgeDoorOpen", false) })
+	seedAt(50*time.Minute, func() { m.setState("fridgeDoorOpen", true) })
+	seedAt(40*time.Minute, func() { m.setState("fridgeDoorOpen", false) })
+	seedAt(20*time.Minute, func() { m.setState("fridgeDoorOpen", true) })
+	seedAt(15*time.Minute, func() { m.setState("fridgeDoorOpen", true) })
+	seedAt(5*time.Minute, func() { m.setState("fridgeDoorOpen", false) })
+
+	if n := len(m.History("fridgeDoorOpen")); n != 5 {
+		t.Fatalf("expected repeated values not to be recorded, got %d transitions", n)
+	}
+	if n := m.countTransitions("fridgeDoorOpen", true, time.Hour); n != 2 {
+		t.Errorf("expected 2 openings within the hour, got %d", n)
+	}
+	if n := m.countTransitions("fridgeDoorOpen", true, 30*time.Minute); n != 1 {
+		t.Errorf("expected 1 opening within 30 minutes, got %d", n)
+	}
+	if d := m.durationTrue("fridgeDoorOpen", time.Hour); d != 25*time.Minute {
+		t.Errorf("expected open for 25 minutes, got %v", d)
+	}
+	// Starts within an open period
+	if d := m.durationTrue("fridgeDoorOpen", 45*time.Minute); d != 20*time.Minute {
+		t.Errorf("expected open for 20 minutes, got %v", d)
+	}
+	if duty := m.dutyCycle("fridgeDoorOpen", 50*time.Minute); duty != 0.5 {
+		t.Errorf("expected duty cycle 0.5, got %v", duty)
+	}
+	if m.countTransitions("unknown", true, time.Hour) != 0 || m.dutyCycle("unknown", time.Hour) != 0 {
+		t.Errorf("expected no history for an unknown key")
+	}
+}
+
+func TestConfigureHistory(t *testing.T) {
+	m := NewStateValueMap()
+	for i := range 10 {
+		seedAt(time.Duration(10-i)*time.Minute, func() { m.setNumber("temperature", float64(i)) })
+	}
+	m.configureHistory([]StateHistoryConfig{{Key: "temperature", MaxEntries: 4}})
+	if transitions := m.History("temperature"); len(transitions) != 4 || transitions[3].Value != 9.0 {
+		t.Fatalf("expected the four latest transitions, got %v", transitions)
+	}
+	m.setNumber("temperature", 10)
+	if n := len(m.History("temperature")); n != 4 {
+		t.Fatalf("expected history to stay at 4 entries, got %d", n)
+	}
+}
+
+func TestPersistStateHistory(t *testing.T) {
+	m := NewStateValueMap()
+	seedAt(50*time.Minute, func() { m.setState("fridgeDoorOpen", true) })
+	seedAt(40*time.Minute, func() { m.setState("fridgeDoorOpen", false) })
+	seedAt(20*time.Minute, func() { m.setState("fridgeDoorOpen", true) })
+
+	// Transition values come back from JSON as bool, float64 or string
+	data, err := json.Marshal(m.persistedHistory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history map[StateKey][]StateTransition
+	if err := json.Unmarshal(data, &history); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewStateValueMap()
+	restored.restorePersisted(m.persistedSnapshot(), history, time.Hour)
+	if n := restored.countTransitions("fridgeDoorOpen", true, time.Hour); n != 2 {
+		t.Errorf("expected 2 restored openings, got %d", n)
+	}
+	if d := restored.durationTrue("fridgeDoorOpen", time.Hour); d != 30*time.Minute {
+		t.Errorf("expected open for 30 minutes, got %v", d)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	masterController := CreateMasterController()
+	seedAt(30*time.Minute, func() { masterController.stateValueMap.setState("fridgeDoorOpen", true) })
+	seedAt(15*time.Minute, func() { masterController.stateValueMap.setState("fridgeDoorOpen", false) })
+	controller := &DebugController{masterController: &masterController}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		controller.historyHandler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	if code := get("/debug/history/garageDoorOpen").Code; code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown key, got %d", code)
+	}
+	if code := get("/debug/history/fridgeDoorOpen?window=soon").Code; code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid window, got %d", code)
+	}
+
+	recorder := get("/debug/history/fridgeDoorOpen?window=1h")
+	var debug StateHistoryDebug
+	if err := json.Unmarshal(recorder.Body.Bytes(), &debug); err != nil {
+		t.Fatalf("could not parse %s: %v", recorder.Body, err)
+	}
+	if len(debug.Transitions) != 2 || debug.CountTrue != 1 || debug.DurationTrue != 15*time.Minute ||
+		debug.DutyCycle != 0.25 || debug.MaxEntries != defaultHistoryMaxEntries {
+		t.Errorf("unexpected history %+v", debug)
+	}
+}
@@ -0,0 +1,320 @@
+package regelverk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// StateRule maps a value in an MQTT payload to a state key and/or a metrics
+// gauge, as declared in the stateRules section of the config file.
+//
+//	stateRules:
+//	  - topic: zigbee2mqtt/fridge-door
+//	    path: battery
+//	    compare: lt
+//	    value: 30
+//	    key: fridgeDoorBatteryLow
+//	    metric: fridgeDoorBattery
+//	  - topic: zigbee2mqtt/fridge-door
+//	    path: battery
+//	    type: number
+//	    key: fridgeDoorBattery
+type StateRule struct {
+	// MQTT topic, may contain + and # wildcards
+	Topic string `yaml:"topic" json:"topic"`
+	// Dot separated path to a property of a JSON object payload. If empty,
+	// the raw payload is used as a string.
+	Path string `yaml:"path" json:"path,omitempty"`
+	// One of eq, ne, lt, le, gt, ge. If empty, a bool rule requires the
+	// extracted value to be a boolean.
+	Compare string `yaml:"compare" json:"compare,omitempty"`
+	Value   any    `yaml:"value" json:"value,omitempty"`
+	Invert  bool   `yaml:"invert" json:"invert,omitempty"`
+	// State key to set, optional if Metric is set
+	Key StateKey `yaml:"key" json:"key,omitempty"`
+	// Kind of value stored under Key, one of bool (default), number, string
+	// or enum. Values other than bool are stored as they are, without
+	// compare or invert.
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Allowed values of an enum
+	Values []string `yaml:"values" json:"values,omitempty"`
+	// Name of the eventvalue gauge the extracted number is written to
+	Metric string `yaml:"metric" json:"metric,omitempty"`
+}
+
+// StateRuleDebug is a JSON-friendly view of a compiled rule.
+type StateRuleDebug struct {
+	StateRule
+	Matched     uint64    `json:"matched"`
+	LastMatched time.Time `json:"lastMatched,omitzero"`
+}
+
+type compiledStateRule struct {
+	rule        StateRule
+	kind        StateValueKind
+	path        []string
+	matched     atomic.Uint64
+	lastMatched atomic.Pointer[time.Time]
+}
+
+var stateRuleComparisons = map[string]bool{"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true}
+
+func compileStateRule(rule StateRule) (*compiledStateRule, error) {
+	var errs []error
+	if rule.Topic == "" {
+		errs = append(errs, fmt.Errorf("topic is required"))
+	}
+	if rule.Key == "" && rule.Metric == "" {
+		errs = append(errs, fmt.Errorf("key or metric is required"))
+	}
+	if rule.Compare != "" {
+		if !stateRuleComparisons[rule.Compare] {
+			errs = append(errs, fmt.Errorf("unknown compare %q, known are %s", rule.Compare, knownKeys(stateRuleComparisons)))
+		}
+		if rule.Value == nil {
+			errs = append(errs, fmt.Errorf("compare %s requires a value", rule.Compare))
+		}
+	} else if rule.Value != nil {
+		errs = append(errs, fmt.Errorf("value requires compare"))
+	}
+	kind := BoolValue
+	if rule.Type != "" {
+		var err error
+		if kind, err = parseStateValueKind(rule.Type); err != nil {
+			errs = append(errs, fmt.Errorf("type: %w", err))
+		}
+	}
+	if kind != BoolValue {
+		if rule.Key == "" {
+			errs = append(errs, fmt.Errorf("type %s requires a key", rule.Type))
+		}
+		if rule.Compare != "" || rule.Invert {
+			errs = append(errs, fmt.Errorf("type %s cannot be combined with compare or invert", rule.Type))
+		}
+	}
+	if (kind == EnumValue) != (len(rule.Values) > 0) {
+		errs = append(errs, fmt.Errorf("values are required for, and only allowed with, type enum"))
+	}
+	// YAML integers are compared as JSON numbers
+	if number, ok := toFloat(rule.Value); ok {
+		rule.Value = number
+	}
+	switch rule.Compare {
+	case "lt", "le", "gt", "ge":
+		if _, ok := rule.Value.(float64); !ok && rule.Value != nil {
+			errs = append(errs, fmt.Errorf("compare %s requires a numeric value, got %v", rule.Compare, rule.Value))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	compiled := &compiledStateRule{rule: rule, kind: kind}
+	if rule.Path != "" {
+		compiled.path = strings.Split(rule.Path, ".")
+	}
+	return compiled, nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// matchTopic matches an MQTT topic against a pattern with + and # wildcards.
+func matchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range patternLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(topicLevels)
+}
+
+// extract returns the value the rule applies to, or false if the event does
+// not carry it.
+func (r *compiledStateRule) extract(ev MQTTEvent) (any, bool) {
+	if !matchTopic(r.rule.Topic, ev.Topic) {
+		return nil, false
+	}
+	payload, ok := ev.Payload.([]byte)
+	if !ok {
+		return nil, false
+	}
+	if len(r.path) == 0 {
+		return string(payload), true
+	}
+
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		slog.Debug("Could not parse payload for state rule", "topic", ev.Topic, "path", r.rule.Path, "error", err)
+		return nil, false
+	}
+	for _, property := range r.path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[property]
+		if !ok || value == nil {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// evaluate maps the extracted value to a state value.
+func (r *compiledStateRule) evaluate(value any) (bool, bool) {
+	var result bool
+	if r.rule.Compare == "" {
+		b, ok := value.(bool)
+		if !ok {
+			return false, false
+		}
+		result = b
+	} else {
+		number, isNumber := value.(float64)
+		operand, operandIsNumber := r.rule.Value.(float64)
+		switch r.rule.Compare {
+		case "eq":
+			result = fmt.Sprint(value) == fmt.Sprint(r.rule.Value)
+		case "ne":
+			result = fmt.Sprint(value) != fmt.Sprint(r.rule.Value)
+		default:
+			if !isNumber || !operandIsNumber {
+				return false, false
+			}
+			switch r.rule.Compare {
+			case "lt":
+				result = number < operand
+			case "le":
+				result = number <= operand
+			case "gt":
+				result = number > operand
+			case "ge":
+				result = number >= operand
+			}
+		}
+	}
+	if r.rule.Invert {
+		result = !result
+	}
+	return result, true
+}
+
+func (masterController *MasterController) stateRuleCallback(r *compiledStateRule) func(MQTTEvent) {
+	return func(ev MQTTEvent) {
+		value, found := r.extract(ev)
+		if !found {
+			return
+		}
+		r.matched.Add(1)
+		now := ev.Timestamp
+		r.lastMatched.Store(&now)
+
+		if r.rule.Key != "" {
+			if r.kind != BoolValue {
+				masterController.setTypedState(r, value)
+			} else if state, ok := r.evaluate(value); ok {
+				masterController.stateValueMap.setState(r.rule.Key, state)
+			} else {
+				slog.Debug("State rule could not evaluate value", "topic", ev.Topic, "path", r.rule.Path,
+					"key", r.rule.Key, "value", value)
+			}
+		}
+
+		if r.rule.Metric != "" && masterController.metricsConfig.CollectMetrics {
+			if number, ok := value.(float64); ok {
+				gauge := metrics.GetOrCreateGauge(fmt.Sprintf(`eventvalue{name="%s",realm="%s"}`,
+					r.rule.Metric, masterController.metricsConfig.MetricsRealm), nil)
+				gauge.Set(number)
+			}
+		}
+	}
+}
+
+// setTypedState stores the extracted value as it is, if it is of the kind
+// the rule declares
+func (masterController *MasterController) setTypedState(r *compiledStateRule, value any) {
+	stateValueMap := &masterController.stateValueMap
+	switch v := value.(type) {
+	case float64:
+		if r.kind == NumberValue {
+			stateValueMap.setNumber(r.rule.Key, v)
+			return
+		}
+	case string:
+		switch r.kind {
+		case StringValue:
+			stateValueMap.setString(r.rule.Key, v)
+			return
+		case EnumValue:
+			stateValueMap.setEnum(r.rule.Key, v)
+			return
+		case NumberValue:
+			// Raw payloads are strings
+			if number, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				stateValueMap.setNumber(r.rule.Key, number)
+				return
+			}
+		}
+	}
+	slog.Debug("State rule value is not of the declared type", "topic", r.rule.Topic, "path", r.rule.Path,
+		"key", r.rule.Key, "type", r.rule.Type, "value", value)
+}
+
+// registerStateRules compiles the rules into event callbacks. Rules are
+// validated when the config file is parsed, invalid rules here are skipped.
+func (masterController *MasterController) registerStateRules(rules []StateRule) {
+	for _, rule := range rules {
+		compiled, err := compileStateRule(rule)
+		if err != nil {
+			slog.Error("Skipping invalid state rule", "topic", rule.Topic, "key", rule.Key, "error", err)
+			continue
+		}
+		if compiled.kind == EnumValue {
+			masterController.stateValueMap.defineEnum(rule.Key, rule.Values...)
+		}
+		masterController.stateRules = append(masterController.stateRules, compiled)
+		masterController.registerEventCallback(masterController.stateRuleCallback(compiled))
+	}
+	slog.Info("Registered state rules", "count", len(masterController.stateRules))
+}
+
+func (masterController *MasterController) stateRulesDebug() []StateRuleDebug {
+	result := make([]StateRuleDebug, 0, len(masterController.stateRules))
+	for _, compiled := range masterController.stateRules {
+		debug := StateRuleDebug{StateRule: compiled.rule, Matched: compiled.matched.Load()}
+		if lastMatched := compiled.lastMatched.Load(); lastMatched != nil {
+			debug.LastMatched = *lastMatched
+		}
+		result = append(result, debug)
+	}
+	return result
+}
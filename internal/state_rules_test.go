@@ -0,0 +1,154 @@
+package regelverk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"zigbee2mqtt/fridge-door", "zigbee2mqtt/fridge-door", true},
+		{"zigbee2mqtt/fridge-door", "zigbee2mqtt/freezer-door", false},
+		{"zigbee2mqtt/+", "zigbee2mqtt/fridge-door", true},
+		{"zigbee2mqtt/+", "zigbee2mqtt/fridge-door/set", false},
+		{"zigbee2mqtt/#", "zigbee2mqtt/fridge-door/set", true},
+		{"+/state", "rotel/state", true},
+		{"rotel/state/extra", "rotel/state", false},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestStateRules(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+stateRules:
+  - topic: zigbee2mqtt/+
+    path: contact
+    invert: true
+    key: doorOpen
+  - topic: zigbee2mqtt/fridge-door
+    path: battery
+    compare: lt
+    value: 30
+    key: batteryLow
+  - topic: zigbee2mqtt/lamp
+    path: update.state
+    compare: eq
+    value: "ON"
+    key: lampOn
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	masterController := CreateMasterController()
+	masterController.registerStateRules(setup.StateRules)
+
+	event := func(topic, payload string) {
+		masterController.executeEventCallbacks(MQTTEvent{Timestamp: time.Now(), Topic: topic, Payload: []byte(payload)})
+	}
+	event("zigbee2mqtt/fridge-door", `{"contact": false, "battery": 25}`)
+	event("zigbee2mqtt/lamp", `{"update": {"state": "ON"}}`)
+
+	sv := &masterController.stateValueMap
+	if !sv.currentlyTrue("doorOpen") || !sv.currentlyTrue("batteryLow") || !sv.currentlyTrue("lampOn") {
+		t.Fatalf("unexpected state values %v", sv.Snapshot())
+	}
+
+	event("zigbee2mqtt/fridge-door", `{"contact": true, "battery": 80}`)
+	if !sv.currentlyFalse("doorOpen") || !sv.currentlyFalse("batteryLow") {
+		t.Fatalf("unexpected state values %v", sv.Snapshot())
+	}
+
+	// Values of the wrong type and missing properties leave the state as is
+	event("zigbee2mqtt/fridge-door", `{"contact": "open"}`)
+	event("zigbee2mqtt/fridge-door", `not json`)
+	if !sv.currentlyFalse("doorOpen") {
+		t.Fatalf("unexpected state values %v", sv.Snapshot())
+	}
+
+	rules := masterController.stateRulesDebug()
+	if len(rules) != 3 || rules[0].Matched != 3 || rules[1].Matched != 2 || rules[2].Matched != 1 {
+		t.Fatalf("unexpected rule debug %+v", rules)
+	}
+}
+
+func TestStateRuleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule StateRule
+	}{
+		{"missing topic", StateRule{Path: "contact", Key: "k"}},
+		{"missing key and metric", StateRule{Topic: "t", Path: "contact"}},
+		{"unknown compare", StateRule{Topic: "t", Compare: "between", Value: 1, Key: "k"}},
+		{"compare without value", StateRule{Topic: "t", Compare: "lt", Key: "k"}},
+		{"non-numeric operand", StateRule{Topic: "t", Compare: "lt", Value: "low", Key: "k"}},
+		{"value without compare", StateRule{Topic: "t", Value: 1, Key: "k"}},
+	}
+	for _, tt := range tests {
+		if _, err := compileStateRule(tt.rule); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestTypedStateRules(t *testing.T) {
+	setup, err := ParseSetup([]byte(`
+stateRules:
+  - topic: zigbee2mqtt/fridge-door
+    path: battery
+    type: number
+    key: fridgeDoorBattery
+  - topic: rotel/state
+    path: source
+    type: enum
+    values: [opt1, opt2]
+    key: rotelSource
+  - topic: home/outdoor/temperature
+    type: number
+    key: outdoorTemperature
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	masterController := CreateMasterController()
+	masterController.registerStateRules(setup.StateRules)
+	event := func(topic, payload string) {
+		masterController.executeEventCallbacks(MQTTEvent{Timestamp: time.Now(), Topic: topic, Payload: []byte(payload)})
+	}
+	event("zigbee2mqtt/fridge-door", `{"battery": 25}`)
+	event("rotel/state", `{"source": "opt2"}`)
+	event("home/outdoor/temperature", "-3.5")
+
+	sv := &masterController.stateValueMap
+	if !sv.currentlyBelow("fridgeDoorBattery", 30) || !sv.currentlyEquals("rotelSource", "opt2") ||
+		!sv.currentlyBelow("outdoorTemperature", -3) {
+		t.Fatalf("unexpected state values %v", sv.Snapshot())
+	}
+
+	// Values outside the enum and of other types are ignored
+	event("rotel/state", `{"source": "tuner"}`)
+	event("zigbee2mqtt/fridge-door", `{"battery": "low"}`)
+	if !sv.currentlyEquals("rotelSource", "opt2") || !sv.currentlyBelow("fridgeDoorBattery", 30) {
+		t.Fatalf("unexpected state values %v", sv.Snapshot())
+	}
+
+	for _, invalid := range []StateRule{
+		{Topic: "a", Key: "k", Type: "number", Compare: "lt", Value: 3},
+		{Topic: "a", Key: "k", Type: "enum"},
+		{Topic: "a", Key: "k", Values: []string{"x"}},
+		{Topic: "a", Metric: "m", Type: "string"},
+		{Topic: "a", Key: "k", Type: "duration"},
+	} {
+		if _, err := compileStateRule(invalid); err == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+}
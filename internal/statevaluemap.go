@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,12 +12,26 @@ type StateKey string
 
 var nowFunc = time.Now
 
+// afterTimer is a pending call scheduled with afterFunc
+type afterTimer interface {
+	Stop() bool
+}
+
+// afterFunc calls f after d, like time.AfterFunc. Simulations replace it
+// along with nowFunc, so that no wall-clock timers fire in virtual time.
+var afterFunc = func(d time.Duration, f func()) afterTimer {
+	return time.AfterFunc(d, f)
+}
+
 const (
 	NoKey StateKey = ""
 )
 
 type StateValue struct {
+	kind         StateValueKind
 	value        bool
+	number       float64 // NumberValue
+	text         string  // StringValue and EnumValue
 	isDefined    bool
 	lastUpdate   time.Time // Last time this state was updated (incl refreshed even if value was not changed)
 	lastChange   time.Time // Last time the state was changed (value was changed differently than before)
@@ -28,12 +43,35 @@ type StateValueMap struct {
 	svMap             map[StateKey]StateValue
 	mu                sync.RWMutex
 	observerCallbacks []func(key StateKey, value, new, updated bool)
-	mutatorCallbacks  []func(key StateKey) (StateKey, bool)
+	valueCallbacks    []func(key StateKey, value StateValue, new, updated bool)
+	// Allowed values of enum keys
+	enums map[StateKey][]string
+	// Transitions per key, see stateHistory
+	history        map[StateKey]*stateHistory
+	historyConfigs map[StateKey]StateHistoryConfig
+
+	// Derived states by owner, and the graph they are evaluated by
+	derivationsMu   sync.Mutex
+	derivations     []*derivedState
+	derivationGraph atomic.Pointer[derivationGraph]
+
+	// Time windows that have been queried, used to compute when a
+	// time-dependent predicate may change outcome
+	windowsMu       sync.Mutex
+	temporalWindows map[temporalWindow]struct{}
+}
+
+type temporalWindow struct {
+	key      StateKey
+	duration time.Duration
 }
 
 func NewStateValueMap() StateValueMap {
 	return StateValueMap{
-		svMap: make(map[StateKey]StateValue),
+		svMap:           make(map[StateKey]StateValue),
+		temporalWindows: make(map[temporalWindow]struct{}),
+		enums:           make(map[StateKey][]string),
+		history:         make(map[StateKey]*stateHistory),
 	}
 }
 
@@ -41,13 +79,16 @@ func (s *StateValueMap) registerObserverCallback(callback func(key StateKey, val
 	s.observerCallbacks = append(s.observerCallbacks, callback)
 }
 
-func (s *StateValueMap) registerMutatorCallback(callback func(key StateKey) (StateKey, bool)) {
-	s.mutatorCallbacks = append(s.mutatorCallbacks, callback)
+// registerValueObserverCallback registers a callback that, unlike the
+// observer callbacks, is called for values of every kind
+func (s *StateValueMap) registerValueObserverCallback(callback func(key StateKey, value StateValue, new, updated bool)) {
+	s.valueCallbacks = append(s.valueCallbacks, callback)
 }
 
 // StateValueDebug is an exported view of a StateValue used for debugging output.
 type StateValueDebug struct {
-	Value        bool      `json:"value"`
+	Kind         string    `json:"kind"`
+	Value        any       `json:"value"`
 	IsDefined    bool      `json:"isDefined"`
 	LastUpdate   time.Time `json:"lastUpdate"`
 	LastChange   time.Time `json:"lastChange"`
@@ -63,7 +104,8 @@ func (s *StateValueMap) Snapshot() map[string]StateValueDebug {
 	snapshot := make(map[string]StateValueDebug, len(s.svMap))
 	for key, stateValue := range s.svMap {
 		snapshot[string(key)] = StateValueDebug{
-			Value:        stateValue.value,
+			Kind:         stateValue.kind.String(),
+			Value:        stateValue.Value(),
 			IsDefined:    stateValue.isDefined,
 			LastUpdate:   stateValue.lastUpdate,
 			LastChange:   stateValue.lastChange,
@@ -81,19 +123,28 @@ func (s *StateValueMap) setStateValue(key StateKey, value StateValue) {
 }
 
 func (s *StateValueMap) setState(key StateKey, value bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.set(key, StateValue{kind: BoolValue, value: value})
+}
 
-	s.updateStateUnsafe(key, value)
+// set updates key and then the keys derived from it through the derivation
+// graph
+func (s *StateValueMap) set(key StateKey, value StateValue) {
+	s.mu.Lock()
+	s.updateUnsafe(key, value)
+	s.mu.Unlock()
 
-	for _, callback := range s.mutatorCallbacks {
-		dependentKey, associatedValue := callback(key)
-		s.updateStateUnsafe(dependentKey, associatedValue)
-	}
+	s.propagate(key)
 }
 
 // Don't call this from outside, use setState instead
 func (s *StateValueMap) updateStateUnsafe(key StateKey, value bool) {
+	s.updateUnsafe(key, StateValue{kind: BoolValue, value: value})
+}
+
+// updateUnsafe stores the kind and value of next under key, keeping the
+// timestamps of the existing value. A change of kind counts as a change of
+// value.
+func (s *StateValueMap) updateUnsafe(key StateKey, next StateValue) {
 
 	if key == NoKey {
 		return
@@ -106,10 +157,16 @@ func (s *StateValueMap) updateStateUnsafe(key StateKey, value bool) {
 	stateNew := false
 	stateUpdate := false
 	if exists {
-		if existingState.value == value {
+		if existingState.sameValue(next) {
 			// don't change value
 		} else {
-			existingState.value = value
+			if existingState.kind != next.kind {
+				existingState.lastSetTrue, existingState.lastSetFalse = time.Time{}, time.Time{}
+			}
+			existingState.kind = next.kind
+			existingState.value = next.value
+			existingState.number = next.number
+			existingState.text = next.text
 			existingState.lastChange = now
 			stateUpdate = true
 		}
@@ -118,7 +175,10 @@ func (s *StateValueMap) updateStateUnsafe(key StateKey, value bool) {
 	} else {
 		// Not exists
 		updatedState = StateValue{
-			value:      value,
+			kind:       next.kind,
+			value:      next.value,
+			number:     next.number,
+			text:       next.text,
 			isDefined:  true,
 			lastUpdate: now,
 			lastChange: now,
@@ -127,15 +187,21 @@ func (s *StateValueMap) updateStateUnsafe(key StateKey, value bool) {
 	}
 
 	if stateUpdate || stateNew {
-		if value {
+		s.recordTransitionUnsafe(key, StateTransition{At: now, Value: updatedState.Value()})
+		if updatedState.kind == BoolValue && updatedState.value {
 			updatedState.lastSetTrue = now
-		} else {
+		} else if updatedState.kind == BoolValue {
 			updatedState.lastSetFalse = now
 		}
 	}
 
-	for _, callback := range s.observerCallbacks {
-		callback(key, value, stateNew, stateUpdate)
+	if updatedState.kind == BoolValue {
+		for _, callback := range s.observerCallbacks {
+			callback(key, updatedState.value, stateNew, stateUpdate)
+		}
+	}
+	for _, callback := range s.valueCallbacks {
+		callback(key, updatedState, stateNew, stateUpdate)
 	}
 
 	s.svMap[key] = updatedState
@@ -176,6 +242,7 @@ func (s *StateValueMap) currentlyFalse(key StateKey) bool {
 
 // Require it has consistently been true
 func (s *StateValueMap) continuouslyTrue(key StateKey, duration time.Duration) bool {
+	s.watchWindow(key, duration)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -189,6 +256,7 @@ func (s *StateValueMap) continuouslyTrue(key StateKey, duration time.Duration) b
 
 // Require it has been true at some point during duration
 func (s *StateValueMap) recentlyTrue(key StateKey, duration time.Duration) bool {
+	s.watchWindow(key, duration)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -202,6 +270,7 @@ func (s *StateValueMap) recentlyTrue(key StateKey, duration time.Duration) bool
 
 // Require it has consistently been false
 func (s *StateValueMap) continuouslyFalse(key StateKey, duration time.Duration) bool {
+	s.watchWindow(key, duration)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -214,6 +283,7 @@ func (s *StateValueMap) continuouslyFalse(key StateKey, duration time.Duration)
 
 // Require it has been false at some point during duration
 func (s *StateValueMap) recentlyFalse(key StateKey, duration time.Duration) bool {
+	s.watchWindow(key, duration)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -224,12 +294,64 @@ func (s *StateValueMap) recentlyFalse(key StateKey, duration time.Duration) bool
 	return stateValue.recentlyFalse(duration)
 }
 
+func (s *StateValueMap) watchWindow(key StateKey, duration time.Duration) {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.temporalWindows == nil {
+		s.temporalWindows = make(map[temporalWindow]struct{})
+	}
+	s.temporalWindows[temporalWindow{key: key, duration: duration}] = struct{}{}
+}
+
+// nextTemporalDeadline returns the earliest instant after now at which any
+// queried time-window predicate (continuously/recently true/false) can change
+// outcome without the underlying state being updated. Such predicates can only
+// flip at lastSetTrue+duration or lastSetFalse+duration, or for typed values
+// and history queries at a recorded transition+duration. durationTrue and
+// dutyCycle are the exception, as they change between those instants, see
+// durationTrue.
+func (s *StateValueMap) nextTemporalDeadline(now time.Time) (time.Time, bool) {
+	s.windowsMu.Lock()
+	windows := make([]temporalWindow, 0, len(s.temporalWindows))
+	for window := range s.temporalWindows {
+		windows = append(windows, window)
+	}
+	s.windowsMu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var next time.Time
+	for _, window := range windows {
+		stateValue, exists := s.svMap[window.key]
+		if !exists {
+			continue
+		}
+		candidates := []time.Time{stateValue.lastSetTrue, stateValue.lastSetFalse}
+		if history, found := s.history[window.key]; found {
+			for _, transition := range history.transitions() {
+				candidates = append(candidates, transition.At)
+			}
+		}
+		for _, t := range candidates {
+			if t.IsZero() {
+				continue
+			}
+			deadline := t.Add(window.duration)
+			if deadline.After(now) && (next.IsZero() || deadline.Before(next)) {
+				next = deadline
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
 func (stateValue *StateValue) currentlyTrue() bool {
 	return stateValue.value
 }
 
 func (stateValue *StateValue) currentlyFalse() bool {
-	return !stateValue.value
+	return stateValue.kind == BoolValue && !stateValue.value
 }
 
 // continuouslyTrue reports whether the signal has been true
@@ -269,7 +391,7 @@ func (s *StateValue) recentlyTrue(d time.Duration) bool {
 }
 
 func (s *StateValue) recentlyFalse(d time.Duration) bool {
-	if !s.isDefined {
+	if !s.isDefined || s.kind != BoolValue {
 		return false
 	}
 	if !s.value {
@@ -319,7 +441,8 @@ func (s *StateValueMap) LogState() {
 		}
 
 		params = append(params, []any{"key", key,
-			"value", stateValue.value,
+			"kind", stateValue.kind.String(),
+			"value", stateValue.Value(),
 			"isDefined", stateValue.isDefined,
 			"lastUpdate", stateValue.lastUpdate,
 			"secondsSinceLastUpdate", secondsSinceLastUpdate,
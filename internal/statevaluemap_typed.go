@@ -0,0 +1,164 @@
+package regelverk
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// StateValueKind is the type of value held by a state key. Keys set with
+// setState are booleans, the other kinds have their own setters.
+type StateValueKind int
+
+const (
+	BoolValue StateValueKind = iota
+	NumberValue
+	StringValue
+	EnumValue
+)
+
+func (k StateValueKind) String() string {
+	switch k {
+	case BoolValue:
+		return "bool"
+	case NumberValue:
+		return "number"
+	case StringValue:
+		return "string"
+	case EnumValue:
+		return "enum"
+	}
+	return "StateValueKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+func parseStateValueKind(s string) (StateValueKind, error) {
+	for _, kind := range []StateValueKind{BoolValue, NumberValue, StringValue, EnumValue} {
+		if kind.String() == s {
+			return kind, nil
+		}
+	}
+	return BoolValue, fmt.Errorf("unknown kind %q, known are bool, enum, number, string", s)
+}
+
+func (stateValue StateValue) sameValue(other StateValue) bool {
+	return stateValue.kind == other.kind && stateValue.value == other.value &&
+		stateValue.number == other.number && stateValue.text == other.text
+}
+
+// Kind returns the type of the value
+func (stateValue StateValue) Kind() StateValueKind {
+	return stateValue.kind
+}
+
+// Value returns the value as a bool, float64 or string depending on kind
+func (stateValue StateValue) Value() any {
+	switch stateValue.kind {
+	case NumberValue:
+		return stateValue.number
+	case StringValue, EnumValue:
+		return stateValue.text
+	}
+	return stateValue.value
+}
+
+// defineEnum declares the values an enum key can take. setEnum rejects
+// anything else.
+func (s *StateValueMap) defineEnum(key StateKey, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enums == nil {
+		s.enums = make(map[StateKey][]string)
+	}
+	s.enums[key] = values
+}
+
+func (s *StateValueMap) enumValues(key StateKey) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enums[key]
+}
+
+func (s *StateValueMap) setNumber(key StateKey, value float64) {
+	s.set(key, StateValue{kind: NumberValue, number: value})
+}
+
+func (s *StateValueMap) setString(key StateKey, value string) {
+	s.set(key, StateValue{kind: StringValue, text: value})
+}
+
+func (s *StateValueMap) setEnum(key StateKey, value string) {
+	values := s.enumValues(key)
+	if values == nil {
+		slog.Error("Enum state key not defined", "key", key, "value", value)
+		return
+	}
+	if !slices.Contains(values, value) {
+		slog.Error("Invalid enum state value", "key", key, "value", value, "allowed", values)
+		return
+	}
+	s.set(key, StateValue{kind: EnumValue, text: value})
+}
+
+// typedState returns the value of key if it is of the given kind
+func (s *StateValueMap) typedState(key StateKey, kind StateValueKind) (StateValue, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stateValue, exists := s.svMap[key]
+	if !exists || stateValue.kind != kind {
+		return StateValue{}, false
+	}
+	return stateValue, true
+}
+
+func (s *StateValueMap) getNumber(key StateKey) (float64, bool) {
+	stateValue, found := s.typedState(key, NumberValue)
+	return stateValue.number, found
+}
+
+// getString returns the value of a string or enum key
+func (s *StateValueMap) getString(key StateKey) (string, bool) {
+	if stateValue, found := s.typedState(key, EnumValue); found {
+		return stateValue.text, true
+	}
+	stateValue, found := s.typedState(key, StringValue)
+	return stateValue.text, found
+}
+
+func (s *StateValueMap) currentlyAbove(key StateKey, threshold float64) bool {
+	number, found := s.getNumber(key)
+	return found && number > threshold
+}
+
+func (s *StateValueMap) currentlyBelow(key StateKey, threshold float64) bool {
+	number, found := s.getNumber(key)
+	return found && number < threshold
+}
+
+// Require it has consistently been above threshold
+func (s *StateValueMap) continuouslyAbove(key StateKey, threshold float64, duration time.Duration) bool {
+	return s.heldFor(key, func(v any) bool {
+		number, ok := v.(float64)
+		return ok && number > threshold
+	}, duration)
+}
+
+// Require it has consistently been below threshold
+func (s *StateValueMap) continuouslyBelow(key StateKey, threshold float64, duration time.Duration) bool {
+	return s.heldFor(key, func(v any) bool {
+		number, ok := v.(float64)
+		return ok && number < threshold
+	}, duration)
+}
+
+// currentlyEquals compares the value of a string or enum key
+func (s *StateValueMap) currentlyEquals(key StateKey, value string) bool {
+	text, found := s.getString(key)
+	return found && text == value
+}
+
+// Require a string or enum key to have had value throughout duration
+func (s *StateValueMap) continuouslyEquals(key StateKey, value string, duration time.Duration) bool {
+	return s.heldFor(key, func(v any) bool { return v == value }, duration)
+}
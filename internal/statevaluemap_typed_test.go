@@ -0,0 +1,101 @@
+package regelverk
+
+import (
+	"testing"
+	"time"
+)
+
+// seedAt runs set as if it happened ago before now
+func seedAt(ago time.Duration, set func()) {
+	now := nowFunc()
+	nowFunc = func() time.Time { return now.Add(-ago) }
+	set()
+	nowFunc = func() time.Time { return now }
+}
+
+func TestTypedStateValues(t *testing.T) {
+	m := NewStateValueMap()
+	m.setNumber("battery", 25)
+	m.setString("display", "OPT1 VOL 38")
+	m.defineEnum("tvSource", "tv", "chromecast")
+	m.setEnum("tvSource", "chromecast")
+	m.setEnum("tvSource", "betamax")
+
+	if number, found := m.getNumber("battery"); !found || number != 25 {
+		t.Errorf("getNumber = %v, %v", number, found)
+	}
+	if !m.currentlyBelow("battery", 30) || m.currentlyAbove("battery", 30) {
+		t.Errorf("expected battery below 30")
+	}
+	if !m.currentlyEquals("display", "OPT1 VOL 38") || !m.currentlyEquals("tvSource", "chromecast") {
+		t.Errorf("unexpected string values %v", m.Snapshot())
+	}
+	// Boolean guards are false for other kinds
+	if m.currentlyTrue("battery") || m.currentlyFalse("battery") || m.recentlyFalse("battery", time.Hour) {
+		t.Errorf("expected bool guards to be false for a number")
+	}
+	if _, found := m.getNumber("tvSource"); found {
+		t.Errorf("expected enum not to be read as a number")
+	}
+
+	snapshot := m.Snapshot()
+	if snapshot["battery"].Kind != "number" || snapshot["battery"].Value != 25.0 ||
+		snapshot["tvSource"].Kind != "enum" || snapshot["tvSource"].Value != "chromecast" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	// Same value only refreshes lastUpdate, a new kind is a change
+	before, _ := m.getState("battery")
+	seedAt(-time.Minute, func() { m.setNumber("battery", 25) })
+	after, _ := m.getState("battery")
+	if !after.lastChange.Equal(before.lastChange) || !after.lastUpdate.After(before.lastUpdate) {
+		t.Errorf("expected only lastUpdate to move, got %+v", after)
+	}
+	m.setState("battery", true)
+	if !m.currentlyTrue("battery") || m.currentlyBelow("battery", 30) {
+		t.Errorf("expected battery to have become a bool")
+	}
+}
+
+func TestContinuouslyAboveAndEquals(t *testing.T) {
+	m := NewStateValueMap()
+	d := 10 * time.Minute
+
+	seedAt(30*time.Minute, func() { m.setNumber("temperature", 19) })
+	seedAt(15*time.Minute, func() { m.setNumber("temperature", 23) })
+	seedAt(5*time.Minute, func() { m.setNumber("temperature", 24) })
+	if !m.continuouslyAbove("temperature", 22, d) {
+		t.Errorf("expected above 22 for the last 15 minutes")
+	}
+	if m.continuouslyAbove("temperature", 23.5, d) || m.continuouslyBelow("temperature", 22, d) {
+		t.Errorf("expected above 23.5 only for 5 minutes")
+	}
+	if deadline, found := m.nextTemporalDeadline(nowFunc()); !found || !deadline.Equal(nowFunc().Add(5*time.Minute)) {
+		t.Errorf("expected the 23.5 window to end in 5 minutes, got %v", deadline)
+	}
+
+	m.defineEnum("tvSource", "tv", "chromecast")
+	seedAt(20*time.Minute, func() { m.setEnum("tvSource", "chromecast") })
+	if !m.continuouslyEquals("tvSource", "chromecast", d) || m.continuouslyEquals("tvSource", "tv", d) {
+		t.Errorf("expected chromecast for 20 minutes")
+	}
+}
+
+func TestPersistTypedStateValues(t *testing.T) {
+	m := NewStateValueMap()
+	m.defineEnum("tvSource", "tv", "chromecast")
+	seedAt(20*time.Minute, func() {
+		m.setNumber("temperature", 23)
+		m.setEnum("tvSource", "tv")
+	})
+	m.setState("tvPower", true)
+
+	restored := NewStateValueMap()
+	if n := restored.restorePersisted(m.persistedSnapshot(), nil, time.Hour); n != 3 {
+		t.Fatalf("expected 3 restored values, got %d", n)
+	}
+	if !restored.continuouslyAbove("temperature", 22, 10*time.Minute) ||
+		!restored.continuouslyEquals("tvSource", "tv", 10*time.Minute) || !restored.currentlyTrue("tvPower") {
+		t.Errorf("unexpected restored values %v", restored.Snapshot())
+	}
+}
@@ -0,0 +1,71 @@
+package regelverk
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Topic of the synthetic event injected when a time-window guard may flip
+const reevaluateTopic = "regelverk/reevaluate"
+
+// temporalReevaluation keeps a single timer armed for the next instant at
+// which a time-window predicate in the StateValueMap can change outcome.
+type temporalReevaluation struct {
+	mu    sync.Mutex
+	timer afterTimer
+	dueAt time.Time
+}
+
+// scheduleReevaluation (re)arms the reevaluation timer. Cheap enough to be
+// called after every processed event.
+func (masterController *MasterController) scheduleReevaluation() {
+	next, found := masterController.stateValueMap.nextTemporalDeadline(nowFunc())
+
+	r := &masterController.reevaluation
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !found {
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+			r.dueAt = time.Time{}
+		}
+		return
+	}
+	if r.timer != nil && r.dueAt.Equal(next) {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.dueAt = next
+	r.timer = afterFunc(next.Sub(nowFunc()), masterController.reevaluate)
+}
+
+func (masterController *MasterController) reevaluate() {
+	r := &masterController.reevaluation
+	r.mu.Lock()
+	dueAt := r.dueAt
+	r.timer = nil
+	r.dueAt = time.Time{}
+	r.mu.Unlock()
+
+	slog.Debug("Re-evaluating guards at temporal deadline", "deadline", dueAt)
+	if masterController.metricsConfig.CollectDebugMetrics {
+		counter := metrics.GetOrCreateCounter(fmt.Sprintf(`regelverk_reevaluations{realm="%s"}`,
+			masterController.metricsConfig.MetricsRealm))
+		counter.Inc()
+	}
+
+	ev := MQTTEvent{
+		Timestamp: nowFunc(),
+		Topic:     reevaluateTopic,
+		Payload:   []byte{},
+	}
+	masterController.ProcessEvent(masterController.mqttClient, ev)
+}
@@ -318,42 +318,43 @@ func TestObserverCallbacks(t *testing.T) {
 	}
 }
 
-// TestMutatorCallbacks ensures mutator callbacks trigger dependent updates.
-func TestMutatorCallbacks(t *testing.T) {
+func TestNextTemporalDeadline(t *testing.T) {
 	m := NewStateValueMap()
-	primary := StateKey("prim")
-	dependent := StateKey("dep")
-
-	// Register mutator: whenever primary updates, mirror the primary value into dependent
-	var lastVal bool
-	m.registerMutatorCallback(func(k StateKey) (StateKey, bool) {
-		if k == primary {
-			return dependent, lastVal
-		}
-		return NoKey, false
-	})
+	now := nowFunc()
+
+	if _, found := m.nextTemporalDeadline(now); found {
+		t.Error("no windows queried: expected no deadline")
+	}
+
+	seedTrue(&m, "tvPower", 20*time.Minute)
+	seedFalse(&m, "tvPower", 5*time.Minute)
 
-	// Set primary true and expect dependent to follow
-	lastVal = true
-	m.setState(primary, true)
-	p, _ := m.getState(primary)
-	d, _ := m.getState(dependent)
-	if !p.value {
-		t.Errorf("primary=%v, want true", p.value)
+	// Not queried yet, so no deadline even though the key exists
+	if _, found := m.nextTemporalDeadline(now); found {
+		t.Error("key not queried: expected no deadline")
 	}
-	if !d.value {
-		t.Errorf("dependent=%v, want true", d.value)
+
+	if !m.recentlyTrue("tvPower", 30*time.Minute) {
+		t.Error(stateErrorString("recentlyTrue within 30m expected", &m, "tvPower"))
+	}
+	deadline, found := m.nextTemporalDeadline(now)
+	if !found {
+		t.Fatal("expected a deadline after querying a window")
+	}
+	// set true 20m ago -> +30m is 10m from now, set false 5m ago -> +30m is 25m from now
+	if expected := now.Add(10 * time.Minute); !deadline.Equal(expected) {
+		t.Errorf("expected deadline %v, got %v", expected, deadline)
 	}
 
-	// Set primary false and expect dependent to follow
-	lastVal = false
-	m.setState(primary, false)
-	p, _ = m.getState(primary)
-	d, _ = m.getState(dependent)
-	if p.value {
-		t.Errorf("primary=%v, want false", p.value)
+	m.continuouslyFalse("tvPower", 7*time.Minute)
+	deadline, _ = m.nextTemporalDeadline(now)
+	if expected := now.Add(2 * time.Minute); !deadline.Equal(expected) {
+		t.Errorf("expected deadline %v, got %v", expected, deadline)
 	}
-	if d.value {
-		t.Errorf("dependent=%v, want false", d.value)
+
+	// Deadlines in the past are ignored
+	deadline, _ = m.nextTemporalDeadline(now.Add(15 * time.Minute))
+	if expected := now.Add(25 * time.Minute); !deadline.Equal(expected) {
+		t.Errorf("expected deadline %v, got %v", expected, deadline)
 	}
 }